@@ -343,6 +343,13 @@ func (lc *LocalClient) DaemonMetrics(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/metrics")
 }
 
+// NetcheckHistory returns tailscaled's recent history of netcheck reports,
+// as a JSON array of netcheck.HistoryEntry, oldest first. It's returned as
+// JSON to not make this package depend on netcheck.
+func (lc *LocalClient) NetcheckHistory(ctx context.Context) ([]byte, error) {
+	return lc.get200(ctx, "/localapi/v0/netcheck-history")
+}
+
 // IncrementCounter increments the value of a Tailscale daemon's counter
 // metric by the given delta. If the metric has yet to exist, a new counter
 // metric is created and initialized to delta.
@@ -1434,7 +1441,16 @@ func (lc *LocalClient) DebugSetExpireIn(ctx context.Context, d time.Duration) er
 // The provided context does not determine the lifetime of the
 // returned io.ReadCloser.
 func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-capture", nil)
+	return lc.StreamDebugCaptureFormat(ctx, "pcap")
+}
+
+// StreamDebugCaptureFormat is like StreamDebugCapture, but streams the
+// capture in the given format, "pcap" or "pcapng". The pcapng format has an
+// interface per capture path and comments describing NAT and disco
+// packets, so it can be read without the Lua dissector.
+func (lc *LocalClient) StreamDebugCaptureFormat(ctx context.Context, format string) (io.ReadCloser, error) {
+	v := url.Values{"format": {format}}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-capture?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1449,6 +1465,65 @@ func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, e
 	return res.Body, nil
 }
 
+// DebugCaptureRingOpts contains options for the StartDebugCaptureRing method.
+type DebugCaptureRingOpts struct {
+	// MaxBytes bounds the memory used for packets. Zero means the
+	// default, 16 MiB.
+	MaxBytes int
+
+	// MaxAge, if non-zero, bounds the age of the packets kept.
+	MaxAge time.Duration
+
+	// Filter selects the packets to keep, such as "peer 100.64.0.2 and
+	// port 22". Empty means all packets.
+	Filter string
+
+	// HealthDump, if non-zero, is how much of the most recent capture is
+	// written to a pcapng file in tailscaled's state directory whenever a
+	// health warning is raised.
+	HealthDump time.Duration
+}
+
+// StartDebugCaptureRing starts keeping a ring buffer of the most recent
+// packets traversing tailscaled, replacing any previous one.
+func (lc *LocalClient) StartDebugCaptureRing(ctx context.Context, opts *DebugCaptureRingOpts) error {
+	if opts == nil {
+		opts = &DebugCaptureRingOpts{}
+	}
+	vals := make(url.Values)
+	if opts.MaxBytes != 0 {
+		vals.Set("max_bytes", strconv.Itoa(opts.MaxBytes))
+	}
+	if opts.MaxAge != 0 {
+		vals.Set("max_age", opts.MaxAge.String())
+	}
+	if opts.Filter != "" {
+		vals.Set("filter", opts.Filter)
+	}
+	if opts.HealthDump != 0 {
+		vals.Set("health_dump", opts.HealthDump.String())
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/debug-capture-ring?"+vals.Encode(), 200, nil)
+	return err
+}
+
+// StopDebugCaptureRing stops the ring buffer started by StartDebugCaptureRing.
+func (lc *LocalClient) StopDebugCaptureRing(ctx context.Context) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/debug-capture-ring", 200, nil)
+	return err
+}
+
+// DumpDebugCaptureRing returns the packets in the ring buffer started by
+// StartDebugCaptureRing that were captured in the last d, or all of them if
+// d is zero, as a pcapng file.
+func (lc *LocalClient) DumpDebugCaptureRing(ctx context.Context, d time.Duration) ([]byte, error) {
+	path := "/localapi/v0/debug-capture-ring"
+	if d != 0 {
+		path += "?last=" + url.QueryEscape(d.String())
+	}
+	return lc.get200(ctx, path)
+}
+
 // WatchIPNBus subscribes to the IPN notification bus. It returns a watcher
 // once the bus is connected successfully.
 //
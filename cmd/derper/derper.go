@@ -35,10 +35,12 @@
 	"syscall"
 	"time"
 
+	"golang.org/x/net/quic"
 	"golang.org/x/time/rate"
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/derp/derpquic"
 	"tailscale.com/metrics"
 	"tailscale.com/net/ktimeout"
 	"tailscale.com/net/stunserver"
@@ -53,21 +55,32 @@
 	versionFlag = flag.Bool("version", false, "print version and exit")
 	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
 	httpPort    = flag.Int("http-port", 80, "The port on which to serve HTTP. Set to -1 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	quicPort    = flag.Int("quic-port", 0, "if non-zero, the UDP port on which to serve DERP over QUIC, with the HTTPS certificate; advertise it with the DERPNode.QUICPort field. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	stunPort    = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	configPath  = flag.String("c", "", "config file path")
 	certMode    = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
 	certDir     = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
 	hostname    = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	runSTUN     = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
+	turnConfig  = flag.String("turn-config", "", "if non-empty, path to a JSON file configuring a TURN relay on the STUN port, for non-Tailscale WebRTC clients; see stunserver.TURNConfig")
 	runDERP     = flag.Bool("derp", true, "whether to run a DERP server. The only reason to set this false is if you're decommissioning a server but want to keep its bootstrap DNS functionality still running.")
 
-	meshPSKFile     = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
-	meshWith        = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
-	bootstrapDNS    = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
-	unpublishedDNS  = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
-	verifyClients   = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
-	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
-	verifyFailOpen  = flag.Bool("verify-client-url-fail-open", true, "whether we fail open if --verify-client-url is unreachable")
+	meshPSKFile          = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
+	meshWith             = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshDiscover         = flag.String("mesh-discover", "", "optional source of additional hostnames to mesh with, re-read every --mesh-discover-interval: srv:<name> for the targets of DNS SRV records, dns:<name> for each A/AAAA record of name, or file:<path> for a file with one hostname per line; the server's own hostname can be included")
+	meshDiscoverInterval = flag.Duration("mesh-discover-interval", 30*time.Second, "how often to re-read --mesh-discover")
+	bootstrapDNS         = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
+	unpublishedDNS       = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
+	verifyClients        = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+	verifyClientURL      = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
+	verifyFailOpen       = flag.Bool("verify-client-url-fail-open", true, "whether we fail open if --verify-client-url is unreachable")
+
+	clientRateLimit  = flag.Int("client-rate-limit", 0, "if non-zero, the rate in bytes per second at which each client may send packets; mesh peers and disco packets are exempt")
+	clientRateBurst  = flag.Int("client-rate-burst", 0, "the number of bytes a client may send at once in excess of --client-rate-limit; at least 64KiB")
+	clientLimitsFile = flag.String("client-limits-file", "", `if non-empty, path to a JSON file mapping node keys to per-client limits overriding --client-rate-limit and --client-rate-burst, like {"nodekey:...": {"bytesPerSec": 1000000, "burst": 2000000, "weight": 2}}`)
+	drainSpread      = flag.Duration("drain-spread", 30*time.Second, "when draining, the period over which connected clients are told to reconnect to another node in the region, so that they don't all reconnect at once")
+	drainOnShutdown  = flag.Bool("drain-on-shutdown", false, "on SIGINT or SIGTERM, drain the server and wait --drain-spread for clients to move elsewhere before exiting; a second signal exits immediately")
+	fairQueuing      = flag.Bool("fair-queuing", false, "share the queue of packets to each client fairly between the peers sending to it, weighted by their weight in --client-limits-file (default 1), rather than first come, first served")
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
@@ -78,6 +91,10 @@
 	tcpUserTimeout = flag.Duration("tcp-user-timeout", 15*time.Second, "TCP user timeout")
 )
 
+// drainGrace is how long derper waits with --drain-on-shutdown, after the
+// last client was told to reconnect elsewhere, before exiting.
+const drainGrace = 5 * time.Second
+
 var (
 	tlsRequestVersion = &metrics.LabelMap{Label: "version"}
 	tlsActiveVersion  = &metrics.LabelMap{Label: "version"}
@@ -161,6 +178,15 @@ func main() {
 
 	if *runSTUN {
 		ss := stunserver.New(ctx)
+		if *turnConfig != "" {
+			c, err := stunserver.ReadTURNConfig(*turnConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := ss.EnableTURN(*c); err != nil {
+				log.Fatal(err)
+			}
+		}
 		go ss.ListenAndServe(net.JoinHostPort(listenHost, fmt.Sprint(*stunPort)))
 	}
 
@@ -185,7 +211,12 @@ func main() {
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
-	if err := startMesh(s); err != nil {
+	if err := setClientLimits(s); err != nil {
+		log.Fatalf("client limits: %v", err)
+	}
+	s.SetFairQueuing(*fairQueuing)
+	mesh, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
@@ -241,6 +272,11 @@ func main() {
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
+	debug.KVFunc("Draining", func() any { return s.IsDraining() })
+	if mesh != nil {
+		debug.Handle("mesh", "Mesh peers (JSON)", mesh)
+		debug.Section(mesh.writeDebugSection)
+	}
 	debug.Handle("check", "Consistency check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := s.ConsistencyCheck()
 		if err != nil {
@@ -264,6 +300,22 @@ func main() {
 		old := runtime.SetMutexProfileFraction(v)
 		fmt.Fprintf(w, "mutex changed from %v to %v\n", old, v)
 	}))
+	debug.Handle("drain", "Drain clients to other nodes (POST)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Sec-Debug") != "derp" {
+			http.Error(w, "To drain, use: curl -XPOST -HSec-Debug:derp 'http://derp/debug/drain?spread=30s'", http.StatusBadRequest)
+			return
+		}
+		spread := *drainSpread
+		if v := r.FormValue("spread"); v != "" {
+			var err error
+			if spread, err = time.ParseDuration(v); err != nil || spread < 0 {
+				http.Error(w, "bad spread value", http.StatusBadRequest)
+				return
+			}
+		}
+		s.Drain(spread)
+		fmt.Fprintf(w, "draining clients over %v\n", spread)
+	}))
 
 	// Longer lived DERP connections send an application layer keepalive. Note
 	// if the keepalive is hit, the user timeout will take precedence over the
@@ -292,6 +344,13 @@ func main() {
 	}
 	go func() {
 		<-ctx.Done()
+		if *drainOnShutdown && *runDERP {
+			// Let a second signal kill the process.
+			cancel()
+			log.Printf("derper: draining clients before exiting")
+			s.Drain(*drainSpread)
+			time.Sleep(*drainSpread + drainGrace)
+		}
 		httpsrv.Shutdown(ctx)
 	}()
 
@@ -334,6 +393,18 @@ func main() {
 
 			mux.ServeHTTP(w, r)
 		})
+		if *quicPort != 0 && *runDERP {
+			ep, err := quic.Listen("udp", net.JoinHostPort(listenHost, fmt.Sprint(*quicPort)), derpquic.ServerConfig(httpsrv.TLSConfig))
+			if err != nil {
+				log.Fatalf("derper: QUIC listen: %v", err)
+			}
+			log.Printf("derper: serving DERP over QUIC on %v", ep.LocalAddr())
+			go func() {
+				<-ctx.Done()
+				ep.Close(context.Background())
+			}()
+			go derpquic.Serve(s, ep)
+		}
 		if *httpPort > -1 {
 			go func() {
 				port80mux := http.NewServeMux()
@@ -412,6 +483,35 @@ func prodAutocertHostPolicy(_ context.Context, host string) error {
 	return errors.New("invalid hostname")
 }
 
+// setClientLimits configures s with the limits from the --client-rate-limit,
+// --client-rate-burst and --client-limits-file flags.
+func setClientLimits(s *derp.Server) error {
+	def := derp.ClientLimits{
+		BytesPerSec: *clientRateLimit,
+		Burst:       *clientRateBurst,
+	}
+	var perNode map[key.NodePublic]derp.ClientLimits
+	if *clientLimitsFile != "" {
+		b, err := os.ReadFile(*clientLimitsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &perNode); err != nil {
+			return fmt.Errorf("parsing %s: %w", *clientLimitsFile, err)
+		}
+	}
+	for k, l := range perNode {
+		if l.BytesPerSec < 0 || l.Burst < 0 || l.Weight < 0 {
+			return fmt.Errorf("negative limit for %v", k.ShortString())
+		}
+	}
+	if def.BytesPerSec < 0 || def.Burst < 0 {
+		return errors.New("negative --client-rate-limit or --client-rate-burst")
+	}
+	s.SetClientLimits(def, perNode)
+	return nil
+}
+
 func defaultMeshPSKFile() string {
 	try := []string{
 		"/home/derp/keys/derp-mesh.key",
@@ -4,44 +4,256 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
-func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
-		return nil
+// meshTarget identifies a derper to mesh with.
+type meshTarget struct {
+	// host is the host (and port, if not 443) in the https://host/derp URL
+	// of the peer.
+	host string
+	// dialAddr, if non-empty, is the IP address to connect to instead of
+	// resolving host, for peers discovered from A or AAAA records.
+	dialAddr string
+}
+
+func (t meshTarget) String() string {
+	if t.dialAddr != "" {
+		return t.host + "@" + t.dialAddr
+	}
+	return t.host
+}
+
+// mesher manages the mesh connections of a derp.Server: one watch connection
+// loop per peer, for the static --mesh-with peers and for the peers found by
+// --mesh-discover, which are added and removed as they come and go.
+type mesher struct {
+	s        *derp.Server
+	static   []meshTarget
+	discover func(context.Context) ([]meshTarget, error) // or nil
+
+	mu    sync.Mutex
+	peers map[meshTarget]*meshPeer
+}
+
+// meshPeer is a derper that a mesher meshes with, and the state of its watch
+// connection loop.
+type meshPeer struct {
+	target  meshTarget
+	static  bool
+	c       *derphttp.Client
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when the watch connection loop returns
+	started time.Time
+
+	mu         sync.Mutex
+	present    map[key.NodePublic]bool // clients connected to the peer
+	lastChange time.Time               // when present last changed
+	lastLog    string                  // last message logged by the client
+	lastLogAt  time.Time
+}
+
+func startMesh(s *derp.Server) (*mesher, error) {
+	if *meshWith == "" && *meshDiscover == "" {
+		return nil, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with and --mesh-discover require --mesh-psk-file")
 	}
+	m := &mesher{s: s}
 	for _, host := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, host); err != nil {
-			return err
+		if host = strings.TrimSpace(host); host != "" {
+			m.static = append(m.static, meshTarget{host: host})
+		}
+	}
+	if *meshDiscover != "" {
+		var err error
+		m.discover, err = parseMeshDiscover(*meshDiscover)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.update(nil)
+	if m.discover != nil {
+		go m.discoverLoop(*meshDiscoverInterval)
+	}
+	return m, nil
+}
+
+// parseMeshDiscover returns the discovery func for the --mesh-discover flag
+// value spec.
+func parseMeshDiscover(spec string) (func(context.Context) ([]meshTarget, error), error) {
+	typ, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid --mesh-discover %q; want srv:<name>, dns:<name> or file:<path>", spec)
+	}
+	var r net.Resolver
+	switch typ {
+	case "srv":
+		return func(ctx context.Context) ([]meshTarget, error) {
+			_, srvs, err := r.LookupSRV(ctx, "", "", arg)
+			if err != nil {
+				return nil, err
+			}
+			var ts []meshTarget
+			for _, srv := range srvs {
+				host := strings.TrimSuffix(srv.Target, ".")
+				if srv.Port != 443 {
+					host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+				}
+				ts = append(ts, meshTarget{host: host})
+			}
+			return ts, nil
+		}, nil
+	case "dns":
+		return func(ctx context.Context) ([]meshTarget, error) {
+			ips, err := r.LookupHost(ctx, arg)
+			if err != nil {
+				return nil, err
+			}
+			var ts []meshTarget
+			for _, ip := range ips {
+				ts = append(ts, meshTarget{host: arg, dialAddr: ip})
+			}
+			return ts, nil
+		}, nil
+	case "file":
+		return func(context.Context) ([]meshTarget, error) {
+			b, err := os.ReadFile(arg)
+			if err != nil {
+				return nil, err
+			}
+			return parseMeshFile(b), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown --mesh-discover type %q; want srv, dns or file", typ)
+}
+
+// parseMeshFile parses a --mesh-discover file: one hostname per line, with
+// blank lines and #-comments ignored.
+func parseMeshFile(b []byte) []meshTarget {
+	var ts []meshTarget
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if host := strings.TrimSpace(line); host != "" {
+			ts = append(ts, meshTarget{host: host})
+		}
+	}
+	return ts
+}
+
+// discoverLoop runs m.discover every interval, forever, updating the mesh
+// peers with the result. On failure, the previously discovered peers are
+// kept.
+func (m *mesher) discoverLoop(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		ts, err := m.discover(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("mesh: discovering peers: %v", err)
+		} else {
+			m.update(ts)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// update starts watch connection loops for the static peers and for the
+// discovered peers ts that don't have one, and stops those of the
+// previously discovered peers that aren't in ts.
+func (m *mesher) update(ts []meshTarget) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	add, remove := meshChanges(m.peers, m.static, ts)
+	for _, t := range remove {
+		log.Printf("mesh: removing peer %v", t)
+		m.peers[t].stop(m.s)
+		delete(m.peers, t)
+	}
+	for _, t := range add {
+		log.Printf("mesh: adding peer %v", t)
+		p, err := m.startPeer(t)
+		if err != nil {
+			log.Printf("mesh: %v: %v", t, err)
+			continue
+		}
+		p.static = slices.Contains(m.static, t)
+		if m.peers == nil {
+			m.peers = map[meshTarget]*meshPeer{}
+		}
+		m.peers[t] = p
+	}
+}
+
+// meshChanges returns the peers to add to and remove from have, for it to be
+// static plus discovered.
+func meshChanges(have map[meshTarget]*meshPeer, static, discovered []meshTarget) (add, remove []meshTarget) {
+	want := map[meshTarget]bool{}
+	for _, t := range slices.Concat(static, discovered) {
+		if !want[t] {
+			want[t] = true
+			if _, ok := have[t]; !ok {
+				add = append(add, t)
+			}
+		}
+	}
+	for t := range have {
+		if !want[t] {
+			remove = append(remove, t)
 		}
 	}
-	return nil
+	slices.SortFunc(remove, func(a, b meshTarget) int { return cmp.Compare(a.String(), b.String()) })
+	return add, remove
 }
 
-func startMeshWithHost(s *derp.Server, host string) error {
-	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
+func (m *mesher) startPeer(t meshTarget) (*meshPeer, error) {
+	p := &meshPeer{
+		target:  t,
+		done:    make(chan struct{}),
+		started: time.Now(),
+		present: map[key.NodePublic]bool{},
+	}
+	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", t))
+	clientLogf := func(format string, args ...any) {
+		p.mu.Lock()
+		p.lastLog = fmt.Sprintf(format, args...)
+		p.lastLogAt = time.Now()
+		p.mu.Unlock()
+		logf(format, args...)
+	}
 	netMon := netmon.NewStatic() // good enough for cmd/derper; no need for netns fanciness
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf, netMon)
+	c, err := derphttp.NewClient(m.s.PrivateKey(), "https://"+t.host+"/derp", clientLogf, netMon)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.MeshKey = s.MeshKey()
+	c.MeshKey = m.s.MeshKey()
 	c.WatchConnectionChanges = true
+	p.c = c
 
 	// For meshed peers within a region, connect via VPC addresses.
 	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -51,6 +263,9 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		}
 		var d net.Dialer
 		var r net.Resolver
+		if t.dialAddr != "" {
+			return d.DialContext(ctx, network, net.JoinHostPort(t.dialAddr, port))
+		}
 		if base, ok := strings.CutSuffix(host, ".tailscale.com"); ok && port == "443" {
 			subCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
 			defer cancel()
@@ -69,8 +284,134 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		return d.DialContext(ctx, network, addr)
 	})
 
-	add := func(m derp.PeerPresentMessage) { s.AddPacketForwarder(m.Key, c) }
-	remove := func(m derp.PeerGoneMessage) { s.RemovePacketForwarder(m.Peer, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
-	return nil
+	add := func(msg derp.PeerPresentMessage) {
+		m.s.AddPacketForwarder(msg.Key, c)
+		p.setPresent(msg.Key, true)
+	}
+	remove := func(msg derp.PeerGoneMessage) {
+		m.s.RemovePacketForwarder(msg.Peer, c)
+		p.setPresent(msg.Peer, false)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go func() {
+		defer close(p.done)
+		c.RunWatchConnectionLoop(ctx, m.s.PublicKey(), logf, add, remove)
+	}()
+	return p, nil
+}
+
+func (p *meshPeer) setPresent(k key.NodePublic, present bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if present {
+		p.present[k] = true
+	} else {
+		delete(p.present, k)
+	}
+	p.lastChange = time.Now()
+}
+
+// stop stops the watch connection loop of p and, once it has returned,
+// removes the packet forwarders it added to s.
+func (p *meshPeer) stop(s *derp.Server) {
+	p.cancel()
+	p.c.Close()
+	go func() {
+		<-p.done
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for k := range p.present {
+			s.RemovePacketForwarder(k, p.c)
+		}
+		clear(p.present)
+	}()
+}
+
+// meshPeerStatus is the health of a mesh peer, as shown on the debug page.
+type meshPeerStatus struct {
+	Peer       string    `json:"peer"`
+	Static     bool      `json:"static"`
+	ServerKey  string    `json:"serverKey,omitempty"`
+	Running    bool      `json:"running"`   // false once the loop has returned (such as for a self-connect)
+	Connected  bool      `json:"connected"` // whether the client is connected
+	Clients    int       `json:"clients"`   // connected to the peer
+	Started    time.Time `json:"started"`
+	LastChange time.Time `json:"lastChange"`
+	LastLog    string    `json:"lastLog,omitempty"`
+	LastLogAt  time.Time `json:"lastLogAt"`
+}
+
+// status returns the health of each mesh peer, ordered by peer.
+func (m *mesher) status() []meshPeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sts []meshPeerStatus
+	for t, p := range m.peers {
+		st := meshPeerStatus{
+			Peer:    t.String(),
+			Static:  p.static,
+			Started: p.started,
+		}
+		select {
+		case <-p.done:
+		default:
+			st.Running = true
+		}
+		if _, err := p.c.LocalAddr(); err == nil {
+			st.Connected = true
+			st.ServerKey = p.c.ServerPublicKey().ShortString()
+		}
+		p.mu.Lock()
+		st.Clients = len(p.present)
+		st.LastChange = p.lastChange
+		st.LastLog = p.lastLog
+		st.LastLogAt = p.lastLogAt
+		p.mu.Unlock()
+		sts = append(sts, st)
+	}
+	slices.SortFunc(sts, func(a, b meshPeerStatus) int { return cmp.Compare(a.Peer, b.Peer) })
+	return sts
+}
+
+// ServeHTTP serves the mesh peer status as JSON.
+func (m *mesher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(m.status())
+}
+
+// writeDebugSection writes the mesh peer status as an HTML table, for the
+// debug page.
+func (m *mesher) writeDebugSection(w io.Writer, r *http.Request) {
+	fmt.Fprintf(w, "<h2>Mesh peers</h2>\n<table><tr><th>Peer</th><th>Source</th><th>State</th><th>Server key</th><th>Clients</th><th>Last change</th><th>Last message</th></tr>\n")
+	now := time.Now()
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return now.Sub(t).Round(time.Second).String() + " ago"
+	}
+	for _, st := range m.status() {
+		source := "discovered"
+		if st.Static {
+			source = "static"
+		}
+		state := "connecting"
+		switch {
+		case !st.Running:
+			state = "stopped (self)"
+		case st.Connected:
+			state = "connected"
+		}
+		lastLog := "-"
+		if st.LastLog != "" {
+			lastLog = ago(st.LastLogAt) + ": " + st.LastLog
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(st.Peer), source, state, html.EscapeString(st.ServerKey), st.Clients,
+			ago(st.LastChange), html.EscapeString(lastLog))
+	}
+	io.WriteString(w, "</table>\n")
 }
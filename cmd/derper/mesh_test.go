@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMeshFile(t *testing.T) {
+	got := parseMeshFile([]byte(`
+# region 1
+derp1a.example.com
+  derp1b.example.com  # backup
+
+derp1c.example.com:8443
+`))
+	want := []meshTarget{
+		{host: "derp1a.example.com"},
+		{host: "derp1b.example.com"},
+		{host: "derp1c.example.com:8443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestParseMeshDiscover(t *testing.T) {
+	for _, spec := range []string{"", "srv", "srv:", "http://example.com", "consul:derp"} {
+		if _, err := parseMeshDiscover(spec); err == nil {
+			t.Errorf("parseMeshDiscover(%q) succeeded; want error", spec)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "mesh")
+	discover, err := parseMeshDiscover("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := discover(context.Background()); err == nil {
+		t.Error("discovering from missing file succeeded; want error")
+	}
+	if err := os.WriteFile(path, []byte("derp1a.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []meshTarget{{host: "derp1a.example.com"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestMeshChanges(t *testing.T) {
+	a := meshTarget{host: "a"}
+	b := meshTarget{host: "b"}
+	c := meshTarget{host: "c"}
+	c2 := meshTarget{host: "c", dialAddr: "10.0.0.2"}
+	have := map[meshTarget]*meshPeer{a: nil, b: nil, c: nil}
+
+	add, remove := meshChanges(have, []meshTarget{a}, []meshTarget{a, c, c2, c2})
+	if want := []meshTarget{c2}; !reflect.DeepEqual(add, want) {
+		t.Errorf("add = %v; want %v", add, want)
+	}
+	if want := []meshTarget{b}; !reflect.DeepEqual(remove, want) {
+		t.Errorf("remove = %v; want %v", remove, want)
+	}
+
+	// Static peers are kept when nothing is discovered.
+	add, remove = meshChanges(have, []meshTarget{a}, nil)
+	if len(add) != 0 {
+		t.Errorf("add = %v; want none", add)
+	}
+	if want := []meshTarget{b, c}; !reflect.DeepEqual(remove, want) {
+		t.Errorf("remove = %v; want %v", remove, want)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// replicaSyncInterval is how often a replica that isn't the leader pulls
+	// the leader's assignments.
+	replicaSyncInterval = 30 * time.Second
+
+	// replicaRequestTimeout is how long a replica waits for the leader to
+	// assign addresses before assigning them itself.
+	replicaRequestTimeout = 2 * time.Second
+)
+
+// replicaSet coordinates the address assignments of the natc replicas that
+// share a --site-id, so that a peer gets the same addresses for a domain from
+// whichever replica answers its DNS queries, and can keep using them when
+// its traffic fails over to another replica.
+//
+// The leader is the first replica in the --replicas list that is online. It
+// makes all assignments: the other replicas forward new assignments to it,
+// and periodically pull its full set of assignments so that they can take
+// over its traffic. If the leader can't be reached, a replica assigns
+// addresses itself, which may conflict with the leader's choices once it is
+// back; the leader's assignments then win at the next sync.
+type replicaSet struct {
+	c     *connector
+	names []string // first DNS labels of the replicas, in order of preference
+	port  uint16   // of the replica API
+	hc    *http.Client
+}
+
+// leader returns the name of the current leader, and whether it is this
+// replica.
+func (rs *replicaSet) leader(ctx context.Context) (name string, self bool, err error) {
+	st, err := rs.c.lc.Status(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	me := dnsname.FirstLabel(st.Self.DNSName)
+	online := map[string]bool{}
+	for _, p := range st.Peer {
+		if p.Online {
+			online[dnsname.FirstLabel(p.DNSName)] = true
+		}
+	}
+	name = pickLeader(rs.names, me, online)
+	return name, name == me, nil
+}
+
+// pickLeader returns the first of names that is self or online. If none are,
+// self is the leader.
+func pickLeader(names []string, self string, online map[string]bool) string {
+	for _, n := range names {
+		if n == self || online[n] {
+			return n
+		}
+	}
+	return self
+}
+
+// assignByLeader asks the leader to assign addresses to domain for peer. It
+// reports false if this replica is the leader or the leader couldn't assign
+// them, in which case the caller should assign them itself.
+func (rs *replicaSet) assignByLeader(peer tailcfg.NodeID, domain string) ([]netip.Addr, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaRequestTimeout)
+	defer cancel()
+	leader, self, err := rs.leader(ctx)
+	if err != nil {
+		log.Printf("replicas: finding leader: %v", err)
+		return nil, false
+	}
+	if self {
+		return nil, false
+	}
+	var a addrAssignment
+	if err := rs.do(ctx, leader, "POST", "/assign", addrAssignment{Peer: peer, Domain: domain}, &a); err != nil {
+		log.Printf("replicas: leader %s did not assign %q for %v, assigning locally: %v", leader, domain, peer, err)
+		return nil, false
+	}
+	if a.Peer != peer || a.Domain != domain || !rs.c.validAssignment(a) {
+		log.Printf("replicas: leader %s returned bogus assignment %+v for %q, assigning locally", leader, a, domain)
+		return nil, false
+	}
+	return a.Addrs, true
+}
+
+// sync pulls the leader's assignments, unless this replica is the leader.
+func (rs *replicaSet) sync(ctx context.Context) error {
+	leader, self, err := rs.leader(ctx)
+	if err != nil || self {
+		return err
+	}
+	var as []addrAssignment
+	if err := rs.do(ctx, leader, "GET", "/assignments", nil, &as); err != nil {
+		return fmt.Errorf("pulling assignments from %s: %w", leader, err)
+	}
+	rs.c.restoreAssignments(as)
+	rs.c.saveAssignments()
+	return nil
+}
+
+// syncLoop calls sync every replicaSyncInterval, forever.
+func (rs *replicaSet) syncLoop() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaSyncInterval/2)
+		if err := rs.sync(ctx); err != nil {
+			log.Printf("replicas: %v", err)
+		}
+		cancel()
+		time.Sleep(replicaSyncInterval)
+	}
+}
+
+// do makes a replica API request to the replica named name, encoding req (if
+// non-nil) and decoding the response into resp.
+func (rs *replicaSet) do(ctx context.Context, name, method, path string, req, resp any) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	u := "http://" + net.JoinHostPort(name, strconv.Itoa(int(rs.port))) + path
+	hreq, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := rs.hc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// serve serves the replica API on ln, forever.
+func (rs *replicaSet) serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /assign", rs.serveAssign)
+	mux.HandleFunc("GET /assignments", rs.serveAssignments)
+	return http.Serve(ln, rs.onlyReplicas(mux))
+}
+
+// onlyReplicas wraps h to reject requests from nodes that aren't replicas:
+// the node must be named in the --replicas list and be owned by the same
+// tags or user as this node.
+func (rs *replicaSet) onlyReplicas(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, err := rs.c.lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		st, err := rs.c.lc.StatusWithoutPeers(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !slices.Contains(rs.names, dnsname.FirstLabel(who.Node.Name)) || !sameOwner(st.Self, who) {
+			http.Error(w, "not a replica", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sameOwner reports whether who is owned by the same tags (or, if untagged,
+// the same user) as self.
+func sameOwner(self *ipnstate.PeerStatus, who *apitype.WhoIsResponse) bool {
+	if self.IsTagged() || who.Node.IsTagged() {
+		if self.Tags == nil {
+			return false
+		}
+		mine := self.Tags.AsSlice()
+		theirs := slices.Clone(who.Node.Tags)
+		slices.Sort(mine)
+		slices.Sort(theirs)
+		return slices.Equal(mine, theirs)
+	}
+	return self.UserID == who.Node.User
+}
+
+func (rs *replicaSet) serveAssign(w http.ResponseWriter, r *http.Request) {
+	var req addrAssignment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, err := normalizeDomain(req.Domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addrs := rs.c.peerState(req.Peer).assignLocally(domain)
+	writeJSON(w, addrAssignment{Peer: req.Peer, Domain: domain, Addrs: addrs})
+}
+
+func (rs *replicaSet) serveAssignments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rs.c.assignments())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("replicas: writing response: %v", err)
+	}
+}
@@ -56,6 +56,9 @@ func main() {
 		printULA        = fs.Bool("print-ula", false, "print the ULA prefix and exit")
 		ignoreDstPfxStr = fs.String("ignore-destinations", "", "comma-separated list of prefixes to ignore")
 		wgPort          = fs.Uint("wg-port", 0, "udp port for wireguard and peer to peer traffic")
+		assignStoreSpec = fs.String("assignment-store", "", `where to persist the addresses assigned to domains: empty to keep them in memory only, "tsnet" for the tsnet state store, or a file path or state store spec as for tailscaled --state`)
+		replicasStr     = fs.String("replicas", "", "comma-separated hostnames of all the natc replicas with this site-id, in order of preference for leader; if set, replicas agree on the addresses assigned to domains")
+		replicaPort     = fs.Uint("replica-port", 8894, "listening port for the API used by replicas to coordinate address assignments")
 	)
 	ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix("TS_NATC"))
 
@@ -145,6 +148,42 @@ func main() {
 		v6ULA:      ula(uint16(*siteID)),
 		ignoreDsts: ignoreDstTable,
 	}
+	c.store, err = openAssignmentStore(*assignStoreSpec, ts)
+	if err != nil {
+		log.Fatalf("opening assignment store: %v", err)
+	}
+	if c.store != nil {
+		as, err := c.store.Load()
+		if err != nil {
+			log.Fatalf("loading assignments: %v", err)
+		}
+		c.restoreAssignments(as)
+		log.Printf("loaded %d address assignments", len(as))
+	}
+	if *replicasStr != "" {
+		if *replicaPort == 0 || *replicaPort >= 1<<16 {
+			log.Fatalf("replica-port must be in the range [1, 65535]")
+		}
+		c.replicas = &replicaSet{
+			c:    c,
+			port: uint16(*replicaPort),
+			hc:   ts.HTTPClient(),
+		}
+		for _, s := range strings.Split(*replicasStr, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				c.replicas.names = append(c.replicas.names, dnsname.FirstLabel(s))
+			}
+		}
+		rln, err := ts.Listen("tcp", fmt.Sprintf(":%d", *replicaPort))
+		if err != nil {
+			log.Fatalf("failed listening on replica port: %v", err)
+		}
+		defer rln.Close()
+		go func() {
+			log.Fatalf("replica serve: %v", c.replicas.serve(rln))
+		}()
+		go c.replicas.syncLoop()
+	}
 	c.run(ctx)
 }
 
@@ -167,6 +206,15 @@ type connector struct {
 
 	perPeerMap syncs.Map[tailcfg.NodeID, *perPeerState]
 
+	// store, if non-nil, persists the assignments in perPeerMap.
+	store assignmentStore
+	// storeMu serializes writes to store.
+	storeMu sync.Mutex
+
+	// replicas, if non-nil, coordinates assignments with the other replicas
+	// of this connector.
+	replicas *replicaSet
+
 	// ignoreDsts is initialized at start up with the contents of --ignore-destinations (if none it is nil)
 	// It is never mutated, only used for lookups.
 	// Users who want to natc a DNS wildcard but not every address record in that domain can supply the
@@ -252,7 +300,9 @@ func lookupDestinationIP(domain string) ([]netip.Addr, error) {
 // It generates a response based on the request and the node that sent it.
 //
 // Each node is assigned a unique pair of IP addresses for each domain it
-// queries. This assignment is done lazily and is not persisted across restarts.
+// queries. This assignment is done lazily. It is persisted across restarts if
+// --assignment-store is set, and shared with the other replicas of the
+// connector if --replicas is set.
 // A per-peer assignment allows the connector to reuse a limited number of IP
 // addresses across multiple nodes and domains. It also allows for clear
 // failover behavior when an app connector is restarted.
@@ -332,7 +382,7 @@ func (c *connector) handleDNS(pc net.PacketConn, buf []byte, remoteAddr *net.UDP
 // generateDNSResponse generates a DNS response for the given request. The from
 // argument is the NodeID of the node that sent the request.
 func (c *connector) generateDNSResponse(req *dnsmessage.Message, from tailcfg.NodeID) ([]byte, error) {
-	pm, _ := c.perPeerMap.LoadOrStore(from, &perPeerState{c: c})
+	pm := c.peerState(from)
 	var addrs []netip.Addr
 	if len(req.Questions) > 0 {
 		switch req.Questions[0].Type {
@@ -475,9 +525,16 @@ func proxyTCPConn(c net.Conn, dest string) {
 	p.Start()
 }
 
+// peerState returns the perPeerState of peer, creating it if needed.
+func (c *connector) peerState(peer tailcfg.NodeID) *perPeerState {
+	ps, _ := c.perPeerMap.LoadOrStore(peer, &perPeerState{c: c, peer: peer})
+	return ps
+}
+
 // perPeerState holds the state for a single peer.
 type perPeerState struct {
-	c *connector
+	c    *connector
+	peer tailcfg.NodeID
 
 	mu           sync.Mutex
 	domainToAddr map[string][]netip.Addr
@@ -495,20 +552,55 @@ func (ps *perPeerState) domainForIP(ip netip.Addr) (_ string, ok bool) {
 // ipForDomain assigns a pair of unique IP addresses for the given domain and
 // returns them. The first address is an IPv4 address and the second is an IPv6
 // address. If the domain already has assigned addresses, it returns them.
+//
+// If the connector has replicas, new addresses are assigned by the leader.
 func (ps *perPeerState) ipForDomain(domain string) ([]netip.Addr, error) {
-	fqdn, err := dnsname.ToFQDN(domain)
+	domain, err := normalizeDomain(domain)
 	if err != nil {
 		return nil, err
 	}
-	domain = fqdn.WithoutTrailingDot()
 
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	if addrs, ok := ps.domainToAddr[domain]; ok {
+	addrs, ok := ps.domainToAddr[domain]
+	ps.mu.Unlock()
+	if ok {
 		return addrs, nil
 	}
-	addrs := ps.assignAddrsLocked(domain)
-	return addrs, nil
+	if ps.c.replicas != nil {
+		if addrs, ok := ps.c.replicas.assignByLeader(ps.peer, domain); ok {
+			ps.mu.Lock()
+			ps.setAddrsLocked(domain, addrs)
+			ps.mu.Unlock()
+			ps.c.saveAssignments()
+			return addrs, nil
+		}
+	}
+	return ps.assignLocally(domain), nil
+}
+
+// normalizeDomain returns domain without a trailing dot, or an error if it
+// isn't a valid domain name.
+func normalizeDomain(domain string) (string, error) {
+	fqdn, err := dnsname.ToFQDN(domain)
+	if err != nil {
+		return "", err
+	}
+	return fqdn.WithoutTrailingDot(), nil
+}
+
+// assignLocally is like ipForDomain, but always assigns new addresses itself
+// rather than asking the leader replica. The domain must be normalized.
+func (ps *perPeerState) assignLocally(domain string) []netip.Addr {
+	ps.mu.Lock()
+	addrs, ok := ps.domainToAddr[domain]
+	if !ok {
+		addrs = ps.assignAddrsLocked(domain)
+	}
+	ps.mu.Unlock()
+	if !ok {
+		ps.c.saveAssignments()
+	}
+	return addrs
 }
 
 // isIPUsedLocked reports whether the given IP address is already assigned to a
@@ -559,9 +651,34 @@ func (ps *perPeerState) assignAddrsLocked(domain string) []netip.Addr {
 	copy(as16[12:], as4[:])
 	v6 := netip.AddrFrom16(as16)
 	addrs := []netip.Addr{v4, v6}
+	ps.setAddrsLocked(domain, addrs)
+	return addrs
+}
+
+// setAddrsLocked assigns addrs to domain, replacing the addresses previously
+// assigned to domain and any other domain previously assigned one of addrs.
+// ps.mu must be held.
+func (ps *perPeerState) setAddrsLocked(domain string, addrs []netip.Addr) {
+	if ps.addrToDomain == nil {
+		ps.addrToDomain = &bart.Table[string]{}
+	}
+	ps.removeDomainLocked(domain)
+	for _, a := range addrs {
+		if old, ok := ps.addrToDomain.Lookup(a); ok {
+			ps.removeDomainLocked(old)
+		}
+	}
 	mak.Set(&ps.domainToAddr, domain, addrs)
 	for _, a := range addrs {
 		ps.addrToDomain.Insert(netip.PrefixFrom(a, a.BitLen()), domain)
 	}
-	return addrs
+}
+
+// removeDomainLocked forgets the addresses assigned to domain, if any.
+// ps.mu must be held.
+func (ps *perPeerState) removeDomainLocked(domain string) {
+	for _, a := range ps.domainToAddr[domain] {
+		ps.addrToDomain.Delete(netip.PrefixFrom(a, a.BitLen()))
+	}
+	delete(ps.domainToAddr, domain)
 }
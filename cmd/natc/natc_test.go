@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/store/mem"
+)
+
+func newTestConnector() *connector {
+	return &connector{
+		dnsAddr:  netip.MustParseAddr("100.64.1.0"),
+		v4Ranges: []netip.Prefix{netip.MustParsePrefix("100.64.1.0/24")},
+		v6ULA:    ula(1),
+	}
+}
+
+func TestAssignmentsPersist(t *testing.T) {
+	st := stateStore{new(mem.Store)}
+	c := newTestConnector()
+	c.store = st
+
+	want, err := c.peerState(1).ipForDomain("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.peerState(2).ipForDomain("example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted connector gets the same addresses.
+	c2 := newTestConnector()
+	as, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.restoreAssignments(as)
+	got, err := c2.peerState(1).ipForDomain("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart got %v; want %v", got, want)
+	}
+	if d, ok := c2.peerState(1).domainForIP(want[1]); !ok || d != "example.com" {
+		t.Errorf("domainForIP(%v) = %q, %v; want example.com", want[1], d, ok)
+	}
+	if !reflect.DeepEqual(c2.assignments(), c.assignments()) {
+		t.Errorf("assignments differ after restart:\n got %v\nwant %v", c2.assignments(), c.assignments())
+	}
+}
+
+func TestRestoreAssignmentsReplaces(t *testing.T) {
+	c := newTestConnector()
+	ps := c.peerState(1)
+	old := ps.assignLocally("a.example.com")
+
+	// The leader assigned a.example.com's addresses to b.example.com, and
+	// something else to a.example.com.
+	other := []netip.Addr{netip.MustParseAddr("100.64.1.77"), netip.MustParseAddr("fd7a:115c:a1e0:a99c:1:0:6440:14d")}
+	c.restoreAssignments([]addrAssignment{
+		{Peer: 1, Domain: "b.example.com", Addrs: old},
+		{Peer: 1, Domain: "a.example.com", Addrs: other},
+		{Peer: 1, Domain: "bogus.example.com", Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), other[1]}},
+	})
+	want := []addrAssignment{
+		{Peer: 1, Domain: "a.example.com", Addrs: other},
+		{Peer: 1, Domain: "b.example.com", Addrs: old},
+	}
+	if got := c.assignments(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if d, _ := ps.domainForIP(old[0]); d != "b.example.com" {
+		t.Errorf("domainForIP(%v) = %q; want b.example.com", old[0], d)
+	}
+}
+
+func TestValidAssignment(t *testing.T) {
+	c := newTestConnector()
+	v4 := netip.MustParseAddr("100.64.1.5")
+	v6 := netip.MustParseAddr("fd7a:115c:a1e0:a99c:1::6440:105")
+	tests := []struct {
+		name string
+		a    addrAssignment
+		want bool
+	}{
+		{"ok", addrAssignment{Domain: "example.com", Addrs: []netip.Addr{v4, v6}}, true},
+		{"no_domain", addrAssignment{Addrs: []netip.Addr{v4, v6}}, false},
+		{"one_addr", addrAssignment{Domain: "example.com", Addrs: []netip.Addr{v4}}, false},
+		{"swapped", addrAssignment{Domain: "example.com", Addrs: []netip.Addr{v6, v4}}, false},
+		{"dns_addr", addrAssignment{Domain: "example.com", Addrs: []netip.Addr{c.dnsAddr, v6}}, false},
+		{"other_site", addrAssignment{Domain: "example.com", Addrs: []netip.Addr{v4, netip.MustParseAddr("fd7a:115c:a1e0:a99c:2::1")}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.validAssignment(tt.a); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickLeader(t *testing.T) {
+	names := []string{"natc-1", "natc-2", "natc-3"}
+	tests := []struct {
+		self   string
+		online []string
+		want   string
+	}{
+		{"natc-1", nil, "natc-1"},
+		{"natc-2", []string{"natc-1", "natc-3"}, "natc-1"},
+		{"natc-3", []string{"natc-2"}, "natc-2"},
+		{"natc-3", nil, "natc-3"},
+		{"other", nil, "other"},
+	}
+	for _, tt := range tests {
+		online := map[string]bool{}
+		for _, n := range tt.online {
+			online[n] = true
+		}
+		if got := pickLeader(names, tt.self, online); got != tt.want {
+			t.Errorf("pickLeader(self=%s, online=%v) = %s; want %s", tt.self, tt.online, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+)
+
+// addrAssignment is the pair of addresses assigned to a domain for a peer. It
+// is the unit persisted in an assignmentStore and exchanged between replicas.
+type addrAssignment struct {
+	Peer   tailcfg.NodeID `json:"peer"`
+	Domain string         `json:"domain"`
+	Addrs  []netip.Addr   `json:"addrs"`
+}
+
+// assignmentStore persists address assignments, so that peers get the same
+// addresses for a domain after the connector restarts.
+type assignmentStore interface {
+	// Load returns the saved assignments, if any.
+	Load() ([]addrAssignment, error)
+	// Save replaces the saved assignments with as.
+	Save(as []addrAssignment) error
+}
+
+// assignmentsStateKey is the key under which a stateStore keeps assignments.
+const assignmentsStateKey ipn.StateKey = "_natc-assignments"
+
+// stateStore is an assignmentStore that keeps assignments in an
+// ipn.StateStore.
+type stateStore struct {
+	st ipn.StateStore
+}
+
+func (s stateStore) Load() ([]addrAssignment, error) {
+	b, err := s.st.ReadState(assignmentsStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var as []addrAssignment
+	if err := json.Unmarshal(b, &as); err != nil {
+		return nil, fmt.Errorf("decoding assignments: %w", err)
+	}
+	return as, nil
+}
+
+func (s stateStore) Save(as []addrAssignment) error {
+	b, err := json.Marshal(as)
+	if err != nil {
+		return err
+	}
+	return s.st.WriteState(assignmentsStateKey, b)
+}
+
+// openAssignmentStore returns the assignmentStore for the --assignment-store
+// flag value spec, or nil if assignments are only kept in memory.
+//
+// The spec "tsnet" selects the state store of ts, which must already be
+// started. Anything else is a path or state store spec as understood by
+// store.New, such as a file path or, in builds that support them, a
+// Kubernetes secret or AWS parameter shared between replicas.
+func openAssignmentStore(spec string, ts *tsnet.Server) (assignmentStore, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "tsnet":
+		if ts.Store == nil {
+			return nil, errors.New("tsnet state store is not initialized")
+		}
+		return stateStore{ts.Store}, nil
+	}
+	st, err := store.New(log.Printf, spec)
+	if err != nil {
+		return nil, err
+	}
+	return stateStore{st}, nil
+}
+
+// assignments returns all the address assignments of c, ordered by peer and
+// domain.
+func (c *connector) assignments() []addrAssignment {
+	var as []addrAssignment
+	c.perPeerMap.Range(func(peer tailcfg.NodeID, ps *perPeerState) bool {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		for domain, addrs := range ps.domainToAddr {
+			as = append(as, addrAssignment{Peer: peer, Domain: domain, Addrs: slices.Clone(addrs)})
+		}
+		return true
+	})
+	slices.SortFunc(as, func(a, b addrAssignment) int {
+		return cmp.Or(cmp.Compare(a.Peer, b.Peer), cmp.Compare(a.Domain, b.Domain))
+	})
+	return as
+}
+
+// restoreAssignments adds as to the assignments of c, replacing any existing
+// assignments of the same domains or addresses. Assignments with addresses
+// outside of the connector's ranges are skipped, as they were made with a
+// different configuration.
+func (c *connector) restoreAssignments(as []addrAssignment) {
+	for _, a := range as {
+		if !c.validAssignment(a) {
+			log.Printf("skipping assignment of %v to %q for %v: addresses not in the advertised ranges", a.Addrs, a.Domain, a.Peer)
+			continue
+		}
+		ps := c.peerState(a.Peer)
+		ps.mu.Lock()
+		ps.setAddrsLocked(a.Domain, a.Addrs)
+		ps.mu.Unlock()
+	}
+}
+
+// validAssignment reports whether a is an IPv4 and IPv6 address pair from the
+// ranges of c.
+func (c *connector) validAssignment(a addrAssignment) bool {
+	if a.Domain == "" || len(a.Addrs) != 2 {
+		return false
+	}
+	v4, v6 := a.Addrs[0], a.Addrs[1]
+	if !v4.Is4() || v4 == c.dnsAddr || !c.v6ULA.Contains(v6) {
+		return false
+	}
+	return slices.ContainsFunc(c.v4Ranges, func(p netip.Prefix) bool {
+		return p.Contains(v4)
+	})
+}
+
+// saveAssignments writes all the assignments of c to its store, if any.
+//
+// The whole set is written each time; this is fine for the number of
+// domains a connector is expected to serve.
+func (c *connector) saveAssignments() {
+	if c.store == nil {
+		return
+	}
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+	if err := c.store.Save(c.assignments()); err != nil {
+		log.Printf("saving assignments: %v", err)
+	}
+}
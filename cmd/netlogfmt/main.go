@@ -22,6 +22,12 @@
 //	                100.85.80.41 -> 192.168.0.101:41641   16.00    2.23Ki   10.40      1.40Ki
 //	               100.107.177.2 -> 192.168.0.100:41641    0.80   83.20      0.80     83.20
 //	=========================================================================================
+//
+// It also reads the files written by a local network log sink
+// (tailscaled --netlog-local=file:PATH), including the older files that
+// the sink rotated out, oldest first:
+//
+//	$ go run tailscale.com/cmd/netlogfmt /var/log/tailscale/netlog.jsonl
 package main
 
 import (
@@ -36,6 +42,7 @@
 	"net/http"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -66,17 +73,54 @@ func main() {
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil && err != io.EOF {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range withRotatedFiles(flag.Args()) {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = processStream(f)
+		f.Close()
+		if err != nil && err != io.EOF {
+			log.Fatalf("processStream: %s: %v", name, err)
+		}
+	}
+}
+
+// withRotatedFiles returns the files names, each preceded by the files that
+// a local network log sink rotated it to (name.N, ..., name.2, name.1),
+// which are older.
+func withRotatedFiles(names []string) []string {
+	var all []string
+	for _, name := range names {
+		type rotated struct {
+			name string
+			n    int
+		}
+		var rs []rotated
+		matches, _ := filepath.Glob(name + ".*")
+		for _, m := range matches {
+			if n, err := strconv.Atoi(strings.TrimPrefix(m, name+".")); err == nil && n > 0 {
+				rs = append(rs, rotated{m, n})
+			}
+		}
+		slices.SortFunc(rs, func(x, y rotated) int { return cmp.Compare(y.n, x.n) })
+		for _, r := range rs {
+			all = append(all, r.name)
 		}
-		log.Fatalf("processStream: %v", err)
+		all = append(all, name)
 	}
+	return all
 }
 
 func processStream(r io.Reader) (err error) {
 	defer try.Handle(&err)
-	dec := jsontext.NewDecoder(os.Stdin)
+	dec := jsontext.NewDecoder(r)
 	for {
 		processValue(dec)
 	}
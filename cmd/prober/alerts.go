@@ -0,0 +1,46 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"tailscale.com/prober"
+)
+
+// webhooks is a prober.AlertNotifier that notifies the webhooks of the
+// current config.
+type webhooks struct {
+	mu    sync.Mutex
+	hooks []*prober.Webhook
+}
+
+// set replaces the webhooks with those of c.
+func (w *webhooks) set(c *config) {
+	var hooks []*prober.Webhook
+	if c.Alerts != nil {
+		for _, wc := range c.Alerts.Webhooks {
+			hooks = append(hooks, wc.toProber())
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = hooks
+}
+
+// Notify implements prober.AlertNotifier.
+func (w *webhooks) Notify(ctx context.Context, ev prober.AlertEvent) error {
+	w.mu.Lock()
+	hooks := w.hooks
+	w.mu.Unlock()
+	var errs []error
+	for _, h := range hooks {
+		if err := h.Notify(ctx, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// apiHandler returns the handler of the API for changing the probes of m,
+// for requests authenticated with the bearer token.
+//
+//	GET    /api/probes               lists probes and their status
+//	POST   /api/probes               adds the probe in the JSON request body
+//	DELETE /api/probes/{name}        removes a probe
+//	POST   /api/probes/{name}/pause  pauses a probe
+//	POST   /api/probes/{name}/resume resumes a paused probe
+//
+// Changes are lost when the config file is reloaded.
+func apiHandler(m *manager, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/probes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.status())
+	})
+	mux.HandleFunc("POST /api/probes", func(w http.ResponseWriter, r *http.Request) {
+		var pc probeConfig
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&pc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.add(pc); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("DELETE /api/probes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.remove(r.PathValue("name")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /api/probes/{name}/pause", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.setPaused(r.PathValue("name"), true); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /api/probes/{name}/resume", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.setPaused(r.PathValue("name"), false); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
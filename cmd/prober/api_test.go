@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/prober"
+)
+
+func TestAPI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	target := ln.Addr().String()
+
+	m := newManager(prober.New())
+	m.apply(&config{Probes: []probeConfig{
+		{Name: "a", Type: "tcp", Target: target, Interval: duration(time.Hour)},
+		{Name: "b", Type: "tcp", Target: target, Interval: duration(time.Hour), Paused: true},
+	}})
+	defer m.apply(&config{})
+
+	h := apiHandler(m, "sekrit")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sekrit")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func() map[string]probeStatus {
+		t.Helper()
+		rec := do("GET", "/api/probes", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("listing probes: %v %s", rec.Code, rec.Body)
+		}
+		var sts []probeStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &sts); err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string]probeStatus{}
+		for _, st := range sts {
+			ret[st.Name] = st
+		}
+		return ret
+	}
+
+	req := httptest.NewRequest("GET", "/api/probes", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %v; want %v", rec.Code, http.StatusUnauthorized)
+	}
+
+	sts := list()
+	if len(sts) != 2 || sts["a"].Info == nil || sts["b"].Info != nil || !sts["b"].Paused {
+		t.Fatalf("unexpected probes: %+v", sts)
+	}
+
+	tests := []struct {
+		method, path, body string
+		wantCode           int
+	}{
+		{"POST", "/api/probes", `{"name": "c", "type": "tcp", "target": "` + target + `", "interval": "1h"}`, http.StatusCreated},
+		{"POST", "/api/probes", `{"name": "c", "type": "tcp", "target": "` + target + `"}`, http.StatusConflict},
+		{"POST", "/api/probes", `{"name": "d", "type": "tcp"}`, http.StatusBadRequest},
+		{"POST", "/api/probes/a/pause", "", http.StatusNoContent},
+		{"POST", "/api/probes/b/resume", "", http.StatusNoContent},
+		{"POST", "/api/probes/x/pause", "", http.StatusNotFound},
+		{"DELETE", "/api/probes/c", "", http.StatusNoContent},
+		{"DELETE", "/api/probes/c", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.path, tt.body); rec.Code != tt.wantCode {
+			t.Errorf("%s %s: got %v %s; want %v", tt.method, tt.path, rec.Code, rec.Body, tt.wantCode)
+		}
+	}
+	sts = list()
+	if len(sts) != 2 || sts["a"].Info != nil || !sts["a"].Paused || sts["b"].Info == nil || sts["b"].Paused {
+		t.Fatalf("unexpected probes: %+v", sts)
+	}
+
+	// Reloading the config discards changes made through the API.
+	m.apply(&config{Probes: []probeConfig{
+		{Name: "a", Type: "tcp", Target: target, Interval: duration(time.Hour)},
+	}})
+	sts = list()
+	if len(sts) != 1 || sts["a"].Info == nil {
+		t.Fatalf("unexpected probes: %+v", sts)
+	}
+
+	// Enabling alerting restarts the probe with an alert.
+	m.apply(&config{
+		Probes: []probeConfig{{Name: "a", Type: "tcp", Target: target, Interval: duration(time.Hour)}},
+		Alerts: &alertsConfig{alertConfig: alertConfig{FailuresToFire: 2}},
+	})
+	if alerts := m.p.Alerts(); len(alerts) != 1 || alerts[0].Probe != "a" {
+		t.Errorf("Alerts() = %+v; want alert for a", alerts)
+	}
+}
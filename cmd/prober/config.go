@@ -0,0 +1,293 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+	"tailscale.com/prober"
+)
+
+// defaultInterval is the interval of probes that don't set one.
+const defaultInterval = 30 * time.Second
+
+// config is the contents of a config file, in YAML or JSON. For example:
+//
+//	probes:
+//	  - name: login
+//	    type: http
+//	    target: https://login.tailscale.com/login
+//	    want: Tailscale
+//	    interval: 1m
+//	    labels:
+//	      team: control
+//	  - name: derp
+//	    type: derp
+//	    target: https://login.tailscale.com/derpmap/default
+//	    tlsInterval: 30s
+//	    stunInterval: 15s
+//	alerts:
+//	  failuresToFire: 3
+//	  successesToClear: 2
+//	  webhooks:
+//	    - url: https://hooks.slack.com/services/...
+//	      format: slack
+type config struct {
+	Probes []probeConfig `json:"probes"`
+
+	// Alerts, if non-nil, enables alerting for all probes.
+	Alerts *alertsConfig `json:"alerts,omitempty"`
+}
+
+// alertsConfig configures alerting.
+type alertsConfig struct {
+	// alertConfig is the default alert config of probes.
+	alertConfig
+
+	// Webhooks are notified when alerts fire and clear.
+	Webhooks []webhookConfig `json:"webhooks,omitempty"`
+}
+
+// alertConfig configures the alert of a probe. See prober.AlertConfig.
+type alertConfig struct {
+	FailuresToFire   int      `json:"failuresToFire,omitempty"`
+	SuccessesToClear int      `json:"successesToClear,omitempty"`
+	FlapThreshold    int      `json:"flapThreshold,omitempty"`
+	FlapWindow       duration `json:"flapWindow,omitempty"`
+}
+
+func (ac alertConfig) toProber() prober.AlertConfig {
+	return prober.AlertConfig{
+		FailuresToFire:   ac.FailuresToFire,
+		SuccessesToClear: ac.SuccessesToClear,
+		FlapThreshold:    ac.FlapThreshold,
+		FlapWindow:       time.Duration(ac.FlapWindow),
+	}
+}
+
+func (ac alertConfig) validate() error {
+	if ac.FailuresToFire < 0 || ac.SuccessesToClear < 0 || ac.FlapThreshold < 0 {
+		return errors.New("negative alert count")
+	}
+	if ac.FlapThreshold > 0 && ac.FlapWindow <= 0 {
+		return errors.New("flapThreshold requires a positive flapWindow")
+	}
+	return nil
+}
+
+// webhookConfig configures a webhook. See prober.Webhook.
+type webhookConfig struct {
+	URL     string `json:"url"`
+	Format  string `json:"format,omitempty"` // "slack" or "json" (the default)
+	Retries *int   `json:"retries,omitempty"`
+}
+
+// defaultWebhookRetries is the number of retries of webhooks that don't set
+// it.
+const defaultWebhookRetries = 3
+
+func (wc webhookConfig) toProber() *prober.Webhook {
+	w := &prober.Webhook{
+		URL:     wc.URL,
+		Format:  wc.Format,
+		Retries: defaultWebhookRetries,
+	}
+	if wc.Retries != nil {
+		w.Retries = *wc.Retries
+	}
+	return w
+}
+
+// probeConfig configures one probe.
+type probeConfig struct {
+	// Name is the name of the probe, and of its metrics. It must be
+	// unique.
+	Name string `json:"name"`
+
+	// Type is the type of the probe: "http", "tls", "tcp", "dns" or
+	// "derp".
+	Type string `json:"type"`
+
+	// Target is what to probe, depending on Type: a URL for "http", a
+	// host:port for "tls" and "tcp", a hostname for "dns", and the URL
+	// of a DERP map (or "local") for "derp".
+	Target string `json:"target"`
+
+	// Interval is how often to probe. If zero, defaultInterval is used.
+	Interval duration `json:"interval,omitempty"`
+
+	// Labels are added to the metrics of the probe.
+	Labels prober.Labels `json:"labels,omitempty"`
+
+	// Paused is whether the probe is configured but not run.
+	Paused bool `json:"paused,omitempty"`
+
+	// Alert, if non-nil, overrides the default alert config of the
+	// probe. It's ignored unless alerting is enabled.
+	Alert *alertConfig `json:"alert,omitempty"`
+
+	// Want is text that the response body of an "http" probe must
+	// contain.
+	Want string `json:"want,omitempty"`
+
+	// Networks are the networks ("ip", "ip4" or "ip6") that a "dns" probe
+	// resolves Target in. If empty, "ip" is used.
+	Networks []string `json:"networks,omitempty"`
+
+	// The intervals of the probes that a "derp" probe runs for each DERP
+	// server in the DERP map. A zero interval disables those probes.
+	TLSInterval  duration `json:"tlsInterval,omitempty"`
+	STUNInterval duration `json:"stunInterval,omitempty"`
+	MeshInterval duration `json:"meshInterval,omitempty"`
+}
+
+// interval returns how often pc probes.
+func (pc *probeConfig) interval() time.Duration {
+	if pc.Interval == 0 {
+		return defaultInterval
+	}
+	return time.Duration(pc.Interval)
+}
+
+// duration is a time.Duration that's a string such as "30s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and validates the config file at path.
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(b)
+}
+
+// parseConfig parses and validates a config file's contents.
+func parseConfig(b []byte) (*config, error) {
+	var c config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *config) validate() error {
+	seen := map[string]bool{}
+	var derp string
+	for i := range c.Probes {
+		pc := &c.Probes[i]
+		if err := pc.validate(); err != nil {
+			return err
+		}
+		if seen[pc.Name] {
+			return fmt.Errorf("duplicate probe %q", pc.Name)
+		}
+		seen[pc.Name] = true
+		if pc.Type == "derp" {
+			// The probes of DERP servers are named after the servers,
+			// so a second DERP map would collide with the first.
+			if derp != "" {
+				return fmt.Errorf("probe %q: only one derp probe is supported, and %q is one", pc.Name, derp)
+			}
+			derp = pc.Name
+		}
+	}
+	if c.Alerts != nil {
+		if err := c.Alerts.validate(); err != nil {
+			return fmt.Errorf("alerts: %w", err)
+		}
+		for _, wc := range c.Alerts.Webhooks {
+			u, err := url.Parse(wc.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				// Don't include the URL, which is often secret.
+				return errors.New("alerts: webhook URL is not an http or https URL")
+			}
+			if wc.Format != "" && wc.Format != "slack" && wc.Format != "json" {
+				return fmt.Errorf("alerts: unknown webhook format %q", wc.Format)
+			}
+			if wc.Retries != nil && *wc.Retries < 0 {
+				return errors.New("alerts: negative webhook retries")
+			}
+		}
+	}
+	return nil
+}
+
+var labelNameRx = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (pc *probeConfig) validate() error {
+	if pc.Name == "" {
+		return errors.New("probe with no name")
+	}
+	if strings.Contains(pc.Name, "/") {
+		// Names with slashes would be ambiguous in API paths, and
+		// collide with the names of DERP server probes.
+		return fmt.Errorf("probe %q: name contains a slash", pc.Name)
+	}
+	if pc.Target == "" {
+		return fmt.Errorf("probe %q: no target", pc.Name)
+	}
+	if pc.Interval < 0 || pc.TLSInterval < 0 || pc.STUNInterval < 0 || pc.MeshInterval < 0 {
+		return fmt.Errorf("probe %q: negative interval", pc.Name)
+	}
+	if pc.Alert != nil {
+		if err := pc.Alert.validate(); err != nil {
+			return fmt.Errorf("probe %q: %w", pc.Name, err)
+		}
+	}
+	for k := range pc.Labels {
+		if !labelNameRx.MatchString(k) || k == "name" || k == "class" {
+			return fmt.Errorf("probe %q: invalid label name %q", pc.Name, k)
+		}
+	}
+	switch pc.Type {
+	case "http":
+		u, err := url.Parse(pc.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("probe %q: target %q is not an http or https URL", pc.Name, pc.Target)
+		}
+	case "tls", "tcp":
+		if _, _, err := net.SplitHostPort(pc.Target); err != nil {
+			return fmt.Errorf("probe %q: target %q is not a host:port", pc.Name, pc.Target)
+		}
+	case "dns":
+		for _, n := range pc.Networks {
+			if n != "ip" && n != "ip4" && n != "ip6" {
+				return fmt.Errorf("probe %q: unknown network %q", pc.Name, n)
+			}
+		}
+	case "derp":
+	default:
+		return fmt.Errorf("probe %q: unknown type %q", pc.Name, pc.Type)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/prober"
+)
+
+func TestParseConfig(t *testing.T) {
+	yamlConfig := `
+probes:
+  - name: login
+    type: http
+    target: https://login.example.com/login
+    want: Example
+    interval: 1m
+    labels:
+      team: control
+  - name: ns
+    type: dns
+    target: example.com
+    networks: [ip4]
+  - name: derp
+    type: derp
+    target: local
+    tlsInterval: 30s
+    paused: true
+`
+	jsonConfig := `{"probes": [
+		{"name": "login", "type": "http", "target": "https://login.example.com/login", "want": "Example", "interval": "1m", "labels": {"team": "control"}},
+		{"name": "ns", "type": "dns", "target": "example.com", "networks": ["ip4"]},
+		{"name": "derp", "type": "derp", "target": "local", "tlsInterval": "30s", "paused": true}
+	]}`
+	want := &config{Probes: []probeConfig{
+		{Name: "login", Type: "http", Target: "https://login.example.com/login", Want: "Example", Interval: duration(time.Minute), Labels: prober.Labels{"team": "control"}},
+		{Name: "ns", Type: "dns", Target: "example.com", Networks: []string{"ip4"}},
+		{Name: "derp", Type: "derp", Target: "local", TLSInterval: duration(30 * time.Second), Paused: true},
+	}}
+	for _, in := range []string{yamlConfig, jsonConfig} {
+		got, err := parseConfig([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+	}
+	if got := want.Probes[1].interval(); got != defaultInterval {
+		t.Errorf("default interval = %v; want %v", got, defaultInterval)
+	}
+}
+
+func TestParseAlertsConfig(t *testing.T) {
+	got, err := parseConfig([]byte(`
+alerts:
+  failuresToFire: 3
+  flapThreshold: 4
+  flapWindow: 10m
+  webhooks:
+    - url: https://hooks.example.com/a
+      format: slack
+    - url: https://hooks.example.com/b
+      retries: 0
+probes:
+  - name: a
+    type: tcp
+    target: "a:1"
+    alert: {failuresToFire: 5}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := 0
+	want := &config{
+		Alerts: &alertsConfig{
+			alertConfig: alertConfig{FailuresToFire: 3, FlapThreshold: 4, FlapWindow: duration(10 * time.Minute)},
+			Webhooks: []webhookConfig{
+				{URL: "https://hooks.example.com/a", Format: "slack"},
+				{URL: "https://hooks.example.com/b", Retries: &zero},
+			},
+		},
+		Probes: []probeConfig{
+			{Name: "a", Type: "tcp", Target: "a:1", Alert: &alertConfig{FailuresToFire: 5}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	wantHooks := []*prober.Webhook{
+		{URL: "https://hooks.example.com/a", Format: "slack", Retries: defaultWebhookRetries},
+		{URL: "https://hooks.example.com/b"},
+	}
+	var w webhooks
+	w.set(got)
+	if !reflect.DeepEqual(w.hooks, wantHooks) {
+		t.Errorf("got webhooks %+v; want %+v", w.hooks, wantHooks)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr string
+	}{
+		{`probes: [{type: tcp, target: "a:1"}]`, "no name"},
+		{`probes: [{name: a/b, type: tcp, target: "a:1"}]`, "slash"},
+		{`probes: [{name: a, type: tcp}]`, "no target"},
+		{`probes: [{name: a, type: tcp, target: a}]`, "not a host:port"},
+		{`probes: [{name: a, type: http, target: "ftp://a"}]`, "not an http"},
+		{`probes: [{name: a, type: icmp, target: a}]`, "unknown type"},
+		{`probes: [{name: a, type: dns, target: a, networks: [ip5]}]`, "unknown network"},
+		{`probes: [{name: a, type: tcp, target: "a:1", interval: -1s}]`, "negative interval"},
+		{`probes: [{name: a, type: tcp, target: "a:1", interval: 30}]`, "cannot unmarshal"},
+		{`probes: [{name: a, type: tcp, target: "a:1", labels: {class: x}}]`, "invalid label"},
+		{`probes: [{name: a, type: tcp, target: "a:1", bogus: 1}]`, "unknown field"},
+		{`probes: [{name: a, type: tcp, target: "a:1"}, {name: a, type: tcp, target: "b:1"}]`, "duplicate probe"},
+		{`probes: [{name: a, type: derp, target: local}, {name: b, type: derp, target: local}]`, "only one derp"},
+		{`probes: [{name: a, type: tcp, target: "a:1", alert: {flapThreshold: 3}}]`, "requires a positive flapWindow"},
+		{`alerts: {failuresToFire: -1}`, "negative alert count"},
+		{`alerts: {webhooks: [{url: "hooks.example.com"}]}`, "not an http"},
+		{`alerts: {webhooks: [{url: "https://hooks.example.com", format: xml}]}`, "unknown webhook format"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig([]byte(tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseConfig(%q) = %v; want error containing %q", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/prober"
+)
+
+var (
+	errNotFound = errors.New("probe not found")
+	errExists   = errors.New("probe already exists")
+)
+
+// manager runs the configured probes, changing them as the config is
+// reloaded or modified through the API.
+type manager struct {
+	p *prober.Prober
+
+	mu     sync.Mutex
+	alerts *alertConfig             // default alert config, or nil if alerting is disabled
+	probes map[string]*managedProbe // by name
+}
+
+// managedProbe is a configured probe.
+type managedProbe struct {
+	cfg probeConfig
+
+	// probe is the running probe, or nil if it's paused.
+	probe *prober.Probe
+
+	// closeExtra, if non-nil, closes other probes that probe started.
+	closeExtra func()
+
+	// alert is the alert config of probe, or nil if alerting is
+	// disabled.
+	alert *alertConfig
+}
+
+func newManager(p *prober.Prober) *manager {
+	return &manager{
+		p:      p,
+		probes: map[string]*managedProbe{},
+	}
+}
+
+// apply changes the running probes to those of c, leaving unchanged probes
+// running. Changes made through the API are discarded.
+func (m *manager) apply(c *config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.alerts = nil
+	if c.Alerts != nil {
+		m.alerts = &c.Alerts.alertConfig
+	}
+	want := map[string]bool{}
+	for _, pc := range c.Probes {
+		want[pc.Name] = true
+	}
+	// Stop removed and changed probes first, so that changed probes can
+	// be restarted under the same name.
+	for name, mp := range m.probes {
+		if !want[name] {
+			log.Printf("removing probe %q", name)
+			m.stopLocked(mp)
+			delete(m.probes, name)
+		}
+	}
+	for _, pc := range c.Probes {
+		if mp, ok := m.probes[pc.Name]; ok {
+			if reflect.DeepEqual(mp.cfg, pc) && reflect.DeepEqual(mp.alert, m.alertLocked(pc)) {
+				continue
+			}
+			log.Printf("reconfiguring probe %q", pc.Name)
+			m.stopLocked(mp)
+			delete(m.probes, pc.Name)
+		}
+		if err := m.startLocked(pc); err != nil {
+			log.Printf("starting probe %q: %v", pc.Name, err)
+		}
+	}
+}
+
+// add starts the probe pc, which must not exist.
+func (m *manager) add(pc probeConfig) error {
+	if err := pc.validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.probes[pc.Name]; ok {
+		return errExists
+	}
+	c := &config{Probes: []probeConfig{pc}}
+	for _, mp := range m.probes {
+		c.Probes = append(c.Probes, mp.cfg)
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	log.Printf("adding probe %q", pc.Name)
+	return m.startLocked(pc)
+}
+
+// remove stops and forgets the named probe.
+func (m *manager) remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.probes[name]
+	if !ok {
+		return errNotFound
+	}
+	log.Printf("removing probe %q", name)
+	m.stopLocked(mp)
+	delete(m.probes, name)
+	return nil
+}
+
+// setPaused pauses or resumes the named probe.
+func (m *manager) setPaused(name string, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.probes[name]
+	if !ok {
+		return errNotFound
+	}
+	if mp.cfg.Paused == paused {
+		return nil
+	}
+	log.Printf("setting probe %q paused=%v", name, paused)
+	m.stopLocked(mp)
+	delete(m.probes, name)
+	pc := mp.cfg
+	pc.Paused = paused
+	return m.startLocked(pc)
+}
+
+// startLocked registers pc and, unless it's paused, runs it.
+//
+// m.mu must be held, and no probe named pc.Name may be running.
+func (m *manager) startLocked(pc probeConfig) error {
+	mp := &managedProbe{cfg: pc, alert: m.alertLocked(pc)}
+	if !pc.Paused {
+		var err error
+		mp.probe, mp.closeExtra, err = m.run(pc)
+		if err != nil {
+			return err
+		}
+		if mp.alert != nil {
+			mp.probe.WithAlert(mp.alert.toProber())
+		}
+	}
+	m.probes[pc.Name] = mp
+	return nil
+}
+
+// alertLocked returns the alert config of pc, or nil if alerting is
+// disabled.
+//
+// m.mu must be held.
+func (m *manager) alertLocked(pc probeConfig) *alertConfig {
+	if m.alerts == nil {
+		return nil
+	}
+	if pc.Alert != nil {
+		return pc.Alert
+	}
+	return m.alerts
+}
+
+// stopLocked stops mp if it's running.
+//
+// m.mu must be held.
+func (m *manager) stopLocked(mp *managedProbe) {
+	if mp.probe != nil {
+		mp.probe.Close()
+		mp.probe = nil
+	}
+	if mp.closeExtra != nil {
+		mp.closeExtra()
+		mp.closeExtra = nil
+	}
+}
+
+// run runs the probe pc.
+func (m *manager) run(pc probeConfig) (_ *prober.Probe, closeExtra func(), _ error) {
+	var class prober.ProbeClass
+	switch pc.Type {
+	case "http":
+		class = prober.HTTP(pc.Target, pc.Want)
+	case "tls":
+		class = prober.TLS(pc.Target)
+	case "tcp":
+		class = prober.TCP(pc.Target)
+	case "dns":
+		// A probe that resolves the name without probing its addresses.
+		class = prober.ForEachAddr(pc.Target, func(netip.Addr) []*prober.Probe { return nil }, prober.ForEachAddrOpts{
+			Logf:     log.Printf,
+			Networks: pc.Networks,
+		})
+	case "derp":
+		dp, err := prober.DERP(m.p, pc.Target,
+			prober.WithTLSProbing(time.Duration(pc.TLSInterval)),
+			prober.WithSTUNProbing(time.Duration(pc.STUNInterval)),
+			prober.WithMeshProbing(time.Duration(pc.MeshInterval)),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		class = dp.ProbeMap
+		closeExtra = func() { dp.Close() }
+	default:
+		return nil, nil, fmt.Errorf("unknown probe type %q", pc.Type)
+	}
+	return m.p.Run(pc.Name, pc.interval(), pc.Labels, class), closeExtra, nil
+}
+
+// probeStatus is the config and state of a probe.
+type probeStatus struct {
+	probeConfig
+
+	// Info is the state of the probe, or nil if it's paused.
+	Info *prober.ProbeInfo `json:"info,omitempty"`
+}
+
+// status returns the status of all probes, sorted by name.
+func (m *manager) status() []probeStatus {
+	infos := m.p.ProbeInfo()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]probeStatus, 0, len(m.probes))
+	for name, mp := range m.probes {
+		st := probeStatus{probeConfig: mp.cfg}
+		if info, ok := infos[name]; ok && mp.probe != nil {
+			st.Info = &info
+		}
+		ret = append(ret, st)
+	}
+	slices.SortFunc(ret, func(a, b probeStatus) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return ret
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The prober binary runs the HTTP, TLS, TCP, DNS and DERP probes described
+// by a config file, exporting their results as Prometheus metrics.
+//
+// The config file is reloaded on SIGHUP. With --api-token-file, probes can
+// also be added, removed and paused through an HTTP API.
+//
+// Alerts, which fire after a number of consecutive failures, can be sent to
+// webhooks, and are shown at /debug/alerts.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"tailscale.com/prober"
+	"tailscale.com/tsweb"
+	"tailscale.com/version"
+)
+
+var (
+	configPath   = flag.String("config", "", "path to the YAML or JSON config file of probes")
+	versionFlag  = flag.Bool("version", false, "print version and exit")
+	listen       = flag.String("listen", ":8030", "HTTP listen address")
+	spread       = flag.Bool("spread", true, "whether to spread probing over time")
+	apiTokenFile = flag.String("api-token-file", "", "if non-empty, path to a file containing the bearer token of the HTTP API for changing probes; the API is disabled otherwise")
+)
+
+func main() {
+	flag.Parse()
+	if *versionFlag {
+		fmt.Println(version.Long())
+		return
+	}
+	if *configPath == "" {
+		log.Fatal("--config is required")
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+
+	hooks := new(webhooks)
+	hooks.set(c)
+	p := prober.New().WithSpread(*spread).WithAlertNotifier(hooks)
+	m := newManager(p)
+	m.apply(c)
+
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for range sigHup {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				log.Printf("reloading config: %v; keeping old config", err)
+				continue
+			}
+			log.Printf("reloading config")
+			hooks.set(c)
+			m.apply(c)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	debug := tsweb.Debugger(mux)
+	debug.Handle("alerts", "Probe alerts", http.HandlerFunc(p.ServeAlerts))
+	if *apiTokenFile != "" {
+		b, err := os.ReadFile(*apiTokenFile)
+		if err != nil {
+			log.Fatalf("reading API token: %v", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			log.Fatalf("API token file %s is empty", *apiTokenFile)
+		}
+		mux.Handle("/api/", apiHandler(m, token))
+	}
+	mux.HandleFunc("/", serveFunc(p, m))
+	log.Printf("Listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+type overallStatus struct {
+	good, bad, paused []string
+}
+
+func (st *overallStatus) addBadf(format string, a ...any) {
+	st.bad = append(st.bad, fmt.Sprintf(format, a...))
+}
+
+func (st *overallStatus) addGoodf(format string, a ...any) {
+	st.good = append(st.good, fmt.Sprintf(format, a...))
+}
+
+// getOverallStatus returns the status of all probes, including those
+// started by DERP probes.
+func getOverallStatus(p *prober.Prober, m *manager) (o overallStatus) {
+	for p, i := range p.ProbeInfo() {
+		if i.End.IsZero() {
+			// Do not show probes that have not finished yet.
+			continue
+		}
+		if i.Result {
+			o.addGoodf("%s: %s", p, i.Latency)
+		} else {
+			o.addBadf("%s: %s", p, i.Error)
+		}
+	}
+	for _, st := range m.status() {
+		if st.Paused {
+			o.paused = append(o.paused, st.Name)
+		}
+	}
+
+	sort.Strings(o.bad)
+	sort.Strings(o.good)
+	return
+}
+
+func serveFunc(p *prober.Prober, m *manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := getOverallStatus(p, m)
+		summary := "All good"
+		if (float64(len(st.bad)) / float64(len(st.bad)+len(st.good))) > 0.25 {
+			// Returning a 500 allows monitoring this server externally and configuring
+			// an alert on HTTP response code.
+			w.WriteHeader(500)
+			summary = fmt.Sprintf("%d problems", len(st.bad))
+		}
+
+		io.WriteString(w, "<html><head><style>.bad { font-weight: bold; color: #700; } .paused { color: #777; }</style></head>\n")
+		fmt.Fprintf(w, "<body><h1>prober</h1>\n%s:<ul>", summary)
+		for _, s := range st.bad {
+			fmt.Fprintf(w, "<li class=bad>%s</li>\n", html.EscapeString(s))
+		}
+		for _, s := range st.good {
+			fmt.Fprintf(w, "<li>%s</li>\n", html.EscapeString(s))
+		}
+		for _, s := range st.paused {
+			fmt.Fprintf(w, "<li class=paused>%s: paused</li>\n", html.EscapeString(s))
+		}
+		io.WriteString(w, "</ul></body></html>\n")
+	}
+}
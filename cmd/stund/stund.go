@@ -20,6 +20,8 @@
 var (
 	stunAddr = flag.String("stun", ":3478", "UDP address on which to start the STUN server")
 	httpAddr = flag.String("http", ":3479", "address on which to start the debug http server")
+	altAddr  = flag.String("alt", "", "if non-empty, the alternate UDP address (IP:port) for RFC 5780 NAT behavior discovery; requires a -stun address with a specific IP")
+	turnPath = flag.String("turn-config", "", "if non-empty, path to a JSON file configuring a TURN relay on the STUN port; see stunserver.TURNConfig")
 )
 
 func main() {
@@ -32,6 +34,24 @@ func main() {
 	go http.ListenAndServe(*httpAddr, mux())
 
 	s := stunserver.New(ctx)
+	if *turnPath != "" {
+		c, err := stunserver.ReadTURNConfig(*turnPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := s.EnableTURN(*c); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *altAddr != "" {
+		if err := s.ListenRFC5780(*stunAddr, *altAddr); err != nil {
+			log.Fatal(err)
+		}
+		if err := s.Serve(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if err := s.ListenAndServe(*stunAddr); err != nil {
 		log.Fatal(err)
 	}
@@ -44,5 +64,8 @@ func mux() *http.ServeMux {
 	})
 	debug := tsweb.Debugger(mux)
 	debug.KV("stun_addr", *stunAddr)
+	if *altAddr != "" {
+		debug.KV("stun_alt_addr", *altAddr)
+	}
 	return mux
 }
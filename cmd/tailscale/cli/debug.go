@@ -284,6 +284,23 @@
 			FlagSet: (func() *flag.FlagSet {
 				fs := newFlagSet("capture")
 				fs.StringVar(&captureArgs.outFile, "o", "", "path to stream the pcap (or - for stdout), leave empty to start wireshark")
+				fs.StringVar(&captureArgs.format, "format", "pcap", `capture format: "pcap", or "pcapng" for per-path interfaces and comments on NAT and disco packets`)
+				return fs
+			})(),
+		},
+		{
+			Name:       "capture-ring",
+			ShortUsage: "tailscale debug capture-ring (start|stop|dump)",
+			Exec:       runCaptureRing,
+			ShortHelp:  "Keeps recent packets in memory, to dump when something goes wrong",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("capture-ring")
+				fs.IntVar(&captureRingArgs.maxBytes, "max-bytes", 0, "start: maximum memory for packets (0 for the default, 16 MiB)")
+				fs.DurationVar(&captureRingArgs.maxAge, "max-age", 0, "start: maximum age of packets (0 for no limit)")
+				fs.StringVar(&captureRingArgs.filter, "filter", "", `start: packets to keep, such as "peer 100.64.0.2 and proto tcp and port 22"`)
+				fs.DurationVar(&captureRingArgs.healthDump, "health-dump", 0, "start: if non-zero, how much of the capture to write to tailscaled's state directory on health warnings")
+				fs.StringVar(&captureRingArgs.outFile, "o", "", "dump: path to write the pcapng file to (or - for stdout)")
+				fs.DurationVar(&captureRingArgs.last, "last", 0, "dump: how far back to dump (0 for all packets)")
 				return fs
 			})(),
 		},
@@ -958,10 +975,15 @@ func runSetExpire(ctx context.Context, args []string) error {
 
 var captureArgs struct {
 	outFile string
+	format  string
 }
 
 func runCapture(ctx context.Context, args []string) error {
-	stream, err := localClient.StreamDebugCapture(ctx)
+	format, err := capture.ParseFormat(captureArgs.format)
+	if err != nil {
+		return err
+	}
+	stream, err := localClient.StreamDebugCaptureFormat(ctx, format.String())
 	if err != nil {
 		return err
 	}
@@ -1000,6 +1022,46 @@ func runCapture(ctx context.Context, args []string) error {
 	return err
 }
 
+var captureRingArgs struct {
+	maxBytes   int
+	maxAge     time.Duration
+	filter     string
+	healthDump time.Duration
+	outFile    string
+	last       time.Duration
+}
+
+func runCaptureRing(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug capture-ring (start|stop|dump)")
+	}
+	switch args[0] {
+	case "start":
+		return localClient.StartDebugCaptureRing(ctx, &tailscale.DebugCaptureRingOpts{
+			MaxBytes:   captureRingArgs.maxBytes,
+			MaxAge:     captureRingArgs.maxAge,
+			Filter:     captureRingArgs.filter,
+			HealthDump: captureRingArgs.healthDump,
+		})
+	case "stop":
+		return localClient.StopDebugCaptureRing(ctx)
+	case "dump":
+		if captureRingArgs.outFile == "" {
+			return errors.New("missing -o flag")
+		}
+		b, err := localClient.DumpDebugCaptureRing(ctx, captureRingArgs.last)
+		if err != nil {
+			return err
+		}
+		if captureRingArgs.outFile == "-" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+		return os.WriteFile(captureRingArgs.outFile, b, 0644)
+	}
+	return fmt.Errorf("unknown capture-ring action %q", args[0])
+}
+
 var debugPortmapArgs struct {
 	duration    time.Duration
 	gatewayAddr string
@@ -12,6 +12,7 @@
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +37,7 @@
 		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
 		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
+		fs.BoolVar(&netcheckArgs.history, "history", false, "instead of running a netcheck, print a summary of how tailscaled's recent netcheck reports changed over time")
 		return fs
 	})(),
 }
@@ -44,9 +46,13 @@
 	format  string
 	every   time.Duration
 	verbose bool
+	history bool
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
+	if netcheckArgs.history {
+		return runNetcheckHistory(ctx)
+	}
 	logf := logger.WithPrefix(log.Printf, "portmap: ")
 	netMon, err := netmon.New(logf)
 	if err != nil {
@@ -56,6 +62,7 @@ func runNetcheck(ctx context.Context, args []string) error {
 		NetMon:      netMon,
 		PortMapper:  portmapper.NewClient(logf, netMon, nil, nil, nil),
 		UseDNSCache: false, // always resolve, don't cache
+		ClassifyNAT: true,
 	}
 	if netcheckArgs.verbose {
 		c.Logf = logger.WithPrefix(log.Printf, "netcheck: ")
@@ -150,6 +157,11 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	if report.CaptivePortal != "" {
 		printf("\t* CaptivePortal: %v\n", report.CaptivePortal)
 	}
+	if report.NATMapping != "" {
+		printf("\t* NAT type: %v mapping, %v filtering, hairpinning: %v\n", report.NATMapping, report.NATFiltering, report.Hairpinning)
+	} else if report.UDP {
+		printf("\t* NAT type: unknown (no nearby STUN server supports RFC 5780)\n")
+	}
 
 	// When DERP latency checking failed,
 	// magicsock will try to pick the DERP server that
@@ -195,6 +207,102 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	return nil
 }
 
+func runNetcheckHistory(ctx context.Context) error {
+	b, err := localClient.NetcheckHistory(ctx)
+	if err != nil {
+		return err
+	}
+	var entries []netcheck.HistoryEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("invalid netcheck history JSON: %w", err)
+	}
+
+	switch netcheckArgs.format {
+	case "":
+	case "json":
+		j, err := json.MarshalIndent(entries, "", "\t")
+		if err != nil {
+			return err
+		}
+		Stdout.Write(append(j, '\n'))
+		return nil
+	case "json-line":
+		for _, e := range entries {
+			j, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			Stdout.Write(append(j, '\n'))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", netcheckArgs.format)
+	}
+
+	if len(entries) == 0 {
+		printf("No netcheck reports yet.\n")
+		return nil
+	}
+	dm, _ := localClient.CurrentDERPMap(ctx)
+	printHistorySummary(dm, netcheck.SummarizeHistory(entries))
+	return nil
+}
+
+func printHistorySummary(dm *tailcfg.DERPMap, s netcheck.HistorySummary) {
+	const timeFormat = "2006-01-02 15:04:05"
+	regionName := func(rid int) string {
+		if dm != nil && dm.Regions[rid] != nil {
+			return dm.Regions[rid].RegionCode
+		}
+		return fmt.Sprintf("derp%d", rid)
+	}
+
+	printf("\nHistory: %d reports from %s to %s\n", s.Reports, s.Start.Local().Format(timeFormat), s.End.Local().Format(timeFormat))
+	if len(s.Changes) == 0 {
+		printf("\t* No changes in NAT, port mapping, preferred DERP, addresses or captive portal\n")
+	} else {
+		printf("\t* Changes:\n")
+		for _, c := range s.Changes {
+			from, to := c.From, c.To
+			if c.Field == "PreferredDERP" {
+				from, to = preferredDERPName(from, regionName), preferredDERPName(to, regionName)
+			}
+			printf("\t\t- %s: %s: %s -> %s\n", c.Time.Local().Format(timeFormat), c.Field, from, to)
+		}
+	}
+
+	if len(s.RegionLatency) == 0 {
+		return
+	}
+	printf("\t* DERP latency (min / median / max, last):\n")
+	var rids []int
+	for rid := range s.RegionLatency {
+		rids = append(rids, rid)
+	}
+	sort.Slice(rids, func(i, j int) bool {
+		return s.RegionLatency[rids[i]].Median < s.RegionLatency[rids[j]].Median
+	})
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond / 10) }
+	for _, rid := range rids {
+		l := s.RegionLatency[rid]
+		last := "-"
+		if l.Last > 0 {
+			last = round(l.Last).String()
+		}
+		printf("\t\t- %3s: %v / %v / %v, last %v (%d samples)\n", regionName(rid), round(l.Min), round(l.Median), round(l.Max), last, l.Samples)
+	}
+}
+
+// preferredDERPName returns the name of the region of the DERP region ID
+// rid, a string.
+func preferredDERPName(rid string, regionName func(int) string) string {
+	id, err := strconv.Atoi(rid)
+	if err != nil || id == 0 {
+		return "none"
+	}
+	return regionName(id)
+}
+
 func portMapping(r *netcheck.Report) string {
 	if !r.AnyPortMappingChecked() {
 		return "not checked"
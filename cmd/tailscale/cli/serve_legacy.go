@@ -21,6 +21,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -153,14 +154,22 @@ type serveEnv struct {
 	json bool // output JSON (status only for now)
 
 	// v2 specific flags
-	bg               bool      // background mode
-	setPath          string    // serve path
-	https            uint      // HTTP port
-	http             uint      // HTTP port
-	tcp              uint      // TCP port
-	tlsTerminatedTCP uint      // a TLS terminated TCP port
-	subcmd           serveMode // subcommand
-	yes              bool      // update without prompt
+	bg               bool          // background mode
+	setPath          string        // serve path
+	https            uint          // HTTP port
+	http             uint          // HTTP port
+	tcp              uint          // TCP port
+	tlsTerminatedTCP uint          // a TLS terminated TCP port
+	udp              uint          // UDP port
+	subcmd           serveMode     // subcommand
+	yes              bool          // update without prompt
+	setHeaders       multiFlag     // response headers to set, as "Name: value"
+	removeHeaders    multiFlag     // names of response headers to remove
+	noDirListing     bool          // disable directory listings for path targets
+	allowFrom        multiFlag     // peers allowed to access the handler
+	expires          time.Duration // how long until the handler is removed; 0 means never
+	lbPolicy         string        // load balancing policy for multiple backends
+	healthCheckPath  string        // health check URL path for load balanced HTTP backends
 
 	lc localServeClient // localClient interface, specific to serve
 
@@ -168,6 +177,7 @@ type serveEnv struct {
 	testFlagOut io.Writer
 	testStdout  io.Writer
 	testStderr  io.Writer
+	testNow     func() time.Time // if non-nil, used instead of time.Now
 }
 
 // getSelfDNSName returns the DNS name of the current node.
@@ -614,7 +624,7 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return nil
 	}
 	printFunnelStatus(ctx)
-	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.UDP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
 		printf("No serve config\n")
 		return nil
 	}
@@ -628,6 +638,10 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		}
 		printf("\n")
 	}
+	if len(sc.UDP) > 0 {
+		printUDPStatusTree(sc, st)
+		printf("\n")
+	}
 	for hp := range sc.Web {
 		err := e.printWebStatusTree(sc, hp)
 		if err != nil {
@@ -642,7 +656,7 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.Status) error {
 	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
 	for p, h := range sc.TCP {
-		if h.TCPForward == "" {
+		if h.TCPForward == "" && h.LoadBalancer == nil {
 			continue
 		}
 		hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(p))))
@@ -654,16 +668,36 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 		if sc.AllowFunnel[hp] {
 			fStatus = "Funnel on"
 		}
+		if exp := expiryStatus(h.Expires); exp != "" {
+			fStatus += ", " + exp
+		}
 		printf("|-- tcp://%s (%s, %s)\n", hp, tlsStatus, fStatus)
 		for _, a := range st.TailscaleIPs {
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
 			printf("|-- tcp://%s\n", ipp)
 		}
-		printf("|--> tcp://%s\n", h.TCPForward)
+		printf("|--> %s\n", tcpForwardDesc(h))
 	}
 	return nil
 }
 
+func printUDPStatusTree(sc *ipn.ServeConfig, st *ipnstate.Status) {
+	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
+	for p, h := range sc.UDP {
+		hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(p))))
+		status := "tailnet only"
+		if exp := expiryStatus(h.Expires); exp != "" {
+			status += ", " + exp
+		}
+		printf("|-- udp://%s (%s)\n", hp, status)
+		for _, a := range st.TailscaleIPs {
+			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
+			printf("|-- udp://%s\n", ipp)
+		}
+		printf("|--> udp://%s\n", h.UDPForward)
+	}
+}
+
 func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) error {
 	// No-op if no serve config
 	if sc == nil {
@@ -701,8 +735,12 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 			return "path", h.Path
 		case h.Proxy != "":
 			return "proxy", h.Proxy
+		case h.LoadBalancer != nil:
+			return "proxy", loadBalancerDesc(h.LoadBalancer)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			return "redirect", h.Redirect
 		}
 		return "", ""
 	}
@@ -719,6 +757,9 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
 		t, d := srvTypeAndDesc(h)
+		if exp := expiryStatus(h.Expires); exp != "" {
+			d += " (" + exp + ")"
+		}
 		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
 	}
 
@@ -21,12 +21,14 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ptr"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
@@ -54,9 +56,25 @@ type commandInfo struct {
   - Expose an HTTPS server with invalid or self-signed certificates at https://localhost:8443
     $ tailscale %[1]s https+insecure://localhost:8443
 
+  - Permanently redirect requests to another site, with an optional 3xx status code:
+    $ tailscale %[1]s --bg redirect:301:https://example.com/
+
+  - Load balance across HTTP servers running at 127.0.0.1:3000 and 127.0.0.1:3001:
+    $ tailscale %[1]s --bg --lb-policy=least-conns --health-check-path=/healthz 3000,3001
+
+%[2]s  - Expose an HTTP server running at 127.0.0.1:3000 in the background for one hour:
+    $ tailscale %[1]s --bg --expires=1h 3000
+
 For more examples and use cases visit our docs site https://tailscale.com/kb/1247/funnel-serve-use-cases
 `)
 
+// serveHelpUDP is the example of serveHelpCommon for flags that only serve
+// has, as funnel doesn't forward UDP.
+const serveHelpUDP = `  - Forward UDP datagrams sent to port 53 to a DNS server running at 127.0.0.1:5353:
+    $ tailscale serve --bg --udp=53 5353
+
+`
+
 type serveMode int
 
 const (
@@ -71,6 +89,7 @@ type commandInfo struct {
 	serveTypeHTTP
 	serveTypeTCP
 	serveTypeTLSTerminatedTCP
+	serveTypeUDP
 )
 
 var infoMap = map[serveMode]commandInfo{
@@ -105,6 +124,10 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 	}
 
 	info := infoMap[subcmd]
+	var serveOnlyHelp string
+	if subcmd == serve {
+		serveOnlyHelp = serveHelpUDP
+	}
 
 	return &ffcli.Command{
 		Name:      info.Name,
@@ -114,7 +137,7 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			fmt.Sprintf("tailscale %s status [--json]", info.Name),
 			fmt.Sprintf("tailscale %s reset", info.Name),
 		}, "\n"),
-		LongHelp: info.LongHelp + fmt.Sprintf(strings.TrimSpace(serveHelpCommon), info.Name),
+		LongHelp: info.LongHelp + fmt.Sprintf(strings.TrimSpace(serveHelpCommon), info.Name, serveOnlyHelp),
 		Exec:     e.runServeCombined(subcmd),
 
 		FlagSet: e.newFlags("serve-set", func(fs *flag.FlagSet) {
@@ -126,7 +149,17 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			}
 			fs.UintVar(&e.tcp, "tcp", 0, "Expose a TCP forwarder to forward raw TCP packets at the specified port")
 			fs.UintVar(&e.tlsTerminatedTCP, "tls-terminated-tcp", 0, "Expose a TCP forwarder to forward TLS-terminated TCP packets at the specified port")
+			if subcmd == serve {
+				fs.UintVar(&e.udp, "udp", 0, "Expose a UDP forwarder to forward UDP datagrams at the specified port")
+			}
 			fs.BoolVar(&e.yes, "yes", false, "Update without interactive prompts (default false)")
+			fs.Var(&e.setHeaders, "set-header", "Set an HTTP response header, in the form \"Name: value\"; may be repeated")
+			fs.Var(&e.removeHeaders, "remove-header", "Remove an HTTP response header by name; may be repeated")
+			fs.BoolVar(&e.noDirListing, "no-dir-listing", false, "Do not list the contents of directories served from a path (default false)")
+			fs.Var(&e.allowFrom, "allow-from", "Only allow access from this user login name, tag:<name> or cap:<peer-capability>; may be repeated")
+			fs.DurationVar(&e.expires, "expires", 0, "Remove the configuration after this duration, such as 30m or 2h (default never)")
+			fs.StringVar(&e.lbPolicy, "lb-policy", "", "Load balancing policy when <target> is a comma-separated list of backends: round-robin, least-conns or hash (default round-robin)")
+			fs.StringVar(&e.healthCheckPath, "health-check-path", "", "URL path to request from load balanced HTTP backends to check their health (default just connect)")
 		}),
 		UsageFunc: usageFuncNoDefaultValues,
 		Subcommands: []*ffcli.Command{
@@ -172,6 +205,10 @@ func (e *serveEnv) validateArgs(subcmd serveMode, args []string) error {
 		fmt.Fprintln(e.stderr(), "Error: invalid argument format")
 		return errHelpFunc(subcmd)
 	}
+	if e.expires < 0 {
+		fmt.Fprintln(e.stderr(), "Error: --expires must be a positive duration")
+		return errHelpFunc(subcmd)
+	}
 
 	// Given the two checks above, we can assume there
 	// are only 1 or 2 arguments which is valid.
@@ -333,6 +370,20 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 const backgroundExistsMsg = "background configuration already exists, use `tailscale %s --%s=%d off` to remove the existing configuration"
 
 func (e *serveEnv) validateConfig(sc *ipn.ServeConfig, port uint16, wantServe serveType) error {
+	if wantServe == serveTypeUDP {
+		// UDP ports don't conflict with TCP ones.
+		sc, isFg := sc.FindUDPConfig(port)
+		if sc == nil {
+			return nil
+		}
+		if isFg {
+			return errors.New("foreground already exists under this port")
+		}
+		if !e.bg {
+			return fmt.Errorf(backgroundExistsMsg, infoMap[e.subcmd].Name, wantServe.String(), port)
+		}
+		return nil
+	}
 	sc, isFg := sc.FindConfig(port)
 	if sc == nil {
 		return nil
@@ -358,7 +409,7 @@ func serveFromPortHandler(tcp *ipn.TCPPortHandler) serveType {
 		return serveTypeHTTPS
 	case tcp.TerminateTLS != "":
 		return serveTypeTLSTerminatedTCP
-	case tcp.TCPForward != "":
+	case tcp.TCPForward != "" || tcp.LoadBalancer != nil:
 		return serveTypeTCP
 	default:
 		return -1
@@ -378,11 +429,31 @@ func (e *serveEnv) setServe(sc *ipn.ServeConfig, st *ipnstate.Status, dnsName st
 		if e.setPath != "" {
 			return fmt.Errorf("cannot mount a path for TCP serve")
 		}
+		if len(e.setHeaders) > 0 || len(e.removeHeaders) > 0 || e.noDirListing {
+			return fmt.Errorf("HTTP response options cannot be used with TCP serve")
+		}
 
 		err := e.applyTCPServe(sc, dnsName, srvType, srvPort, target)
 		if err != nil {
 			return fmt.Errorf("failed to apply TCP serve: %w", err)
 		}
+	case serveTypeUDP:
+		if e.setPath != "" {
+			return fmt.Errorf("cannot mount a path for UDP serve")
+		}
+		if len(e.setHeaders) > 0 || len(e.removeHeaders) > 0 || e.noDirListing {
+			return fmt.Errorf("HTTP response options cannot be used with UDP serve")
+		}
+		if allowFunnel {
+			return fmt.Errorf("UDP cannot be served over Funnel")
+		}
+
+		err := e.applyUDPServe(sc, srvPort, target)
+		if err != nil {
+			return fmt.Errorf("failed to apply UDP serve: %w", err)
+		}
+		// Funnel is per TCP port; leave it alone.
+		return nil
 	default:
 		return fmt.Errorf("invalid type %q", srvType)
 	}
@@ -408,7 +479,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 
 	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
 
-	if sc.AllowFunnel[hp] == true {
+	if srvType != serveTypeUDP && sc.AllowFunnel[hp] {
 		output.WriteString(msgFunnelAvailable)
 	} else {
 		output.WriteString(msgServeAvailable)
@@ -432,13 +503,25 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			return "path", h.Path
 		case h.Proxy != "":
 			return "proxy", h.Proxy
+		case h.LoadBalancer != nil:
+			return "proxy", loadBalancerDesc(h.LoadBalancer)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			return "redirect", h.Redirect
 		}
 		return "", ""
 	}
 
-	if sc.Web[hp] != nil {
+	if srvType == serveTypeUDP && sc.UDP[srvPort] != nil {
+		h := sc.UDP[srvPort]
+		output.WriteString(fmt.Sprintf("|-- udp://%s\n", hp))
+		for _, a := range st.TailscaleIPs {
+			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
+			output.WriteString(fmt.Sprintf("|-- udp://%s\n", ipp))
+		}
+		output.WriteString(fmt.Sprintf("|--> udp://%s\n\n", h.UDPForward))
+	} else if sc.Web[hp] != nil {
 		var mounts []string
 
 		for k := range sc.Web[hp].Handlers {
@@ -468,7 +551,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
 			output.WriteString(fmt.Sprintf("|-- tcp://%s\n", ipp))
 		}
-		output.WriteString(fmt.Sprintf("|--> tcp://%s\n", h.TCPForward))
+		output.WriteString(fmt.Sprintf("|--> %s\n", tcpForwardDesc(h)))
 	}
 
 	if !e.bg {
@@ -496,6 +579,20 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case strings.HasPrefix(target, "redirect:"):
+		redirect := strings.TrimPrefix(target, "redirect:")
+		if _, _, err := ipn.ParseRedirect(redirect); err != nil {
+			return fmt.Errorf("unable to serve; %w", err)
+		}
+		h.Redirect = redirect
+	case strings.Contains(target, ","):
+		lb, err := e.loadBalancerFromTarget(target, func(t string) (string, error) {
+			return ipn.ExpandProxyTargetValue(t, []string{"http", "https", "https+insecure"}, "http")
+		})
+		if err != nil {
+			return err
+		}
+		h.LoadBalancer = lb
 	case filepath.IsAbs(target):
 		if version.IsMacAppStore() || version.IsMacSys() {
 			// The Tailscale network extension cannot serve arbitrary paths on macOS due to sandbox restrictions (2024-03-26)
@@ -523,6 +620,35 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 		h.Proxy = t
 	}
 
+	if h.LoadBalancer == nil && (e.lbPolicy != "" || e.healthCheckPath != "") {
+		return errors.New("--lb-policy and --health-check-path require a comma-separated list of backends")
+	}
+	if e.noDirListing {
+		if h.Path == "" {
+			return errors.New("--no-dir-listing is only supported when serving a path")
+		}
+		h.NoDirListing = true
+	}
+	for _, hv := range e.setHeaders {
+		name, value, ok := strings.Cut(hv, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid --set-header %q; want \"Name: value\"", hv)
+		}
+		mak.Set(&h.SetHeaders, name, strings.TrimSpace(value))
+	}
+	for _, name := range e.removeHeaders {
+		if name == "" {
+			return errors.New("invalid empty --remove-header")
+		}
+		h.RemoveHeaders = append(h.RemoveHeaders, name)
+	}
+	if err := ipn.CheckAllowFrom(e.allowFrom); err != nil {
+		return err
+	}
+	h.AllowFrom = append(h.AllowFrom, e.allowFrom...)
+	h.Expires = e.expiresAt()
+
 	// TODO: validation needs to check nested foreground configs
 	if sc.IsTCPForwardingOnPort(srvPort) {
 		return errors.New("cannot serve web; already serving TCP")
@@ -544,14 +670,33 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("invalid TCP target %q", target)
 	}
 
-	targetURL, err := ipn.ExpandProxyTargetValue(target, []string{"tcp"}, "tcp")
-	if err != nil {
-		return fmt.Errorf("unable to expand target: %v", err)
+	expand := func(target string) (string, error) {
+		targetURL, err := ipn.ExpandProxyTargetValue(target, []string{"tcp"}, "tcp")
+		if err != nil {
+			return "", fmt.Errorf("unable to expand target: %v", err)
+		}
+		dstURL, err := url.Parse(targetURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid TCP target %q: %v", target, err)
+		}
+		return dstURL.Host, nil
+	}
+	var fwdAddr string
+	var lb *ipn.LoadBalancer
+	var err error
+	if strings.Contains(target, ",") {
+		if e.healthCheckPath != "" {
+			return errors.New("--health-check-path is not supported for TCP backends")
+		}
+		lb, err = e.loadBalancerFromTarget(target, expand)
+	} else {
+		if e.lbPolicy != "" {
+			return errors.New("--lb-policy requires a comma-separated list of backends")
+		}
+		fwdAddr, err = expand(target)
 	}
-
-	dstURL, err := url.Parse(targetURL)
 	if err != nil {
-		return fmt.Errorf("invalid TCP target %q: %v", target, err)
+		return err
 	}
 
 	// TODO: needs to account for multiple configs from foreground mode
@@ -559,7 +704,41 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
 
-	sc.SetTCPForwarding(srcPort, dstURL.Host, terminateTLS, dnsName)
+	if err := ipn.CheckAllowFrom(e.allowFrom); err != nil {
+		return err
+	}
+
+	sc.SetTCPForwarding(srcPort, fwdAddr, terminateTLS, dnsName)
+	sc.TCP[srcPort].LoadBalancer = lb
+	sc.TCP[srcPort].AllowFrom = append(sc.TCP[srcPort].AllowFrom, e.allowFrom...)
+	sc.TCP[srcPort].Expires = e.expiresAt()
+
+	return nil
+}
+
+func (e *serveEnv) applyUDPServe(sc *ipn.ServeConfig, srcPort uint16, target string) error {
+	if strings.Contains(target, ",") {
+		return errors.New("load balancing is not supported for UDP")
+	}
+	if e.lbPolicy != "" || e.healthCheckPath != "" {
+		return errors.New("--lb-policy and --health-check-path are not supported for UDP")
+	}
+	targetURL, err := ipn.ExpandProxyTargetValue(target, []string{"udp"}, "udp")
+	if err != nil {
+		return fmt.Errorf("unable to expand target: %v", err)
+	}
+	dstURL, err := url.Parse(targetURL)
+	if err != nil {
+		return fmt.Errorf("invalid UDP target %q: %v", target, err)
+	}
+
+	if err := ipn.CheckAllowFrom(e.allowFrom); err != nil {
+		return err
+	}
+
+	sc.SetUDPForwarding(srcPort, dstURL.Host)
+	sc.UDP[srcPort].AllowFrom = append(sc.UDP[srcPort].AllowFrom, e.allowFrom...)
+	sc.UDP[srcPort].Expires = e.expiresAt()
 
 	return nil
 }
@@ -592,6 +771,11 @@ func (e *serveEnv) unsetServe(sc *ipn.ServeConfig, dnsName string, srvType serve
 		if err != nil {
 			return fmt.Errorf("failed to remove TCP serve: %w", err)
 		}
+	case serveTypeUDP:
+		err := e.removeUDPServe(sc, srvPort)
+		if err != nil {
+			return fmt.Errorf("failed to remove UDP serve: %w", err)
+		}
 	default:
 		return fmt.Errorf("invalid type %q", srvType)
 	}
@@ -607,6 +791,7 @@ func srvTypeAndPortFromFlags(e *serveEnv) (srvType serveType, srvPort uint16, er
 		serveTypeHTTPS:            e.https,
 		serveTypeTCP:              e.tcp,
 		serveTypeTLSTerminatedTCP: e.tlsTerminatedTCP,
+		serveTypeUDP:              e.udp,
 	}
 
 	var srcTypeCount int
@@ -785,6 +970,19 @@ func (e *serveEnv) removeTCPServe(sc *ipn.ServeConfig, src uint16) error {
 	return nil
 }
 
+// removeUDPServe removes the UDP forwarding configuration for the
+// given srvPort, or serving port.
+func (e *serveEnv) removeUDPServe(sc *ipn.ServeConfig, src uint16) error {
+	if sc == nil {
+		return nil
+	}
+	if sc.GetUDPPortHandler(src) == nil {
+		return errors.New("error: serve config does not exist")
+	}
+	sc.RemoveUDPForwarding(src)
+	return nil
+}
+
 // cleanURLPath ensures the path is clean and has a leading "/".
 func cleanURLPath(urlPath string) (string, error) {
 	if urlPath == "" {
@@ -804,6 +1002,86 @@ func cleanURLPath(urlPath string) (string, error) {
 	return "", fmt.Errorf("invalid mount point %q", urlPath)
 }
 
+// multiFlag is a flag.Value for flags that may be repeated, collecting
+// each of their values in order.
+type multiFlag []string
+
+// loadBalancerFromTarget returns a LoadBalancer for target, a comma-separated
+// list of backends that are each expanded by expand, using the policy and
+// health check flags.
+func (e *serveEnv) loadBalancerFromTarget(target string, expand func(string) (string, error)) (*ipn.LoadBalancer, error) {
+	lb := &ipn.LoadBalancer{Policy: ipn.LBPolicy(e.lbPolicy)}
+	for _, t := range strings.Split(target, ",") {
+		backend, err := expand(strings.TrimSpace(t))
+		if err != nil {
+			return nil, err
+		}
+		lb.Backends = append(lb.Backends, backend)
+	}
+	if e.healthCheckPath != "" {
+		lb.HealthCheck = &ipn.HealthCheck{Path: e.healthCheckPath}
+	}
+	if err := ipn.CheckLoadBalancer(lb); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// loadBalancerDesc describes lb for status output.
+func loadBalancerDesc(lb *ipn.LoadBalancer) string {
+	policy := lb.Policy
+	if policy == "" {
+		policy = ipn.LBPolicyRoundRobin
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(lb.Backends, ", "), policy)
+}
+
+// tcpForwardDesc describes where h forwards TCP connections to, for status
+// output.
+func tcpForwardDesc(h *ipn.TCPPortHandler) string {
+	if h.LoadBalancer != nil {
+		backends := make([]string, len(h.LoadBalancer.Backends))
+		for i, b := range h.LoadBalancer.Backends {
+			backends[i] = "tcp://" + b
+		}
+		return loadBalancerDesc(&ipn.LoadBalancer{Backends: backends, Policy: h.LoadBalancer.Policy})
+	}
+	return "tcp://" + h.TCPForward
+}
+
+// expiresAt returns when a handler configured with the --expires flag is
+// removed, or nil if it's kept until turned off.
+func (e *serveEnv) expiresAt() *time.Time {
+	if e.expires == 0 {
+		return nil
+	}
+	now := time.Now
+	if e.testNow != nil {
+		now = e.testNow
+	}
+	return ptr.To(now().Add(e.expires))
+}
+
+// expiryStatus describes the time remaining before a handler with the given
+// expiry is removed, or returns the empty string if it never expires.
+func expiryStatus(expires *time.Time) string {
+	if expires == nil {
+		return ""
+	}
+	left := time.Until(*expires).Round(time.Second)
+	if left <= 0 {
+		return "expired"
+	}
+	return "expires in " + left.String()
+}
+
+func (v *multiFlag) String() string { return strings.Join(*v, ",") }
+
+func (v *multiFlag) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
 func (s serveType) String() string {
 	switch s {
 	case serveTypeHTTP:
@@ -814,6 +1092,8 @@ func (s serveType) String() string {
 		return "tcp"
 	case serveTypeTLSTerminatedTCP:
 		return "tls-terminated-tcp"
+	case serveTypeUDP:
+		return "udp"
 	default:
 		return "unknownServeType"
 	}
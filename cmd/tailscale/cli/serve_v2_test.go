@@ -14,6 +14,7 @@
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -36,6 +37,10 @@ type group struct {
 		steps []step
 	}
 
+	testNow := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	inOneHour := testNow.Add(time.Hour)
+	inThirtyMinutes := testNow.Add(30 * time.Minute)
+
 	// creaet a temporary directory for path-based destinations
 	td := t.TempDir()
 	writeFile := func(suffix, contents string) {
@@ -496,6 +501,273 @@ type group struct {
 				},
 			}},
 		},
+		{
+			name: "redirect",
+			steps: []step{
+				{
+					command: cmd("serve --bg redirect:https://example.com/"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Redirect: "https://example.com/"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/old redirect:301:https://example.com/new"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/":    {Redirect: "https://example.com/"},
+								"/old": {Redirect: "301:https://example.com/new"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad redirect:200:https://example.com/"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "response_headers",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-header=Cache-Control:no-store --set-header=X-Frame-Options:DENY --remove-header=Server 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy: "http://127.0.0.1:3000",
+									SetHeaders: map[string]string{
+										"Cache-Control":   "no-store",
+										"X-Frame-Options": "DENY",
+									},
+									RemoveHeaders: []string{"Server"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 --set-header=bogus 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --remove-header=Server 5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "allow_from",
+			steps: []step{
+				{
+					command: cmd("serve --bg --allow-from=alice@example.com --allow-from=tag:prod 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:     "http://127.0.0.1:3000",
+									AllowFrom: []string{"alice@example.com", "tag:prod"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --allow-from=cap:example.com/cap/db 5432"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443: {HTTPS: true},
+							5432: {
+								TCPForward: "127.0.0.1:5432",
+								AllowFrom:  []string{"cap:example.com/cap/db"},
+							},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:     "http://127.0.0.1:3000",
+									AllowFrom: []string{"alice@example.com", "tag:prod"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 --allow-from=bogus 3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "load_balancer",
+			steps: []step{
+				{
+					command: cmd("serve --bg --lb-policy=least-conns --health-check-path=/healthz 3000,localhost:3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {LoadBalancer: &ipn.LoadBalancer{
+									Backends:    []string{"http://127.0.0.1:3000", "http://localhost:3001"},
+									Policy:      ipn.LBPolicyLeastConns,
+									HealthCheck: &ipn.HealthCheck{Path: "/healthz"},
+								}},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 5432,5433"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443: {HTTPS: true},
+							5432: {LoadBalancer: &ipn.LoadBalancer{
+								Backends: []string{"127.0.0.1:5432", "127.0.0.1:5433"},
+							}},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {LoadBalancer: &ipn.LoadBalancer{
+									Backends:    []string{"http://127.0.0.1:3000", "http://localhost:3001"},
+									Policy:      ipn.LBPolicyLeastConns,
+									HealthCheck: &ipn.HealthCheck{Path: "/healthz"},
+								}},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 --lb-policy=random 3000,3001"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --https=8443 --lb-policy=hash 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --tcp=6000 --health-check-path=/ 6000,6001"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "udp",
+			steps: []step{
+				{
+					command: cmd("serve --bg --udp=53 5353"),
+					want: &ipn.ServeConfig{
+						UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}},
+					},
+				},
+				{
+					command: cmd("serve --bg --tcp=53 localhost:53"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "localhost:53"}},
+						UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}},
+					},
+				},
+				{
+					command: cmd("serve --bg --udp=9000 --allow-from=tag:game udp://localhost:9001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "localhost:53"}},
+						UDP: map[uint16]*ipn.UDPPortHandler{
+							53:   {UDPForward: "127.0.0.1:5353"},
+							9000: {UDPForward: "localhost:9001", AllowFrom: []string{"tag:game"}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --udp=53 off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "localhost:53"}},
+						UDP: map[uint16]*ipn.UDPPortHandler{
+							9000: {UDPForward: "localhost:9001", AllowFrom: []string{"tag:game"}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --udp=7000 tcp://localhost:7000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --udp=7000 7000,7001"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --udp=7000 --set-path=/foo 7000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("funnel --bg --udp=7000 7000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "expires",
+			steps: []step{
+				{
+					command: cmd("funnel --bg --expires=1h 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://127.0.0.1:3000", Expires: &inOneHour},
+							}},
+						},
+						AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+					},
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --expires=30m 5432"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443:  {HTTPS: true},
+							5432: {TCPForward: "127.0.0.1:5432", Expires: &inThirtyMinutes},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://127.0.0.1:3000", Expires: &inOneHour},
+							}},
+						},
+						AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 --expires=-1h 3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "no_dir_listing",
+			steps: []step{
+				{
+					command: cmd("serve --bg --no-dir-listing " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Path: filepath.Join(td, "subdir"), NoDirListing: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 --no-dir-listing 3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
 		{
 			name: "path",
 			steps: []step{
@@ -825,6 +1097,7 @@ type group struct {
 					testFlagOut: &flagOut,
 					testStdout:  &stdout,
 					testStderr:  &stderr,
+					testNow:     func() time.Time { return testNow },
 				}
 				lastCount := lc.setCount
 				var cmd *ffcli.Command
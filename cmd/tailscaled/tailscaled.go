@@ -21,6 +21,7 @@
 	"net/http"
 	"net/http/pprof"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -59,12 +60,15 @@
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
+	"tailscale.com/util/bytesize"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
+	"tailscale.com/wgengine/netlog"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
 )
@@ -129,6 +133,14 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	netLogSink     *netlog.SinkConfig // or nil for no local network log sink
+	captureRing    *captureRingArgs   // or nil to not start the capture ring at boot
+}
+
+// captureRingArgs are the options of the -capture-ring flag.
+type captureRingArgs struct {
+	cfg        capture.RingConfig
+	healthDump time.Duration
 }
 
 var (
@@ -170,6 +182,14 @@ func main() {
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
 	flag.StringVar(&args.confFile, "config", "", "path to config file, or 'vm:user-data' to use the VM's user-data (EC2)")
+	flag.Func("netlog-local", `optional local sink for network flow logs, written whether or not the control plane enables network logging: "file:PATH[?max-size=10M&max-files=5]" (rotated JSON lines), "unix:PATH" (JSON lines to a listening socket), "ipfix:HOST[:PORT][?domain=N&template-refresh=10m&enterprise=PEN]" or "netflow9:HOST[:PORT][?...]" (flow records over UDP, with node and user identities)`, func(s string) (err error) {
+		args.netLogSink, err = netlog.ParseSinkConfig(s)
+		return err
+	})
+	flag.Func("capture-ring", `optional capture ring buffer to start at boot, keeping recent packets in memory for "tailscale debug capture-ring dump": "on" for the defaults, or options such as "max-bytes=64M&max-age=10m&health-dump=1m&filter=port+22"`, func(s string) (err error) {
+		args.captureRing, err = parseCaptureRing(s)
+		return err
+	})
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
 		beCLI()
@@ -567,6 +587,14 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 			}
 			return udpConn, nil
 		}
+		dialer.NetstackListenTCP = func(ipp netip.AddrPort) (net.Listener, error) {
+			// As above, don't return a typed nil.
+			ln, err := ns.ListenTCP(ipp)
+			if err != nil {
+				return nil, err
+			}
+			return ln, nil
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		var addrs []string
@@ -582,6 +610,9 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 				Logf:   logger.WithPrefix(logf, "socks5: "),
 				Dialer: dialer.UserDial,
 			}
+			if onlyNetstack {
+				ss.Listen = dialer.UserListen
+			}
 			go func() {
 				log.Fatalf("SOCKS5 server exited: %v", ss.Serve(socksListener))
 			}()
@@ -618,12 +649,57 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 		UseSocketOnly: args.socketpath != paths.DefaultTailscaledSocket(),
 	})
 	configureTaildrop(logf, lb)
+	if cr := args.captureRing; cr != nil {
+		if err := lb.StartCaptureRing(cr.cfg, cr.healthDump); err != nil {
+			return nil, fmt.Errorf("starting capture ring: %w", err)
+		}
+	}
 	if err := ns.Start(lb); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
 	}
 	return lb, nil
 }
 
+// parseCaptureRing parses the value of the -capture-ring flag: "on", or
+// URL query options max-bytes (as parsed by bytesize.Parse), max-age,
+// health-dump and filter, as with "tailscale debug capture-ring start".
+func parseCaptureRing(s string) (*captureRingArgs, error) {
+	cr := new(captureRingArgs)
+	if s == "on" {
+		return cr, nil
+	}
+	opts, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	for k := range opts {
+		v := opts.Get(k)
+		switch k {
+		case "max-bytes":
+			n, err := bytesize.Parse(v)
+			if err != nil || n > capture.MaxRingBytes {
+				return nil, fmt.Errorf("invalid max-bytes %q; want at most %d bytes", v, capture.MaxRingBytes)
+			}
+			cr.cfg.MaxBytes = int(n)
+		case "max-age":
+			if cr.cfg.MaxAge, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid max-age: %w", err)
+			}
+		case "health-dump":
+			if cr.healthDump, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid health-dump: %w", err)
+			}
+		case "filter":
+			if cr.cfg.Filter, err = capture.ParseFilter(v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown capture ring option %q", k)
+		}
+	}
+	return cr, nil
+}
+
 // createEngine tries to the wgengine.Engine based on the order of tunnels
 // specified in the command line flags.
 //
@@ -677,6 +753,7 @@ func tryEngine(logf logger.Logf, sys *tsd.System, name string) (onlyNetstack boo
 		SetSubsystem:  sys.Set,
 		ControlKnobs:  sys.ControlKnobs(),
 		DriveForLocal: driveimpl.NewFileSystemForLocal(logf),
+		NetLogSink:    args.netLogSink,
 	}
 
 	onlyNetstack = name == "userspace-networking"
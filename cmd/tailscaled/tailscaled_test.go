@@ -5,6 +5,7 @@
 
 import (
 	"testing"
+	"time"
 
 	"tailscale.com/tstest/deptest"
 )
@@ -34,3 +35,36 @@ func TestDeps(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestParseCaptureRing(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantBytes  int
+		wantAge    time.Duration
+		wantHealth time.Duration
+		wantErr    bool
+	}{
+		{in: "on"},
+		{in: "max-bytes=64M&max-age=10m", wantBytes: 64 << 20, wantAge: 10 * time.Minute},
+		{in: "max-bytes=4096&health-dump=1m", wantBytes: 4096, wantHealth: time.Minute},
+		{in: "filter=port+22"},
+		{in: "max-bytes=2G", wantErr: true},
+		{in: "max-bytes=-1", wantErr: true},
+		{in: "max-bytes=9223372036854775807G", wantErr: true},
+		{in: "max-age=soon", wantErr: true},
+		{in: "bogus=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		cr, err := parseCaptureRing(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCaptureRing(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cr.cfg.MaxBytes != tt.wantBytes || cr.cfg.MaxAge != tt.wantAge || cr.healthDump != tt.wantHealth {
+			t.Errorf("parseCaptureRing(%q) = %+v, %v; want MaxBytes %d, MaxAge %v, health dump %v", tt.in, cr.cfg, cr.healthDump, tt.wantBytes, tt.wantAge, tt.wantHealth)
+		}
+	}
+}
@@ -10,21 +10,28 @@
 	"context"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +39,7 @@
 
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/atomicfile"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
@@ -51,6 +59,8 @@
 	flagPort               = flag.Int("port", 443, "port to listen on")
 	flagLocalPort          = flag.Int("local-port", -1, "allow requests from localhost")
 	flagUseLocalTailscaled = flag.Bool("use-local-tailscaled", false, "use local tailscaled instead of tsnet")
+	flagDir                = flag.String("dir", "", "tsnet state directory, also holding the signing keys, clients and refresh tokens; a default one will be created if not provided")
+	flagKeyRotation        = flag.Duration("key-rotation", 30*24*time.Hour, "how often to rotate the token signing key; 0 disables rotation")
 )
 
 func main() {
@@ -67,7 +77,11 @@ func main() {
 
 		lns []net.Listener
 	)
+	dir := *flagDir
 	if *flagUseLocalTailscaled {
+		if dir == "" {
+			dir = "."
+		}
 		lc = &tailscale.LocalClient{}
 		st, err = lc.StatusWithoutPeers(ctx)
 		if err != nil {
@@ -91,8 +105,18 @@ func main() {
 			log.Fatalf("failed to listen on any of %v", st.TailscaleIPs)
 		}
 	} else {
+		if dir == "" {
+			// The same directory tsnet would pick, so that our state lives
+			// next to its own.
+			confDir, err := os.UserConfigDir()
+			if err != nil {
+				log.Fatalf("finding state directory: %v; use --dir", err)
+			}
+			dir = filepath.Join(confDir, "tsnet-tsidp")
+		}
 		ts := &tsnet.Server{
 			Hostname: "idp",
+			Dir:      dir,
 		}
 		if *flagVerbose {
 			ts.Logf = log.Printf
@@ -113,7 +137,12 @@ func main() {
 	}
 
 	srv := &idpServer{
-		lc: lc,
+		lc:          lc,
+		stateDir:    dir,
+		keyRotation: *flagKeyRotation,
+	}
+	if err := srv.loadState(); err != nil {
+		log.Fatalf("loading state from %s: %v", dir, err)
 	}
 	if *flagPort != 443 {
 		srv.serverURL = fmt.Sprintf("https://%s:%d", strings.TrimSuffix(st.Self.DNSName, "."), *flagPort)
@@ -142,16 +171,36 @@ func main() {
 type idpServer struct {
 	lc          *tailscale.LocalClient
 	loopbackURL string
-	serverURL   string // "https://foo.bar.ts.net"
+	serverURL   string        // "https://foo.bar.ts.net"
+	stateDir    string        // where the files persisting our state live
+	keyRotation time.Duration // how often to rotate the signing key; 0 means never
+
+	lazyMux lazy.SyncValue[*http.ServeMux]
+
+	mu           sync.Mutex              // guards the fields below
+	code         map[string]*authRequest // keyed by random hex
+	accessToken  map[string]*authRequest // keyed by random hex
+	refreshToken map[string]*authRequest // keyed by random hex; persisted in refreshTokensFile
+	clients      map[string]*oidcClient  // keyed by client ID; persisted in clientsFile
+	signingKeys  []*signingKey           // oldest first, the last one signs; persisted in keysFile
+}
 
-	lazyMux        lazy.SyncValue[*http.ServeMux]
-	lazySigningKey lazy.SyncValue[*signingKey]
-	lazySigner     lazy.SyncValue[jose.Signer]
+const (
+	// codeTTL is how long an authorization code may be exchanged for tokens.
+	codeTTL = 5 * time.Minute
 
-	mu          sync.Mutex              // guards the fields below
-	code        map[string]*authRequest // keyed by random hex
-	accessToken map[string]*authRequest // keyed by random hex
-}
+	// tokenTTL is how long ID and access tokens are valid.
+	tokenTTL = 5 * time.Minute
+
+	// refreshTokenTTL is how long a refresh token may be used. Each use
+	// returns a new refresh token and invalidates the old one.
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	// maxSigningKeys is the number of signing keys kept in the JWKS. Keeping
+	// the previous key lets relying parties verify tokens it signed while
+	// they refresh their cached copy of the JWKS after a rotation.
+	maxSigningKeys = 2
+)
 
 type authRequest struct {
 	// localRP is true if the request is from a relying party running on the
@@ -172,12 +221,17 @@ type authRequest struct {
 	// redirectURI is the redirect_uri presented in the request.
 	redirectURI string
 
+	// codeChallenge and codeChallengeMethod are the PKCE (RFC 7636)
+	// parameters presented in the request, if any. codeChallengeMethod is
+	// "plain" or "S256".
+	codeChallenge       string
+	codeChallengeMethod string
+
 	// remoteUser is the user who is being authenticated.
 	remoteUser *apitype.WhoIsResponse
 
-	// validTill is the time until which the token is valid.
-	// As of 2023-11-14, it is 5 minutes.
-	// TODO: add routine to delete expired tokens.
+	// validTill is the time until which the code or token is valid.
+	// TODO: add routine to delete expired codes and tokens.
 	validTill time.Time
 }
 
@@ -214,10 +268,40 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 
 	code := rands.HexString(32)
 	ar := &authRequest{
-		nonce:       uq.Get("nonce"),
-		remoteUser:  who,
-		redirectURI: uq.Get("redirect_uri"),
-		clientID:    uq.Get("client_id"),
+		nonce:               uq.Get("nonce"),
+		remoteUser:          who,
+		redirectURI:         uq.Get("redirect_uri"),
+		clientID:            uq.Get("client_id"),
+		codeChallenge:       uq.Get("code_challenge"),
+		codeChallengeMethod: uq.Get("code_challenge_method"),
+		validTill:           time.Now().Add(codeTTL),
+	}
+
+	// Errors about the client or redirect_uri must not redirect, lest we
+	// send the user somewhere the client didn't register.
+	s.mu.Lock()
+	client, registered := s.clients[ar.clientID]
+	haveClients := len(s.clients) > 0
+	s.mu.Unlock()
+	if !registered && haveClients {
+		http.Error(w, "tsidp: unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if registered && !slices.Contains(client.RedirectURIs, ar.redirectURI) {
+		http.Error(w, "tsidp: redirect_uri not registered for client", http.StatusBadRequest)
+		return
+	}
+	if ar.codeChallenge != "" {
+		if ar.codeChallengeMethod == "" {
+			ar.codeChallengeMethod = "plain"
+		}
+		if ar.codeChallengeMethod != "plain" && ar.codeChallengeMethod != "S256" {
+			http.Error(w, "tsidp: unsupported code_challenge_method", http.StatusBadRequest)
+			return
+		}
+	} else if registered && client.Secret == "" {
+		http.Error(w, "tsidp: code_challenge is required for public clients", http.StatusBadRequest)
+		return
 	}
 
 	if r.URL.Path == "/authorize/localhost" {
@@ -251,6 +335,8 @@ func (s *idpServer) newMux() *http.ServeMux {
 	mux.HandleFunc("/authorize/", s.authorize)
 	mux.HandleFunc("/userinfo", s.serveUserInfo)
 	mux.HandleFunc("/token", s.serveToken)
+	mux.HandleFunc("/clients", s.serveClients)
+	mux.HandleFunc("/clients/", s.serveClient)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			io.WriteString(w, "<html><body><h1>Tailscale OIDC IdP</h1>")
@@ -295,6 +381,7 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 		s.mu.Lock()
 		delete(s.accessToken, tk)
 		s.mu.Unlock()
+		return
 	}
 
 	ui := userInfo{}
@@ -310,8 +397,20 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 	// TODO(maisem): not sure if this is the right thing to do
 	ui.UserName, _, _ = strings.Cut(ar.remoteUser.UserProfile.LoginName, "@")
 
+	extra, err := extraClaims(ar.remoteUser, ar.clientID, true)
+	if err != nil {
+		log.Printf("Error getting extra claims: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	claims, err := withExtraClaims(ui, extra)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(ui); err != nil {
+	if err := json.NewEncoder(w).Encode(claims); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -329,23 +428,19 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.FormValue("grant_type") != "authorization_code" {
+	var ar *authRequest
+	var err error
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		ar, err = s.authRequestForCode(r)
+	case "refresh_token":
+		ar, err = s.authRequestForRefreshToken(r)
+	default:
 		http.Error(w, "tsidp: grant_type not supported", http.StatusBadRequest)
 		return
 	}
-	code := r.FormValue("code")
-	if code == "" {
-		http.Error(w, "tsidp: code is required", http.StatusBadRequest)
-		return
-	}
-	s.mu.Lock()
-	ar, ok := s.code[code]
-	if ok {
-		delete(s.code, code)
-	}
-	s.mu.Unlock()
-	if !ok {
-		http.Error(w, "tsidp: code not found", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if err := ar.allowRelyingParty(r.Context(), r.RemoteAddr, s.lc); err != nil {
@@ -353,10 +448,6 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	if ar.redirectURI != r.FormValue("redirect_uri") {
-		http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
-		return
-	}
 	signer, err := s.oidcSigner()
 	if err != nil {
 		log.Printf("Error getting signer: %v", err)
@@ -379,7 +470,7 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	tsClaims := tailscaleClaims{
 		Claims: jwt.Claims{
 			Audience:  jwt.Audience{ar.clientID},
-			Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			Expiry:    jwt.NewNumericDate(now.Add(tokenTTL)),
 			ID:        jti,
 			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    s.serverURL,
@@ -400,8 +491,20 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		tsClaims.Issuer = s.loopbackURL
 	}
 
+	extra, err := extraClaims(who, ar.clientID, false)
+	if err != nil {
+		log.Printf("Error getting extra claims: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	claims, err := withExtraClaims(tsClaims, extra)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Create an OIDC token using this issuer's signer.
-	token, err := jwt.Signed(signer).Claims(tsClaims).CompactSerialize()
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
 	if err != nil {
 		log.Printf("Error getting token: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -409,22 +512,160 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	at := rands.HexString(32)
+	rt := rands.HexString(32)
 	s.mu.Lock()
-	ar.validTill = now.Add(5 * time.Minute)
+	ar.validTill = now.Add(tokenTTL)
 	mak.Set(&s.accessToken, at, ar)
+	rar := *ar
+	rar.nonce = "" // only for the ID token of the original authentication
+	rar.validTill = now.Add(refreshTokenTTL)
+	mak.Set(&s.refreshToken, rt, &rar)
+	err = s.saveRefreshTokensLocked()
 	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving refresh tokens: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
-		AccessToken: at,
-		TokenType:   "Bearer",
-		ExpiresIn:   5 * 60,
-		IDToken:     token,
+		AccessToken:  at,
+		TokenType:    "Bearer",
+		RefreshToken: rt,
+		ExpiresIn:    int(tokenTTL.Seconds()),
+		IDToken:      token,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// authRequestForCode returns the authRequest for the authorization code
+// presented in the authorization_code grant request r, checking the client's
+// credentials and PKCE code verifier. The code can only be used once.
+func (s *idpServer) authRequestForCode(r *http.Request) (*authRequest, error) {
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, errors.New("tsidp: code is required")
+	}
+	s.mu.Lock()
+	ar, ok := s.code[code]
+	if ok {
+		delete(s.code, code)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.New("tsidp: code not found")
+	}
+	if ar.validTill.Before(time.Now()) {
+		return nil, errors.New("tsidp: code expired")
+	}
+	if ar.redirectURI != r.FormValue("redirect_uri") {
+		return nil, errors.New("tsidp: redirect_uri mismatch")
+	}
+	if err := s.authenticateClient(r, ar.clientID); err != nil {
+		return nil, err
+	}
+	if ar.codeChallenge != "" {
+		if err := verifyPKCE(ar.codeChallenge, ar.codeChallengeMethod, r.FormValue("code_verifier")); err != nil {
+			return nil, err
+		}
+	}
+	return ar, nil
+}
+
+// authRequestForRefreshToken returns a new authRequest for the refresh token
+// presented in the refresh_token grant request r, checking the client's
+// credentials and that the authenticated user's node still exists. The
+// refresh token can only be used once.
+func (s *idpServer) authRequestForRefreshToken(r *http.Request) (*authRequest, error) {
+	rt := r.FormValue("refresh_token")
+	if rt == "" {
+		return nil, errors.New("tsidp: refresh_token is required")
+	}
+	s.mu.Lock()
+	ar, ok := s.refreshToken[rt]
+	if ok {
+		delete(s.refreshToken, rt)
+		if err := s.saveRefreshTokensLocked(); err != nil {
+			log.Printf("Error saving refresh tokens: %v", err)
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.New("tsidp: refresh_token not found")
+	}
+	if ar.validTill.Before(time.Now()) {
+		return nil, errors.New("tsidp: refresh_token expired")
+	}
+	if err := s.authenticateClient(r, ar.clientID); err != nil {
+		return nil, err
+	}
+
+	// Get the latest identity of the user's node, which must still be in
+	// the tailnet.
+	old := ar.remoteUser
+	if old.Node == nil || len(old.Node.Addresses) == 0 {
+		return nil, errors.New("tsidp: refresh_token has no node")
+	}
+	who, err := s.lc.WhoIs(r.Context(), old.Node.Addresses[0].Addr().String())
+	if err != nil || who.Node.ID != old.Node.ID {
+		return nil, errors.New("tsidp: node of refresh_token no longer exists")
+	}
+	nar := *ar
+	nar.remoteUser = who
+	return &nar, nil
+}
+
+// authenticateClient checks the credentials that the token request r presents
+// for clientID, as the "client_id" and "client_secret" form values or via
+// HTTP Basic authentication. Registered confidential clients must present
+// their secret. Public clients and, if no clients are registered, any client
+// need only present a matching client ID, if any.
+func (s *idpServer) authenticateClient(r *http.Request, clientID string) error {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if id != "" && id != clientID {
+		return errors.New("tsidp: client_id mismatch")
+	}
+	s.mu.Lock()
+	client, registered := s.clients[clientID]
+	s.mu.Unlock()
+	if !registered || client.Secret == "" {
+		return nil
+	}
+	if id == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return errors.New("tsidp: invalid client credentials")
+	}
+	return nil
+}
+
+// verifyPKCE reports whether verifier is the PKCE (RFC 7636) code verifier
+// for challenge, which was derived from it using method.
+func verifyPKCE(challenge, method, verifier string) error {
+	if len(verifier) < 43 || len(verifier) > 128 || strings.ContainsFunc(verifier, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r))
+	}) {
+		return errors.New("tsidp: invalid code_verifier")
+	}
+	want := verifier
+	switch method {
+	case "plain":
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		want = base64.RawURLEncoding.EncodeToString(sum[:])
+	default:
+		return fmt.Errorf("tsidp: unsupported code_challenge_method %q", method)
+	}
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(want)) != 1 {
+		return errors.New("tsidp: code_verifier mismatch")
+	}
+	return nil
+}
+
 type oidcTokenResponse struct {
 	IDToken      string `json:"id_token"`
 	TokenType    string `json:"token_type"`
@@ -438,45 +679,57 @@ type oidcTokenResponse struct {
 	oidcConfigPath = "/.well-known/openid-configuration"
 )
 
+// oidcSigner returns a signer using the current signing key, rotating the
+// signing keys first if it's due.
 func (s *idpServer) oidcSigner() (jose.Signer, error) {
-	return s.lazySigner.GetErr(func() (jose.Signer, error) {
-		sk, err := s.oidcPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		return jose.NewSigner(jose.SigningKey{
-			Algorithm: jose.RS256,
-			Key:       sk.k,
-		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
-			jose.HeaderType: "JWT",
-			"kid":           fmt.Sprint(sk.kid),
-		}})
-	})
+	keys, err := s.oidcSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	sk := keys[len(keys)-1]
+	return jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       sk.k,
+	}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
+		jose.HeaderType: "JWT",
+		"kid":           fmt.Sprint(sk.kid),
+	}})
 }
 
-func (s *idpServer) oidcPrivateKey() (*signingKey, error) {
-	return s.lazySigningKey.GetErr(func() (*signingKey, error) {
-		var sk signingKey
-		b, err := os.ReadFile("oidc-key.json")
-		if err == nil {
-			if err := sk.UnmarshalJSON(b); err == nil {
-				return &sk, nil
-			} else {
-				log.Printf("Error unmarshaling key: %v", err)
-			}
+// oidcSigningKeys returns the signing keys to publish in the JWKS, oldest
+// first, rotating them first if it's due. The last key is the one to sign
+// new tokens with.
+func (s *idpServer) oidcSigningKeys() ([]*signingKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rotateKeysLocked(time.Now()) {
+		if err := s.writeStateLocked(keysFile, s.signingKeys); err != nil {
+			return nil, fmt.Errorf("saving signing keys: %w", err)
 		}
+	}
+	return slices.Clone(s.signingKeys), nil
+}
+
+// rotateKeysLocked adds a new signing key if there is none or the current
+// one is older than s.keyRotation, and drops the oldest keys beyond
+// maxSigningKeys. It reports whether s.signingKeys changed.
+//
+// s.mu must be held.
+func (s *idpServer) rotateKeysLocked(now time.Time) (changed bool) {
+	n := len(s.signingKeys)
+	if n == 0 || s.keyRotation > 0 && now.Sub(s.signingKeys[n-1].created) >= s.keyRotation {
 		id, k := mustGenRSAKey(2048)
-		sk.k = k
-		sk.kid = id
-		b, err = sk.MarshalJSON()
-		if err != nil {
-			log.Fatalf("Error marshaling key: %v", err)
+		s.signingKeys = append(s.signingKeys, &signingKey{k: k, kid: id, created: now})
+		if n > 0 {
+			log.Printf("Rotated signing key %d to %d", s.signingKeys[n-1].kid, id)
 		}
-		if err := os.WriteFile("oidc-key.json", b, 0600); err != nil {
-			log.Fatalf("Error writing key: %v", err)
-		}
-		return &sk, nil
-	})
+		changed = true
+	}
+	if n := len(s.signingKeys); n > maxSigningKeys {
+		s.signingKeys = slices.Delete(s.signingKeys, 0, n-maxSigningKeys)
+		changed = true
+	}
+	return changed
 }
 
 func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
@@ -485,25 +738,24 @@ func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	sk, err := s.oidcPrivateKey()
+	keys, err := s.oidcSigningKeys()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// TODO(maisem): maybe only marshal this once and reuse?
-	// TODO(maisem): implement key rotation.
+	var jwks jose.JSONWebKeySet
+	for _, sk := range keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       sk.k.Public(),
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+			KeyID:     fmt.Sprint(sk.kid),
+		})
+	}
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
-	if err := je.Encode(jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Key:       sk.k.Public(),
-				Algorithm: string(jose.RS256),
-				Use:       "sig",
-				KeyID:     fmt.Sprint(sk.kid),
-			},
-		},
-	}); err != nil {
+	if err := je.Encode(jwks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	return
@@ -512,16 +764,19 @@ func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 // openIDProviderMetadata is a partial representation of
 // https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata.
 type openIDProviderMetadata struct {
-	Issuer                           string              `json:"issuer"`
-	AuthorizationEndpoint            string              `json:"authorization_endpoint,omitempty"`
-	TokenEndpoint                    string              `json:"token_endpoint,omitempty"`
-	UserInfoEndpoint                 string              `json:"userinfo_endpoint,omitempty"`
-	JWKS_URI                         string              `json:"jwks_uri"`
-	ScopesSupported                  views.Slice[string] `json:"scopes_supported"`
-	ResponseTypesSupported           views.Slice[string] `json:"response_types_supported"`
-	SubjectTypesSupported            views.Slice[string] `json:"subject_types_supported"`
-	ClaimsSupported                  views.Slice[string] `json:"claims_supported"`
-	IDTokenSigningAlgValuesSupported views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	Issuer                            string              `json:"issuer"`
+	AuthorizationEndpoint             string              `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string              `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                  string              `json:"userinfo_endpoint,omitempty"`
+	JWKS_URI                          string              `json:"jwks_uri"`
+	ScopesSupported                   views.Slice[string] `json:"scopes_supported"`
+	ResponseTypesSupported            views.Slice[string] `json:"response_types_supported"`
+	SubjectTypesSupported             views.Slice[string] `json:"subject_types_supported"`
+	ClaimsSupported                   views.Slice[string] `json:"claims_supported"`
+	IDTokenSigningAlgValuesSupported  views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported               views.Slice[string] `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported views.Slice[string] `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     views.Slice[string] `json:"code_challenge_methods_supported"`
 	// TODO(maisem): maybe add other fields?
 	// Currently we fill out the REQUIRED fields, scopes_supported and claims_supported.
 }
@@ -567,6 +822,15 @@ type tailscaleClaims struct {
 	// The algo used for signing. The OpenID spec says "The algorithm RS256 MUST be included."
 	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
 	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256)})
+
+	openIDSupportedGrantTypes = views.SliceOf([]string{"authorization_code", "refresh_token"})
+
+	// How clients authenticate to the token endpoint. Public clients, which
+	// have no secret, use "none" and PKCE.
+	openIDSupportedTokenAuthMethods = views.SliceOf([]string{"client_secret_basic", "client_secret_post", "none"})
+
+	// The PKCE (RFC 7636) code challenge methods.
+	openIDSupportedCodeChallengeMethods = views.SliceOf([]string{"plain", "S256"})
 )
 
 func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
@@ -596,21 +860,436 @@ func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
 	if err := je.Encode(openIDProviderMetadata{
-		AuthorizationEndpoint:            authorizeEndpoint,
-		Issuer:                           rpEndpoint,
-		JWKS_URI:                         rpEndpoint + oidcJWKSPath,
-		UserInfoEndpoint:                 rpEndpoint + "/userinfo",
-		TokenEndpoint:                    rpEndpoint + "/token",
-		ScopesSupported:                  openIDSupportedScopes,
-		ResponseTypesSupported:           openIDSupportedReponseTypes,
-		SubjectTypesSupported:            openIDSupportedSubjectTypes,
-		ClaimsSupported:                  openIDSupportedClaims,
-		IDTokenSigningAlgValuesSupported: openIDSupportedSigningAlgos,
+		AuthorizationEndpoint:             authorizeEndpoint,
+		Issuer:                            rpEndpoint,
+		JWKS_URI:                          rpEndpoint + oidcJWKSPath,
+		UserInfoEndpoint:                  rpEndpoint + "/userinfo",
+		TokenEndpoint:                     rpEndpoint + "/token",
+		ScopesSupported:                   openIDSupportedScopes,
+		ResponseTypesSupported:            openIDSupportedReponseTypes,
+		SubjectTypesSupported:             openIDSupportedSubjectTypes,
+		ClaimsSupported:                   openIDSupportedClaims,
+		IDTokenSigningAlgValuesSupported:  openIDSupportedSigningAlgos,
+		GrantTypesSupported:               openIDSupportedGrantTypes,
+		TokenEndpointAuthMethodsSupported: openIDSupportedTokenAuthMethods,
+		CodeChallengeMethodsSupported:     openIDSupportedCodeChallengeMethods,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// peerCapabilityTSIDP is the peer capability that grants tailnet peers
+// access to tsidp features. Its values are capRules.
+const peerCapabilityTSIDP = tailcfg.PeerCapability("tailscale.com/cap/tsidp")
+
+// capRule is a value of the peerCapabilityTSIDP capability.
+//
+// For example, this grant adds a "groups" claim to the tokens of the members
+// of group:admins, for all clients:
+//
+//	{
+//		"src": ["group:admins"],
+//		"dst": ["tag:idp"],
+//		"app": {
+//			"tailscale.com/cap/tsidp": [{
+//				"extraClaims": {"groups": ["admins"]},
+//				"includeInUserInfo": true
+//			}]
+//		}
+//	}
+type capRule struct {
+	// AllowAdmin permits managing the registered OIDC clients via the
+	// /clients endpoints.
+	AllowAdmin bool `json:"allowAdmin,omitempty"`
+
+	// ExtraClaims are added to the ID tokens of the users that the grant
+	// applies to; tagged nodes can't get tokens. They can't replace the
+	// standard and Tailscale claims. If several grants set the same claim,
+	// array values are merged and otherwise the first grant wins.
+	ExtraClaims map[string]any `json:"extraClaims,omitempty"`
+
+	// IncludeInUserInfo is whether ExtraClaims are also returned by the
+	// /userinfo endpoint.
+	IncludeInUserInfo bool `json:"includeInUserInfo,omitempty"`
+
+	// Audiences, if non-empty, limits ExtraClaims to the tokens for the
+	// clients with these IDs, so that users can have different roles in
+	// different apps.
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// extraClaims returns the claims that the peerCapabilityTSIDP grants of who
+// add to the tokens for clientID, or, if forUserInfo, to its /userinfo
+// responses.
+func extraClaims(who *apitype.WhoIsResponse, clientID string, forUserInfo bool) (map[string]any, error) {
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, peerCapabilityTSIDP)
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: invalid %s capability: %w", peerCapabilityTSIDP, err)
+	}
+	var claims map[string]any
+	for _, rule := range rules {
+		if forUserInfo && !rule.IncludeInUserInfo {
+			continue
+		}
+		if len(rule.Audiences) > 0 && !slices.Contains(rule.Audiences, clientID) {
+			continue
+		}
+		for k, v := range rule.ExtraClaims {
+			if isReservedClaim(k) {
+				log.Printf("Ignoring extra claim %q: reserved", k)
+				continue
+			}
+			old, ok := claims[k]
+			if !ok {
+				mak.Set(&claims, k, v)
+				continue
+			}
+			oldVals, ok1 := old.([]any)
+			newVals, ok2 := v.([]any)
+			if !ok1 || !ok2 {
+				continue // the first grant wins
+			}
+			for _, nv := range newVals {
+				if !slices.ContainsFunc(oldVals, func(ov any) bool { return reflect.DeepEqual(ov, nv) }) {
+					oldVals = append(oldVals, nv)
+				}
+			}
+			claims[k] = oldVals
+		}
+	}
+	return claims, nil
+}
+
+// isReservedClaim reports whether the claim k is one that tsidp sets itself
+// and so can't be an extra claim.
+func isReservedClaim(k string) bool {
+	switch k {
+	case "nonce", "name", "picture":
+		return true
+	}
+	return views.SliceContains(openIDSupportedClaims, k)
+}
+
+// withExtraClaims returns the JSON object of claims, such as a
+// tailscaleClaims or userInfo, with the extra claims added to it. Extra
+// claims don't replace the ones already in claims.
+func withExtraClaims(claims any, extra map[string]any) (map[string]any, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+// oidcClient is a relying party registered with tsidp.
+//
+// Once any client is registered, only registered clients may use tsidp.
+type oidcClient struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"` // empty for public clients, which must use PKCE
+	Name         string   `json:"client_name,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// clientRegistration is the request body to register a new client, a subset
+// of the client metadata of RFC 7591.
+type clientRegistration struct {
+	Name         string   `json:"client_name"`
+	RedirectURIs []string `json:"redirect_uris"`
+
+	// TokenEndpointAuthMethod is "none" to register a public client.
+	// Otherwise the client gets a secret.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"`
+}
+
+// allowAdmin reports an error unless the requester of r was granted the right
+// to manage tsidp by a peerCapabilityTSIDP capability.
+func (s *idpServer) allowAdmin(r *http.Request) error {
+	who, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("tsidp: error getting WhoIs: %w", err)
+	}
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, peerCapabilityTSIDP)
+	if err != nil {
+		return fmt.Errorf("tsidp: invalid %s capability: %w", peerCapabilityTSIDP, err)
+	}
+	for _, rule := range rules {
+		if rule.AllowAdmin {
+			return nil
+		}
+	}
+	return fmt.Errorf("tsidp: managing clients requires the %s capability with allowAdmin", peerCapabilityTSIDP)
+}
+
+// serveClients lists the registered clients, without their secrets, or
+// registers a new one, returning it with its secret.
+func (s *idpServer) serveClients(w http.ResponseWriter, r *http.Request) {
+	if err := s.allowAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		s.mu.Lock()
+		var clients []*oidcClient
+		for _, c := range s.clients {
+			c := *c
+			c.Secret = ""
+			clients = append(clients, &c)
+		}
+		s.mu.Unlock()
+		slices.SortFunc(clients, func(a, b *oidcClient) int { return strings.Compare(a.ID, b.ID) })
+		writeJSON(w, clients)
+	case "POST":
+		var reg clientRegistration
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&reg); err != nil {
+			http.Error(w, "tsidp: invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := newOIDCClient(reg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		mak.Set(&s.clients, c.ID, c)
+		err = s.writeStateLocked(clientsFile, s.clients)
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("Error saving clients: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Registered client %s (%q)", c.ID, c.Name)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, c)
+	default:
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveClient returns the client at /clients/<client_id>, without its
+// secret, or deletes it along with its refresh tokens.
+func (s *idpServer) serveClient(w http.ResponseWriter, r *http.Request) {
+	if err := s.allowAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+	s.mu.Lock()
+	c, ok := s.clients[id]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "tsidp: client not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		c := *c
+		c.Secret = ""
+		writeJSON(w, &c)
+	case "DELETE":
+		s.mu.Lock()
+		delete(s.clients, id)
+		err := s.writeStateLocked(clientsFile, s.clients)
+		for rt, ar := range s.refreshToken {
+			if ar.clientID == id {
+				delete(s.refreshToken, rt)
+			}
+		}
+		err = errors.Join(err, s.saveRefreshTokensLocked())
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("Error saving clients: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted client %s (%q)", c.ID, c.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// newOIDCClient returns a new client with a random ID and, unless it's
+// public, secret for reg.
+func newOIDCClient(reg clientRegistration) (*oidcClient, error) {
+	if len(reg.RedirectURIs) == 0 {
+		return nil, errors.New("tsidp: redirect_uris is required")
+	}
+	for _, ru := range reg.RedirectURIs {
+		u, err := url.Parse(ru)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, fmt.Errorf("tsidp: invalid redirect URI %q", ru)
+		}
+	}
+	c := &oidcClient{
+		ID:           rands.HexString(32),
+		Name:         reg.Name,
+		RedirectURIs: reg.RedirectURIs,
+	}
+	switch reg.TokenEndpointAuthMethod {
+	case "none":
+	case "", "client_secret_basic", "client_secret_post":
+		c.Secret = rands.HexString(64)
+	default:
+		return nil, fmt.Errorf("tsidp: unsupported token_endpoint_auth_method %q", reg.TokenEndpointAuthMethod)
+	}
+	return c, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	je := json.NewEncoder(w)
+	je.SetIndent("", "  ")
+	if err := je.Encode(v); err != nil {
+		log.Printf("Error writing JSON: %v", err)
+	}
+}
+
+// The files in idpServer.stateDir persisting its state.
+const (
+	keysFile          = "oidc-keys.json"           // []*signingKey
+	clientsFile       = "oidc-clients.json"        // map[string]*oidcClient
+	refreshTokensFile = "oidc-refresh-tokens.json" // map[string]*storedRefreshToken
+
+	// legacyKeyFile is the single signing key used before key rotation was
+	// supported, which used to be stored in the working directory.
+	legacyKeyFile = "oidc-key.json"
+)
+
+// storedRefreshToken is the authRequest of a refresh token, as stored in
+// refreshTokensFile.
+type storedRefreshToken struct {
+	LocalRP     bool           `json:",omitempty"`
+	RPNodeID    tailcfg.NodeID `json:",omitempty"`
+	ClientID    string
+	RedirectURI string
+	RemoteUser  *apitype.WhoIsResponse
+	ValidTill   time.Time
+}
+
+// loadState loads the signing keys, clients and refresh tokens from
+// s.stateDir, and creates or rotates the signing key as needed.
+func (s *idpServer) loadState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.readState(clientsFile, &s.clients); err != nil {
+		return err
+	}
+
+	var rts map[string]*storedRefreshToken
+	if _, err := s.readState(refreshTokensFile, &rts); err != nil {
+		return err
+	}
+	for rt, st := range rts {
+		mak.Set(&s.refreshToken, rt, &authRequest{
+			localRP:     st.LocalRP,
+			rpNodeID:    st.RPNodeID,
+			clientID:    st.ClientID,
+			redirectURI: st.RedirectURI,
+			remoteUser:  st.RemoteUser,
+			validTill:   st.ValidTill,
+		})
+	}
+
+	var keys []*signingKey
+	ok, err := s.readState(keysFile, &keys)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Import the signing key from before rotation, so that tokens it
+		// signed stay valid. Look for it where it used to be too.
+		for _, name := range []string{filepath.Join(s.stateDir, legacyKeyFile), legacyKeyFile} {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				continue
+			}
+			var sk signingKey
+			if err := sk.UnmarshalJSON(b); err != nil {
+				log.Printf("Error unmarshaling key: %v", err)
+				continue
+			}
+			sk.created = time.Now()
+			keys = append(keys, &sk)
+			log.Printf("Imported signing key %d from %s", sk.kid, name)
+			break
+		}
+	}
+	for _, sk := range keys {
+		if sk != nil && sk.k != nil {
+			s.signingKeys = append(s.signingKeys, sk)
+		}
+	}
+	if s.rotateKeysLocked(time.Now()) || !ok {
+		return s.writeStateLocked(keysFile, s.signingKeys)
+	}
+	return nil
+}
+
+// saveRefreshTokensLocked writes the unexpired refresh tokens to
+// refreshTokensFile.
+//
+// s.mu must be held.
+func (s *idpServer) saveRefreshTokensLocked() error {
+	now := time.Now()
+	rts := map[string]*storedRefreshToken{}
+	for rt, ar := range s.refreshToken {
+		if ar.validTill.Before(now) {
+			delete(s.refreshToken, rt)
+			continue
+		}
+		rts[rt] = &storedRefreshToken{
+			LocalRP:     ar.localRP,
+			RPNodeID:    ar.rpNodeID,
+			ClientID:    ar.clientID,
+			RedirectURI: ar.redirectURI,
+			RemoteUser:  ar.remoteUser,
+			ValidTill:   ar.validTill,
+		}
+	}
+	return s.writeStateLocked(refreshTokensFile, rts)
+}
+
+// readState unmarshals the JSON file name in s.stateDir into v. It reports
+// false if the file doesn't exist.
+func (s *idpServer) readState(name string, v any) (ok bool, err error) {
+	b, err := os.ReadFile(filepath.Join(s.stateDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return true, nil
+}
+
+// writeStateLocked atomically writes v as JSON to the file name in
+// s.stateDir. The files hold secrets, so only we may read them.
+//
+// s.mu must be held.
+func (s *idpServer) writeStateLocked(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.stateDir, name), b, 0600)
+}
+
 const (
 	minimumRSAKeySize = 2048
 )
@@ -642,13 +1321,15 @@ func readUint64(r io.Reader) (uint64, error) {
 // rsaPrivateKeyJSONWrapper is the the JSON serialization
 // format used by RSAPrivateKey.
 type rsaPrivateKeyJSONWrapper struct {
-	Key string
-	ID  uint64
+	Key     string
+	ID      uint64
+	Created time.Time
 }
 
 type signingKey struct {
-	k   *rsa.PrivateKey
-	kid uint64
+	k       *rsa.PrivateKey
+	kid     uint64
+	created time.Time // zero in keys from before rotation was supported
 }
 
 func (sk *signingKey) MarshalJSON() ([]byte, error) {
@@ -658,8 +1339,9 @@ func (sk *signingKey) MarshalJSON() ([]byte, error) {
 	}
 	bts := pem.EncodeToMemory(&b)
 	return json.Marshal(rsaPrivateKeyJSONWrapper{
-		Key: base64.URLEncoding.EncodeToString(bts),
-		ID:  sk.kid,
+		Key:     base64.URLEncoding.EncodeToString(bts),
+		ID:      sk.kid,
+		Created: sk.created,
 	})
 }
 
@@ -682,6 +1364,7 @@ func (sk *signingKey) UnmarshalJSON(b []byte) error {
 	}
 	sk.k = k
 	sk.kid = wrapper.ID
+	sk.created = wrapper.Created
 	return nil
 }
 
@@ -0,0 +1,260 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier := strings.Repeat("a1-._~", 8)
+	sum := sha256.Sum256([]byte(verifier))
+	s256 := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		wantErr   bool
+	}{
+		{"s256", s256, "S256", verifier, false},
+		{"plain", verifier, "plain", verifier, false},
+		{"s256_mismatch", s256, "S256", verifier + "x", true},
+		{"plain_mismatch", verifier, "plain", verifier + "x", true},
+		{"s256_as_plain", s256, "plain", verifier, true},
+		{"too_short", "abc", "plain", "abc", true},
+		{"too_long", strings.Repeat("a", 129), "plain", strings.Repeat("a", 129), true},
+		{"bad_chars", strings.Repeat("a", 42) + "+", "plain", strings.Repeat("a", 42) + "+", true},
+		{"bad_method", verifier, "S512", verifier, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPKCE(tt.challenge, tt.method, tt.verifier)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyPKCE = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClient(t *testing.T) {
+	s := &idpServer{
+		clients: map[string]*oidcClient{
+			"confidential": {ID: "confidential", Secret: "s3cret"},
+			"public":       {ID: "public"},
+		},
+	}
+	tests := []struct {
+		name     string
+		clientID string // of the authRequest
+		form     url.Values
+		basic    []string // user, password
+		wantErr  bool
+	}{
+		{"basic", "confidential", nil, []string{"confidential", "s3cret"}, false},
+		{"post", "confidential", url.Values{"client_id": {"confidential"}, "client_secret": {"s3cret"}}, nil, false},
+		{"wrong_secret", "confidential", nil, []string{"confidential", "nope"}, true},
+		{"no_secret", "confidential", url.Values{"client_id": {"confidential"}}, nil, true},
+		{"no_credentials", "confidential", nil, nil, true},
+		{"other_client", "confidential", nil, []string{"public", ""}, true},
+		{"public", "public", url.Values{"client_id": {"public"}}, nil, false},
+		{"unregistered", "legacy", nil, nil, false},
+		{"unregistered_mismatch", "legacy", url.Values{"client_id": {"other"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/token", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basic != nil {
+				r.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			err := s.authenticateClient(r, tt.clientID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authenticateClient = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewOIDCClient(t *testing.T) {
+	c, err := newOIDCClient(clientRegistration{Name: "grafana", RedirectURIs: []string{"https://grafana.example.com/login/generic_oauth"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID == "" || c.Secret == "" {
+		t.Errorf("confidential client = %+v; want ID and secret", c)
+	}
+	c, err = newOIDCClient(clientRegistration{RedirectURIs: []string{"http://localhost:8080/cb"}, TokenEndpointAuthMethod: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Secret != "" {
+		t.Errorf("public client has secret %q", c.Secret)
+	}
+	for _, reg := range []clientRegistration{
+		{},
+		{RedirectURIs: []string{"/relative"}},
+		{RedirectURIs: []string{"https://example.com/cb#frag"}},
+		{RedirectURIs: []string{"https://example.com/cb"}, TokenEndpointAuthMethod: "private_key_jwt"},
+	} {
+		if _, err := newOIDCClient(reg); err == nil {
+			t.Errorf("newOIDCClient(%+v) succeeded; want error", reg)
+		}
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	s := &idpServer{stateDir: dir, keyRotation: time.Hour}
+	if err := s.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.oidcSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys; want 1", len(keys))
+	}
+	first := keys[0]
+
+	// Pretend the key is old, and check that rotating keeps it in the JWKS
+	// behind the new one, until the next rotation.
+	s.mu.Lock()
+	first.created = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+	keys, err = s.oidcSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != first {
+		t.Fatalf("after rotation got %d keys, first %v; want 2 keys, first %v", len(keys), keys[0].kid, first.kid)
+	}
+	second := keys[1]
+
+	// The keys survive a restart.
+	s2 := &idpServer{stateDir: dir, keyRotation: time.Hour}
+	if err := s2.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.signingKeys) != 2 || s2.signingKeys[0].kid != first.kid || s2.signingKeys[1].kid != second.kid {
+		t.Fatalf("reloaded keys differ")
+	}
+
+	s2.signingKeys[1].created = time.Now().Add(-2 * time.Hour)
+	keys, err = s2.oidcSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != maxSigningKeys || keys[0].kid != second.kid {
+		t.Errorf("after second rotation got %d keys, first %v; want %d keys, first %v", len(keys), keys[0].kid, maxSigningKeys, second.kid)
+	}
+}
+
+func TestLoadStateLegacyKey(t *testing.T) {
+	dir := t.TempDir()
+	id, k := mustGenRSAKey(2048)
+	b, err := (&signingKey{k: k, kid: id}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacyKeyFile), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &idpServer{stateDir: dir, keyRotation: time.Hour}
+	if err := s.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.signingKeys) != 1 || s.signingKeys[0].kid != id {
+		t.Fatalf("legacy key %v not imported", id)
+	}
+	if _, err := os.Stat(filepath.Join(dir, keysFile)); err != nil {
+		t.Errorf("keys not saved: %v", err)
+	}
+}
+
+func TestExtraClaims(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		CapMap: tailcfg.PeerCapMap{
+			peerCapabilityTSIDP: {
+				`{"extraClaims": {"groups": ["admins"], "team": "infra", "sub": "evil"}, "includeInUserInfo": true}`,
+				`{"extraClaims": {"groups": ["devs", "admins"], "team": "other"}}`,
+				`{"extraClaims": {"role": "editor"}, "audiences": ["grafana"]}`,
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		clientID    string
+		forUserInfo bool
+		want        map[string]any
+	}{
+		{
+			name:     "token",
+			clientID: "gitea",
+			want: map[string]any{
+				"groups": []any{"admins", "devs"},
+				"team":   "infra",
+			},
+		},
+		{
+			name:     "token_audience",
+			clientID: "grafana",
+			want: map[string]any{
+				"groups": []any{"admins", "devs"},
+				"team":   "infra",
+				"role":   "editor",
+			},
+		},
+		{
+			name:        "userinfo",
+			clientID:    "grafana",
+			forUserInfo: true,
+			want: map[string]any{
+				"groups": []any{"admins"},
+				"team":   "infra",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extraClaims(who, tt.clientID, tt.forUserInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := extraClaims(&apitype.WhoIsResponse{}, "gitea", false); err != nil || got != nil {
+		t.Errorf("no grants: got %v, %v; want nil, nil", got, err)
+	}
+}
+
+func TestWithExtraClaims(t *testing.T) {
+	got, err := withExtraClaims(userInfo{Sub: "123", Email: "alice@example.com"}, map[string]any{
+		"groups": []any{"admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["sub"] != "123" || got["email"] != "alice@example.com" || !reflect.DeepEqual(got["groups"], []any{"admins"}) {
+		t.Errorf("got %v", got)
+	}
+}
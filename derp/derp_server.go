@@ -36,6 +36,7 @@
 
 	"go4.org/mem"
 	"golang.org/x/sync/errgroup"
+	xrate "golang.org/x/time/rate"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
@@ -74,6 +75,15 @@ func init() {
 	writeTimeout            = 2 * time.Second
 )
 
+// discoBytesPerSec and discoBurst limit the disco packets of a client with
+// a send rate limit. They're exempt from that limit, so that path discovery
+// keeps working when the client is over it, but since any packet can look
+// like a disco packet, they have a small budget of their own.
+const (
+	discoBytesPerSec = 32 << 10
+	discoBurst       = 64 << 10
+)
+
 // dupPolicy is a temporary (2021-08-30) mechanism to change the policy
 // of how duplicate connection for the same key are handled.
 type dupPolicy int8
@@ -143,6 +153,9 @@ type Server struct {
 	tcpRtt                       metrics.LabelMap // histogram
 	meshUpdateBatchSize          *metrics.Histogram
 	meshUpdateLoopCount          *metrics.Histogram
+	bytesDroppedRateLimited      expvar.Int
+	drainRestartingFrames        expvar.Int // restarting frames sent to clients while draining
+	drainRejectedAccepts         expvar.Int // client connections turned away while draining
 
 	// verifyClientsLocalTailscaled only accepts client connections to the DERP
 	// server if the clientKey is a known peer in the network, as specified by a
@@ -152,6 +165,13 @@ type Server struct {
 	verifyClientsURL         string
 	verifyClientsURLFailOpen bool
 
+	// clientLimits are the limits of clients not in clientLimitsByKey.
+	clientLimits      ClientLimits
+	clientLimitsByKey map[key.NodePublic]ClientLimits
+	fairQueuing       bool
+
+	draining atomic.Bool // whether Drain has been called
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -351,6 +371,8 @@ func (s *Server) genPacketsDroppedReasonCounters() []*expvar.Int {
 		dropReasonQueueTail:        getMetric("queue_tail"),
 		dropReasonWriteError:       getMetric("write_error"),
 		dropReasonDupClient:        getMetric("dup_client"),
+		dropReasonRateLimited:      getMetric("rate_limited"),
+		dropReasonQueueFair:        getMetric("queue_fair"),
 	}
 	if len(ret) != int(numDropReasons) {
 		panic("dropReason metrics out of sync")
@@ -391,6 +413,94 @@ func (s *Server) SetVerifyClientURLFailOpen(v bool) {
 	s.verifyClientsURLFailOpen = v
 }
 
+// ClientLimits are limits applied by a Server to a client.
+type ClientLimits struct {
+	// BytesPerSec is the rate at which the client may send packets through
+	// the server, in bytes per second. Zero means unlimited. Disco packets
+	// and mesh peers are exempt.
+	//
+	// The limit is advertised to the client, which drops the packets over it
+	// itself; the server drops those it still receives.
+	BytesPerSec int `json:"bytesPerSec,omitempty"`
+
+	// Burst is the number of bytes the client may send at once in excess of
+	// BytesPerSec. It's raised to MaxPacketSize if smaller.
+	Burst int `json:"burst,omitempty"`
+
+	// Weight is the share of the bandwidth to other clients that the client
+	// gets relative to other senders when fair queuing is enabled. Zero
+	// means 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// SetClientLimits sets the limits applied to clients: perNode for the
+// clients with those keys, and def for the others.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientLimits(def ClientLimits, perNode map[key.NodePublic]ClientLimits) {
+	s.clientLimits = def
+	s.clientLimitsByKey = perNode
+}
+
+// limitsOf returns the limits of the client with key k.
+func (s *Server) limitsOf(k key.NodePublic) ClientLimits {
+	if l, ok := s.clientLimitsByKey[k]; ok {
+		return l
+	}
+	return s.clientLimits
+}
+
+// SetFairQueuing sets whether the queue of packets to each client is shared
+// fairly between the senders of the packets, weighted by their
+// ClientLimits.Weight, rather than first come, first served.
+//
+// It must be called before serving begins.
+func (s *Server) SetFairQueuing(v bool) {
+	s.fairQueuing = v
+}
+
+// drainTryFor is the TryFor duration of the restarting frames sent to
+// clients by a draining server: how long they should avoid the server.
+const drainTryFor = 5 * time.Second
+
+// Drain puts the server in drain mode, ahead of it being shut down.
+//
+// A draining server tells each connected client, other than mesh peers, to
+// reconnect elsewhere, at a random time within spread so that the clients
+// don't all reconnect at once. New clients are told the same, with no delay,
+// and then disconnected. Mesh peers are unaffected, so that packets keep
+// flowing to the clients that are still connected.
+//
+// Drain can't be undone. Calls after the first do nothing.
+func (s *Server) Drain(spread time.Duration) {
+	if !s.draining.CompareAndSwap(false, true) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logf("derp: draining %d clients over %v", len(s.clients), spread)
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				return
+			}
+			m := ServerRestartingMessage{TryFor: drainTryFor}
+			if spread > 0 {
+				m.ReconnectIn = rand.N(spread)
+			}
+			select {
+			case c.restarting <- m:
+			default:
+			}
+		})
+	}
+}
+
+// IsDraining reports whether Drain has been called.
+func (s *Server) IsDraining() bool {
+	return s.draining.Load()
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -734,6 +844,18 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		return fmt.Errorf("client %v rejected: %v", clientKey, err)
 	}
 
+	if s.draining.Load() && !s.isMeshPeer(clientInfo) {
+		s.drainRejectedAccepts.Add(1)
+		if err := s.sendServerInfo(bw, clientKey, ClientLimits{}); err != nil {
+			return fmt.Errorf("send server info: %v", err)
+		}
+		s.drainRestartingFrames.Add(1)
+		if err := writeRestarting(bw.bw(), ServerRestartingMessage{TryFor: drainTryFor}); err != nil {
+			return fmt.Errorf("send restarting: %v", err)
+		}
+		return bw.Flush()
+	}
+
 	// At this point we trust the client so we don't time out.
 	nc.SetDeadline(time.Time{})
 
@@ -756,6 +878,7 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		sendQueue:      make(chan pkt, perClientSendQueueDepth),
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
+		restarting:     make(chan ServerRestartingMessage, 1),
 		peerGone:       make(chan peerGoneMsg),
 		canMesh:        s.isMeshPeer(clientInfo),
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
@@ -764,6 +887,17 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{}, 1) // must be buffered; >1 is fine but wasteful
 	}
+	if s.fairQueuing {
+		c.fairQueue = newFairQueue(perClientSendQueueDepth)
+	}
+	lim := s.limitsOf(clientKey)
+	if lim.BytesPerSec > 0 && !c.canMesh {
+		c.limits = lim
+		// Allow an extra packet of burst over what the client is told, as
+		// packets sent on time may arrive bunched up.
+		c.sendLim = xrate.NewLimiter(xrate.Limit(lim.BytesPerSec), max(lim.Burst, MaxPacketSize)+MaxPacketSize)
+		c.discoLim = xrate.NewLimiter(discoBytesPerSec, discoBurst)
+	}
 	if clientInfo != nil {
 		c.info = *clientInfo
 		if envknob.Bool("DERP_PROBER_DEBUG_LOGS") && clientInfo.IsProber {
@@ -776,8 +910,15 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 
 	s.registerClient(c)
 	defer s.unregisterClient(c)
+	if s.draining.Load() && !c.canMesh {
+		// Drain started after the check above, and may have missed c.
+		select {
+		case c.restarting <- ServerRestartingMessage{TryFor: drainTryFor}:
+		default:
+		}
+	}
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c.bw, clientKey, c.limits)
 	if err != nil {
 		return fmt.Errorf("send server info: %v", err)
 	}
@@ -1002,6 +1143,18 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %v: recvPacket: %v", c.key, err)
 	}
+	if c.sendLim != nil {
+		lim := c.sendLim
+		if disco.LooksLikeDiscoWrapper(contents) {
+			lim = c.discoLim
+		}
+		if !lim.AllowN(s.clock.Now(), frameHeaderLen+int(fl)) {
+			s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+			s.bytesDroppedRateLimited.Add(int64(len(contents)))
+			c.debugLogf("SendPacket for %s, dropping: over rate limit", dstKey.ShortString())
+			return nil
+		}
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -1069,6 +1222,8 @@ func (c *sclient) debugLogf(format string, v ...any) {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // source client is over its ClientLimits.BytesPerSec
+	dropReasonQueueFair                          // destination fair queue is full, dropped oldest packet of heaviest sender
 	numDropReasons                               // unused; keep last
 )
 
@@ -1102,6 +1257,19 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	sendQueue := dst.sendQueue
 	if disco.LooksLikeDiscoWrapper(p.bs) {
 		sendQueue = dst.discoSendQueue
+	} else if dst.fairQueue != nil {
+		select {
+		case <-dst.done:
+			s.recordDrop(p.bs, c.key, dstKey, dropReasonGoneDisconnected)
+			dst.debugLogf("sendPkt dropped, dst gone")
+			return nil
+		default:
+		}
+		if dropped, ok := dst.fairQueue.enqueue(p, s.limitsOf(p.src).Weight); ok {
+			s.recordDrop(dropped.bs, dropped.src, dstKey, dropReasonQueueFair)
+			c.recordQueueTime(dropped.enqueuedAt)
+		}
+		return nil
 	}
 	for attempt := 0; attempt < 3; attempt++ {
 		select {
@@ -1302,8 +1470,13 @@ type serverInfo struct {
 	TokenBucketBytesBurst     int `json:",omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic, lim ClientLimits) error {
+	si := serverInfo{Version: ProtocolVersion}
+	if lim.BytesPerSec > 0 {
+		si.TokenBucketBytesPerSecond = lim.BytesPerSec
+		si.TokenBucketBytesBurst = max(lim.Burst, MaxPacketSize)
+	}
+	msg, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
@@ -1427,6 +1600,10 @@ type sclient struct {
 	isDup          atomic.Bool      // whether more than 1 sclient for key is connected
 	isDisabled     atomic.Bool      // whether sends to this peer are disabled due to active/active dups
 	debug          bool             // turn on for verbose logging
+	fairQueue      *fairQueue       // if non-nil, used instead of sendQueue
+	limits         ClientLimits     // advertised to the client, if it has a sendLim
+	sendLim        *xrate.Limiter   // if non-nil, limits the bytes the client may send
+	discoLim       *xrate.Limiter   // non-nil with sendLim, limits disco packets instead
 
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
@@ -1448,6 +1625,10 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// restarting is the restarting frame to send to the client when the
+	// server is draining. It is never closed.
+	restarting chan ServerRestartingMessage
 }
 
 func (c *sclient) presentFlags() PeerPresentFlags {
@@ -1551,11 +1732,25 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			case pkt := <-c.discoSendQueue:
 				c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
 			default:
-				return
+				if c.fairQueue == nil {
+					return
+				}
+				for {
+					pkt, ok := c.fairQueue.dequeue()
+					if !ok {
+						return
+					}
+					c.s.recordDrop(pkt.bs, pkt.src, c.key, dropReasonGoneDisconnected)
+				}
 			}
 		}
 	}()
 
+	var fairQueueReady <-chan struct{} // nil (never ready) without a fairQueue
+	if c.fairQueue != nil {
+		fairQueueReady = c.fairQueue.ready
+	}
+
 	jitter := rand.N(5 * time.Second)
 	keepAliveTick, keepAliveTickChannel := c.s.clock.NewTicker(keepAlive + jitter)
 	defer keepAliveTick.Stop()
@@ -1584,9 +1779,15 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
 			continue
+		case <-fairQueueReady:
+			werr = c.sendFairQueued()
+			continue
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 			continue
+		case msg := <-c.restarting:
+			werr = c.sendRestarting(msg)
+			continue
 		case <-keepAliveTickChannel:
 			werr = c.sendKeepAlive()
 			continue
@@ -1613,15 +1814,31 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
+		case <-fairQueueReady:
+			werr = c.sendFairQueued()
 		case msg := <-c.sendPongCh:
 			werr = c.sendPong(msg)
 			continue
+		case msg := <-c.restarting:
+			werr = c.sendRestarting(msg)
 		case <-keepAliveTickChannel:
 			werr = c.sendKeepAlive()
 		}
 	}
 }
 
+// sendFairQueued sends the next packet from c.fairQueue, if any, without
+// flushing.
+func (c *sclient) sendFairQueued() error {
+	msg, ok := c.fairQueue.dequeue()
+	if !ok {
+		return nil
+	}
+	err := c.sendPacket(msg.src, msg.bs)
+	c.recordQueueTime(msg.enqueuedAt)
+	return err
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
@@ -1643,6 +1860,25 @@ func (c *sclient) sendPong(data [8]byte) error {
 	return err
 }
 
+// sendRestarting sends a restarting frame, without flushing.
+func (c *sclient) sendRestarting(m ServerRestartingMessage) error {
+	c.s.drainRestartingFrames.Add(1)
+	c.setWriteDeadline()
+	return writeRestarting(c.bw.bw(), m)
+}
+
+// writeRestarting writes a frameRestarting for m to bw, without flushing.
+func writeRestarting(bw *bufio.Writer, m ServerRestartingMessage) error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[0:4], uint32(m.ReconnectIn.Milliseconds()))
+	binary.BigEndian.PutUint32(b[4:8], uint32(m.TryFor.Milliseconds()))
+	if err := writeFrameHeader(bw, frameRestarting, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := bw.Write(b[:])
+	return err
+}
+
 const (
 	peerGoneFrameLen    = keyLen + 1
 	peerPresentFrameLen = keyLen + 16 + 2 + 1 // 16 byte IP + 2 byte port + 1 byte flags
@@ -1927,11 +2163,20 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_clients_remote", expvar.Func(func() any { return len(s.clientsMesh) - len(s.clients) }))
 	m.Set("gauge_current_dup_client_keys", &s.dupClientKeys)
 	m.Set("gauge_current_dup_client_conns", &s.dupClientConns)
+	m.Set("gauge_draining", expvar.Func(func() any {
+		if s.draining.Load() {
+			return 1
+		}
+		return 0
+	}))
 	m.Set("counter_total_dup_client_conns", &s.dupClientConnTotal)
 	m.Set("accepts", &s.accepts)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("packets_dropped", &s.packetsDropped)
+	m.Set("bytes_dropped_rate_limited", &s.bytesDroppedRateLimited)
+	m.Set("drain_restarting_frames", &s.drainRestartingFrames)
+	m.Set("drain_rejected_accepts", &s.drainRejectedAccepts)
 	m.Set("counter_packets_dropped_reason", &s.packetsDroppedReason)
 	m.Set("counter_packets_dropped_type", &s.packetsDroppedType)
 	m.Set("counter_packets_received_kind", &s.packetsRecvByKind)
@@ -19,6 +19,7 @@
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -1522,3 +1523,208 @@ func TestServerRepliesToPing(t *testing.T) {
 		}
 	}
 }
+
+func TestServerClientRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetClientLimits(ClientLimits{BytesPerSec: 1000}, nil)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	// The limit is advertised to clients.
+	alice.c.wmu.Lock()
+	advertised := alice.c.rate != nil
+	// Ignore it, to check that the server enforces it too.
+	alice.c.rate = nil
+	alice.c.wmu.Unlock()
+	if !advertised {
+		t.Fatal("client rate limit not advertised")
+	}
+
+	const n = 1000
+	pkt := make([]byte, 1000)
+	for range n {
+		if err := alice.c.Send(bob.pub, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the server to read them all.
+	if err := alice.c.SendPing([8]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := alice.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(PongMessage); ok {
+			break
+		}
+	}
+	// Up to the burst (two max size packets) gets through.
+	if got, min := ts.s.packetsDroppedReasonCounters[dropReasonRateLimited].Value(), int64(n-2*MaxPacketSize/len(pkt)); got < min {
+		t.Errorf("rate limited drops = %d; want at least %d", got, min)
+	}
+}
+
+func TestServerClientRateLimitDisco(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetClientLimits(ClientLimits{BytesPerSec: 1 << 30}, nil)
+
+	alice := newRegularClient(t, ts, "alice")
+	bob := newRegularClient(t, ts, "bob")
+
+	// Disco packets aren't subject to the client's limit, but bulk traffic
+	// made to look like disco doesn't get through unlimited.
+	const n = 500
+	pkt := make([]byte, 1000)
+	copy(pkt, disco.Magic)
+	for range n {
+		if err := alice.c.Send(bob.pub, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.c.SendPing([8]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := alice.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(PongMessage); ok {
+			break
+		}
+	}
+	if got, min := ts.s.packetsDroppedReasonCounters[dropReasonRateLimited].Value(), int64(n-2*discoBurst/len(pkt)); got < min {
+		t.Errorf("rate limited drops = %d; want at least %d", got, min)
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	heavy := key.NewNode().Public()
+	light := key.NewNode().Public()
+	q := newFairQueue(10)
+
+	for range 8 {
+		if _, dropped := q.enqueue(pkt{src: heavy, bs: make([]byte, fairQueueQuantum)}, 1); dropped {
+			t.Fatal("dropped before queue full")
+		}
+	}
+	q.enqueue(pkt{src: light, bs: make([]byte, fairQueueQuantum)}, 1)
+	q.enqueue(pkt{src: light, bs: make([]byte, fairQueueQuantum)}, 1)
+	// The queue overflows, and the heavy sender pays.
+	dropped, ok := q.enqueue(pkt{src: light, bs: make([]byte, fairQueueQuantum)}, 1)
+	if !ok || dropped.src != heavy {
+		t.Fatalf("on overflow, dropped %v from %v; want heavy sender's packet", ok, dropped.src.ShortString())
+	}
+	if q.n != 10 || len(q.flows[heavy].pkts) != 7 || len(q.flows[light].pkts) != 3 {
+		t.Fatalf("after overflow: n=%d heavy=%d light=%d; want 10, 7, 3", q.n, len(q.flows[heavy].pkts), len(q.flows[light].pkts))
+	}
+
+	// The light sender's packets aren't stuck behind the heavy sender's.
+	var order []string
+	for {
+		p, ok := q.dequeue()
+		if !ok {
+			break
+		}
+		if p.src == light {
+			order = append(order, "L")
+		} else {
+			order = append(order, "H")
+		}
+	}
+	if got, want := strings.Join(order, ""), "HLHLHLHHHH"; got != want {
+		t.Errorf("dequeue order = %s; want %s", got, want)
+	}
+	if q.n != 0 || len(q.flows) != 0 || len(q.active) != 0 {
+		t.Errorf("queue not empty after draining: n=%d flows=%d active=%d", q.n, len(q.flows), len(q.active))
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	a := key.NewNode().Public()
+	b := key.NewNode().Public()
+	q := newFairQueue(100)
+	for range 30 {
+		q.enqueue(pkt{src: a, bs: make([]byte, 1500)}, 2)
+		q.enqueue(pkt{src: b, bs: make([]byte, 1500)}, 1)
+	}
+	counts := map[key.NodePublic]int{}
+	for range 30 {
+		p, _ := q.dequeue()
+		counts[p.src]++
+	}
+	if counts[a] != 20 || counts[b] != 10 {
+		t.Errorf("of first 30 packets, a (weight 2) got %d, b (weight 1) got %d; want 20, 10", counts[a], counts[b])
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	alice := newRegularClient(t, ts, "alice")
+	watcher := newTestWatcher(t, ts, "watcher")
+	watcher.wantPresent(t, alice.pub, watcher.pub)
+
+	ts.s.Drain(time.Second)
+	if !ts.s.IsDraining() {
+		t.Fatal("IsDraining = false after Drain")
+	}
+
+	// Connected clients are told to go elsewhere, within the spread.
+	for {
+		m, err := alice.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := m.(ServerRestartingMessage); ok {
+			if m.ReconnectIn >= time.Second || m.TryFor != drainTryFor {
+				t.Errorf("got %+v; want ReconnectIn < 1s, TryFor %v", m, drainTryFor)
+			}
+			break
+		}
+	}
+
+	// New clients are told to go elsewhere straight away, and disconnected.
+	nc, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	bob, err := NewClient(key.NewNode(), nc, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, bob)
+	m, err := bob.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := m.(ServerRestartingMessage); !ok || m.ReconnectIn != 0 {
+		t.Fatalf("got %#v; want ServerRestartingMessage with no delay", m)
+	}
+	if _, err := bob.recvTimeout(5 * time.Second); err == nil {
+		t.Fatal("rejected client still connected")
+	}
+
+	// Mesh peers may still connect.
+	newTestWatcher(t, ts, "watcher2")
+	if got := ts.s.drainRejectedAccepts.Value(); got != 1 {
+		t.Errorf("drain rejected accepts = %d; want 1", got)
+	}
+}
@@ -100,6 +100,17 @@ type Client struct {
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
 	clock        tstime.Clock
+	node         *tailcfg.DERPNode // node of client, if dialed by region
+	handoff      handoff           // from the last server restarting message
+	noQUICUntil  time.Time         // when to next try QUIC, after a failure
+}
+
+// handoff is the state of a move away from a server that said it was
+// restarting, such as a draining derper.
+type handoff struct {
+	client     *derp.Client // connection being moved away from
+	avoidNode  string       // name of the node to avoid, if known
+	avoidUntil time.Time    // when to stop avoiding avoidNode
 }
 
 // ConnectedState describes the state of a derphttp Client.
@@ -420,6 +431,9 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		tcpConn, err = c.dialURL(ctx)
 	default:
 		c.logf("%s: connecting to derp-%d (%v)", caller, reg.RegionID, reg.RegionCode)
+		if client, connGen, ok := c.connectQUIC(ctx, caller, reg); ok {
+			return client, connGen, nil
+		}
 		tcpConn, node, err = c.dialRegion(ctx, reg)
 	}
 	if err != nil {
@@ -554,6 +568,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	c.client = derpClient
 	c.netConn = tcpConn
 	c.tlsState = tlsState
+	c.node = node
 	c.connGen++
 
 	localAddr, _ := c.client.LocalAddr()
@@ -609,7 +624,7 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 		return nil, nil, fmt.Errorf("no nodes for %s", c.targetString(reg))
 	}
 	var firstErr error
-	for _, n := range reg.Nodes {
+	for _, n := range c.nodesToDial(reg) {
 		if n.STUNOnly {
 			if firstErr == nil {
 				firstErr = fmt.Errorf("no non-STUNOnly nodes for %s", c.targetString(reg))
@@ -627,7 +642,35 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 	return nil, nil, firstErr
 }
 
+// nodesToDial returns the nodes of reg in the order to dial them: in order,
+// except that a node the client was recently told to move away from by
+// a restarting server is last.
+//
+// c.mu must be held.
+func (c *Client) nodesToDial(reg *tailcfg.DERPRegion) []*tailcfg.DERPNode {
+	h := c.handoff
+	if h.avoidNode == "" || !c.clock.Now().Before(h.avoidUntil) {
+		return reg.Nodes
+	}
+	nodes := make([]*tailcfg.DERPNode, 0, len(reg.Nodes))
+	var avoid []*tailcfg.DERPNode
+	for _, n := range reg.Nodes {
+		if n.Name == h.avoidNode {
+			avoid = append(avoid, n)
+		} else {
+			nodes = append(nodes, n)
+		}
+	}
+	return append(nodes, avoid...)
+}
+
 func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
+	return tls.Client(nc, c.tlsConfig(node))
+}
+
+// tlsConfig returns the TLS config to use to connect to node, which may be
+// nil when using c.url to dial.
+func (c *Client) tlsConfig(node *tailcfg.DERPNode) *tls.Config {
 	tlsConf := tlsdial.Config(c.tlsServerName(node), c.HealthTracker, c.TLSConfig)
 	if node != nil {
 		if node.InsecureForTests {
@@ -638,7 +681,7 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
 		}
 	}
-	return tls.Client(nc, tlsConf)
+	return tlsConf
 }
 
 // DialRegionTLS returns a TLS connection to a DERP node in the given region.
@@ -1052,6 +1095,17 @@ func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
 			if c.handledPong(m) {
 				continue
 			}
+		case derp.ServerRestartingMessage:
+			c.handleServerRestarting(client, m)
+		}
+		if err != nil && c.handedOff(client) {
+			// We closed the connection ourselves to move to
+			// another server, so this isn't a failure.
+			client, connGen, err = c.connect(c.newContext(), "derphttp.Client.Recv")
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
 		}
 		if err != nil {
 			c.closeForReconnect(client)
@@ -1063,6 +1117,48 @@ func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
 	}
 }
 
+// handleServerRestarting handles a restarting message from the server of
+// client, such as a draining derper telling its clients to go elsewhere.
+//
+// The connection is kept until m.ReconnectIn has passed, so that packets
+// keep flowing, and then closed. The next connection avoids the node for
+// m.TryFor, so that the client moves to another node in the region, if there
+// is one.
+func (c *Client) handleServerRestarting(client *derp.Client, m derp.ServerRestartingMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != client || c.handoff.client == client {
+		return
+	}
+	var node string
+	if c.node != nil {
+		node = c.node.Name
+	}
+	now := c.clock.Now()
+	if c.handoff.avoidNode == node && now.Before(c.handoff.avoidUntil) {
+		// We were just told to leave this node, but had nowhere
+		// else to go. Let the server close the connection and fall
+		// back to the normal reconnect logic, to avoid a tight
+		// reconnect loop.
+		return
+	}
+	c.logf("derphttp.Client: server %v restarting; reconnecting in %v", c.serverPubKey.ShortString(), m.ReconnectIn)
+	c.handoff = handoff{
+		client:     client,
+		avoidNode:  node,
+		avoidUntil: now.Add(m.ReconnectIn + m.TryFor),
+	}
+	c.clock.AfterFunc(m.ReconnectIn, func() { c.closeForReconnect(client) })
+}
+
+// handedOff reports whether client is a connection that was closed (or is
+// to be closed) to move away from a restarting server.
+func (c *Client) handedOff(client *derp.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handoff.client == client && !c.closed
+}
+
 func (c *Client) isClosed() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
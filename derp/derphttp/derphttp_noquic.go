@@ -0,0 +1,19 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_enable_derp_quic
+
+package derphttp
+
+import (
+	"context"
+
+	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
+)
+
+// connectQUIC reports that it didn't connect, as DERP over QUIC is only
+// supported by clients built with the ts_enable_derp_quic tag.
+func (c *Client) connectQUIC(ctx context.Context, caller string, reg *tailcfg.DERPRegion) (client *derp.Client, connGen int, ok bool) {
+	return nil, 0, false
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_enable_derp_quic
+
+package derphttp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derpquic"
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+)
+
+// Clients built with the ts_enable_derp_quic tag connect to regions over
+// DERP over QUIC (see package derpquic) if a node advertises a QUICPort, and
+// fall back to TCP if that fails.
+
+// quicRetryInterval is how long a client that failed to connect over QUIC,
+// such as because UDP is blocked, uses TCP before trying QUIC again.
+const quicRetryInterval = 5 * time.Minute
+
+// quicDialTimeout is how long a client tries to connect over QUIC before
+// falling back to TCP. It's a var so tests can change it.
+var quicDialTimeout = 3 * time.Second
+
+var debugNoQUIC = envknob.RegisterBool("TS_DEBUG_DERP_NO_QUIC")
+
+// connectQUIC connects to the first node of reg that serves DERP over QUIC,
+// if any, and reports whether it succeeded.
+//
+// c.mu must be held.
+func (c *Client) connectQUIC(ctx context.Context, caller string, reg *tailcfg.DERPRegion) (client *derp.Client, connGen int, ok bool) {
+	if debugNoQUIC() || c.clock.Now().Before(c.noQUICUntil) {
+		return nil, 0, false
+	}
+	var node *tailcfg.DERPNode
+	for _, n := range c.nodesToDial(reg) {
+		if n.QUICPort != 0 && !n.STUNOnly {
+			node = n
+			break
+		}
+	}
+	if node == nil {
+		return nil, 0, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, quicDialTimeout)
+	defer cancel()
+	nc, derpClient, err := c.dialQUIC(ctx, node)
+	if err != nil {
+		c.logf("%s: QUIC to %v failed, using TCP: %v", caller, node.HostName, err)
+		c.noQUICUntil = c.clock.Now().Add(quicRetryInterval)
+		return nil, 0, false
+	}
+
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = nc
+	c.tlsState = nil
+	c.node = node
+	c.connGen++
+
+	localAddr, _ := c.client.LocalAddr()
+	c.atomicState.Store(ConnectedState{
+		Connected: true,
+		LocalAddr: localAddr,
+	})
+	return c.client, c.connGen, true
+}
+
+// dialQUIC connects to node over QUIC and starts speaking DERP.
+func (c *Client) dialQUIC(ctx context.Context, node *tailcfg.DERPNode) (_ *derpquic.Conn, _ *derp.Client, err error) {
+	host := node.HostName
+	if ip, err := netip.ParseAddr(node.IPv4); err == nil {
+		host = ip.String()
+	} else if ip, err := netip.ParseAddr(node.IPv6); err == nil {
+		host = ip.String()
+	}
+	nc, err := derpquic.Dial(ctx, net.JoinHostPort(host, strconv.Itoa(node.QUICPort)), c.tlsConfig(node))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			nc.Close()
+		}
+	}()
+
+	// Give up on the DERP handshake when ctx is done, as with TCP.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			nc.Close()
+		}
+	}()
+
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	derpClient, err := derp.NewClient(c.privateKey, nc, brw, c.logf,
+		derp.MeshKey(c.MeshKey),
+		derp.CanAckPings(c.canAckPings),
+		derp.IsProber(c.IsProber),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.preferred {
+		if err := derpClient.NotePreferred(true); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.WatchConnectionChanges {
+		if err := derpClient.WatchConnectionChanges(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nc, derpClient, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_enable_derp_quic
+
+package derphttp
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derpquic"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// newQUICTestRegion returns a region of one node serving DERP over TLS and,
+// if withQUIC is true, over QUIC.
+func newQUICTestRegion(t *testing.T, withQUIC bool) *tailcfg.DERPRegion {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	t.Cleanup(func() { s.Close() })
+	hs := httptest.NewUnstartedServer(Handler(s))
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         1,
+		HostName:         "localhost",
+		IPv4:             "127.0.0.1",
+		IPv6:             "none",
+		DERPPort:         hs.Listener.Addr().(*net.TCPAddr).Port,
+		InsecureForTests: true,
+	}
+	if withQUIC {
+		ep, err := quic.Listen("udp", "127.0.0.1:0", derpquic.ServerConfig(hs.TLS))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ep.Close(context.Background()) })
+		go derpquic.Serve(s, ep)
+		node.QUICPort = int(ep.LocalAddr().Port())
+	} else {
+		// A port nothing is listening on, as if UDP were blocked.
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.QUICPort = pc.LocalAddr().(*net.UDPAddr).Port
+		pc.Close()
+	}
+	return &tailcfg.DERPRegion{RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{node}}
+}
+
+func newQUICTestClient(t *testing.T, region *tailcfg.DERPRegion) (*Client, key.NodePublic) {
+	k := key.NewNode()
+	c := NewRegionClient(k, t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion { return region })
+	t.Cleanup(func() { c.Close() })
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c, k.Public()
+}
+
+func isQUIC(c *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.netConn.(*derpquic.Conn)
+	return ok
+}
+
+func TestQUIC(t *testing.T) {
+	region := newQUICTestRegion(t, true)
+	alice, _ := newQUICTestClient(t, region)
+	bob, bobPub := newQUICTestClient(t, region)
+	if !isQUIC(alice) || !isQUIC(bob) {
+		t.Fatal("not connected over QUIC")
+	}
+	if _, err := alice.LocalAddr(); err != nil {
+		t.Errorf("LocalAddr: %v", err)
+	}
+
+	waitConnect(t, bob)
+	if err := alice.Send(bobPub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := bob.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if string(p.Data) != "hello" {
+				t.Errorf("got %q; want hello", p.Data)
+			}
+			break
+		}
+	}
+}
+
+func TestQUICFallback(t *testing.T) {
+	old := quicDialTimeout
+	quicDialTimeout = 200 * time.Millisecond
+	defer func() { quicDialTimeout = old }()
+
+	region := newQUICTestRegion(t, false)
+	c, _ := newQUICTestClient(t, region)
+	if isQUIC(c) {
+		t.Fatal("connected over QUIC to a node not serving it")
+	}
+	waitConnect(t, c)
+
+	// QUIC isn't tried again for a while.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.clock.Now().Before(c.noQUICUntil) {
+		t.Error("QUIC will be retried on the next connection")
+	}
+}
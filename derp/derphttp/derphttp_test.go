@@ -17,6 +17,7 @@
 
 	"tailscale.com/derp"
 	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
@@ -485,3 +486,68 @@ func TestProbe(t *testing.T) {
 		}
 	}
 }
+
+func TestServerDrainHandoff(t *testing.T) {
+	// Two nodes in a region.
+	region := &tailcfg.DERPRegion{RegionID: 1, RegionCode: "test"}
+	var servers []*derp.Server
+	for i := range 2 {
+		s := derp.NewServer(key.NewNode(), t.Logf)
+		defer s.Close()
+		hs := httptest.NewUnstartedServer(Handler(s))
+		hs.StartTLS()
+		defer hs.Close()
+		region.Nodes = append(region.Nodes, &tailcfg.DERPNode{
+			Name:             fmt.Sprintf("%da", i),
+			RegionID:         1,
+			HostName:         "localhost",
+			IPv4:             "127.0.0.1",
+			IPv6:             "none",
+			DERPPort:         hs.Listener.Addr().(*net.TCPAddr).Port,
+			InsecureForTests: true,
+		})
+		servers = append(servers, s)
+	}
+
+	c := NewRegionClient(key.NewNode(), t.Logf, netmon.NewStatic(), func() *tailcfg.DERPRegion { return region })
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.ServerPublicKey(), servers[0].PublicKey(); got != want {
+		t.Fatalf("connected to %v; want first node %v", got, want)
+	}
+
+	// The server info is sent once the server has registered the client.
+	if m, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m.(derp.ServerInfoMessage); !ok {
+		t.Fatalf("first Recv was %T; want ServerInfoMessage", m)
+	}
+
+	servers[0].Drain(0)
+	for {
+		m, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv while draining: %v", err)
+		}
+		if _, ok := m.(derp.ServerRestartingMessage); ok {
+			break
+		}
+	}
+
+	// The next Recv moves to the other node, without an error.
+	m, connGen, err := c.RecvDetail()
+	if err != nil {
+		t.Fatalf("Recv after drain: %v", err)
+	}
+	if _, ok := m.(derp.ServerInfoMessage); !ok {
+		t.Errorf("got %T; want ServerInfoMessage", m)
+	}
+	if connGen != 2 {
+		t.Errorf("connGen = %d; want 2", connGen)
+	}
+	if got, want := c.ServerPublicKey(), servers[1].PublicKey(); got != want {
+		t.Errorf("reconnected to %v; want second node %v", got, want)
+	}
+}
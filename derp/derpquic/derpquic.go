@@ -0,0 +1,454 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derpquic implements DERP over QUIC.
+//
+// A client opens a bidirectional control stream per QUIC connection, writes
+// a preamble (so that the server learns of the stream), and then speaks the
+// DERP protocol as it would on a TCP connection after the HTTP upgrade,
+// except that each frame that carries a packet is sent on its own
+// unidirectional stream. A lost QUIC packet thus only delays the DERP
+// packet it carried, rather than every frame behind it, as it would on TCP
+// or a single stream; other frames keep their order on the control stream.
+//
+// golang.org/x/net/quic doesn't support the QUIC datagram extension
+// (RFC 9221), so lost packets are still retransmitted, unlike with UDP.
+package derpquic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+	"tailscale.com/derp"
+)
+
+// ALPN is the TLS ALPN protocol of DERP over QUIC.
+const ALPN = "tailscale-derp"
+
+// preamble is written by the client at the start of its control stream.
+const preamble = "DERPQUIC1"
+
+const (
+	// keepAlive is how often an idle QUIC connection is pinged, to keep
+	// NAT mappings alive. The DERP keepalive is too infrequent for that.
+	keepAlive = 25 * time.Second
+
+	// idleTimeout is how long a QUIC connection may go without hearing
+	// from the peer before it's closed.
+	idleTimeout = 2 * time.Minute
+
+	// maxPacketStreams is how many packet streams a peer may have open at
+	// once. Streams are short-lived, so the limit is replenished quickly.
+	maxPacketStreams = 1000
+)
+
+// The DERP frame header, and the types of frames that carry packets, as in
+// package derp.
+const (
+	frameHeaderLen     = 1 + 4 // frame type byte + 4 byte length
+	frameSendPacket    = 0x04
+	frameRecvPacket    = 0x05
+	frameForwardPacket = 0x0a
+
+	// maxFrameLen bounds the length of frames read from peers.
+	maxFrameLen = 1 << 20
+)
+
+func isPacketFrame(typ byte) bool {
+	return typ == frameSendPacket || typ == frameRecvPacket || typ == frameForwardPacket
+}
+
+// ServerConfig returns the QUIC config for serving DERP over QUIC with
+// Serve, using the certificates of tlsConf.
+func ServerConfig(tlsConf *tls.Config) *quic.Config {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	tlsConf.MinVersion = tls.VersionTLS13
+	return &quic.Config{
+		TLSConfig:            tlsConf,
+		MaxBidiRemoteStreams: 1,
+		MaxUniRemoteStreams:  maxPacketStreams,
+		MaxIdleTimeout:       idleTimeout,
+		KeepAlivePeriod:      keepAlive,
+	}
+}
+
+// Serve serves DERP over QUIC to clients connecting to ep, which should have
+// been created with a config from ServerConfig, until ep is closed.
+func Serve(s *derp.Server, ep *quic.Endpoint) error {
+	for {
+		qc, err := ep.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveConn(s, qc)
+	}
+}
+
+func serveConn(s *derp.Server, qc *quic.Conn) {
+	defer qc.Abort(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	st, err := qc.AcceptStream(ctx)
+	if err != nil {
+		return
+	}
+	st.SetReadContext(ctx)
+	var pre [len(preamble)]byte
+	if _, err := io.ReadFull(st, pre[:]); err != nil || string(pre[:]) != preamble {
+		log.Printf("derp: QUIC client %v: bad preamble", remoteAddr(qc))
+		return
+	}
+	nc := newConn(qc, st, nil)
+	defer nc.Close()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	s.Accept(context.Background(), nc, brw, nc.RemoteAddr().String())
+}
+
+// Dial connects to the DERP server at addr over QUIC, and returns a conn on
+// which to speak DERP, as with derp.NewClient. The ALPN protocol of tlsConf
+// is set to ALPN.
+func Dial(ctx context.Context, addr string, tlsConf *tls.Config) (_ *Conn, err error) {
+	ep, err := quic.Listen("udp", ":0", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			go ep.Close(context.Background())
+		}
+	}()
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	qc, err := ep.Dial(ctx, "udp", addr, &quic.Config{
+		TLSConfig:            tlsConf,
+		MaxBidiRemoteStreams: -1,
+		MaxUniRemoteStreams:  maxPacketStreams,
+		MaxIdleTimeout:       idleTimeout,
+		KeepAlivePeriod:      keepAlive,
+	})
+	if err != nil {
+		return nil, err
+	}
+	st, err := qc.NewStream(ctx)
+	if err != nil {
+		qc.Abort(nil)
+		return nil, err
+	}
+	st.SetWriteContext(ctx)
+	if _, err := io.WriteString(st, preamble); err != nil {
+		qc.Abort(nil)
+		return nil, err
+	}
+	st.Flush()
+	return newConn(qc, st, ep), nil
+}
+
+// Conn is a DERP over QUIC connection, adapted to be a derp.Conn.
+type Conn struct {
+	qc *quic.Conn
+	st *quic.Stream   // control stream
+	ep *quic.Endpoint // if non-nil, the client's endpoint, closed with the conn
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+
+	frames   chan []byte   // whole frames received, from any stream
+	readDone chan struct{} // closed when the control stream is done
+	readErr  error         // why the control stream is done; set before readDone is closed
+	rbuf     []byte        // rest of the frame being read by Read
+
+	wmu  sync.Mutex
+	wbuf []byte // start of a frame written but not yet sent
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+}
+
+func newConn(qc *quic.Conn, st *quic.Stream, ep *quic.Endpoint) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		qc:       qc,
+		st:       st,
+		ep:       ep,
+		ctx:      ctx,
+		cancel:   cancel,
+		frames:   make(chan []byte, 64),
+		readDone: make(chan struct{}),
+	}
+	go c.readControl()
+	go c.acceptPacketStreams()
+	return c
+}
+
+// readFrame reads a whole DERP frame, including its header, from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrameLen {
+		return nil, fmt.Errorf("frame of %d bytes is too long", n)
+	}
+	f := make([]byte, frameHeaderLen+n)
+	copy(f, hdr[:])
+	if _, err := io.ReadFull(r, f[frameHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// deliver queues the frame f for Read, and reports whether it did before
+// the conn was closed.
+func (c *Conn) deliver(f []byte) bool {
+	select {
+	case c.frames <- f:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// readControl reads frames from the control stream until it's done.
+func (c *Conn) readControl() {
+	c.st.SetReadContext(c.ctx)
+	br := bufio.NewReader(c.st)
+	for {
+		f, err := readFrame(br)
+		if err != nil {
+			switch {
+			case c.ctx.Err() != nil:
+				err = net.ErrClosed
+			case err != io.EOF && c.peerClosed():
+				// Like a TCP connection the peer closed.
+				err = io.EOF
+			}
+			c.readErr = err
+			close(c.readDone)
+			return
+		}
+		if !c.deliver(f) {
+			return
+		}
+	}
+}
+
+// acceptPacketStreams reads the packet streams opened by the peer, each of
+// which carries one frame, until the conn is closed.
+func (c *Conn) acceptPacketStreams() {
+	for {
+		st, err := c.qc.AcceptStream(c.ctx)
+		if err != nil {
+			return
+		}
+		if !st.IsReadOnly() {
+			st.Reset(0)
+			continue
+		}
+		// Read each stream on its own, so that one waiting for a lost
+		// QUIC packet doesn't hold up the others.
+		go func() {
+			defer st.CloseRead()
+			st.SetReadContext(c.ctx)
+			f, err := readFrame(st)
+			if err != nil || !isPacketFrame(f[0]) {
+				return
+			}
+			c.deliver(f)
+		}()
+	}
+}
+
+// peerClosed reports whether the peer closed the connection without error.
+func (c *Conn) peerClosed() bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Wait returns nil if the peer closed the connection, and otherwise
+	// an error, including when the connection is still open.
+	return c.qc.Wait(ctx) == nil
+}
+
+// Read reads the frames received on any stream, in the order they arrive.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		c.mu.Lock()
+		d := c.readDeadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !d.IsZero() {
+			t := time.NewTimer(time.Until(d))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case c.rbuf = <-c.frames:
+		case <-c.readDone:
+			// Return the frames that were received first.
+			select {
+			case c.rbuf = <-c.frames:
+			default:
+				return 0, c.readErr
+			}
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.ctx.Done():
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends the frames in b: those that carry packets each on a new
+// stream, and the others on the control stream. A trailing partial frame
+// is kept until the rest of it is written. Callers should buffer their
+// writes.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	d := c.writeDeadline
+	c.mu.Unlock()
+	ctx, cancel := deadlineContext(d)
+	defer cancel()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+	off := 0
+	for len(c.wbuf)-off >= frameHeaderLen {
+		n := frameHeaderLen + int(binary.BigEndian.Uint32(c.wbuf[off+1:]))
+		if n > frameHeaderLen+maxFrameLen {
+			return 0, fmt.Errorf("frame of %d bytes is too long", n)
+		}
+		if len(c.wbuf)-off < n {
+			break
+		}
+		f := c.wbuf[off : off+n]
+		off += n
+		var err error
+		if isPacketFrame(f[0]) {
+			err = c.writePacket(ctx, f)
+		} else {
+			c.st.SetWriteContext(ctx)
+			_, err = c.st.Write(f)
+		}
+		if err != nil {
+			return 0, deadlineErr(err)
+		}
+	}
+	c.wbuf = append(c.wbuf[:0], c.wbuf[off:]...)
+	c.st.Flush()
+	return len(b), nil
+}
+
+// writePacket sends the frame f on a new stream.
+func (c *Conn) writePacket(ctx context.Context, f []byte) error {
+	st, err := c.qc.NewSendOnlyStream(ctx)
+	if err != nil {
+		return err
+	}
+	st.SetWriteContext(ctx)
+	if _, err := st.Write(f); err != nil {
+		st.Reset(0)
+		return err
+	}
+	st.CloseWrite() // sends f, with a FIN
+	return nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		// Send a FIN, so that the peer reads EOF, as with TCP.
+		c.st.CloseWrite()
+		c.qc.Abort(nil)
+		if c.ep != nil {
+			go c.ep.Close(context.Background())
+		}
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of a client's conn. It's the zero
+// address for a server's conn.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.ep == nil {
+		return &net.UDPAddr{}
+	}
+	return net.UDPAddrFromAddrPort(c.ep.LocalAddr())
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return remoteAddr(c.qc)
+}
+
+func remoteAddr(qc *quic.Conn) net.Addr {
+	// quic.Conn doesn't export its peer's address, but includes it in
+	// its String method, as "quic.Conn(side,->ip:port)".
+	s := qc.String()
+	if i := strings.LastIndex(s, "->"); i >= 0 {
+		if ap, err := netip.ParseAddrPort(strings.TrimSuffix(s[i+len("->"):], ")")); err == nil {
+			return net.UDPAddrFromAddrPort(ap)
+		}
+	}
+	return &net.UDPAddr{}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// deadlineContext returns a context that is done at d, or never if d is
+// zero.
+func deadlineContext(d time.Time) (context.Context, context.CancelFunc) {
+	if d.IsZero() {
+		return context.Background(), func() {}
+	}
+	return context.WithDeadline(context.Background(), d)
+}
+
+// deadlineErr returns err, mapping a missed deadline to the error of a
+// net.Conn that missed one.
+func deadlineErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
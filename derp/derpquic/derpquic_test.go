@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpquic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// newTestEndpoint returns a QUIC endpoint configured with ServerConfig, and
+// the client TLS config to connect to it.
+func newTestEndpoint(t *testing.T) (*quic.Endpoint, *tls.Config) {
+	hs := httptest.NewUnstartedServer(http.NotFoundHandler())
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+	ep, err := quic.Listen("udp", "127.0.0.1:0", ServerConfig(hs.TLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ep.Close(context.Background()) })
+	return ep, &tls.Config{InsecureSkipVerify: true}
+}
+
+func dialTest(t *testing.T, ep *quic.Endpoint, tlsConf *tls.Config) *Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, ep.LocalAddr().String(), tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newTestClient(t *testing.T, ep *quic.Endpoint, tlsConf *tls.Config) (*derp.Client, key.NodePublic) {
+	k := key.NewNode()
+	nc := dialTest(t, ep, tlsConf)
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	c, err := derp.NewClient(k, nc, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, k.Public()
+}
+
+func TestDERP(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	ep, tlsConf := newTestEndpoint(t)
+	go Serve(s, ep)
+
+	alice, _ := newTestClient(t, ep, tlsConf)
+	bob, bobPub := newTestClient(t, ep, tlsConf)
+
+	got := make(chan string, 1)
+	go func() {
+		for {
+			m, err := bob.Recv()
+			if err != nil {
+				return
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				got <- string(p.Data)
+				return
+			}
+		}
+	}()
+
+	// Packets to bob are dropped until the server has registered him, so
+	// resend until one arrives.
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		if err := alice.Send(bobPub, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case s := <-got:
+			if s != "hello" {
+				t.Errorf("got %q; want hello", s)
+			}
+			return
+		case <-tick.C:
+		case <-timeout:
+			t.Fatal("timed out waiting for packet")
+		}
+	}
+}
+
+func frame(typ byte, payload string) []byte {
+	f := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(f[1:], uint32(len(payload)))
+	return append(f, payload...)
+}
+
+func TestPacketStreams(t *testing.T) {
+	ep, tlsConf := newTestEndpoint(t)
+	c := dialTest(t, ep, tlsConf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qc, err := ep.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qc.Abort(nil)
+	control, err := qc.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control.SetReadContext(ctx)
+
+	// A control frame, a packet frame, and a frame split across writes.
+	ping := frame(0x12, "ping1234")
+	packet := frame(frameSendPacket, "packet")
+	note := frame(0x07, "\x01")
+	if _, err := c.Write(append(append(ping, packet...), note[:2]...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(note[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte(preamble), append(ping, note...)...)
+	gotControl := make([]byte, len(want))
+	if _, err := io.ReadFull(control, gotControl); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotControl, want) {
+		t.Errorf("control stream = %q; want %q", gotControl, want)
+	}
+
+	st, err := qc.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.IsReadOnly() {
+		t.Fatal("packet stream isn't unidirectional")
+	}
+	st.SetReadContext(ctx)
+	gotPacket, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotPacket, packet) {
+		t.Errorf("packet stream = %q; want %q", gotPacket, packet)
+	}
+}
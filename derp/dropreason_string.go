@@ -18,12 +18,14 @@ func _() {
 	_ = x[dropReasonQueueTail-4]
 	_ = x[dropReasonWriteError-5]
 	_ = x[dropReasonDupClient-6]
-	_ = x[numDropReasons-7]
+	_ = x[dropReasonRateLimited-7]
+	_ = x[dropReasonQueueFair-8]
+	_ = x[numDropReasons-9]
 }
 
-const _dropReason_name = "UnknownDestUnknownDestOnFwdGoneDisconnectedQueueHeadQueueTailWriteErrorDupClientnumDropReasons"
+const _dropReason_name = "UnknownDestUnknownDestOnFwdGoneDisconnectedQueueHeadQueueTailWriteErrorDupClientRateLimitedQueueFairnumDropReasons"
 
-var _dropReason_index = [...]uint8{0, 11, 27, 43, 52, 61, 71, 80, 94}
+var _dropReason_index = [...]uint8{0, 11, 27, 43, 52, 61, 71, 80, 91, 100, 114}
 
 func (i dropReason) String() string {
 	if i < 0 || i >= dropReason(len(_dropReason_index)-1) {
@@ -0,0 +1,135 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"sync"
+
+	"tailscale.com/types/key"
+)
+
+// fairQueueQuantum is the number of bytes a sender of weight 1 may have
+// dequeued from a fairQueue per round.
+const fairQueueQuantum = 1500
+
+// fairQueue is the queue of packets to send to a client when the server has
+// fair queuing enabled, in place of sclient.sendQueue.
+//
+// Packets are queued per sender and dequeued with deficit round robin,
+// weighted per sender, so that a sender with a lot of traffic to the client
+// can't starve the others. When the queue is full, the packets of the
+// sender with the most queued packets (relative to its weight) are dropped
+// first.
+type fairQueue struct {
+	// ready has a value when the queue may be non-empty.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	limit  int // max queued packets
+	n      int // queued packets
+	flows  map[key.NodePublic]*fairQueueFlow
+	active []*fairQueueFlow // flows with queued packets, in round-robin order
+}
+
+// fairQueueFlow is the queued packets of one sender.
+type fairQueueFlow struct {
+	src     key.NodePublic
+	quantum int // bytes added to deficit per round
+	deficit int // bytes that may be dequeued this round
+	pkts    []pkt
+}
+
+// newFairQueue returns a new fairQueue holding at most limit packets.
+func newFairQueue(limit int) *fairQueue {
+	return &fairQueue{
+		ready: make(chan struct{}, 1),
+		limit: limit,
+		flows: map[key.NodePublic]*fairQueueFlow{},
+	}
+}
+
+// signal marks the queue ready.
+func (q *fairQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds p, from a sender with the given weight, to the queue. If the
+// queue was full, it drops the oldest packet of the sender with the most
+// queued packets relative to its weight, which may be p's sender, and
+// returns it.
+func (q *fairQueue) enqueue(p pkt, weight int) (dropped pkt, didDrop bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+
+	f, ok := q.flows[p.src]
+	if !ok {
+		f = &fairQueueFlow{
+			src:     p.src,
+			quantum: max(weight, 1) * fairQueueQuantum,
+		}
+		q.flows[p.src] = f
+		q.active = append(q.active, f)
+	}
+	f.pkts = append(f.pkts, p)
+	q.n++
+	if q.n <= q.limit {
+		return pkt{}, false
+	}
+
+	victim := f
+	for _, f := range q.active {
+		if len(f.pkts)*victim.quantum > len(victim.pkts)*f.quantum {
+			victim = f
+		}
+	}
+	dropped = q.popLocked(victim)
+	return dropped, true
+}
+
+// dequeue removes and returns the next packet to send, if any.
+func (q *fairQueue) dequeue() (p pkt, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.active) > 0 {
+		f := q.active[0]
+		if f.deficit < len(f.pkts[0].bs) {
+			// Out of credit for this round; move to the back of the line.
+			f.deficit += f.quantum
+			q.active = append(q.active[1:], f)
+			continue
+		}
+		f.deficit -= len(f.pkts[0].bs)
+		p = q.popLocked(f)
+		if q.n > 0 {
+			q.signal()
+		}
+		return p, true
+	}
+	return pkt{}, false
+}
+
+// popLocked removes and returns the oldest packet of f, forgetting f if it
+// has no more packets.
+//
+// q.mu must be held.
+func (q *fairQueue) popLocked(f *fairQueueFlow) pkt {
+	p := f.pkts[0]
+	f.pkts[0] = pkt{}
+	f.pkts = f.pkts[1:]
+	q.n--
+	if len(f.pkts) == 0 {
+		delete(q.flows, f.src)
+		for i, af := range q.active {
+			if af == f {
+				q.active = append(q.active[:i], q.active[i+1:]...)
+				break
+			}
+		}
+	}
+	return p
+}
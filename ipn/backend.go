@@ -73,6 +73,8 @@ type EngineStatus struct {
 	NotifyInitialOutgoingFiles // if set, the first Notify message (sent immediately) will contain the current Taildrop OutgoingFiles
 
 	NotifyInitialHealthState // if set, the first Notify message (sent immediately) will contain the current health.State of the client
+
+	NotifyInitialServeConfig // if set, the first Notify message (sent immediately) will contain the current ServeConfig
 )
 
 // Notify is a communication from a backend (e.g. tailscaled) to a frontend
@@ -146,6 +148,12 @@ type Notify struct {
 	// any changes to the user in the UI.
 	Health *health.State `json:",omitempty"`
 
+	// ServeConfig, if non-nil, is the new or current serve config. It is sent
+	// whenever the config changes, including when tailscaled removes expired
+	// serve or Funnel handlers. An empty ServeConfig means nothing is being
+	// served.
+	ServeConfig *ServeConfigView `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -188,6 +196,9 @@ func (n Notify) String() string {
 	if n.Health != nil {
 		sb.WriteString("Health{...} ")
 	}
+	if n.ServeConfig != nil {
+		sb.WriteString("ServeConfig{...} ")
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
@@ -8,6 +8,7 @@
 import (
 	"maps"
 	"net/netip"
+	"time"
 
 	"tailscale.com/drive"
 	"tailscale.com/tailcfg"
@@ -89,7 +90,17 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
+			}
+		}
+	}
+	if dst.UDP != nil {
+		dst.UDP = map[uint16]*UDPPortHandler{}
+		for k, v := range src.UDP {
+			if v == nil {
+				dst.UDP[k] = nil
+			} else {
+				dst.UDP[k] = v.Clone()
 			}
 		}
 	}
@@ -120,6 +131,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 	Foreground  map[string]*ServeConfig
@@ -134,6 +146,11 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	dst.LoadBalancer = src.LoadBalancer.Clone()
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
+	if dst.Expires != nil {
+		dst.Expires = ptr.To(*src.Expires)
+	}
 	return dst
 }
 
@@ -142,7 +159,33 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	HTTPS        bool
 	HTTP         bool
 	TCPForward   string
+	LoadBalancer *LoadBalancer
 	TerminateTLS string
+	AllowFrom    []string
+	Expires      *time.Time
+}{})
+
+// Clone makes a deep copy of UDPPortHandler.
+// The result aliases no memory with the original.
+func (src *UDPPortHandler) Clone() *UDPPortHandler {
+	if src == nil {
+		return nil
+	}
+	dst := new(UDPPortHandler)
+	*dst = *src
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
+	if dst.Expires != nil {
+		dst.Expires = ptr.To(*src.Expires)
+	}
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerCloneNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward         string
+	IdleTimeoutSeconds int
+	AllowFrom          []string
+	Expires            *time.Time
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -153,14 +196,28 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.LoadBalancer = src.LoadBalancer.Clone()
+	dst.SetHeaders = maps.Clone(src.SetHeaders)
+	dst.RemoveHeaders = append(src.RemoveHeaders[:0:0], src.RemoveHeaders...)
+	dst.AllowFrom = append(src.AllowFrom[:0:0], src.AllowFrom...)
+	if dst.Expires != nil {
+		dst.Expires = ptr.To(*src.Expires)
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path          string
+	Proxy         string
+	Text          string
+	LoadBalancer  *LoadBalancer
+	Redirect      string
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	NoDirListing  bool
+	AllowFrom     []string
+	Expires       *time.Time
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -177,7 +234,7 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 			if v == nil {
 				dst.Handlers[k] = nil
 			} else {
-				dst.Handlers[k] = ptr.To(*v)
+				dst.Handlers[k] = v.Clone()
 			}
 		}
 	}
@@ -188,3 +245,25 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 var _WebServerConfigCloneNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
 }{})
+
+// Clone makes a deep copy of LoadBalancer.
+// The result aliases no memory with the original.
+func (src *LoadBalancer) Clone() *LoadBalancer {
+	if src == nil {
+		return nil
+	}
+	dst := new(LoadBalancer)
+	*dst = *src
+	dst.Backends = append(src.Backends[:0:0], src.Backends...)
+	if dst.HealthCheck != nil {
+		dst.HealthCheck = ptr.To(*src.HealthCheck)
+	}
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _LoadBalancerCloneNeedsRegeneration = LoadBalancer(struct {
+	Backends    []string
+	Policy      LBPolicy
+	HealthCheck *HealthCheck
+}{})
@@ -9,6 +9,7 @@
 	"encoding/json"
 	"errors"
 	"net/netip"
+	"time"
 
 	"tailscale.com/drive"
 	"tailscale.com/tailcfg"
@@ -18,7 +19,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,UDPPortHandler,HTTPHandler,WebServerConfig,LoadBalancer
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -185,6 +186,12 @@ func (v ServeConfigView) TCP() views.MapFn[uint16, *TCPPortHandler, TCPPortHandl
 	})
 }
 
+func (v ServeConfigView) UDP() views.MapFn[uint16, *UDPPortHandler, UDPPortHandlerView] {
+	return views.MapFnOf(v.ж.UDP, func(t *UDPPortHandler) UDPPortHandlerView {
+		return t.View()
+	})
+}
+
 func (v ServeConfigView) Web() views.MapFn[HostPort, *WebServerConfig, WebServerConfigView] {
 	return views.MapFnOf(v.ж.Web, func(t *WebServerConfig) WebServerConfigView {
 		return t.View()
@@ -205,6 +212,7 @@ func (v ServeConfigView) ETag() string { return v.ж.ETag }
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 	Foreground  map[string]*ServeConfig
@@ -256,17 +264,97 @@ func (v *TCPPortHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v TCPPortHandlerView) HTTPS() bool          { return v.ж.HTTPS }
-func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
-func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
-func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) HTTPS() bool                    { return v.ж.HTTPS }
+func (v TCPPortHandlerView) HTTP() bool                     { return v.ж.HTTP }
+func (v TCPPortHandlerView) TCPForward() string             { return v.ж.TCPForward }
+func (v TCPPortHandlerView) LoadBalancer() LoadBalancerView { return v.ж.LoadBalancer.View() }
+func (v TCPPortHandlerView) TerminateTLS() string           { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) AllowFrom() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowFrom)
+}
+func (v TCPPortHandlerView) Expires() *time.Time {
+	if v.ж.Expires == nil {
+		return nil
+	}
+	x := *v.ж.Expires
+	return &x
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
 	HTTPS        bool
 	HTTP         bool
 	TCPForward   string
+	LoadBalancer *LoadBalancer
 	TerminateTLS string
+	AllowFrom    []string
+	Expires      *time.Time
+}{})
+
+// View returns a readonly view of UDPPortHandler.
+func (p *UDPPortHandler) View() UDPPortHandlerView {
+	return UDPPortHandlerView{ж: p}
+}
+
+// UDPPortHandlerView provides a read-only view over UDPPortHandler.
+//
+// Its methods should only be called if `Valid()` returns true.
+type UDPPortHandlerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *UDPPortHandler
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v UDPPortHandlerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v UDPPortHandlerView) AsStruct() *UDPPortHandler {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v UDPPortHandlerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *UDPPortHandlerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x UDPPortHandler
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v UDPPortHandlerView) UDPForward() string      { return v.ж.UDPForward }
+func (v UDPPortHandlerView) IdleTimeoutSeconds() int { return v.ж.IdleTimeoutSeconds }
+func (v UDPPortHandlerView) AllowFrom() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowFrom)
+}
+func (v UDPPortHandlerView) Expires() *time.Time {
+	if v.ж.Expires == nil {
+		return nil
+	}
+	x := *v.ж.Expires
+	return &x
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerViewNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward         string
+	IdleTimeoutSeconds int
+	AllowFrom          []string
+	Expires            *time.Time
 }{})
 
 // View returns a readonly view of HTTPHandler.
@@ -314,15 +402,40 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string                   { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string                  { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string                   { return v.ж.Text }
+func (v HTTPHandlerView) LoadBalancer() LoadBalancerView { return v.ж.LoadBalancer.View() }
+func (v HTTPHandlerView) Redirect() string               { return v.ж.Redirect }
+
+func (v HTTPHandlerView) SetHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.SetHeaders)
+}
+func (v HTTPHandlerView) RemoveHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveHeaders)
+}
+func (v HTTPHandlerView) NoDirListing() bool             { return v.ж.NoDirListing }
+func (v HTTPHandlerView) AllowFrom() views.Slice[string] { return views.SliceOf(v.ж.AllowFrom) }
+func (v HTTPHandlerView) Expires() *time.Time {
+	if v.ж.Expires == nil {
+		return nil
+	}
+	x := *v.ж.Expires
+	return &x
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path          string
+	Proxy         string
+	Text          string
+	LoadBalancer  *LoadBalancer
+	Redirect      string
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	NoDirListing  bool
+	AllowFrom     []string
+	Expires       *time.Time
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -380,3 +493,65 @@ func (v WebServerConfigView) Handlers() views.MapFn[string, *HTTPHandler, HTTPHa
 var _WebServerConfigViewNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
 }{})
+
+// View returns a readonly view of LoadBalancer.
+func (p *LoadBalancer) View() LoadBalancerView {
+	return LoadBalancerView{ж: p}
+}
+
+// LoadBalancerView provides a read-only view over LoadBalancer.
+//
+// Its methods should only be called if `Valid()` returns true.
+type LoadBalancerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *LoadBalancer
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v LoadBalancerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v LoadBalancerView) AsStruct() *LoadBalancer {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v LoadBalancerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *LoadBalancerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x LoadBalancer
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v LoadBalancerView) Backends() views.Slice[string] { return views.SliceOf(v.ж.Backends) }
+func (v LoadBalancerView) Policy() LBPolicy              { return v.ж.Policy }
+func (v LoadBalancerView) HealthCheck() *HealthCheck {
+	if v.ж.HealthCheck == nil {
+		return nil
+	}
+	x := *v.ж.HealthCheck
+	return &x
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _LoadBalancerViewNeedsRegeneration = LoadBalancer(struct {
+	Backends    []string
+	Policy      LBPolicy
+	HealthCheck *HealthCheck
+}{})
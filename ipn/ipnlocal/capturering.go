@@ -0,0 +1,169 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/capture"
+)
+
+// ErrCaptureRingNotRunning is returned by WriteCaptureRing when
+// StartCaptureRing hasn't been called.
+var ErrCaptureRingNotRunning = errors.New("capture ring buffer not running")
+
+const (
+	// captureRingDumpInterval is the minimum time between dumps of the
+	// capture ring on health warnings, which tend to come in bunches.
+	captureRingDumpInterval = time.Minute
+
+	// maxCaptureRingDumps is the number of dumps kept in the captures
+	// directory. Older ones are deleted.
+	maxCaptureRingDumps = 10
+)
+
+// installCaptureHookLocked installs the engine's capture hook for the debug
+// sink and capture ring, whichever are running.
+//
+// b.mu must be held.
+func (b *LocalBackend) installCaptureHookLocked() {
+	sink, ring := b.debugSink, b.captureRing
+	switch {
+	case sink == nil && ring == nil:
+		b.e.InstallCaptureHook(nil)
+	case ring == nil:
+		b.e.InstallCaptureHook(sink.LogPacket)
+	case sink == nil:
+		b.e.InstallCaptureHook(ring.LogPacket)
+	default:
+		b.e.InstallCaptureHook(func(path capture.Path, when time.Time, data []byte, meta packet.CaptureMeta) {
+			sink.LogPacket(path, when, data, meta)
+			ring.LogPacket(path, when, data, meta)
+		})
+	}
+}
+
+// StartCaptureRing starts keeping the most recent packets traversing
+// tailscaled in memory, as configured by cfg, replacing any packets kept
+// before.
+//
+// If healthDump is non-zero, the packets captured in the last healthDump are
+// written to a pcapng file in the captures directory of the state directory
+// whenever a health warning is raised.
+func (b *LocalBackend) StartCaptureRing(cfg capture.RingConfig, healthDump time.Duration) error {
+	if cfg.MaxBytes < 0 || cfg.MaxBytes > capture.MaxRingBytes {
+		return fmt.Errorf("capture ring size %d out of range; want at most %d bytes", cfg.MaxBytes, capture.MaxRingBytes)
+	}
+	if healthDump > 0 && b.TailscaleVarRoot() == "" {
+		return errors.New("no state directory to write health warning captures to")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.captureRing = capture.NewRing(cfg)
+	b.captureRingHealthDump = healthDump
+	b.installCaptureHookLocked()
+	b.logf("capture ring: started; max %d bytes, max age %v, filter %q, health dump %v", b.captureRing.Config().MaxBytes, cfg.MaxAge, cfg.Filter, healthDump)
+	return nil
+}
+
+// StopCaptureRing stops the capture ring started by StartCaptureRing and
+// discards its packets.
+func (b *LocalBackend) StopCaptureRing() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.captureRing == nil {
+		return
+	}
+	b.captureRing = nil
+	b.captureRingHealthDump = 0
+	b.installCaptureHookLocked()
+	b.logf("capture ring: stopped")
+}
+
+// WriteCaptureRing writes the packets that the capture ring captured in the
+// last d, or all of them if d is zero, to w as a pcapng file.
+func (b *LocalBackend) WriteCaptureRing(w io.Writer, d time.Duration) error {
+	b.mu.Lock()
+	ring := b.captureRing
+	b.mu.Unlock()
+	if ring == nil {
+		return ErrCaptureRingNotRunning
+	}
+	var since time.Time
+	if d > 0 {
+		since = b.clock.Now().Add(-d)
+	}
+	return ring.WritePcapng(w, since)
+}
+
+// maybeDumpCaptureRing writes the recent packets of the capture ring to a
+// file, if it's configured to do so on health warnings and hasn't done so
+// recently. code is the health warning that triggered it.
+func (b *LocalBackend) maybeDumpCaptureRing(code health.WarnableCode) {
+	b.mu.Lock()
+	ring, d := b.captureRing, b.captureRingHealthDump
+	now := b.clock.Now()
+	if ring == nil || d == 0 || now.Sub(b.lastCaptureRingDump) < captureRingDumpInterval {
+		b.mu.Unlock()
+		return
+	}
+	b.lastCaptureRingDump = now
+	b.mu.Unlock()
+
+	go func() {
+		name, err := b.dumpCaptureRing(ring, now, d, code)
+		if err != nil {
+			b.logf("capture ring: dumping on health warning %q: %v", code, err)
+			return
+		}
+		b.logf("capture ring: health warning %q; wrote last %v of packets to %s", code, d, name)
+	}()
+}
+
+func (b *LocalBackend) dumpCaptureRing(ring *capture.Ring, now time.Time, d time.Duration, code health.WarnableCode) (string, error) {
+	dir := filepath.Join(b.TailscaleVarRoot(), "captures")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("capture-%s-%s.pcapng", now.UTC().Format("20060102T150405Z"), code))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = ring.WritePcapng(f, now.Add(-d))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+
+	// Keep only the most recent dumps. Their names sort by time.
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return name, nil
+	}
+	var dumps []string
+	for _, e := range ents {
+		if n := e.Name(); strings.HasPrefix(n, "capture-") && strings.HasSuffix(n, ".pcapng") {
+			dumps = append(dumps, n)
+		}
+	}
+	slices.Sort(dumps)
+	for len(dumps) > maxCaptureRingDumps {
+		os.Remove(filepath.Join(dir, dumps[0]))
+		dumps = dumps[1:]
+	}
+	return name, nil
+}
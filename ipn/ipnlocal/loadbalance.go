@@ -0,0 +1,330 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// defaultHealthCheckInterval is the time between health checks of a
+	// load balancer backend if ipn.HealthCheck.IntervalSeconds is unset.
+	defaultHealthCheckInterval = 10 * time.Second
+
+	// healthCheckTimeout is how long a single health check may take.
+	healthCheckTimeout = 5 * time.Second
+
+	// unhealthyThreshold is the number of consecutive failed health checks
+	// after which a backend is ejected.
+	unhealthyThreshold = 2
+)
+
+// backendPool balances connections or requests across the backends of an
+// ipn.LoadBalancer, ejecting the backends that fail active health checks.
+type backendPool struct {
+	logf     logger.Logf
+	policy   ipn.LBPolicy
+	backends []*poolBackend
+	next     atomic.Uint32 // round-robin position
+
+	cancel context.CancelFunc // stops the health checks
+}
+
+// poolBackend is a backend of a backendPool.
+type poolBackend struct {
+	addr     string       // as in ipn.LoadBalancer.Backends
+	inFlight atomic.Int64 // connections or requests in flight
+	healthy  atomic.Bool
+}
+
+// newBackendPool returns a new pool for lb and starts health checking its
+// backends with check, which reports an error if the backend at addr is
+// unhealthy. The pool must be closed when no longer needed.
+func newBackendPool(logf logger.Logf, lb ipn.LoadBalancerView, check func(ctx context.Context, addr string) error) *backendPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &backendPool{
+		logf:   logf,
+		policy: lb.Policy(),
+		cancel: cancel,
+	}
+	interval := defaultHealthCheckInterval
+	if hc := lb.HealthCheck(); hc != nil && hc.IntervalSeconds > 0 {
+		interval = time.Duration(hc.IntervalSeconds) * time.Second
+	}
+	for i := range lb.Backends().Len() {
+		be := &poolBackend{addr: lb.Backends().At(i)}
+		be.healthy.Store(true)
+		p.backends = append(p.backends, be)
+		go p.healthCheckLoop(ctx, be, interval, check)
+	}
+	return p
+}
+
+// close stops the health checks of p.
+func (p *backendPool) close() {
+	p.cancel()
+}
+
+// healthCheckLoop checks be right away and then every interval until ctx is
+// done, ejecting it after unhealthyThreshold consecutive failures and
+// restoring it after a success.
+func (p *backendPool) healthCheckLoop(ctx context.Context, be *poolBackend, interval time.Duration, check func(ctx context.Context, addr string) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	fails := 0
+	for {
+		cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := check(cctx, be.addr)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			fails = 0
+			if !be.healthy.Swap(true) {
+				p.logf("serve: load balancer backend %s is healthy again", be.addr)
+			}
+		} else {
+			fails++
+			if fails >= unhealthyThreshold && be.healthy.Swap(false) {
+				p.logf("serve: ejecting load balancer backend %s: %v", be.addr, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// errNoBackends is returned by backendPool.acquire for a pool without
+// backends, which ipn.CheckLoadBalancer rejects.
+var errNoBackends = errors.New("load balancer has no backends")
+
+// acquire picks a backend for a connection or request from client according
+// to the pool's policy. If every backend is ejected, all are considered, so
+// that a broken health check doesn't take the service down. The returned
+// release func must be called when the connection or request is done.
+func (p *backendPool) acquire(client netip.Addr) (be *poolBackend, release func(), err error) {
+	if len(p.backends) == 0 {
+		return nil, nil, errNoBackends
+	}
+	candidates := make([]*poolBackend, 0, len(p.backends))
+	for _, be := range p.backends {
+		if be.healthy.Load() {
+			candidates = append(candidates, be)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+
+	switch p.policy {
+	case ipn.LBPolicyLeastConns:
+		// Start from the round-robin position so that ties are spread out.
+		start := int(p.next.Add(1) % uint32(len(candidates)))
+		for i := range candidates {
+			c := candidates[(start+i)%len(candidates)]
+			if be == nil || c.inFlight.Load() < be.inFlight.Load() {
+				be = c
+			}
+		}
+	case ipn.LBPolicyHash:
+		// Rendezvous hashing, so that ejecting a backend only moves the
+		// clients that were using it.
+		var best uint64
+		for _, c := range candidates {
+			if w := hashBackend(c.addr, client); be == nil || w > best {
+				be, best = c, w
+			}
+		}
+	default:
+		be = candidates[(p.next.Add(1)-1)%uint32(len(candidates))]
+	}
+	be.inFlight.Add(1)
+	return be, func() { be.inFlight.Add(-1) }, nil
+}
+
+// checkServeLoadBalancers reports an error if any LoadBalancer in sc, or in
+// its foreground configs, is invalid according to ipn.CheckLoadBalancer.
+func checkServeLoadBalancers(sc *ipn.ServeConfig) error {
+	if sc == nil {
+		return nil
+	}
+	for port, h := range sc.TCP {
+		if h != nil && h.LoadBalancer != nil {
+			if err := ipn.CheckLoadBalancer(h.LoadBalancer); err != nil {
+				return fmt.Errorf("TCP port %d: %w", port, err)
+			}
+		}
+	}
+	for hp, conf := range sc.Web {
+		if conf == nil {
+			continue
+		}
+		for mount, h := range conf.Handlers {
+			if h != nil && h.LoadBalancer != nil {
+				if err := ipn.CheckLoadBalancer(h.LoadBalancer); err != nil {
+					return fmt.Errorf("%s%s: %w", hp, mount, err)
+				}
+			}
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if err := checkServeLoadBalancers(fg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashBackend returns the rendezvous hashing weight of the backend at addr
+// for client.
+func hashBackend(addr string, client netip.Addr) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	b, _ := client.MarshalBinary()
+	h.Write(b)
+	var sum [8]byte
+	return binary.BigEndian.Uint64(h.Sum(sum[:0]))
+}
+
+// backendPoolKey returns the key of the pool for lb in
+// LocalBackend.serveBackendPools. HTTP and TCP pools are kept apart, as
+// their backends are health checked differently.
+func backendPoolKey(kind string, lb ipn.LoadBalancerView) string {
+	j, _ := lb.MarshalJSON()
+	return kind + ":" + string(j)
+}
+
+// setServeBackendPoolsLocked ensures there is a backendPool for each
+// LoadBalancer in serveConfig, and closes the pools no longer in use. It
+// expects serveConfig to be up-to-date, so should be called after
+// reloadServeConfigLocked.
+//
+// b.mu must be held.
+func (b *LocalBackend) setServeBackendPoolsLocked() {
+	keep := map[string]bool{}
+	ensure := func(kind string, lb ipn.LoadBalancerView, check func(context.Context, string) error) {
+		key := backendPoolKey(kind, lb)
+		keep[key] = true
+		if _, ok := b.serveBackendPools.Load(key); ok {
+			return
+		}
+		b.serveBackendPools.Store(key, newBackendPool(b.logf, lb, check))
+	}
+	if b.serveConfig.Valid() {
+		b.serveConfig.RangeOverTCPs(func(_ uint16, h ipn.TCPPortHandlerView) bool {
+			if lb := h.LoadBalancer(); lb.Valid() {
+				ensure("tcp", lb, b.checkTCPBackend)
+			}
+			return true
+		})
+		b.serveConfig.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) bool {
+			conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) bool {
+				if lb := h.LoadBalancer(); lb.Valid() {
+					path := ""
+					if hc := lb.HealthCheck(); hc != nil {
+						path = hc.Path
+					}
+					ensure("http", lb, func(ctx context.Context, backend string) error {
+						return b.checkHTTPBackend(ctx, backend, path)
+					})
+				}
+				return true
+			})
+			return true
+		})
+	}
+	b.closeServeBackendPools(func(key string) bool { return !keep[key] })
+}
+
+// closeServeBackendPools closes and forgets the backend pools whose keys
+// match.
+func (b *LocalBackend) closeServeBackendPools(match func(key string) bool) {
+	b.serveBackendPools.Range(func(key, value any) bool {
+		if match(key.(string)) {
+			b.serveBackendPools.Delete(key)
+			value.(*backendPool).close()
+		}
+		return true
+	})
+}
+
+// serveBackendPool returns the pool created by setServeBackendPoolsLocked
+// for lb.
+func (b *LocalBackend) serveBackendPool(kind string, lb ipn.LoadBalancerView) (*backendPool, bool) {
+	p, ok := b.serveBackendPools.Load(backendPoolKey(kind, lb))
+	if !ok {
+		return nil, false
+	}
+	return p.(*backendPool), true
+}
+
+// checkTCPBackend is a health check reporting whether the TCP backend at
+// addr (an ipn.TCPPortHandler.TCPForward value) accepts connections.
+func (b *LocalBackend) checkTCPBackend(ctx context.Context, addr string) error {
+	c, err := b.dialer.SystemDial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// checkHTTPBackend is a health check for the HTTP backend (an
+// ipn.HTTPHandler.Proxy value). If path is empty, it reports whether the
+// backend accepts connections. Otherwise it requests path from the backend,
+// which must not reply with a 5xx status.
+func (b *LocalBackend) checkHTTPBackend(ctx context.Context, backend, path string) error {
+	targetURL, insecure := expandProxyArg(backend)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		return b.checkTCPBackend(ctx, host)
+	}
+	u.Path, u.RawPath, u.RawQuery = path, "", ""
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{
+		DialContext:     b.dialer.SystemDial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}
+	defer tr.CloseIdleConnections()
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("health check status %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+func newTestBackendPool(t *testing.T, policy ipn.LBPolicy, backends ...string) *backendPool {
+	lb := &ipn.LoadBalancer{Backends: backends, Policy: policy}
+	p := newBackendPool(logger.Discard, lb.View(), func(context.Context, string) error { return nil })
+	t.Cleanup(p.close)
+	return p
+}
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	p := newTestBackendPool(t, ipn.LBPolicyRoundRobin, "a", "b", "c")
+	var got []string
+	for range 4 {
+		be, release, _ := p.acquire(netip.Addr{})
+		release()
+		got = append(got, be.addr)
+	}
+	if want := []string{"a", "b", "c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// Ejected backends are skipped.
+	p.backends[1].healthy.Store(false)
+	for range 4 {
+		be, release, _ := p.acquire(netip.Addr{})
+		release()
+		if be.addr == "b" {
+			t.Fatal("picked ejected backend")
+		}
+	}
+
+	// But if all are ejected, all are used.
+	for _, be := range p.backends {
+		be.healthy.Store(false)
+	}
+	if be, release, _ := p.acquire(netip.Addr{}); be == nil {
+		t.Fatal("no backend picked")
+	} else {
+		release()
+	}
+}
+
+func TestBackendPoolLeastConns(t *testing.T) {
+	p := newTestBackendPool(t, ipn.LBPolicyLeastConns, "a", "b")
+	be1, release1, _ := p.acquire(netip.Addr{})
+	be2, release2, _ := p.acquire(netip.Addr{})
+	if be1 == be2 {
+		t.Fatalf("both requests went to %s", be1.addr)
+	}
+	release2()
+	be3, release3, _ := p.acquire(netip.Addr{})
+	defer release3()
+	if be3 != be2 {
+		t.Errorf("got %s; want idle backend %s", be3.addr, be2.addr)
+	}
+	release1()
+	if n := be1.inFlight.Load(); n != 0 {
+		t.Errorf("in flight after release = %d; want 0", n)
+	}
+}
+
+func TestBackendPoolHash(t *testing.T) {
+	p := newTestBackendPool(t, ipn.LBPolicyHash, "a", "b", "c", "d")
+	pick := func(client netip.Addr) *poolBackend {
+		be, release, _ := p.acquire(client)
+		release()
+		return be
+	}
+	clients := []netip.Addr{
+		netip.MustParseAddr("100.64.0.1"),
+		netip.MustParseAddr("100.64.0.2"),
+		netip.MustParseAddr("100.64.0.3"),
+		netip.MustParseAddr("100.64.0.4"),
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	}
+	before := map[netip.Addr]*poolBackend{}
+	for _, c := range clients {
+		before[c] = pick(c)
+		if again := pick(c); again != before[c] {
+			t.Errorf("client %v moved from %s to %s", c, before[c].addr, again.addr)
+		}
+	}
+
+	// Ejecting a backend only moves the clients that were using it.
+	ejected := before[clients[0]]
+	ejected.healthy.Store(false)
+	for _, c := range clients {
+		got := pick(c)
+		if got == ejected {
+			t.Errorf("client %v picked ejected backend %s", c, got.addr)
+		}
+		if before[c] != ejected && got != before[c] {
+			t.Errorf("client %v moved from %s to %s", c, before[c].addr, got.addr)
+		}
+	}
+}
+
+func TestBackendPoolChecksImmediately(t *testing.T) {
+	checked := make(chan string, 1)
+	lb := &ipn.LoadBalancer{Backends: []string{"a"}, HealthCheck: &ipn.HealthCheck{IntervalSeconds: 3600}}
+	p := newBackendPool(logger.Discard, lb.View(), func(_ context.Context, addr string) error {
+		select {
+		case checked <- addr:
+		default:
+		}
+		return nil
+	})
+	defer p.close()
+	select {
+	case addr := <-checked:
+		if addr != "a" {
+			t.Errorf("checked %q; want a", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend not checked before the first interval")
+	}
+}
+
+func TestBackendPoolEmpty(t *testing.T) {
+	for _, policy := range []ipn.LBPolicy{ipn.LBPolicyRoundRobin, ipn.LBPolicyLeastConns, ipn.LBPolicyHash} {
+		p := newTestBackendPool(t, policy)
+		if be, _, err := p.acquire(netip.Addr{}); err == nil {
+			t.Errorf("%s: acquire from empty pool = %v; want error", policy, be.addr)
+		}
+	}
+}
+
+func TestCheckServeLoadBalancers(t *testing.T) {
+	empty := &ipn.LoadBalancer{Backends: []string{}}
+	ok := &ipn.LoadBalancer{Backends: []string{"127.0.0.1:3000"}}
+	tests := []struct {
+		name    string
+		sc      *ipn.ServeConfig
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"tcp", &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {LoadBalancer: ok}}}, false},
+		{"tcp-empty", &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {LoadBalancer: empty}}}, true},
+		{"web-empty", &ipn.ServeConfig{Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": {LoadBalancer: empty}}},
+		}}, true},
+		{"foreground-empty", &ipn.ServeConfig{Foreground: map[string]*ipn.ServeConfig{
+			"sess": {TCP: map[uint16]*ipn.TCPPortHandler{443: {LoadBalancer: empty}}},
+		}}, true},
+	}
+	for _, tt := range tests {
+		if err := checkServeLoadBalancers(tt.sc); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkServeLoadBalancers = %v; want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -70,6 +70,7 @@
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tstun"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/syncs"
@@ -174,6 +175,7 @@ type LocalBackend struct {
 	logf                  logger.Logf        // general logging
 	keyLogf               logger.Logf        // for printing list of peers on change
 	statsLogf             logger.Logf        // for printing peers stats on change
+	serveDropLogf         logger.Logf        // rate-limited, for serve UDP flows rejected by AllowFrom
 	sys                   *tsd.System
 	health                *health.Tracker // always non-nil
 	e                     wgengine.Engine // non-nil; TODO(bradfitz): remove; use sys
@@ -198,6 +200,9 @@ type LocalBackend struct {
 	exposeRemoteWebClientAtomicBool atomic.Bool
 	shutdownCalled                  bool // if Shutdown has been called
 	debugSink                       *capture.Sink
+	captureRing                     *capture.Ring // or nil if not running
+	captureRingHealthDump           time.Duration // how much of captureRing to dump on health warnings, or 0
+	lastCaptureRingDump             time.Time
 	sockstatLogger                  *sockstatlog.Logger
 
 	// getTCPHandlerForFunnelFlow returns a handler for an incoming TCP flow for
@@ -219,6 +224,7 @@ type LocalBackend struct {
 	filterAtomic                 atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic      syncs.AtomicValue[func(netip.Addr) bool]
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
+	shouldInterceptUDPPortAtomic syncs.AtomicValue[func(uint16) bool]
 	numClientStatusCalls         atomic.Uint32
 
 	// The mutex protects the following elements.
@@ -300,14 +306,16 @@ type LocalBackend struct {
 	offlineAutoUpdateCancel func()
 
 	// ServeConfig fields. (also guarded by mu)
-	lastServeConfJSON mem.RO              // last JSON that was parsed into serveConfig
-	serveConfig       ipn.ServeConfigView // or !Valid if none
+	lastServeConfJSON mem.RO                 // last JSON that was parsed into serveConfig
+	serveConfig       ipn.ServeConfigView    // or !Valid if none
+	serveExpiryTimer  tstime.TimerController // for removing expired serve handlers; can be nil
 
 	webClient          webClient
 	webClientListeners map[netip.AddrPort]*localListener // listeners for local web client traffic
 
 	serveListeners     map[netip.AddrPort]*localListener // listeners for local serve traffic
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *reverseProxy
+	serveBackendPools  sync.Map                          // string (backendPoolKey) => *backendPool
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -415,6 +423,7 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 		logf:                logf,
 		keyLogf:             logger.LogOnChange(logf, 5*time.Minute, clock.Now),
 		statsLogf:           logger.LogOnChange(logf, 5*time.Minute, clock.Now),
+		serveDropLogf:       logger.RateLimitedFnWithClock(logf, time.Minute, 5, 10, clock.Now),
 		sys:                 sys,
 		health:              sys.HealthTracker(),
 		conf:                sys.InitialConfig,
@@ -450,6 +459,7 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	b.e.SetJailedFilter(noneFilter)
 
 	b.setTCPPortsIntercepted(nil)
+	b.setUDPPortsIntercepted(nil)
 
 	b.statusChanged = sync.NewCond(&b.statusLock)
 	b.e.SetStatusCallback(b.setWgengineStatus)
@@ -681,6 +691,10 @@ func (b *LocalBackend) onHealthChange(w *health.Warnable, us *health.UnhealthySt
 		b.logf("health(warnable=%s): error: %s", w.Code, us.Text)
 	}
 
+	if us != nil {
+		b.maybeDumpCaptureRing(w.Code)
+	}
+
 	// Whenever health changes, send the current health state to the frontend.
 	state := b.health.CurrentState()
 	b.send(ipn.Notify{
@@ -726,6 +740,8 @@ func (b *LocalBackend) Shutdown() {
 	if b.notifyCancel != nil {
 		b.notifyCancel()
 	}
+	b.stopServeExpiryTimerLocked()
+	b.closeServeBackendPools(func(string) bool { return true })
 	b.mu.Unlock()
 	b.webClientShutdown()
 
@@ -2357,7 +2373,7 @@ func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWa
 
 	b.mu.Lock()
 
-	const initialBits = ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialNetMap | ipn.NotifyInitialDriveShares
+	const initialBits = ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialNetMap | ipn.NotifyInitialDriveShares | ipn.NotifyInitialServeConfig
 	if mask&initialBits != 0 {
 		ini = &ipn.Notify{Version: version.Long()}
 		if mask&ipn.NotifyInitialState != 0 {
@@ -2379,6 +2395,9 @@ func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWa
 		if mask&ipn.NotifyInitialHealthState != 0 {
 			ini.Health = b.HealthTracker().CurrentState()
 		}
+		if mask&ipn.NotifyInitialServeConfig != 0 {
+			ini.ServeConfig = b.serveConfigForNotifyLocked()
+		}
 	}
 
 	mak.Set(&b.notifyWatchers, sessionID, &watchSession{ch, sessionID})
@@ -2776,6 +2795,19 @@ func (b *LocalBackend) clearMachineKeyLocked() error {
 // efficient func for ShouldInterceptTCPPort to use, which is called on every
 // incoming packet.
 func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptTCPPortAtomic.Store(portSetFunc(ports))
+}
+
+// setUDPPortsIntercepted populates b.shouldInterceptUDPPortAtomic with an
+// efficient func for ShouldInterceptUDPPort to use, which is called on every
+// incoming packet.
+func (b *LocalBackend) setUDPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptUDPPortAtomic.Store(portSetFunc(ports))
+}
+
+// portSetFunc returns an efficient func reporting whether a port is one of
+// ports. It sorts and dedups ports in place.
+func portSetFunc(ports []uint16) func(uint16) bool {
 	slices.Sort(ports)
 	uniq.ModifySlice(&ports)
 	var f func(uint16) bool
@@ -2806,11 +2838,12 @@ func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
 			}
 		}
 	}
-	b.shouldInterceptTCPPortAtomic.Store(f)
+	return f
 }
 
 // setAtomicValuesFromPrefsLocked populates sshAtomicBool, containsViaIPFuncAtomic,
-// shouldInterceptTCPPortAtomic, and exposeRemoteWebClientAtomicBool from the prefs p,
+// shouldInterceptTCPPortAtomic, shouldInterceptUDPPortAtomic, and
+// exposeRemoteWebClientAtomicBool from the prefs p,
 // which may be !Valid().
 func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	b.sshAtomicBool.Store(p.Valid() && p.RunSSH() && envknob.CanSSHD())
@@ -2819,6 +2852,7 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(ipset.FalseContainsIPFunc())
 		b.setTCPPortsIntercepted(nil)
+		b.setUDPPortsIntercepted(nil)
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
 	} else {
@@ -3781,6 +3815,10 @@ func (b *LocalBackend) authReconfig() {
 		b.dialer.SetExitDNSDoH("")
 	}
 
+	if tunWrap, ok := b.sys.Tun.GetOK(); ok {
+		tunWrap.SetShaper(shaperConfigForNetmap(nm, b.logf))
+	}
+
 	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID())
 	if err != nil {
 		b.logf("wgcfg: %v", err)
@@ -3805,6 +3843,35 @@ func (b *LocalBackend) authReconfig() {
 	b.initPeerAPIListener()
 }
 
+// shaperConfigForNetmap returns the traffic shaper configuration from the
+// NodeAttrTrafficShaping values of the self node in nm, or nil if it has none.
+func shaperConfigForNetmap(nm *netmap.NetworkMap, logf logger.Logf) *tstun.ShaperConfig {
+	if nm == nil || !nm.SelfNode.Valid() || !nm.SelfNode.HasCap(tailcfg.NodeAttrTrafficShaping) {
+		return nil
+	}
+	cfgs, err := tailcfg.UnmarshalNodeCapJSON[tstun.ShaperConfig](nm.SelfNode.CapMap().AsMap(), tailcfg.NodeAttrTrafficShaping)
+	if err != nil {
+		logf("[unexpected] error parsing traffic shaping nodeattr: %v", err)
+		return nil
+	}
+	var ret tstun.ShaperConfig
+	for _, c := range cfgs {
+		for _, r := range c.Rules {
+			if err := r.Check(); err != nil {
+				logf("traffic shaping: ignoring invalid rule: %v", err)
+				continue
+			}
+			ret.Rules = append(ret.Rules, r)
+		}
+		if c.QueueLen < 0 {
+			logf("traffic shaping: ignoring negative queue length %d", c.QueueLen)
+		} else {
+			ret.QueueLen = cmp.Or(ret.QueueLen, c.QueueLen)
+		}
+	}
+	return &ret
+}
+
 // shouldUseOneCGNATRoute reports whether we should prefer to make one big
 // CGNAT /10 route rather than a /32 per peer.
 //
@@ -5244,12 +5311,14 @@ func (b *LocalBackend) reloadServeConfigLocked(prefs ipn.PrefsView) {
 	b.serveConfig = conf.View()
 }
 
-// setTCPPortsInterceptedFromNetmapAndPrefsLocked calls setTCPPortsIntercepted with
-// the ports that tailscaled should handle as a function of b.netMap and b.prefs.
+// setTCPPortsInterceptedFromNetmapAndPrefsLocked calls setTCPPortsIntercepted
+// and setUDPPortsIntercepted with the ports that tailscaled should handle as a
+// function of b.netMap and b.prefs.
 //
 // b.mu must be held.
 func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.PrefsView) {
 	handlePorts := make([]uint16, 0, 4)
+	var udpPorts []uint16
 
 	if prefs.Valid() && prefs.RunSSH() && envknob.CanSSHD() {
 		handlePorts = append(handlePorts, 22)
@@ -5264,6 +5333,8 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.reloadServeConfigLocked(prefs)
+	b.updateServeExpiryTimerLocked()
+	b.setServeBackendPoolsLocked()
 	if b.serveConfig.Valid() {
 		servePorts := make([]uint16, 0, 3)
 		b.serveConfig.RangeOverTCPs(func(port uint16, _ ipn.TCPPortHandlerView) bool {
@@ -5273,6 +5344,12 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 			return true
 		})
 		handlePorts = append(handlePorts, servePorts...)
+		b.serveConfig.RangeOverUDPs(func(port uint16, _ ipn.UDPPortHandlerView) bool {
+			if port > 0 {
+				udpPorts = append(udpPorts, port)
+			}
+			return true
+		})
 
 		b.setServeProxyHandlersLocked()
 
@@ -5289,6 +5366,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.setTCPPortsIntercepted(handlePorts)
+	b.setUDPPortsIntercepted(udpPorts)
 }
 
 // setServeProxyHandlersLocked ensures there is an http proxy handler for each
@@ -5301,25 +5379,23 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	var backends map[string]bool
 	b.serveConfig.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
 		conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
-			backend := h.Proxy()
-			if backend == "" {
-				// Only create proxy handlers for servers with a proxy backend.
-				return true
-			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				return true
-			}
+			// Only create proxy handlers for servers with proxy backends.
+			for _, backend := range proxyBackends(h) {
+				mak.Set(&backends, backend, true)
+				if _, ok := b.serveProxyHandlers.Load(backend); ok {
+					continue
+				}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
-				return true
+				b.logf("serve: creating a new proxy handler for %s", backend)
+				p, err := b.proxyHandlerForBackend(backend)
+				if err != nil {
+					// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
+					// in the CLI, so just log the error here.
+					b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					continue
+				}
+				b.serveProxyHandlers.Store(backend, p)
 			}
-			b.serveProxyHandlers.Store(backend, p)
 			return true
 		})
 		return true
@@ -6111,6 +6187,13 @@ func (b *LocalBackend) ShouldInterceptTCPPort(port uint16) bool {
 	return b.shouldInterceptTCPPortAtomic.Load()(port)
 }
 
+// ShouldInterceptUDPPort reports whether the given UDP port number to a
+// Tailscale IP (not a subnet router, service IP, etc) should be intercepted by
+// Tailscaled and handled in-process.
+func (b *LocalBackend) ShouldInterceptUDPPort(port uint16) bool {
+	return b.shouldInterceptUDPPortAtomic.Load()(port)
+}
+
 // SwitchProfile switches to the profile with the given id.
 // It will restart the backend on success.
 // If the profile is not known, it returns an errProfileNotFound.
@@ -6290,22 +6373,22 @@ func (b *LocalBackend) ResetAuth() error {
 	return b.resetForProfileChangeLockedOnEntry(unlock)
 }
 
-// StreamDebugCapture writes a pcap stream of packets traversing
-// tailscaled to the provided response writer.
-func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
+// StreamDebugCapture writes a stream of packets traversing tailscaled,
+// in the given format, to the provided response writer.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer, format capture.Format) error {
 	var s *capture.Sink
 
 	b.mu.Lock()
 	if b.debugSink == nil {
 		s = capture.New()
 		b.debugSink = s
-		b.e.InstallCaptureHook(s.LogPacket)
+		b.installCaptureHookLocked()
 	} else {
 		s = b.debugSink
 	}
 	b.mu.Unlock()
 
-	unregister := s.RegisterOutput(w)
+	unregister := s.RegisterOutputFormat(w, format)
 
 	select {
 	case <-ctx.Done():
@@ -6325,8 +6408,8 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	}
 	if b.debugSink != nil && b.debugSink.NumOutputs() == 0 {
 		s := b.debugSink
-		b.e.InstallCaptureHook(nil)
 		b.debugSink = nil
+		b.installCaptureHookLocked()
 		return s.Close()
 	}
 	return nil
@@ -36,6 +36,7 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/tstest"
@@ -3998,3 +3999,50 @@ func TestFillAllowedSuggestions(t *testing.T) {
 		})
 	}
 }
+
+func TestShaperConfigForNetmap(t *testing.T) {
+	rule := func(rate int64) string {
+		return fmt.Sprintf(`{"rules":[{"dst":["100.64.0.0/10"],"rate":%d}],"queueLen":%d}`, rate, rate/1000)
+	}
+	nm := func(vals ...string) *netmap.NetworkMap {
+		var raw []tailcfg.RawMessage
+		for _, v := range vals {
+			raw = append(raw, tailcfg.RawMessage(v))
+		}
+		return &netmap.NetworkMap{
+			SelfNode: (&tailcfg.Node{
+				CapMap: tailcfg.NodeCapMap{tailcfg.NodeAttrTrafficShaping: raw},
+			}).View(),
+		}
+	}
+	pfx := []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")}
+
+	tests := []struct {
+		name string
+		nm   *netmap.NetworkMap
+		want *tstun.ShaperConfig
+	}{
+		{"nil", nil, nil},
+		{"no-attr", &netmap.NetworkMap{SelfNode: (&tailcfg.Node{}).View()}, nil},
+		{"invalid", nm(`{"rules":1}`), nil},
+		{"one", nm(rule(1000)), &tstun.ShaperConfig{
+			Rules:    []tstun.ShaperRule{{Dst: pfx, Rate: 1000}},
+			QueueLen: 1,
+		}},
+		{"merged", nm(rule(1000), rule(2000)), &tstun.ShaperConfig{
+			Rules:    []tstun.ShaperRule{{Dst: pfx, Rate: 1000}, {Dst: pfx, Rate: 2000}},
+			QueueLen: 1,
+		}},
+		{"bad-rules-ignored", nm(`{"rules":[{"rate":-1},{"burst":-5},{"ports":[{"first":90,"last":80}]},{"priority":"urgent"},{"dst":["100.64.0.0/10"],"rate":1000}],"queueLen":-3}`), &tstun.ShaperConfig{
+			Rules: []tstun.ShaperRule{{Dst: pfx, Rate: 1000}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shaperConfigForNetmap(tt.nm, t.Logf)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -36,6 +36,8 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
+	"tailscale.com/types/views"
 	"tailscale.com/util/ctxkey"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
@@ -265,6 +267,9 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 	if b.isConfigLocked_Locked() {
 		return errors.New("can't reconfigure tailscaled when using a config file; config file is locked")
 	}
+	if err := checkServeLoadBalancers(config); err != nil {
+		return err
+	}
 
 	nm := b.netMap
 	if nm == nil {
@@ -310,6 +315,10 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 
 	b.setTCPPortsInterceptedFromNetmapAndPrefsLocked(b.pm.CurrentPrefs())
 
+	// Notify watchers before closing the channels of replaced foreground
+	// sessions below, as sending on a closed channel panics.
+	b.sendLocked(ipn.Notify{ServeConfig: b.serveConfigForNotifyLocked()})
+
 	// clean up and close all previously open foreground sessions
 	// if the current ServeConfig has overwritten them.
 	if prevConfig.Valid() {
@@ -328,10 +337,75 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 			return true
 		})
 	}
-
 	return nil
 }
 
+// serveConfigForNotifyLocked returns the current serve config for use in an
+// ipn.Notify. If serving is not configured, it returns an empty config.
+//
+// b.mu must be held.
+func (b *LocalBackend) serveConfigForNotifyLocked() *ipn.ServeConfigView {
+	if !b.serveConfig.Valid() {
+		return ptr.To(new(ipn.ServeConfig).View())
+	}
+	return ptr.To(b.serveConfig)
+}
+
+// updateServeExpiryTimerLocked (re)starts the timer that removes expired
+// handlers from the serve config, or stops it if no handler expires. It
+// expects serveConfig to be up-to-date, so should be called after
+// reloadServeConfigLocked.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateServeExpiryTimerLocked() {
+	b.stopServeExpiryTimerLocked()
+	if !b.serveConfig.Valid() {
+		return
+	}
+	next, ok := b.serveConfig.NextExpiry()
+	if !ok {
+		return
+	}
+	d := max(next.Sub(b.clock.Now()), 0)
+	b.serveExpiryTimer = b.clock.AfterFunc(d, func() {
+		// Not inline: removing the handlers re-arms this timer, and
+		// simulated clocks such as tstest.Clock run timer funcs with
+		// their own lock held.
+		go b.removeExpiredServeHandlers()
+	})
+}
+
+// stopServeExpiryTimerLocked stops the timer started by
+// updateServeExpiryTimerLocked, if any.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopServeExpiryTimerLocked() {
+	if b.serveExpiryTimer != nil {
+		b.serveExpiryTimer.Stop()
+		b.serveExpiryTimer = nil
+	}
+}
+
+// removeExpiredServeHandlers removes the handlers that have expired from the
+// serve config, saves it and notifies IPN bus watchers of the change.
+func (b *LocalBackend) removeExpiredServeHandlers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shutdownCalled || !b.serveConfig.Valid() {
+		return
+	}
+	sc := b.serveConfig.AsStruct()
+	if !sc.RemoveExpired(b.clock.Now()) {
+		// Raced with a config change; wait for the next expiry, if any.
+		b.updateServeExpiryTimerLocked()
+		return
+	}
+	b.logf("serve: removing expired handlers")
+	if err := b.setServeConfigLocked(sc, ""); err != nil {
+		b.logf("serve: removing expired handlers: %v", err)
+	}
+}
+
 // ServeConfig provides a view of the current serve mappings.
 // If serving is not configured, the returned view is not Valid.
 func (b *LocalBackend) ServeConfig() ipn.ServeConfigView {
@@ -439,6 +513,14 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 		return nil
 	}
 
+	if !b.serveAccessAllowed(srcAddr, tcph.AllowFrom()) {
+		return func(c net.Conn) error {
+			b.logf("localbackend: rejecting serve conn to port %v from %v: not in AllowFrom", dport, srcAddr)
+			resetConn(c)
+			return nil
+		}
+	}
+
 	if tcph.HTTPS() || tcph.HTTP() {
 		hs := &http.Server{
 			Handler: http.HandlerFunc(b.serveWebHandler),
@@ -463,9 +545,28 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 		}
 	}
 
-	if backDst := tcph.TCPForward(); backDst != "" {
+	backDst := tcph.TCPForward()
+	var pool *backendPool
+	if lb := tcph.LoadBalancer(); lb.Valid() {
+		var ok bool
+		if pool, ok = b.serveBackendPool("tcp", lb); !ok {
+			b.logf("[unexpected] localbackend: no backend pool for port %v", dport)
+			return nil
+		}
+	}
+	if backDst != "" || pool != nil {
 		return func(conn net.Conn) error {
 			defer conn.Close()
+			backDst := backDst
+			if pool != nil {
+				be, release, err := pool.acquire(srcAddr.Addr())
+				if err != nil {
+					b.logf("localbackend: failed to TCP proxy port %v (from %v): %v", dport, srcAddr, err)
+					return nil
+				}
+				defer release()
+				backDst = be.addr
+			}
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
 			cancel()
@@ -510,6 +611,89 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 	return nil
 }
 
+// defaultServeUDPIdleTimeout is how long a served UDP flow is kept without
+// traffic if ipn.UDPPortHandler.IdleTimeoutSeconds is unset.
+const defaultServeUDPIdleTimeout = 2 * time.Minute
+
+// UDPHandlerForDst returns a handler for the UDP flow from src to dst, or nil
+// if dst is not a UDP port of our node served via the ipn.ServeConfig.
+func (b *LocalBackend) UDPHandlerForDst(src, dst netip.AddrPort) (handler func(c net.Conn)) {
+	if !b.isLocalIP(dst.Addr()) {
+		return nil
+	}
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	if !sc.Valid() {
+		return nil
+	}
+	dport := dst.Port()
+	udph, ok := sc.FindUDP(dport)
+	if !ok {
+		return nil
+	}
+
+	if !b.serveAccessAllowed(src, udph.AllowFrom()) {
+		return func(c net.Conn) {
+			b.serveDropLogf("localbackend: dropping serve UDP flow to port %v from %v: not in AllowFrom", dport, src)
+			c.Close()
+		}
+	}
+
+	backDst := udph.UDPForward()
+	if backDst == "" {
+		return nil
+	}
+	idle := defaultServeUDPIdleTimeout
+	if secs := udph.IdleTimeoutSeconds(); secs > 0 {
+		idle = time.Duration(secs) * time.Second
+	}
+	return func(c net.Conn) {
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		backConn, err := b.dialer.SystemDial(ctx, "udp", backDst)
+		cancel()
+		if err != nil {
+			b.logf("localbackend: failed to UDP proxy port %v (from %v) to %s: %v", dport, src, backDst, err)
+			return
+		}
+		defer backConn.Close()
+		proxyUDPFlow(c, backConn, idle)
+	}
+}
+
+// proxyUDPFlow copies datagrams between the client flow c and backConn until
+// either fails or there has been no traffic in either direction for idle, in
+// which case both are closed.
+func proxyUDPFlow(c, backConn net.Conn, idle time.Duration) {
+	timer := time.AfterFunc(idle, func() {
+		c.Close()
+		backConn.Close()
+	})
+	defer timer.Stop()
+
+	errc := make(chan error, 2)
+	copyPackets := func(dst, src net.Conn) {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			timer.Reset(idle)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go copyPackets(backConn, c)
+	go copyPackets(c, backConn)
+	<-errc
+}
+
 func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
 	var z ipn.HTTPHandlerView // zero value
 
@@ -555,6 +739,60 @@ func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView,
 	}
 }
 
+// serveAccessAllowed reports whether the peer at src may access a serve
+// handler restricted to the entries of allowFrom, as described by
+// ipn.CheckAllowFrom. An empty allowFrom permits everyone.
+func (b *LocalBackend) serveAccessAllowed(src netip.AddrPort, allowFrom views.Slice[string]) bool {
+	if allowFrom.Len() == 0 {
+		return true
+	}
+	node, user, ok := b.WhoIs("tcp", src)
+	if !ok {
+		return false // not a tailnet peer (e.g. funneled)
+	}
+	var caps tailcfg.PeerCapMap
+	for i := range allowFrom.Len() {
+		e := allowFrom.At(i)
+		switch {
+		case strings.HasPrefix(e, "tag:"):
+			if views.SliceContains(node.Tags(), e) {
+				return true
+			}
+		case strings.HasPrefix(e, ipn.AllowFromCapPrefix):
+			if caps == nil {
+				caps = b.PeerCaps(src.Addr())
+			}
+			if caps.HasCapability(tailcfg.PeerCapability(strings.TrimPrefix(e, ipn.AllowFromCapPrefix))) {
+				return true
+			}
+		default:
+			if !node.IsTagged() && strings.EqualFold(user.LoginName, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resetConn closes c, sending a TCP RST rather than a FIN if c supports it.
+func resetConn(c net.Conn) {
+	if lc, ok := c.(interface{ SetLinger(sec int) error }); ok {
+		lc.SetLinger(0)
+	}
+	c.Close()
+}
+
+// proxyBackends returns the backends that h proxies requests to, if any.
+func proxyBackends(h ipn.HTTPHandlerView) []string {
+	if lb := h.LoadBalancer(); lb.Valid() {
+		return lb.Backends().AsSlice()
+	}
+	if v := h.Proxy(); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
 // proxyHandlerForBackend creates a new HTTP reverse proxy for a particular backend that
 // we serve requests for. `backend` is a HTTPHandler.Proxy string (url, hostport or just port).
 func (b *LocalBackend) proxyHandlerForBackend(backend string) (http.Handler, error) {
@@ -756,16 +994,56 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if h.AllowFrom().Len() > 0 {
+		sctx, ok := serveHTTPContextKey.ValueOk(r.Context())
+		if !ok || !b.serveAccessAllowed(sctx.SrcAddr, h.AllowFrom()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	if h.SetHeaders().Len() > 0 || h.RemoveHeaders().Len() > 0 {
+		hw := &headerRulesResponseWriter{ResponseWriter: w, h: h}
+		defer hw.finish()
+		w = hw
+	}
+	if s := h.Redirect(); s != "" {
+		target, code, err := ipn.ParseRedirect(s)
+		if err != nil {
+			b.logf("serve: invalid redirect %q: %v", s, err)
+			http.Error(w, "invalid redirect", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, target, code)
+		return
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		io.WriteString(w, s)
 		return
 	}
 	if v := h.Path(); v != "" {
-		b.serveFileOrDirectory(w, r, v, mountPoint)
+		b.serveFileOrDirectory(w, r, v, mountPoint, h.NoDirListing())
 		return
 	}
-	if v := h.Proxy(); v != "" {
+	if v := h.Proxy(); v != "" || h.LoadBalancer().Valid() {
+		if lb := h.LoadBalancer(); lb.Valid() {
+			pool, ok := b.serveBackendPool("http", lb)
+			if !ok {
+				http.Error(w, "unknown load balancer", http.StatusInternalServerError)
+				return
+			}
+			var client netip.Addr
+			if sctx, ok := serveHTTPContextKey.ValueOk(r.Context()); ok {
+				client = sctx.SrcAddr.Addr()
+			}
+			be, release, err := pool.acquire(client)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer release()
+			v = be.addr
+		}
 		p, ok := b.serveProxyHandlers.Load(v)
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
@@ -783,7 +1061,10 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "empty handler", 500)
 }
 
-func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
+// serveFileOrDirectory serves the file or directory fileOrDir mounted at
+// mountPoint. If noDirListing is true, directories without an index.html
+// file are not listed.
+func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string, noDirListing bool) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -818,7 +1099,11 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var fs http.Handler = http.FileServer(http.Dir(fileOrDir))
+	var dir http.FileSystem = http.Dir(fileOrDir)
+	if noDirListing {
+		dir = noDirListingFS{dir}
+	}
+	var fs http.Handler = http.FileServer(dir)
 	if mountPoint != "/" {
 		fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
 	}
@@ -828,6 +1113,83 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 	}, r)
 }
 
+// noDirListingFS is an http.FileSystem that refuses to open directories that
+// lack an index.html file, so that http.FileServer never lists them.
+type noDirListingFS struct {
+	fs http.FileSystem
+}
+
+func (fs noDirListingFS) Open(name string) (http.File, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		index, err := fs.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// headerRulesResponseWriter is an http.ResponseWriter wrapper that, upon
+// flushing HTTP headers, applies the response header rules of an
+// ipn.HTTPHandler. Its finish method must be called once the handler
+// returns.
+type headerRulesResponseWriter struct {
+	http.ResponseWriter
+	h       ipn.HTTPHandlerView
+	fixOnce sync.Once // guards call to fix
+}
+
+func (w *headerRulesResponseWriter) fix() {
+	hdr := w.ResponseWriter.Header()
+	for i := range w.h.RemoveHeaders().Len() {
+		hdr.Del(w.h.RemoveHeaders().At(i))
+	}
+	w.h.SetHeaders().Range(func(k, v string) bool {
+		hdr.Set(k, v)
+		return true
+	})
+}
+
+func (w *headerRulesResponseWriter) WriteHeader(code int) {
+	w.fixOnce.Do(w.fix)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRulesResponseWriter) Write(p []byte) (int, error) {
+	w.fixOnce.Do(w.fix)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher. It's also what http.ResponseController
+// finds, rather than the Flush method of the underlying ResponseWriter.
+func (w *headerRulesResponseWriter) Flush() {
+	w.fixOnce.Do(w.fix)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish applies the header rules if the handler returned without writing
+// anything, before net/http sends the headers of the implicit response.
+func (w *headerRulesResponseWriter) finish() {
+	w.fixOnce.Do(w.fix)
+}
+
+// Unwrap returns the underlying ResponseWriter, so that
+// http.ResponseController can reach its Flush and Hijack methods.
+func (w *headerRulesResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // fixLocationHeaderResponseWriter is an http.ResponseWriter wrapper that, upon
 // flushing HTTP headers, prefixes any Location header with the mount point.
 type fixLocationHeaderResponseWriter struct {
@@ -13,6 +13,8 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -30,9 +32,11 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/tstest"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/wgengine"
@@ -288,6 +292,74 @@ func TestServeConfigForeground(t *testing.T) {
 	}
 }
 
+func TestServeConfigExpiry(t *testing.T) {
+	now := time.Now()
+	clock := tstest.NewClock(tstest.ClockOpts{Start: now})
+	b := newTestBackendWithClock(t, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan struct{})
+	notified := make(chan ipn.ServeConfigView, 4)
+	go b.WatchNotifications(ctx, 0, func() { close(watching) }, func(roNotify *ipn.Notify) (keepGoing bool) {
+		if roNotify.ServeConfig != nil {
+			notified <- *roNotify.ServeConfig
+		}
+		return true
+	})
+	<-watching
+
+	expires := now.Add(time.Hour)
+	err := b.SetServeConfig(&ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {HTTPS: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hello"},
+			}},
+			"example.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "demo", Expires: &expires},
+			}},
+		},
+		AllowFunnel: map[ipn.HostPort]bool{"example.ts.net:8443": true},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for serve config notification")
+	}
+
+	clock.Advance(time.Hour + time.Second)
+
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hello"},
+			}},
+		},
+	}
+	select {
+	case got := <-notified:
+		if !reflect.DeepEqual(got.AsStruct(), want) {
+			t.Errorf("notified serve config = %+v; want %+v", got.AsStruct(), want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for serve config notification")
+	}
+	if got := b.ServeConfig().AsStruct(); !reflect.DeepEqual(got, want) {
+		t.Errorf("serve config after expiry = %+v; want %+v", got, want)
+	}
+	if _, ok := b.ServeConfig().NextExpiry(); ok {
+		t.Error("serve config still has an expiry")
+	}
+}
+
 func TestServeConfigETag(t *testing.T) {
 	b := newTestBackend(t)
 
@@ -666,6 +738,12 @@ func mustCreateURL(t *testing.T, u string) url.URL {
 }
 
 func newTestBackend(t *testing.T) *LocalBackend {
+	return newTestBackendWithClock(t, nil)
+}
+
+// newTestBackendWithClock is like newTestBackend, but if clock is non-nil
+// the backend uses it instead of the real time.
+func newTestBackendWithClock(t *testing.T, clock tstime.Clock) *LocalBackend {
 	var logf logger.Logf = logger.Discard
 	const debug = true
 	if debug {
@@ -687,6 +765,9 @@ func newTestBackend(t *testing.T) *LocalBackend {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if clock != nil {
+		b.clock = clock
+	}
 	t.Cleanup(b.Shutdown)
 	dir := t.TempDir()
 	b.SetVarRoot(dir)
@@ -806,7 +887,7 @@ func TestServeFileOrDirectory(t *testing.T) {
 	for _, tt := range tests {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", tt.req, nil)
-		b.serveFileOrDirectory(rec, req, td, tt.mount)
+		b.serveFileOrDirectory(rec, req, td, tt.mount, false)
 		if tt.want == nil {
 			t.Errorf("no want for path %q", tt.req)
 			return
@@ -817,6 +898,246 @@ func TestServeFileOrDirectory(t *testing.T) {
 	}
 }
 
+func TestServeFileOrDirectoryNoDirListing(t *testing.T) {
+	td := t.TempDir()
+	os.MkdirAll(filepath.Join(td, "listed"), 0700)
+	os.MkdirAll(filepath.Join(td, "indexed"), 0700)
+	if err := os.WriteFile(filepath.Join(td, "listed", "file-a"), []byte("this is A"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(td, "indexed", "index.html"), []byte("this is index"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &LocalBackend{}
+	tests := []struct {
+		req      string
+		wantCode int
+		wantBody string
+	}{
+		{"/", 404, ""},
+		{"/listed/", 404, ""},
+		{"/listed/file-a", 200, "this is A"},
+		{"/indexed/", 200, "this is index"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.req, nil)
+		b.serveFileOrDirectory(rec, req, td, "/", true)
+		if rec.Code != tt.wantCode {
+			t.Errorf("req %q: status = %d; want %d", tt.req, rec.Code, tt.wantCode)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("req %q: body = %q; want %q", tt.req, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestServeHTTPResponseRules(t *testing.T) {
+	b := newTestBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", "backend")
+			w.Header().Set("X-Keep", "yes")
+			io.WriteString(w, "from backend")
+		},
+	))
+	defer testServ.Close()
+
+	tests := []struct {
+		name         string
+		handler      *ipn.HTTPHandler
+		wantCode     int
+		wantLocation string
+		wantHeaders  map[string]string
+	}{
+		{
+			name:         "redirect-default-code",
+			handler:      &ipn.HTTPHandler{Redirect: "https://example.com/"},
+			wantCode:     http.StatusFound,
+			wantLocation: "https://example.com/",
+		},
+		{
+			name:         "redirect-with-code",
+			handler:      &ipn.HTTPHandler{Redirect: "301:https://example.com/new"},
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "https://example.com/new",
+		},
+		{
+			name:     "redirect-bad-code",
+			handler:  &ipn.HTTPHandler{Redirect: "200:https://example.com/"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name: "text-set-headers",
+			handler: &ipn.HTTPHandler{
+				Text:       "hi",
+				SetHeaders: map[string]string{"Cache-Control": "no-store"},
+			},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Cache-Control": "no-store"},
+		},
+		{
+			name: "proxy-set-and-remove-headers",
+			handler: &ipn.HTTPHandler{
+				Proxy:         testServ.URL,
+				SetHeaders:    map[string]string{"Server": "tailscale"},
+				RemoveHeaders: []string{"X-Keep"},
+			},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Server": "tailscale", "X-Keep": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": tt.handler,
+					}},
+				},
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{
+				URL: &url.URL{Path: "/"},
+				TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+				&serveHTTPContext{
+					DestPort: 443,
+					SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+				}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			res := w.Result()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+			if got := res.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q; want %q", got, tt.wantLocation)
+			}
+			for k, want := range tt.wantHeaders {
+				if got := res.Header.Get(k); got != want {
+					t.Errorf("header %s = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderRulesResponseWriter(t *testing.T) {
+	h := (&ipn.HTTPHandler{
+		SetHeaders:    map[string]string{"Server": "tailscale"},
+		RemoveHeaders: []string{"X-Drop"},
+	}).View()
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+	}{
+		{"empty-body", func(w http.ResponseWriter) {
+			w.Header().Set("X-Drop", "yes")
+		}},
+		{"write-header", func(w http.ResponseWriter) {
+			w.Header().Set("X-Drop", "yes")
+			w.WriteHeader(http.StatusNoContent)
+		}},
+		{"flush", func(w http.ResponseWriter) {
+			w.Header().Set("X-Drop", "yes")
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("Flush: %v", err)
+			}
+			io.WriteString(w, "streamed")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			hw := &headerRulesResponseWriter{ResponseWriter: rec, h: h}
+			tt.handler(hw)
+			hw.finish()
+			res := rec.Result()
+			if got := res.Header.Get("Server"); got != "tailscale" {
+				t.Errorf("Server = %q; want tailscale", got)
+			}
+			if got := res.Header.Get("X-Drop"); got != "" {
+				t.Errorf("X-Drop = %q; want it removed", got)
+			}
+		})
+	}
+}
+
+func TestServeAccessAllowed(t *testing.T) {
+	b := newTestBackend(t)
+
+	userPeer := netip.MustParseAddrPort("100.150.151.152:1234")
+	taggedPeer := netip.MustParseAddrPort("100.150.151.153:1234")
+	nonPeer := netip.MustParseAddrPort("1.2.3.4:1234")
+
+	tests := []struct {
+		name      string
+		allowFrom []string
+		src       netip.AddrPort
+		want      bool
+	}{
+		{"empty-allows-all", nil, nonPeer, true},
+		{"user-match", []string{"someone@example.com"}, userPeer, true},
+		{"user-match-case", []string{"SomeOne@example.com"}, userPeer, true},
+		{"user-mismatch", []string{"other@example.com"}, userPeer, false},
+		{"user-not-tagged", []string{"someone@example.com"}, taggedPeer, false},
+		{"tag-match", []string{"tag:test"}, taggedPeer, true},
+		{"tag-mismatch", []string{"tag:prod"}, taggedPeer, false},
+		{"tag-or-user", []string{"tag:prod", "someone@example.com"}, userPeer, true},
+		{"cap-not-granted", []string{"cap:example.com/cap/webapp"}, userPeer, false},
+		{"non-peer", []string{"someone@example.com", "tag:test"}, nonPeer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := b.serveAccessAllowed(tt.src, views.SliceOf(tt.allowFrom))
+			if got != tt.want {
+				t.Errorf("serveAccessAllowed(%v, %q) = %v; want %v", tt.src, tt.allowFrom, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPAllowFrom(t *testing.T) {
+	b := newTestBackend(t)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi", AllowFrom: []string{"tag:test"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	for src, wantCode := range map[string]int{
+		"100.150.151.153:1234": http.StatusOK,
+		"100.150.151.152:1234": http.StatusForbidden,
+	} {
+		req := &http.Request{
+			URL: &url.URL{Path: "/"},
+			TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(src),
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != wantCode {
+			t.Errorf("from %v: status = %d; want %d", src, w.Code, wantCode)
+		}
+	}
+}
+
 func Test_isGRPCContentType(t *testing.T) {
 	tests := []struct {
 		contentType string
@@ -854,3 +1175,57 @@ func TestEncTailscaleHeaderValue(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyUDPFlow(t *testing.T) {
+	// An echo server standing in for the served UDP backend.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	backConn, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client flow, as netstack would hand it to the handler.
+	client, flow := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxyUDPFlow(flow, backConn, 100*time.Millisecond)
+	}()
+
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("got %q; want %q", got, msg)
+		}
+	}
+
+	// Without traffic, the flow is closed after the idle timeout.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed after idle timeout")
+	}
+}
@@ -43,6 +43,7 @@
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/portmapper"
@@ -64,6 +65,7 @@
 	"tailscale.com/util/progresstracking"
 	"tailscale.com/util/rands"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/magicsock"
 )
 
@@ -88,6 +90,7 @@
 	"component-debug-logging":     (*Handler).serveComponentDebugLogging,
 	"debug":                       (*Handler).serveDebug,
 	"debug-capture":               (*Handler).serveDebugCapture,
+	"debug-capture-ring":          (*Handler).serveDebugCaptureRing,
 	"debug-derp-region":           (*Handler).serveDebugDERPRegion,
 	"debug-dial-types":            (*Handler).serveDebugDialTypes,
 	"debug-log":                   (*Handler).serveDebugLog,
@@ -108,6 +111,7 @@
 	"logout":                      (*Handler).serveLogout,
 	"logtap":                      (*Handler).serveLogTap,
 	"metrics":                     (*Handler).serveMetrics,
+	"netcheck-history":            (*Handler).serveNetcheckHistory,
 	"ping":                        (*Handler).servePing,
 	"pprof":                       (*Handler).servePprof,
 	"prefs":                       (*Handler).servePrefs,
@@ -1871,6 +1875,25 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// serveNetcheckHistory serves the recent history of netcheck reports, as a
+// JSON array of netcheck.HistoryEntry.
+func (h *Handler) serveNetcheckHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netcheck history access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusBadRequest)
+		return
+	}
+	entries := h.b.MagicConn().NetcheckHistory()
+	if entries == nil {
+		entries = []netcheck.HistoryEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
 // serveSetExpirySooner sets the expiry date on the current machine, specified
 // by an `expiry` unix timestamp as POST or query param.
 func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
@@ -2681,10 +2704,87 @@ func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
+	format, err := capture.ParseFormat(r.FormValue("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
-	h.b.StreamDebugCapture(r.Context(), w)
+	h.b.StreamDebugCapture(r.Context(), w, format)
+}
+
+// serveDebugCaptureRing starts (POST), stops (DELETE) or dumps as pcapng
+// (GET) the ring buffer of recently captured packets.
+func (h *Handler) serveDebugCaptureRing(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	durationValue := func(name string) (time.Duration, error) {
+		v := r.FormValue(name)
+		if v == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return d, nil
+	}
+	switch r.Method {
+	case httpm.GET:
+		last, err := durationValue("last")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Buffer the dump, so that errors can still be reported.
+		var buf bytes.Buffer
+		if err := h.b.WriteCaptureRing(&buf, last); err != nil {
+			if errors.Is(err, ipnlocal.ErrCaptureRingNotRunning) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf.Bytes())
+	case httpm.POST:
+		var cfg capture.RingConfig
+		var err error
+		if v := r.FormValue("max_bytes"); v != "" {
+			if cfg.MaxBytes, err = strconv.Atoi(v); err != nil || cfg.MaxBytes < 0 || cfg.MaxBytes > capture.MaxRingBytes {
+				http.Error(w, fmt.Sprintf("invalid max_bytes; want at most %d", capture.MaxRingBytes), http.StatusBadRequest)
+				return
+			}
+		}
+		if cfg.MaxAge, err = durationValue("max_age"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.Filter, err = capture.ParseFilter(r.FormValue("filter")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		healthDump, err := durationValue("health_dump")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.b.StartCaptureRing(cfg, healthDump); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case httpm.DELETE:
+		h.b.StopCaptureRing()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
 }
 
 func (h *Handler) serveDebugLog(w http.ResponseWriter, r *http.Request) {
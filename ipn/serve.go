@@ -7,11 +7,13 @@
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -31,6 +33,10 @@ type ServeConfig struct {
 	// the Tailscale IP addresses. (not subnet routers, etc)
 	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
 
+	// UDP are the list of UDP port numbers that tailscaled should handle for
+	// the Tailscale IP addresses, forwarding their datagrams elsewhere.
+	UDP map[uint16]*UDPPortHandler `json:",omitempty"`
+
 	// Web maps from "$SNI_NAME:$PORT" to a set of HTTP handlers
 	// keyed by mount point ("/", "/foo", etc)
 	Web map[HostPort]*WebServerConfig `json:",omitempty"`
@@ -120,14 +126,51 @@ type TCPPortHandler struct {
 	// It is mutually exclusive with HTTPS.
 	TCPForward string `json:",omitempty"`
 
+	// LoadBalancer, if non-nil, forwards TCP connections to one of several
+	// IP:port backends instead of the single TCPForward backend.
+	//
+	// It is mutually exclusive with HTTPS and TCPForward.
+	LoadBalancer *LoadBalancer `json:",omitempty"`
+
 	// TerminateTLS, if non-empty, means that tailscaled should terminate the
-	// TLS connections before forwarding them to TCPForward, permitting only the
-	// SNI name with this value. It is only used if TCPForward is non-empty.
+	// TLS connections before forwarding them to TCPForward or LoadBalancer,
+	// permitting only the SNI name with this value. It is only used if
+	// TCPForward or LoadBalancer is set.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts which tailnet peers may connect to
+	// this port. Connections from other peers are reset. See CheckAllowFrom
+	// for the supported entries.
+	AllowFrom []string `json:",omitempty"`
+
+	// Expires, if non-nil, is when tailscaled removes this handler from the
+	// ServeConfig. See ServeConfig.RemoveExpired.
+	Expires *time.Time `json:",omitempty"`
 }
 
-// HTTPHandler is either a path or a proxy to serve.
+// UDPPortHandler describes what to do when handling UDP datagrams.
+type UDPPortHandler struct {
+	// UDPForward is the IP:port to forward UDP datagrams to. Each client
+	// IP:port gets its own flow to UDPForward, over which replies are
+	// returned to the client.
+	UDPForward string
+
+	// IdleTimeoutSeconds is the number of seconds after which a flow without
+	// traffic in either direction is closed. Zero means 2 minutes.
+	IdleTimeoutSeconds int `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts which tailnet peers may send
+	// datagrams to this port. Datagrams from other peers are dropped. See
+	// CheckAllowFrom for the supported entries.
+	AllowFrom []string `json:",omitempty"`
+
+	// Expires, if non-nil, is when tailscaled removes this handler from the
+	// ServeConfig. See ServeConfig.RemoveExpired.
+	Expires *time.Time `json:",omitempty"`
+}
+
+// HTTPHandler is either a path, a proxy, text or a redirect to serve.
 type HTTPHandler struct {
 	// Exactly one of the following may be set.
 
@@ -136,8 +179,172 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
-	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// LoadBalancer, if non-nil, proxies requests to one of several backends,
+	// each in the same form as Proxy.
+	LoadBalancer *LoadBalancer `json:",omitempty"`
+
+	// Redirect, if non-empty, is the URL to redirect requests to, optionally
+	// prefixed by a 3xx HTTP status code and a colon, as in
+	// "301:https://example.com/". The status code defaults to 302 (Found).
+	// See ParseRedirect.
+	Redirect string `json:",omitempty"`
+
+	// The following optionally modify the response of any of the above.
+
+	// SetHeaders are HTTP headers to set on responses, replacing any value
+	// the handler (e.g. a proxied backend) set.
+	SetHeaders map[string]string `json:",omitempty"`
+
+	// RemoveHeaders are the names of HTTP headers to remove from responses.
+	RemoveHeaders []string `json:",omitempty"`
+
+	// NoDirListing, if true, disables directory listings for Path handlers
+	// serving a directory. Requests for a directory without an index.html
+	// file get a 404 instead.
+	NoDirListing bool `json:",omitempty"`
+
+	// AllowFrom, if non-empty, restricts which tailnet peers may access this
+	// handler. Requests from other peers get a 403 Forbidden response. See
+	// CheckAllowFrom for the supported entries.
+	AllowFrom []string `json:",omitempty"`
+
+	// Expires, if non-nil, is when tailscaled removes this handler from the
+	// ServeConfig, along with Funnel access to its host:port if no other
+	// handlers remain. See ServeConfig.RemoveExpired.
+	Expires *time.Time `json:",omitempty"`
+}
+
+// LoadBalancer describes a set of equivalent backends that a serve handler
+// spreads connections or requests across.
+type LoadBalancer struct {
+	// Backends are the backends to balance across, in the same form as
+	// HTTPHandler.Proxy or TCPPortHandler.TCPForward, depending on the handler.
+	Backends []string
+
+	// Policy is how a backend is chosen. The empty value means
+	// LBPolicyRoundRobin.
+	Policy LBPolicy `json:",omitempty"`
+
+	// HealthCheck, if non-nil, configures the active health checks of the
+	// backends. If nil, a backend is checked every 10 seconds by connecting
+	// to it.
+	HealthCheck *HealthCheck `json:",omitempty"`
+}
+
+// LBPolicy is a LoadBalancer policy for choosing a backend.
+type LBPolicy string
+
+const (
+	// LBPolicyRoundRobin picks the healthy backends in turn.
+	LBPolicyRoundRobin LBPolicy = "round-robin"
+
+	// LBPolicyLeastConns picks the healthy backend with the fewest
+	// connections or requests in flight.
+	LBPolicyLeastConns LBPolicy = "least-conns"
+
+	// LBPolicyHash consistently picks the same healthy backend for a given
+	// client node, by hashing its IP address.
+	LBPolicyHash LBPolicy = "hash"
+)
+
+// HealthCheck configures the active health checks of the backends of a
+// LoadBalancer. Backends failing consecutive checks are ejected until they
+// pass a check again.
+type HealthCheck struct {
+	// Path, if non-empty, is the URL path to GET from HTTP backends. Such a
+	// backend is healthy if it replies with a non-5xx status. Otherwise, and
+	// for TCP backends, a backend is healthy if it accepts a connection.
+	Path string `json:",omitempty"`
+
+	// IntervalSeconds is the number of seconds between checks of each
+	// backend. Zero means 10.
+	IntervalSeconds int `json:",omitempty"`
+}
+
+// CheckLoadBalancer reports an error if lb is not a valid LoadBalancer.
+// The backends themselves are not validated.
+func CheckLoadBalancer(lb *LoadBalancer) error {
+	if len(lb.Backends) == 0 {
+		return errors.New("load balancer has no backends")
+	}
+	switch lb.Policy {
+	case "", LBPolicyRoundRobin, LBPolicyLeastConns, LBPolicyHash:
+	default:
+		return fmt.Errorf("unknown load balancing policy %q; want %q, %q or %q", lb.Policy, LBPolicyRoundRobin, LBPolicyLeastConns, LBPolicyHash)
+	}
+	if hc := lb.HealthCheck; hc != nil {
+		if hc.IntervalSeconds < 0 {
+			return errors.New("negative health check interval")
+		}
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("health check path %q must start with /", hc.Path)
+		}
+	}
+	return nil
+}
+
+// AllowFromCapPrefix is the prefix of an AllowFrom entry that matches peers
+// granted a peer capability, as in "cap:example.com/cap/webapp".
+const AllowFromCapPrefix = "cap:"
+
+// CheckAllowFrom reports an error if any of the entries of an HTTPHandler or
+// TCPPortHandler AllowFrom list is invalid. Valid entries are:
+//
+//   - a user login name ("alice@example.com"), matching untagged nodes
+//     owned by that user
+//   - an ACL tag ("tag:prod"), matching nodes with that tag
+//   - a peer capability ("cap:example.com/cap/webapp"), matching nodes that
+//     the tailnet policy grants that capability to this node
+//
+// Traffic that does not come from a tailnet peer, such as Funnel traffic,
+// never matches.
+func CheckAllowFrom(entries []string) error {
+	for _, e := range entries {
+		switch {
+		case strings.HasPrefix(e, "tag:"):
+			if err := tailcfg.CheckTag(e); err != nil {
+				return fmt.Errorf("invalid AllowFrom entry %q: %w", e, err)
+			}
+		case strings.HasPrefix(e, AllowFromCapPrefix):
+			if e == AllowFromCapPrefix {
+				return fmt.Errorf("invalid AllowFrom entry %q: empty capability", e)
+			}
+		case strings.Contains(e, "@"):
+		default:
+			return fmt.Errorf("invalid AllowFrom entry %q; want a login name, tag:<name> or cap:<capability>", e)
+		}
+	}
+	return nil
+}
+
+// ParseRedirect parses an HTTPHandler.Redirect value of the form
+// "[<code>:]<url>" and returns its target URL and HTTP status code.
+// The code defaults to http.StatusFound and must be a 3xx status.
+func ParseRedirect(v string) (target string, code int, err error) {
+	code = http.StatusFound
+	if codeStr, rest, ok := strings.Cut(v, ":"); ok && allDigits(codeStr) {
+		code, err = strconv.Atoi(codeStr)
+		if err != nil || code < 300 || code > 399 {
+			return "", 0, fmt.Errorf("invalid redirect status code %q; must be 3xx", codeStr)
+		}
+		v = rest
+	}
+	if v == "" {
+		return "", 0, errors.New("empty redirect URL")
+	}
+	if _, err := url.Parse(v); err != nil {
+		return "", 0, fmt.Errorf("invalid redirect URL %q: %w", v, err)
+	}
+	return v, code, nil
+}
+
+func allDigits(s string) bool {
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
 }
 
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
@@ -165,6 +372,15 @@ func (sc *ServeConfig) GetTCPPortHandler(port uint16) *TCPPortHandler {
 	return sc.TCP[port]
 }
 
+// GetUDPPortHandler returns the UDPPortHandler for the given port.
+// If the port is not configured, nil is returned.
+func (sc *ServeConfig) GetUDPPortHandler(port uint16) *UDPPortHandler {
+	if sc == nil {
+		return nil
+	}
+	return sc.UDP[port]
+}
+
 // HasPathHandler reports whether if ServeConfig has at least
 // one path handler, including foreground configs.
 func (sc *ServeConfig) HasPathHandler() bool {
@@ -190,13 +406,13 @@ func (sc *ServeConfig) HasPathHandler() bool {
 }
 
 // IsTCPForwardingAny reports whether ServeConfig is currently forwarding in
-// TCPForward mode on any port. This is exclusive of Web/HTTPS serving.
+// TCPForward or LoadBalancer mode on any port. This is exclusive of Web/HTTPS serving.
 func (sc *ServeConfig) IsTCPForwardingAny() bool {
 	if sc == nil || len(sc.TCP) == 0 {
 		return false
 	}
 	for _, h := range sc.TCP {
-		if h.TCPForward != "" {
+		if h.TCPForward != "" || h.LoadBalancer != nil {
 			return true
 		}
 	}
@@ -254,6 +470,23 @@ func (sc *ServeConfig) FindConfig(port uint16) (*ServeConfig, bool) {
 	return nil, false
 }
 
+// FindUDPConfig is like FindConfig, but finds a config that contains the
+// given UDP port.
+func (sc *ServeConfig) FindUDPConfig(port uint16) (*ServeConfig, bool) {
+	if sc == nil {
+		return nil, false
+	}
+	if _, ok := sc.UDP[port]; ok {
+		return sc, false
+	}
+	for _, sc := range sc.Foreground {
+		if _, ok := sc.UDP[port]; ok {
+			return sc, true
+		}
+	}
+	return nil, false
+}
+
 // SetWebHandler sets the given HTTPHandler at the specified host, port,
 // and mount in the serve config. sc.TCP is also updated to reflect web
 // serving usage of the given port.
@@ -300,6 +533,15 @@ func (sc *ServeConfig) SetTCPForwarding(port uint16, fwdAddr string, terminateTL
 	}
 }
 
+// SetUDPForwarding sets the fwdAddr (IP:port form) to which to forward
+// datagrams sent to the given port.
+func (sc *ServeConfig) SetUDPForwarding(port uint16, fwdAddr string) {
+	if sc == nil {
+		sc = new(ServeConfig)
+	}
+	mak.Set(&sc.UDP, port, &UDPPortHandler{UDPForward: fwdAddr})
+}
+
 // SetFunnel sets the sc.AllowFunnel value for the given host and port.
 func (sc *ServeConfig) SetFunnel(host string, port uint16, setOn bool) {
 	if sc == nil {
@@ -359,6 +601,138 @@ func (sc *ServeConfig) RemoveTCPForwarding(port uint16) {
 	}
 }
 
+// RemoveExpired deletes the TCP port, UDP port and web handlers of sc, and of its
+// foreground configs, that expired at or before now. Funnel is turned off for
+// any host:port left without handlers, and foreground configs left with
+// nothing to serve are deleted. It reports whether sc was modified.
+func (sc *ServeConfig) RemoveExpired(now time.Time) (changed bool) {
+	if sc == nil {
+		return false
+	}
+	expired := func(t *time.Time) bool {
+		return t != nil && !t.After(now)
+	}
+	for port, h := range sc.TCP {
+		if h == nil || !expired(h.Expires) {
+			continue
+		}
+		// Web handlers on the port go away with it.
+		for hp := range sc.Web {
+			if p, err := hp.Port(); err == nil && p == port {
+				delete(sc.Web, hp)
+				delete(sc.AllowFunnel, hp)
+			}
+		}
+		sc.RemoveTCPForwarding(port)
+		changed = true
+	}
+	for port, h := range sc.UDP {
+		if h != nil && expired(h.Expires) {
+			sc.RemoveUDPForwarding(port)
+			changed = true
+		}
+	}
+	for hp, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		var mounts []string
+		for mount, h := range wsc.Handlers {
+			if h != nil && expired(h.Expires) {
+				mounts = append(mounts, mount)
+			}
+		}
+		if len(mounts) == 0 {
+			continue
+		}
+		host, _, err := net.SplitHostPort(string(hp))
+		if err != nil {
+			continue
+		}
+		port, err := hp.Port()
+		if err != nil {
+			continue
+		}
+		sc.RemoveWebHandler(host, port, mounts, true)
+		changed = true
+	}
+	for session, fsc := range sc.Foreground {
+		if !fsc.RemoveExpired(now) {
+			continue
+		}
+		changed = true
+		if len(fsc.TCP) == 0 && len(fsc.UDP) == 0 && len(fsc.Web) == 0 {
+			delete(sc.Foreground, session)
+		}
+	}
+	if len(sc.Web) == 0 {
+		sc.Web = nil
+	}
+	if len(sc.AllowFunnel) == 0 {
+		sc.AllowFunnel = nil
+	}
+	if len(sc.Foreground) == 0 {
+		sc.Foreground = nil
+	}
+	return changed
+}
+
+// NextExpiry returns the earliest Expires time of the handlers in v,
+// including those of its foreground configs. It reports false if no handler
+// expires.
+//
+// View version of ServeConfig.NextExpiry.
+func (v ServeConfigView) NextExpiry() (time.Time, bool) { return v.ж.NextExpiry() }
+
+// NextExpiry returns the earliest Expires time of the handlers in sc,
+// including those of its foreground configs. It reports false if no handler
+// expires.
+func (sc *ServeConfig) NextExpiry() (next time.Time, ok bool) {
+	if sc == nil {
+		return time.Time{}, false
+	}
+	consider := func(t *time.Time) {
+		if t != nil && (!ok || t.Before(next)) {
+			next, ok = *t, true
+		}
+	}
+	for _, h := range sc.TCP {
+		if h != nil {
+			consider(h.Expires)
+		}
+	}
+	for _, h := range sc.UDP {
+		if h != nil {
+			consider(h.Expires)
+		}
+	}
+	for _, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for _, h := range wsc.Handlers {
+			if h != nil {
+				consider(h.Expires)
+			}
+		}
+	}
+	for _, fsc := range sc.Foreground {
+		if t, fok := fsc.NextExpiry(); fok {
+			consider(&t)
+		}
+	}
+	return next, ok
+}
+
+// RemoveUDPForwarding deletes the UDP forwarding configuration for the given
+// port from the serve config.
+func (sc *ServeConfig) RemoveUDPForwarding(port uint16) {
+	delete(sc.UDP, port)
+	if len(sc.UDP) == 0 {
+		sc.UDP = nil
+	}
+}
+
 // IsFunnelOn reports whether if ServeConfig is currently allowing funnel
 // traffic for any host:port.
 //
@@ -564,6 +938,27 @@ func (v ServeConfigView) RangeOverTCPs(f func(port uint16, _ TCPPortHandlerView)
 	})
 }
 
+// RangeOverUDPs ranges over both background and foreground UDPs.
+// If the returned bool from the given f is false, then this function stops
+// iterating immediately and does not check other foreground configs.
+func (v ServeConfigView) RangeOverUDPs(f func(port uint16, _ UDPPortHandlerView) bool) {
+	parentCont := true
+	v.UDP().Range(func(k uint16, v UDPPortHandlerView) (cont bool) {
+		parentCont = f(k, v)
+		return parentCont
+	})
+	v.Foreground().Range(func(k string, v ServeConfigView) (cont bool) {
+		if !parentCont {
+			return false
+		}
+		v.UDP().Range(func(k uint16, v UDPPortHandlerView) (cont bool) {
+			parentCont = f(k, v)
+			return parentCont
+		})
+		return parentCont
+	})
+}
+
 // RangeOverWebs ranges over both background and foreground Webs.
 // If the returned bool from the given f is false, then this function stops
 // iterating immediately and does not check other foreground configs.
@@ -599,6 +994,20 @@ func (v ServeConfigView) FindTCP(port uint16) (res TCPPortHandlerView, ok bool)
 	return v.TCP().GetOk(port)
 }
 
+// FindUDP returns the first UDP that matches with the given port. It
+// prefers a foreground match first followed by a background search if none
+// existed.
+func (v ServeConfigView) FindUDP(port uint16) (res UDPPortHandlerView, ok bool) {
+	v.Foreground().Range(func(_ string, v ServeConfigView) (cont bool) {
+		res, ok = v.UDP().GetOk(port)
+		return !ok
+	})
+	if ok {
+		return res, ok
+	}
+	return v.UDP().GetOk(port)
+}
+
 // FindWeb returns the first Web that matches with the given HostPort. It
 // prefers a foreground match first followed by a background search if none
 // existed.
@@ -3,7 +3,10 @@
 package ipn
 
 import (
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -182,3 +185,162 @@ func TestExpandProxyTargetDev(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckAllowFrom(t *testing.T) {
+	tests := []struct {
+		entries []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"alice@example.com"}, false},
+		{[]string{"tag:prod", "cap:example.com/cap/webapp"}, false},
+		{[]string{"tag:"}, true},
+		{[]string{"cap:"}, true},
+		{[]string{"alice"}, true},
+	}
+	for _, tt := range tests {
+		err := CheckAllowFrom(tt.entries)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckAllowFrom(%q) = %v; wantErr %v", tt.entries, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeConfigRemoveExpired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	sc := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432", Expires: &past},
+		},
+		UDP: map[uint16]*UDPPortHandler{
+			53:   {UDPForward: "127.0.0.1:5353"},
+			5432: {UDPForward: "127.0.0.1:5432", Expires: &past},
+		},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/demo": {Proxy: "http://127.0.0.1:4000", Expires: &past},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*HTTPHandler{
+				"/": {Text: "hi", Expires: &now},
+			}},
+		},
+		AllowFunnel: map[HostPort]bool{
+			"foo.test.ts.net:443":  true,
+			"foo.test.ts.net:8443": true,
+		},
+		Foreground: map[string]*ServeConfig{
+			"fg1": {
+				TCP: map[uint16]*TCPPortHandler{9000: {TCPForward: "127.0.0.1:9000", Expires: &past}},
+			},
+			"fg2": {
+				TCP: map[uint16]*TCPPortHandler{9001: {TCPForward: "127.0.0.1:9001", Expires: &future}},
+			},
+			"fg3": {
+				UDP: map[uint16]*UDPPortHandler{9002: {UDPForward: "127.0.0.1:9002", Expires: &past}},
+			},
+		},
+	}
+
+	if got, ok := sc.NextExpiry(); !ok || !got.Equal(past) {
+		t.Errorf("NextExpiry = %v, %v; want %v, true", got, ok, past)
+	}
+	if !sc.RemoveExpired(now) {
+		t.Fatal("RemoveExpired = false; want true")
+	}
+	want := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true}},
+		UDP: map[uint16]*UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+		},
+		AllowFunnel: map[HostPort]bool{"foo.test.ts.net:443": true},
+		Foreground: map[string]*ServeConfig{
+			"fg2": {
+				TCP: map[uint16]*TCPPortHandler{9001: {TCPForward: "127.0.0.1:9001", Expires: &future}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(sc, want) {
+		t.Errorf("after RemoveExpired:\n got %+v\nwant %+v", sc, want)
+	}
+	if got, ok := sc.NextExpiry(); !ok || !got.Equal(future) {
+		t.Errorf("NextExpiry = %v, %v; want %v, true", got, ok, future)
+	}
+	if sc.RemoveExpired(now) {
+		t.Error("second RemoveExpired = true; want false")
+	}
+	if got, ok := (&ServeConfig{}).NextExpiry(); ok {
+		t.Errorf("NextExpiry of empty config = %v, true; want false", got)
+	}
+}
+
+func TestServeConfigUDP(t *testing.T) {
+	sc := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{53: {TCPForward: "127.0.0.1:53"}},
+		Foreground: map[string]*ServeConfig{
+			"fg": {UDP: map[uint16]*UDPPortHandler{9000: {UDPForward: "127.0.0.1:9000"}}},
+		},
+	}
+	sc.SetUDPForwarding(53, "127.0.0.1:5353")
+	if got := sc.GetUDPPortHandler(53); got == nil || got.UDPForward != "127.0.0.1:5353" {
+		t.Fatalf("GetUDPPortHandler(53) = %+v", got)
+	}
+	if sc.TCP[53].TCPForward != "127.0.0.1:53" {
+		t.Error("SetUDPForwarding changed the TCP handler on the same port")
+	}
+
+	v := sc.View()
+	if h, ok := v.FindUDP(9000); !ok || h.UDPForward() != "127.0.0.1:9000" {
+		t.Errorf("FindUDP(9000) = %v, %v", h.AsStruct(), ok)
+	}
+	if _, ok := v.FindUDP(54); ok {
+		t.Error("FindUDP(54) found a handler")
+	}
+	if _, isFg := sc.FindUDPConfig(9000); !isFg {
+		t.Error("FindUDPConfig(9000) is not foreground")
+	}
+	var ports []uint16
+	v.RangeOverUDPs(func(port uint16, _ UDPPortHandlerView) bool {
+		ports = append(ports, port)
+		return true
+	})
+	slices.Sort(ports)
+	if want := []uint16{53, 9000}; !slices.Equal(ports, want) {
+		t.Errorf("RangeOverUDPs ports = %v; want %v", ports, want)
+	}
+
+	sc.RemoveUDPForwarding(53)
+	if sc.UDP != nil {
+		t.Errorf("UDP = %v after removing the last port; want nil", sc.UDP)
+	}
+}
+
+func TestCheckLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		lb      *LoadBalancer
+		wantErr bool
+	}{
+		{"ok", &LoadBalancer{Backends: []string{"a", "b"}}, false},
+		{"policy", &LoadBalancer{Backends: []string{"a"}, Policy: LBPolicyHash}, false},
+		{"health_check", &LoadBalancer{Backends: []string{"a"}, HealthCheck: &HealthCheck{Path: "/healthz", IntervalSeconds: 5}}, false},
+		{"no_backends", &LoadBalancer{}, true},
+		{"bad_policy", &LoadBalancer{Backends: []string{"a"}, Policy: "random"}, true},
+		{"bad_path", &LoadBalancer{Backends: []string{"a"}, HealthCheck: &HealthCheck{Path: "healthz"}}, true},
+		{"bad_interval", &LoadBalancer{Backends: []string{"a"}, HealthCheck: &HealthCheck{IntervalSeconds: -1}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckLoadBalancer(tt.lb); (err != nil) != tt.wantErr {
+				t.Errorf("CheckLoadBalancer = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
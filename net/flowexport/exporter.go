@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flowexport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+)
+
+// Config configures an Exporter.
+type Config struct {
+	Protocol Protocol
+
+	// Collector is the host and optional port of the collector that flows
+	// are sent to over UDP. The port defaults to the protocol's
+	// DefaultPort.
+	Collector string
+
+	// ObservationDomain, MaxMessageSize, TemplateRefresh,
+	// TemplateRefreshMessages and EnterpriseNumber configure the encoding
+	// of flows, as the Encoder fields of the same names do.
+	ObservationDomain       uint32
+	MaxMessageSize          int
+	TemplateRefresh         time.Duration
+	TemplateRefreshMessages int
+	EnterpriseNumber        uint32
+
+	// Logf logs the errors of Dump. If nil, log.Printf is used.
+	Logf logger.Logf
+}
+
+// Exporter sends flows to a collector over UDP, with the identities of the
+// tailnet IPs of their sources and destinations, as set by SetIdentities.
+//
+// Its Dump method lets it export the statistics of a connstats.Statistics
+// on its own:
+//
+//	stats := connstats.NewStatistics(5*time.Second, 0, x.Dump)
+//
+// All methods are safe for concurrent use.
+type Exporter struct {
+	conn net.Conn
+	logf logger.Logf
+
+	mu  sync.Mutex
+	enc Encoder
+	ids map[netip.Addr]Identity
+	buf []Flow
+}
+
+// NewExporter returns an Exporter that sends flows to the collector of cfg.
+func NewExporter(cfg Config) (*Exporter, error) {
+	if cfg.Collector == "" {
+		return nil, errors.New("no flow collector address")
+	}
+	addr := cfg.Collector
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), fmt.Sprint(cfg.Protocol.DefaultPort()))
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logf := cfg.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	return &Exporter{
+		conn: conn,
+		logf: logger.WithPrefix(logf, "flowexport: "),
+		enc: Encoder{
+			Protocol:                cfg.Protocol,
+			ObservationDomain:       cfg.ObservationDomain,
+			MaxSize:                 cfg.MaxMessageSize,
+			TemplateRefresh:         cfg.TemplateRefresh,
+			TemplateRefreshMessages: cfg.TemplateRefreshMessages,
+			EnterpriseNumber:        cfg.EnterpriseNumber,
+		},
+	}, nil
+}
+
+// SetIdentities sets the identities of tailnet IPs. Flows from or to them
+// are exported with enterprise-specific information elements for the
+// identities of both ends.
+//
+// The map must not be modified after it's passed to SetIdentities.
+func (x *Exporter) SetIdentities(ids map[netip.Addr]Identity) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.ids = ids
+}
+
+// Export sends the flows of the connections in cc, which were counted from
+// start to end, to the collector.
+func (x *Exporter) Export(start, end time.Time, cc []netlogtype.ConnectionCounts) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.buf = AppendFlows(x.buf[:0], start, end, cc)
+	if len(x.ids) > 0 {
+		for i := range x.buf {
+			f := &x.buf[i]
+			if id, ok := x.ids[f.Src.Addr()]; ok {
+				f.SrcIdentity = &id
+			}
+			if id, ok := x.ids[f.Dst.Addr()]; ok {
+				f.DstIdentity = &id
+			}
+		}
+	}
+	for _, msg := range x.enc.Encode(time.Now(), x.buf) {
+		if _, err := x.conn.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump exports the virtual connections counted from start to end. It has
+// the signature of the dump function of connstats.NewStatistics.
+//
+// Physical connections aren't exported: they pair a peer's Tailscale IP
+// with its WireGuard endpoint, which aren't the source and destination of
+// any packet.
+func (x *Exporter) Dump(start, end time.Time, virtual, physical map[netlogtype.Connection]netlogtype.Counts) {
+	cc := make([]netlogtype.ConnectionCounts, 0, len(virtual))
+	for c, n := range virtual {
+		cc = append(cc, netlogtype.ConnectionCounts{Connection: c, Counts: n})
+	}
+	if len(cc) == 0 {
+		return
+	}
+	if err := x.Export(start, end, cc); err != nil {
+		x.logf("exporting %d connections: %v", len(cc), err)
+	}
+}
+
+// Close closes the connection to the collector.
+func (x *Exporter) Close() error {
+	return x.conn.Close()
+}
@@ -0,0 +1,601 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package flowexport encodes network traffic counts as IPFIX (RFC 7011) or
+// NetFlow version 9 (RFC 3954) flow records and sends them to a collector.
+package flowexport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"tailscale.com/types/netlogtype"
+)
+
+// Protocol is a flow export protocol.
+type Protocol int
+
+const (
+	IPFIX     Protocol = iota // IPFIX, RFC 7011
+	NetFlowV9                 // NetFlow version 9, RFC 3954
+)
+
+// String returns the name of p, as accepted by ParseProtocol.
+func (p Protocol) String() string {
+	switch p {
+	case IPFIX:
+		return "ipfix"
+	case NetFlowV9:
+		return "netflow9"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// ParseProtocol parses the name of a Protocol: "ipfix" or "netflow9".
+func ParseProtocol(s string) (Protocol, error) {
+	switch strings.ToLower(s) {
+	case "ipfix":
+		return IPFIX, nil
+	case "netflow9", "netflow", "nfv9":
+		return NetFlowV9, nil
+	}
+	return 0, fmt.Errorf("unknown flow export protocol %q; want ipfix or netflow9", s)
+}
+
+// DefaultPort returns the port that collectors conventionally listen on for
+// messages of protocol p.
+func (p Protocol) DefaultPort() uint16 {
+	if p == NetFlowV9 {
+		return 2055
+	}
+	return 4739
+}
+
+const (
+	// DefaultMaxMessageSize is the size of the messages that an Encoder
+	// with a zero MaxSize stays below, so that they aren't fragmented on
+	// most links.
+	DefaultMaxMessageSize = 1400
+
+	// DefaultTemplateRefresh is how often an Encoder with a zero
+	// TemplateRefresh resends each template, so that collectors that
+	// missed it, or restarted, can decode the records that use it.
+	// It's the default templateRefreshTimeout of RFC 6728.
+	DefaultTemplateRefresh = 10 * time.Minute
+
+	// DefaultTemplateRefreshMessages is how many messages an Encoder with
+	// a zero TemplateRefreshMessages sends before resending a template.
+	DefaultTemplateRefreshMessages = 20
+
+	// DocumentationEnterpriseNumber is the Private Enterprise Number that
+	// RFC 5612 reserves for documentation. An Encoder with a zero
+	// EnterpriseNumber uses it for the information elements of
+	// identities; collectors must be configured to decode them with it.
+	DocumentationEnterpriseNumber = 32473
+)
+
+// Identity identifies the node that a tailnet IP belongs to.
+type Identity struct {
+	NodeName string // the node's MagicDNS name, such as "server.example.ts.net."
+	NodeID   string // the node's stable ID, such as "n123456CNTRL"
+
+	// User is the login name of the node's user, such as
+	// "alice@example.com", or its tags, comma-separated, if it's tagged.
+	User string
+}
+
+// Flow is the traffic in one direction of a connection during an interval.
+type Flow struct {
+	netlogtype.Connection // Src sent the traffic to Dst
+
+	// Egress is whether the traffic was sent by this node, rather than
+	// received by it.
+	Egress bool
+
+	Packets uint64
+	Bytes   uint64
+
+	Start, End time.Time
+
+	// SrcIdentity and DstIdentity optionally identify the nodes of the
+	// source and destination addresses. Flows with either are encoded
+	// with enterprise-specific information elements for both.
+	SrcIdentity, DstIdentity *Identity
+}
+
+// AppendFlows appends to dst the flows of the connections in cc, which were
+// counted from start to end. Each connection has up to two flows: one for
+// the traffic transmitted from its source to its destination, and one, with
+// source and destination swapped, for the traffic received.
+func AppendFlows(dst []Flow, start, end time.Time, cc []netlogtype.ConnectionCounts) []Flow {
+	for _, c := range cc {
+		if c.TxPackets > 0 || c.TxBytes > 0 {
+			dst = append(dst, Flow{
+				Connection: c.Connection,
+				Egress:     true,
+				Packets:    c.TxPackets,
+				Bytes:      c.TxBytes,
+				Start:      start,
+				End:        end,
+			})
+		}
+		if c.RxPackets > 0 || c.RxBytes > 0 {
+			rx := c.Connection
+			rx.Src, rx.Dst = rx.Dst, rx.Src
+			dst = append(dst, Flow{
+				Connection: rx,
+				Packets:    c.RxPackets,
+				Bytes:      c.RxBytes,
+				Start:      start,
+				End:        end,
+			})
+		}
+	}
+	return dst
+}
+
+// Information elements, from the IANA IPFIX registry. Those below 128 have
+// the same meaning in NetFlow v9.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieFlowEndSysUpTime         = 21 // LAST_SWITCHED in NetFlow v9
+	ieFlowStartSysUpTime       = 22 // FIRST_SWITCHED in NetFlow v9
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// Enterprise-specific information elements, for identities. In IPFIX, they
+// have the enterprise bit set and the Encoder's EnterpriseNumber. NetFlow
+// v9 has neither, so there they're field types with the high bit set, which
+// are conventionally vendor-specific.
+const (
+	enterpriseBit = 0x8000
+
+	eiSourceNodeName      = enterpriseBit | 1
+	eiSourceNodeID        = enterpriseBit | 2
+	eiSourceUser          = enterpriseBit | 3
+	eiDestinationNodeName = enterpriseBit | 4
+	eiDestinationNodeID   = enterpriseBit | 5
+	eiDestinationUser     = enterpriseBit | 6
+)
+
+const (
+	// variableLength is the field length of variable-length IPFIX
+	// information elements, whose lengths are encoded in records.
+	variableLength = 0xffff
+
+	// nfv9StringLen is the length of the string fields of NetFlow v9
+	// records, which has no variable-length fields. Longer strings are
+	// truncated, and shorter ones padded with NULs.
+	nfv9StringLen = 64
+)
+
+// Template IDs. IDs below 256 are reserved for sets other than data sets.
+const (
+	templateIPv4         = 256
+	templateIPv6         = 257
+	templateIPv4Identity = 258
+	templateIPv6Identity = 259
+)
+
+type fieldSpec struct {
+	id, length uint16
+}
+
+type template struct {
+	id     uint16
+	fields []fieldSpec
+}
+
+// templates returns the templates of flow records, for IPv4 and IPv6 flows,
+// without and with identities, indexed by template ID minus templateIPv4.
+// Flows between an IPv4 and an IPv6 address use an IPv6 template, with the
+// IPv4 address mapped.
+func (p Protocol) templates() [4]template {
+	addrLen := [2]uint16{4, 16}
+	srcAddr := [2]uint16{ieSourceIPv4Address, ieSourceIPv6Address}
+	dstAddr := [2]uint16{ieDestinationIPv4Address, ieDestinationIPv6Address}
+	strLen := uint16(variableLength)
+	if p == NetFlowV9 {
+		strLen = nfv9StringLen
+	}
+	var ts [4]template
+	for i := range ts {
+		af := i % 2
+		fields := []fieldSpec{
+			{srcAddr[af], addrLen[af]},
+			{dstAddr[af], addrLen[af]},
+			{ieSourceTransportPort, 2},
+			{ieDestinationTransportPort, 2},
+			{ieProtocolIdentifier, 1},
+			{ieFlowDirection, 1},
+			{ieOctetDeltaCount, 8},
+			{iePacketDeltaCount, 8},
+		}
+		if p == NetFlowV9 {
+			fields = append(fields, fieldSpec{ieFlowStartSysUpTime, 4}, fieldSpec{ieFlowEndSysUpTime, 4})
+		} else {
+			fields = append(fields, fieldSpec{ieFlowStartMilliseconds, 8}, fieldSpec{ieFlowEndMilliseconds, 8})
+		}
+		if i >= 2 {
+			for _, id := range []uint16{eiSourceNodeName, eiSourceNodeID, eiSourceUser, eiDestinationNodeName, eiDestinationNodeID, eiDestinationUser} {
+				fields = append(fields, fieldSpec{id, strLen})
+			}
+		}
+		ts[i] = template{id: templateIPv4 + uint16(i), fields: fields}
+	}
+	return ts
+}
+
+// appendTemplateRecord appends the template record of t to b.
+func (e *Encoder) appendTemplateRecord(b []byte, t *template) []byte {
+	b = binary.BigEndian.AppendUint16(b, t.id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.fields)))
+	for _, f := range t.fields {
+		b = binary.BigEndian.AppendUint16(b, f.id)
+		b = binary.BigEndian.AppendUint16(b, f.length)
+		if e.Protocol == IPFIX && f.id&enterpriseBit != 0 {
+			b = binary.BigEndian.AppendUint32(b, e.enterpriseNumber())
+		}
+	}
+	return b
+}
+
+// Encoder encodes flows as IPFIX or NetFlow v9 messages.
+//
+// Collectors need the templates that describe records to decode them. An
+// Encoder sends each template in the first message that uses it, and
+// resends it after TemplateRefresh or TemplateRefreshMessages, whichever
+// comes first, so that collectors that missed it or restarted recover.
+//
+// The exported fields must not be changed after the first call to Encode.
+type Encoder struct {
+	Protocol Protocol
+
+	// ObservationDomain is the observation domain ID (IPFIX), or source ID
+	// (NetFlow v9), that distinguishes this exporter's flows from those of
+	// others that send to the same collector.
+	ObservationDomain uint32
+
+	// MaxSize bounds the size of the encoded messages.
+	// Zero means DefaultMaxMessageSize.
+	MaxSize int
+
+	// TemplateRefresh and TemplateRefreshMessages are the time and the
+	// number of messages after which a template is resent. Zero means
+	// DefaultTemplateRefresh and DefaultTemplateRefreshMessages; one
+	// message means that every message carries its templates.
+	TemplateRefresh         time.Duration
+	TemplateRefreshMessages int
+
+	// EnterpriseNumber is the Private Enterprise Number of the IPFIX
+	// information elements of identities.
+	// Zero means DocumentationEnterpriseNumber.
+	EnterpriseNumber uint32
+
+	started bool
+	start   time.Time // for NetFlow v9 system uptime
+	seq     uint32    // data records (IPFIX) or messages (NetFlow v9) sent
+	msgs    int       // messages encoded
+	sent    [4]templateSent
+}
+
+// templateSent records when a template was last sent.
+type templateSent struct {
+	ok   bool
+	when time.Time
+	msg  int // value of Encoder.msgs
+}
+
+func (e *Encoder) enterpriseNumber() uint32 {
+	if e.EnterpriseNumber == 0 {
+		return DocumentationEnterpriseNumber
+	}
+	return e.EnterpriseNumber
+}
+
+// needsTemplate reports whether the message being encoded must carry t.
+func (e *Encoder) needsTemplate(t *template, now time.Time) bool {
+	s := e.sent[t.id-templateIPv4]
+	refresh, refreshMsgs := e.TemplateRefresh, e.TemplateRefreshMessages
+	if refresh <= 0 {
+		refresh = DefaultTemplateRefresh
+	}
+	if refreshMsgs <= 0 {
+		refreshMsgs = DefaultTemplateRefreshMessages
+	}
+	return !s.ok || now.Sub(s.when) >= refresh || e.msgs-s.msg >= refreshMsgs
+}
+
+// Message header and set header sizes.
+const (
+	ipfixHeaderLen = 16
+	nfv9HeaderLen  = 20
+	setHeaderLen   = 4
+)
+
+// Encode returns the messages that export flows at now. It returns no
+// messages if there are no flows.
+func (e *Encoder) Encode(now time.Time, flows []Flow) [][]byte {
+	if !e.started {
+		e.started = true
+		e.start = now
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+	maxSize := e.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	maxSize = min(maxSize, 1<<16-1) // IPFIX message lengths are 16 bits
+	ts := e.Protocol.templates()
+
+	var msgs [][]byte
+	m := new(message)
+	var rec []byte
+	for _, f := range flows {
+		i := 0
+		if !f.Src.Addr().Is4() || !f.Dst.Addr().Is4() {
+			i = 1
+		}
+		if f.SrcIdentity != nil || f.DstIdentity != nil {
+			i += 2
+		}
+		t := &ts[i]
+		rec = e.appendRecord(rec[:0], t, f)
+		if m.dataRecords > 0 && m.size(e)+m.cost(e, t, now, len(rec)) > maxSize {
+			msgs = append(msgs, e.finish(m, now))
+			m = new(message)
+		}
+		m.add(e, t, now, rec)
+	}
+	return append(msgs, e.finish(m, now))
+}
+
+// message is a message being encoded.
+type message struct {
+	templates   []*template // to send in the message
+	sets        []dataSet
+	dataRecords int
+}
+
+type dataSet struct {
+	t *template
+	b []byte // records
+}
+
+// size returns the encoded size of m, without padding.
+func (m *message) size(e *Encoder) int {
+	n := ipfixHeaderLen
+	if e.Protocol == NetFlowV9 {
+		n = nfv9HeaderLen
+	}
+	if len(m.templates) > 0 {
+		n += setHeaderLen + 3
+		for _, t := range m.templates {
+			n += len(e.appendTemplateRecord(nil, t))
+		}
+	}
+	for _, s := range m.sets {
+		n += setHeaderLen + 3 + len(s.b)
+	}
+	return n
+}
+
+// cost returns how much adding a record of recLen bytes with template t
+// grows m.
+func (m *message) cost(e *Encoder, t *template, now time.Time, recLen int) int {
+	n := recLen
+	if len(m.sets) == 0 || m.sets[len(m.sets)-1].t != t {
+		n += setHeaderLen + 3
+	}
+	if !m.hasTemplate(t) && e.needsTemplate(t, now) {
+		n += len(e.appendTemplateRecord(nil, t))
+		if len(m.templates) == 0 {
+			n += setHeaderLen + 3
+		}
+	}
+	return n
+}
+
+func (m *message) hasTemplate(t *template) bool {
+	for _, mt := range m.templates {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds the record rec, of template t, to m.
+func (m *message) add(e *Encoder, t *template, now time.Time, rec []byte) {
+	if !m.hasTemplate(t) && e.needsTemplate(t, now) {
+		m.templates = append(m.templates, t)
+	}
+	if len(m.sets) == 0 || m.sets[len(m.sets)-1].t != t {
+		m.sets = append(m.sets, dataSet{t: t})
+	}
+	s := &m.sets[len(m.sets)-1]
+	s.b = append(s.b, rec...)
+	m.dataRecords++
+}
+
+// finish encodes m, records that its templates were sent, and returns it.
+func (e *Encoder) finish(m *message, now time.Time) []byte {
+	hdrLen := ipfixHeaderLen
+	templateSet := uint16(2)
+	if e.Protocol == NetFlowV9 {
+		hdrLen = nfv9HeaderLen
+		templateSet = 0
+	}
+	b := make([]byte, hdrLen, DefaultMaxMessageSize)
+	records := m.dataRecords
+	if len(m.templates) > 0 {
+		start := len(b)
+		b = appendSetHeader(b, templateSet)
+		for _, t := range m.templates {
+			b = e.appendTemplateRecord(b, t)
+			e.sent[t.id-templateIPv4] = templateSent{ok: true, when: now, msg: e.msgs}
+		}
+		b = e.endSet(b, start)
+		records += len(m.templates)
+	}
+	for _, s := range m.sets {
+		start := len(b)
+		b = appendSetHeader(b, s.t.id)
+		b = append(b, s.b...)
+		b = e.endSet(b, start)
+	}
+	e.msgs++
+
+	switch e.Protocol {
+	case NetFlowV9:
+		binary.BigEndian.PutUint16(b[0:], 9)
+		binary.BigEndian.PutUint16(b[2:], uint16(records))
+		binary.BigEndian.PutUint32(b[4:], e.sysUptime(now))
+		binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[12:], e.seq)
+		binary.BigEndian.PutUint32(b[16:], e.ObservationDomain)
+		e.seq++
+	default:
+		binary.BigEndian.PutUint16(b[0:], 10)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[8:], e.seq)
+		binary.BigEndian.PutUint32(b[12:], e.ObservationDomain)
+		e.seq += uint32(m.dataRecords)
+	}
+	return b
+}
+
+func appendSetHeader(b []byte, id uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	return binary.BigEndian.AppendUint16(b, 0) // length, set by endSet
+}
+
+// endSet pads the set that starts at b[start:], if needed, and sets its
+// length.
+func (e *Encoder) endSet(b []byte, start int) []byte {
+	if e.Protocol == NetFlowV9 {
+		// RFC 3954 says flowsets should be padded to 32 bits; IPFIX
+		// collectors don't need padding, so it's omitted there.
+		for (len(b)-start)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// sysUptime returns the NetFlow v9 system uptime at t, in milliseconds
+// since the first call to Encode.
+func (e *Encoder) sysUptime(t time.Time) uint32 {
+	return uint32(max(t.Sub(e.start).Milliseconds(), 0))
+}
+
+func (e *Encoder) appendRecord(b []byte, t *template, f Flow) []byte {
+	var src, dst Identity
+	if f.SrcIdentity != nil {
+		src = *f.SrcIdentity
+	}
+	if f.DstIdentity != nil {
+		dst = *f.DstIdentity
+	}
+	for _, fs := range t.fields {
+		switch fs.id {
+		case ieSourceIPv4Address, ieSourceIPv6Address:
+			b = appendAddr(b, f.Src.Addr(), fs.length)
+		case ieDestinationIPv4Address, ieDestinationIPv6Address:
+			b = appendAddr(b, f.Dst.Addr(), fs.length)
+		case ieSourceTransportPort:
+			b = binary.BigEndian.AppendUint16(b, f.Src.Port())
+		case ieDestinationTransportPort:
+			b = binary.BigEndian.AppendUint16(b, f.Dst.Port())
+		case ieProtocolIdentifier:
+			b = append(b, byte(f.Proto))
+		case ieFlowDirection:
+			if f.Egress {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case ieOctetDeltaCount:
+			b = binary.BigEndian.AppendUint64(b, f.Bytes)
+		case iePacketDeltaCount:
+			b = binary.BigEndian.AppendUint64(b, f.Packets)
+		case ieFlowStartMilliseconds:
+			b = binary.BigEndian.AppendUint64(b, uint64(f.Start.UnixMilli()))
+		case ieFlowEndMilliseconds:
+			b = binary.BigEndian.AppendUint64(b, uint64(f.End.UnixMilli()))
+		case ieFlowStartSysUpTime:
+			b = binary.BigEndian.AppendUint32(b, e.sysUptime(f.Start))
+		case ieFlowEndSysUpTime:
+			b = binary.BigEndian.AppendUint32(b, e.sysUptime(f.End))
+		case eiSourceNodeName:
+			b = appendString(b, src.NodeName, fs.length)
+		case eiSourceNodeID:
+			b = appendString(b, src.NodeID, fs.length)
+		case eiSourceUser:
+			b = appendString(b, src.User, fs.length)
+		case eiDestinationNodeName:
+			b = appendString(b, dst.NodeName, fs.length)
+		case eiDestinationNodeID:
+			b = appendString(b, dst.NodeID, fs.length)
+		case eiDestinationUser:
+			b = appendString(b, dst.User, fs.length)
+		default:
+			panic(fmt.Sprintf("unhandled information element %d", fs.id))
+		}
+	}
+	return b
+}
+
+// appendAddr appends a, which is zero if invalid, as an IPv4 address if
+// n is 4, or as an IPv6 address.
+func appendAddr(b []byte, a netip.Addr, n uint16) []byte {
+	if n == 4 {
+		if !a.Is4() {
+			return append(b, 0, 0, 0, 0)
+		}
+		a4 := a.As4()
+		return append(b, a4[:]...)
+	}
+	if !a.IsValid() {
+		return append(b, make([]byte, 16)...)
+	}
+	a16 := a.As16()
+	return append(b, a16[:]...)
+}
+
+// appendString appends s as a field of length n: variable-length, as in RFC
+// 7011 section 7, if n is variableLength, or else truncated or padded with
+// NULs to n bytes.
+func appendString(b []byte, s string, n uint16) []byte {
+	if n != variableLength {
+		s = s[:min(len(s), int(n))]
+		b = append(b, s...)
+		return append(b, make([]byte, int(n)-len(s))...)
+	}
+	// Stay well below the maximum message size.
+	s = s[:min(len(s), 255)]
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		b = append(b, 255)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,441 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flowexport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// decodedMessage is a message, as decoded by a collector.
+type decodedMessage struct {
+	version   uint16
+	count     uint16 // NetFlow v9 only
+	seq       uint32
+	domain    uint32
+	templates []uint16            // IDs of the templates in the message
+	records   []map[uint16][]byte // by information element
+}
+
+// collector decodes messages of protocol p, remembering their templates.
+type collector struct {
+	p         Protocol
+	pen       uint32 // enterprise number of enterprise-specific fields
+	templates map[uint16][]fieldSpec
+}
+
+func newCollector(p Protocol) *collector {
+	return &collector{p: p, templates: make(map[uint16][]fieldSpec)}
+}
+
+// decode decodes msg.
+func (c *collector) decode(t *testing.T, msg []byte) decodedMessage {
+	t.Helper()
+	var d decodedMessage
+	be := binary.BigEndian
+	d.version = be.Uint16(msg)
+	var b []byte
+	templateSet := uint16(2)
+	switch c.p {
+	case NetFlowV9:
+		d.count = be.Uint16(msg[2:])
+		d.seq = be.Uint32(msg[12:])
+		d.domain = be.Uint32(msg[16:])
+		b = msg[nfv9HeaderLen:]
+		templateSet = 0
+	default:
+		if n := int(be.Uint16(msg[2:])); n != len(msg) {
+			t.Fatalf("message length %d; want %d", n, len(msg))
+		}
+		d.seq = be.Uint32(msg[8:])
+		d.domain = be.Uint32(msg[12:])
+		b = msg[ipfixHeaderLen:]
+	}
+	for len(b) > 0 {
+		id := be.Uint16(b)
+		n := int(be.Uint16(b[2:]))
+		if n < setHeaderLen || n > len(b) {
+			t.Fatalf("bad set length %d", n)
+		}
+		if c.p == NetFlowV9 && n%4 != 0 {
+			t.Errorf("flowset length %d isn't padded", n)
+		}
+		body := b[setHeaderLen:n]
+		b = b[n:]
+		if id == templateSet {
+			for len(body) >= 4 {
+				tid := be.Uint16(body)
+				nf := int(be.Uint16(body[2:]))
+				body = body[4:]
+				var fields []fieldSpec
+				for range nf {
+					f := fieldSpec{be.Uint16(body), be.Uint16(body[2:])}
+					body = body[4:]
+					if c.p == IPFIX && f.id&enterpriseBit != 0 {
+						c.pen = be.Uint32(body)
+						body = body[4:]
+					}
+					fields = append(fields, f)
+				}
+				c.templates[tid] = fields
+				d.templates = append(d.templates, tid)
+			}
+			continue
+		}
+		fields, ok := c.templates[id]
+		if !ok {
+			t.Fatalf("data set %d has no template", id)
+		}
+		for len(body) > 3 { // more than NetFlow v9 padding
+			rec := make(map[uint16][]byte)
+			for _, f := range fields {
+				n := int(f.length)
+				if n == variableLength {
+					n = int(body[0])
+					body = body[1:]
+					if n == 255 {
+						n = int(be.Uint16(body))
+						body = body[2:]
+					}
+				}
+				rec[f.id] = body[:n]
+				body = body[n:]
+			}
+			d.records = append(d.records, rec)
+		}
+	}
+	return d
+}
+
+// decode decodes msg, a message of protocol p that carries its templates.
+func decode(t *testing.T, p Protocol, msg []byte) decodedMessage {
+	t.Helper()
+	return newCollector(p).decode(t, msg)
+}
+
+var (
+	testStart = time.Unix(1700000000, 0)
+	testEnd   = testStart.Add(5 * time.Second)
+	testConns = []netlogtype.ConnectionCounts{{
+		Connection: netlogtype.Connection{
+			Proto: ipproto.TCP,
+			Src:   netip.MustParseAddrPort("100.64.0.1:1234"),
+			Dst:   netip.MustParseAddrPort("100.64.0.2:22"),
+		},
+		Counts: netlogtype.Counts{TxPackets: 10, TxBytes: 1000, RxPackets: 20, RxBytes: 3000},
+	}, {
+		Connection: netlogtype.Connection{
+			Proto: ipproto.UDP,
+			Src:   netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:53"),
+			Dst:   netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:5353"),
+		},
+		Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 100},
+	}}
+)
+
+func TestAppendFlows(t *testing.T) {
+	got := AppendFlows(nil, testStart, testEnd, testConns)
+	want := []Flow{
+		{Connection: testConns[0].Connection, Egress: true, Packets: 10, Bytes: 1000, Start: testStart, End: testEnd},
+		{
+			Connection: netlogtype.Connection{Proto: ipproto.TCP, Src: testConns[0].Dst, Dst: testConns[0].Src},
+			Packets:    20, Bytes: 3000, Start: testStart, End: testEnd,
+		},
+		{Connection: testConns[1].Connection, Egress: true, Packets: 1, Bytes: 100, Start: testStart, End: testEnd},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AppendFlows:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	flows := AppendFlows(nil, testStart, testEnd, testConns)
+	for _, p := range []Protocol{IPFIX, NetFlowV9} {
+		t.Run(p.String(), func(t *testing.T) {
+			e := &Encoder{Protocol: p, ObservationDomain: 7}
+			msgs := e.Encode(testEnd, flows)
+			if len(msgs) != 1 {
+				t.Fatalf("got %d messages; want 1", len(msgs))
+			}
+			c := newCollector(p)
+			d := c.decode(t, msgs[0])
+			wantVersion := uint16(10)
+			if p == NetFlowV9 {
+				wantVersion = 9
+				if d.count != 2+3 {
+					t.Errorf("count = %d; want 5", d.count)
+				}
+			}
+			if d.version != wantVersion || d.domain != 7 || d.seq != 0 {
+				t.Errorf("version, domain, seq = %d, %d, %d; want %d, 7, 0", d.version, d.domain, d.seq, wantVersion)
+			}
+			if len(d.templates) != 2 || len(d.records) != 3 {
+				t.Fatalf("got %d templates, %d records; want 2, 3", len(d.templates), len(d.records))
+			}
+
+			rx := d.records[1]
+			if got := netip.AddrFrom4([4]byte(rx[ieSourceIPv4Address])); got != testConns[0].Dst.Addr() {
+				t.Errorf("source = %v; want %v", got, testConns[0].Dst.Addr())
+			}
+			if got := binary.BigEndian.Uint16(rx[ieSourceTransportPort]); got != 22 {
+				t.Errorf("source port = %d; want 22", got)
+			}
+			if got := rx[ieProtocolIdentifier][0]; got != byte(ipproto.TCP) {
+				t.Errorf("protocol = %d; want TCP", got)
+			}
+			if got := rx[ieFlowDirection][0]; got != 0 {
+				t.Errorf("direction = %d; want 0 (ingress)", got)
+			}
+			if got := binary.BigEndian.Uint64(rx[ieOctetDeltaCount]); got != 3000 {
+				t.Errorf("octets = %d; want 3000", got)
+			}
+			if got := binary.BigEndian.Uint64(rx[iePacketDeltaCount]); got != 20 {
+				t.Errorf("packets = %d; want 20", got)
+			}
+			if p == IPFIX {
+				if got := binary.BigEndian.Uint64(rx[ieFlowEndMilliseconds]); got != uint64(testEnd.UnixMilli()) {
+					t.Errorf("flow end = %d; want %d", got, testEnd.UnixMilli())
+				}
+			}
+
+			tx6 := d.records[2]
+			if got := netip.AddrFrom16([16]byte(tx6[ieDestinationIPv6Address])); got != testConns[1].Dst.Addr() {
+				t.Errorf("IPv6 destination = %v; want %v", got, testConns[1].Dst.Addr())
+			}
+			if got := tx6[ieFlowDirection][0]; got != 1 {
+				t.Errorf("direction = %d; want 1 (egress)", got)
+			}
+
+			// Sequence numbers count data records in IPFIX, and
+			// messages in NetFlow v9. The templates were just sent,
+			// so the second message doesn't repeat them.
+			d = c.decode(t, e.Encode(testEnd, flows)[0])
+			wantSeq := uint32(3)
+			if p == NetFlowV9 {
+				wantSeq = 1
+			}
+			if d.seq != wantSeq {
+				t.Errorf("second message seq = %d; want %d", d.seq, wantSeq)
+			}
+			if len(d.templates) != 0 || len(d.records) != 3 {
+				t.Errorf("second message has %d templates, %d records; want 0, 3", len(d.templates), len(d.records))
+			}
+		})
+	}
+}
+
+func TestEncodeSplit(t *testing.T) {
+	var flows []Flow
+	for i := range 100 {
+		flows = append(flows, Flow{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.UDP,
+				Src:   netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), uint16(i)),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:53"),
+			},
+			Packets: 1,
+			Bytes:   100,
+		})
+	}
+	for _, p := range []Protocol{IPFIX, NetFlowV9} {
+		e := &Encoder{Protocol: p, MaxSize: 512}
+		msgs := e.Encode(testEnd, flows)
+		if len(msgs) < 2 {
+			t.Fatalf("%v: got %d messages; want several", p, len(msgs))
+		}
+		c := newCollector(p)
+		var n int
+		for _, msg := range msgs {
+			if len(msg) > 512 {
+				t.Errorf("%v: message of %d bytes; want at most 512", p, len(msg))
+			}
+			n += len(c.decode(t, msg).records)
+		}
+		if n != len(flows) {
+			t.Errorf("%v: got %d records; want %d", p, n, len(flows))
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	x, err := NewExporter(Config{Protocol: IPFIX, Collector: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	c := newCollector(IPFIX)
+	read := func() decodedMessage {
+		t.Helper()
+		buf := make([]byte, 2048)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.decode(t, buf[:n])
+	}
+
+	if err := x.Export(testStart, testEnd, testConns); err != nil {
+		t.Fatal(err)
+	}
+	if d := read(); len(d.records) != 3 {
+		t.Errorf("got %d records; want 3", len(d.records))
+	}
+
+	// Once identities are set, flows between tailnet IPs get them.
+	x.SetIdentities(map[netip.Addr]Identity{
+		netip.MustParseAddr("100.64.0.1"): {NodeName: "self.example.ts.net.", NodeID: "nSELF", User: "alice@example.com"},
+		netip.MustParseAddr("100.64.0.2"): {NodeName: "server.example.ts.net.", NodeID: "nSERVER", User: "tag:server"},
+	})
+	if err := x.Export(testStart, testEnd, testConns); err != nil {
+		t.Fatal(err)
+	}
+	d := read()
+	if !slices.Contains(d.templates, templateIPv4Identity) {
+		t.Errorf("templates = %v; want %d", d.templates, templateIPv4Identity)
+	}
+	if len(d.records) != 3 {
+		t.Fatalf("got %d records; want 3", len(d.records))
+	}
+	rx := d.records[1]
+	if got := string(rx[eiSourceNodeName]); got != "server.example.ts.net." {
+		t.Errorf("source node name = %q; want server.example.ts.net.", got)
+	}
+	if got := string(rx[eiDestinationUser]); got != "alice@example.com" {
+		t.Errorf("destination user = %q; want alice@example.com", got)
+	}
+	if _, ok := d.records[2][eiSourceNodeName]; ok {
+		t.Errorf("IPv6 flow without identities has identity fields")
+	}
+}
+
+func TestTemplateRefresh(t *testing.T) {
+	flows := AppendFlows(nil, testStart, testEnd, testConns[:1])
+	e := &Encoder{Protocol: IPFIX, TemplateRefresh: time.Minute, TemplateRefreshMessages: 3}
+	c := newCollector(IPFIX)
+	now := testEnd
+	var got []int
+	for range 7 {
+		got = append(got, len(c.decode(t, e.Encode(now, flows)[0]).templates))
+	}
+	if want := []int{1, 0, 0, 1, 0, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("templates per message = %v; want %v", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	if d := c.decode(t, e.Encode(now, flows)[0]); len(d.templates) != 1 {
+		t.Errorf("got %d templates a minute later; want 1", len(d.templates))
+	}
+
+	// Only the templates of the records in a message are sent.
+	flows[0].SrcIdentity = &Identity{NodeName: "self.example.ts.net."}
+	if d := c.decode(t, e.Encode(now, flows)[0]); !slices.Equal(d.templates, []uint16{templateIPv4Identity}) {
+		t.Errorf("templates = %v; want [%d]", d.templates, templateIPv4Identity)
+	}
+}
+
+func TestIdentityFields(t *testing.T) {
+	flows := AppendFlows(nil, testStart, testEnd, testConns[:1])
+	self := &Identity{NodeName: "self.example.ts.net.", NodeID: "nSELF", User: "alice@example.com"}
+	flows[0].SrcIdentity = self
+	flows[1].DstIdentity = self
+	for _, p := range []Protocol{IPFIX, NetFlowV9} {
+		t.Run(p.String(), func(t *testing.T) {
+			e := &Encoder{Protocol: p, EnterpriseNumber: 12345}
+			c := newCollector(p)
+			d := c.decode(t, e.Encode(testEnd, flows)[0])
+			if !slices.Equal(d.templates, []uint16{templateIPv4Identity}) {
+				t.Errorf("templates = %v; want [%d]", d.templates, templateIPv4Identity)
+			}
+			if p == IPFIX && c.pen != 12345 {
+				t.Errorf("enterprise number = %d; want 12345", c.pen)
+			}
+			tx, rx := d.records[0], d.records[1]
+			for _, tt := range []struct {
+				rec  map[uint16][]byte
+				id   uint16
+				want string
+			}{
+				{tx, eiSourceNodeName, "self.example.ts.net."},
+				{tx, eiSourceNodeID, "nSELF"},
+				{tx, eiSourceUser, "alice@example.com"},
+				{tx, eiDestinationNodeName, ""},
+				{rx, eiDestinationUser, "alice@example.com"},
+				{rx, eiSourceNodeID, ""},
+			} {
+				b := tt.rec[tt.id]
+				if p == NetFlowV9 {
+					// Strings are NUL-padded to a fixed length.
+					if len(b) != nfv9StringLen {
+						t.Errorf("field %#x has length %d; want %d", tt.id, len(b), nfv9StringLen)
+					}
+					b = bytes.TrimRight(b, "\x00")
+				}
+				if string(b) != tt.want {
+					t.Errorf("field %#x = %q; want %q", tt.id, b, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	x, err := NewExporter(Config{Protocol: NetFlowV9, Collector: pc.LocalAddr().String(), ObservationDomain: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	// Physical connections aren't exported.
+	conn := testConns[0].Connection
+	x.Dump(testStart, testEnd,
+		map[netlogtype.Connection]netlogtype.Counts{conn: {TxPackets: 1, TxBytes: 100}},
+		map[netlogtype.Connection]netlogtype.Counts{{Src: conn.Src, Dst: netip.MustParseAddrPort("192.0.2.1:41641")}: {TxPackets: 1, TxBytes: 132}})
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := decode(t, NetFlowV9, buf[:n])
+	if d.domain != 7 || len(d.records) != 1 {
+		t.Fatalf("got domain %d, %d records; want 7, 1", d.domain, len(d.records))
+	}
+	if got := netip.AddrFrom4([4]byte(d.records[0][ieDestinationIPv4Address])); got != conn.Dst.Addr() {
+		t.Errorf("destination = %v; want %v", got, conn.Dst.Addr())
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for _, p := range []Protocol{IPFIX, NetFlowV9} {
+		if got, err := ParseProtocol(p.String()); err != nil || got != p {
+			t.Errorf("ParseProtocol(%q) = %v, %v; want %v", p, got, err, p)
+		}
+	}
+	if _, err := ParseProtocol("sflow"); err == nil {
+		t.Error("ParseProtocol(sflow) succeeded; want error")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/types/opt"
+	"tailscale.com/util/ringbuffer"
+)
+
+const (
+	// historySize is the number of reports a History holds.
+	historySize = 360
+
+	// historyInterval is how often a History records a report that's
+	// materially the same as the previous one. With historySize, it
+	// makes a History of steady network conditions cover 30 hours.
+	historyInterval = 5 * time.Minute
+)
+
+// HistoryEntry is a report in a History.
+type HistoryEntry struct {
+	Time   time.Time
+	Report *Report
+}
+
+// History is a bounded history of reports, for debugging how network
+// conditions changed over time.
+//
+// Reports are recorded when they differ materially from the previous
+// report (in NAT behavior, port mapping, preferred DERP, global
+// addresses, or captive portal), and otherwise at most every
+// historyInterval, so that it covers a longer span than recording every
+// report would.
+type History struct {
+	rb *ringbuffer.RingBuffer[HistoryEntry]
+
+	mu   sync.Mutex
+	last HistoryEntry // last recorded entry, or zero
+}
+
+// NewHistory returns a new, empty History.
+func NewHistory() *History {
+	return &History{rb: ringbuffer.New[HistoryEntry](historySize)}
+}
+
+// Add records r, which was generated at now, if it's due to be recorded.
+// It does nothing if h is nil.
+func (h *History) Add(now time.Time, r *Report) {
+	if h == nil || r == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last.Report != nil && now.Sub(h.last.Time) < historyInterval &&
+		len(reportChanges(h.last.Report, r)) == 0 {
+		return
+	}
+	h.last = HistoryEntry{Time: now, Report: r.Clone()}
+	h.rb.Add(h.last)
+}
+
+// Entries returns the recorded entries, oldest first.
+// It returns nil if h is nil.
+func (h *History) Entries() []HistoryEntry {
+	if h == nil {
+		return nil
+	}
+	return h.rb.GetAll()
+}
+
+// HistoryChange is a material change between two consecutive reports.
+type HistoryChange struct {
+	Time     time.Time // of the report with the change
+	Field    string    // such as "MappingVariesByDestIP"
+	From, To string
+}
+
+// LatencySummary summarizes the latencies to a DERP region over a history.
+type LatencySummary struct {
+	Samples          int
+	Min, Median, Max time.Duration
+	Last             time.Duration
+}
+
+// HistorySummary summarizes how network conditions changed over a history.
+type HistorySummary struct {
+	Start, End time.Time // of the first and last reports
+	Reports    int
+
+	// Changes are the material changes between reports, oldest first.
+	Changes []HistoryChange
+
+	// RegionLatency summarizes the latency to each DERP region, keyed by
+	// region ID.
+	RegionLatency map[int]LatencySummary
+}
+
+// SummarizeHistory summarizes entries, which are oldest first.
+func SummarizeHistory(entries []HistoryEntry) HistorySummary {
+	var s HistorySummary
+	if len(entries) == 0 {
+		return s
+	}
+	s.Start = entries[0].Time
+	s.End = entries[len(entries)-1].Time
+	s.Reports = len(entries)
+
+	latencies := map[int][]time.Duration{}
+	var last map[int]time.Duration
+	for i, e := range entries {
+		if i > 0 {
+			for _, c := range reportChanges(entries[i-1].Report, e.Report) {
+				c.Time = e.Time
+				s.Changes = append(s.Changes, c)
+			}
+		}
+		for rid, d := range e.Report.RegionLatency {
+			latencies[rid] = append(latencies[rid], d)
+		}
+		last = e.Report.RegionLatency
+	}
+
+	s.RegionLatency = map[int]LatencySummary{}
+	for rid, ds := range latencies {
+		slices.Sort(ds)
+		s.RegionLatency[rid] = LatencySummary{
+			Samples: len(ds),
+			Min:     ds[0],
+			Median:  ds[len(ds)/2],
+			Max:     ds[len(ds)-1],
+			Last:    last[rid],
+		}
+	}
+	return s
+}
+
+// historyFields are the fields of a Report whose changes are material.
+var historyFields = []struct {
+	name string
+	get  func(*Report) string
+}{
+	{"UDP", func(r *Report) string { return strconv.FormatBool(r.UDP) }},
+	{"IPv4", func(r *Report) string { return strconv.FormatBool(r.IPv4) }},
+	{"IPv6", func(r *Report) string { return strconv.FormatBool(r.IPv6) }},
+	{"MappingVariesByDestIP", func(r *Report) string { return optBoolString(r.MappingVariesByDestIP) }},
+	{"UPnP", func(r *Report) string { return optBoolString(r.UPnP) }},
+	{"PMP", func(r *Report) string { return optBoolString(r.PMP) }},
+	{"PCP", func(r *Report) string { return optBoolString(r.PCP) }},
+	{"PreferredDERP", func(r *Report) string { return strconv.Itoa(r.PreferredDERP) }},
+	// Only the addresses, as the ports may change with every mapping.
+	{"GlobalV4", func(r *Report) string { return addrString(r.GlobalV4.Addr()) }},
+	{"GlobalV6", func(r *Report) string { return addrString(r.GlobalV6.Addr()) }},
+	{"CaptivePortal", func(r *Report) string { return optBoolString(r.CaptivePortal) }},
+}
+
+// reportChanges returns the material changes from a to b.
+func reportChanges(a, b *Report) []HistoryChange {
+	var ret []HistoryChange
+	for _, f := range historyFields {
+		if from, to := f.get(a), f.get(b); from != to {
+			ret = append(ret, HistoryChange{Field: f.name, From: from, To: to})
+		}
+	}
+	return ret
+}
+
+func optBoolString(b opt.Bool) string {
+	v, ok := b.Get()
+	if !ok {
+		return "unknown"
+	}
+	return strconv.FormatBool(v)
+}
+
+func addrString(a netip.Addr) string {
+	if !a.IsValid() {
+		return "none"
+	}
+	return a.String()
+}
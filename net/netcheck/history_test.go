@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/types/opt"
+)
+
+func TestHistory(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	report := func(derp int, varies bool, latency time.Duration) *Report {
+		return &Report{
+			UDP:                   true,
+			IPv4:                  true,
+			PreferredDERP:         derp,
+			MappingVariesByDestIP: opt.NewBool(varies),
+			GlobalV4:              netip.MustParseAddrPort("1.2.3.4:5678"),
+			RegionLatency:         map[int]time.Duration{derp: latency},
+		}
+	}
+
+	var nilHistory *History
+	nilHistory.Add(start, report(1, false, time.Millisecond))
+	if got := nilHistory.Entries(); got != nil {
+		t.Errorf("nil History has entries %v", got)
+	}
+
+	h := NewHistory()
+	h.Add(start, report(1, false, 10*time.Millisecond))
+	// Same as the last recorded report, and too soon: not recorded.
+	h.Add(start.Add(time.Minute), report(1, false, 20*time.Millisecond))
+	// A new port is not a material change.
+	r := report(1, false, 20*time.Millisecond)
+	r.GlobalV4 = netip.MustParseAddrPort("1.2.3.4:1")
+	h.Add(start.Add(2*time.Minute), r)
+	// Material change: recorded.
+	h.Add(start.Add(3*time.Minute), report(2, true, 30*time.Millisecond))
+	// No change, but due.
+	h.Add(start.Add(9*time.Minute), report(2, true, 50*time.Millisecond))
+
+	entries := h.Entries()
+	var times []time.Duration
+	for _, e := range entries {
+		times = append(times, e.Time.Sub(start))
+	}
+	if want := []time.Duration{0, 3 * time.Minute, 9 * time.Minute}; !reflect.DeepEqual(times, want) {
+		t.Fatalf("recorded reports at %v; want %v", times, want)
+	}
+
+	s := SummarizeHistory(entries)
+	if s.Reports != 3 || !s.Start.Equal(start) || !s.End.Equal(start.Add(9*time.Minute)) {
+		t.Errorf("summary covers %d reports from %v to %v", s.Reports, s.Start, s.End)
+	}
+	wantChanges := []HistoryChange{
+		{Time: start.Add(3 * time.Minute), Field: "MappingVariesByDestIP", From: "false", To: "true"},
+		{Time: start.Add(3 * time.Minute), Field: "PreferredDERP", From: "1", To: "2"},
+	}
+	if !reflect.DeepEqual(s.Changes, wantChanges) {
+		t.Errorf("changes = %+v; want %+v", s.Changes, wantChanges)
+	}
+	wantLatency := map[int]LatencySummary{
+		1: {Samples: 1, Min: 10 * time.Millisecond, Median: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+		2: {Samples: 2, Min: 30 * time.Millisecond, Median: 50 * time.Millisecond, Max: 50 * time.Millisecond, Last: 50 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(s.RegionLatency, wantLatency) {
+		t.Errorf("latency = %+v; want %+v", s.RegionLatency, wantLatency)
+	}
+
+	if got := SummarizeHistory(nil); got.Reports != 0 {
+		t.Errorf("empty summary = %+v", got)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/net/netaddr"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/nettype"
+)
+
+// NATBehavior is the mapping or filtering behavior of a NAT, as defined by
+// RFC 4787.
+type NATBehavior string
+
+const (
+	// EndpointIndependent means the NAT reuses a mapping for all
+	// destinations (mapping), or lets in packets from any source to a
+	// mapping (filtering).
+	EndpointIndependent NATBehavior = "endpoint-independent"
+	// AddressDependent means the NAT reuses a mapping only for the same
+	// destination IP (mapping), or lets in packets only from IPs that the
+	// mapping was used to send to (filtering).
+	AddressDependent NATBehavior = "address-dependent"
+	// AddressAndPortDependent means the NAT reuses a mapping only for the
+	// same destination IP and port (mapping), or lets in packets only from
+	// IPs and ports that the mapping was used to send to (filtering).
+	AddressAndPortDependent NATBehavior = "address-and-port-dependent"
+)
+
+// NATType is the behavior of a NAT, as discovered by ClassifyNAT.
+type NATType struct {
+	Mapping     NATBehavior
+	Filtering   NATBehavior
+	Hairpinning bool // packets sent to our own mapped address came back
+}
+
+// ErrNoRFC5780 is returned by ClassifyNAT when the STUN server doesn't
+// support RFC 5780 NAT behavior discovery.
+var ErrNoRFC5780 = errors.New("STUN server doesn't support RFC 5780")
+
+// errNoSTUNResponse is returned by ClassifyNAT when the STUN server didn't
+// respond to a test that it must respond to.
+var errNoSTUNResponse = errors.New("no STUN response")
+
+// Timing of the RFC 5780 tests. They're variables for tests.
+var (
+	// natTestTimeout is how long a test waits for a response. The
+	// filtering tests and the hairpinning test wait this long when the
+	// NAT drops the response.
+	natTestTimeout = time.Second
+	// natTestRetransmit is how often a test retransmits its request while
+	// it waits for a response.
+	natTestRetransmit = 200 * time.Millisecond
+)
+
+// ClassifyNAT discovers the behavior of the NAT between pc and server, an
+// IPv4 STUN server that supports RFC 5780, using the tests in RFC 5780
+// Section 4. It returns ErrNoRFC5780 if server doesn't support them.
+//
+// pc should be a new socket, so that the NAT has no mappings for it yet,
+// and must not be read from by anything else until ClassifyNAT returns.
+func ClassifyNAT(ctx context.Context, pc nettype.PacketConn, server netip.AddrPort) (NATType, error) {
+	t := &natTester{pc: pc, ch: make(chan natPacket, 16)}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		t.readLoop()
+	}()
+	defer func() {
+		// Break the read loop without closing pc, which the caller owns.
+		pc.SetReadDeadline(time.Unix(1, 0))
+		<-readDone
+		pc.SetReadDeadline(time.Time{})
+	}()
+	return t.classify(ctx, server)
+}
+
+// natPacket is a STUN packet received by a natTester.
+type natPacket struct {
+	src     netip.AddrPort
+	tx      stun.TxID
+	request bool // a binding request, rather than a response
+	addrs   stun.ResponseAddrs
+}
+
+type natTester struct {
+	pc nettype.PacketConn
+	ch chan natPacket
+}
+
+func (t *natTester) readLoop() {
+	var buf [64 << 10]byte
+	for {
+		n, src, err := t.pc.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			return
+		}
+		pkt := buf[:n]
+		if !stun.Is(pkt) {
+			continue
+		}
+		p := natPacket{src: netaddr.Unmap(src)}
+		if tx, err := stun.ParseBindingRequest(pkt); err == nil {
+			p.tx, p.request = tx, true
+		} else if tx, addrs, err := stun.ParseResponseAddrs(pkt); err == nil {
+			p.tx, p.addrs = tx, addrs
+		} else {
+			continue
+		}
+		select {
+		case t.ch <- p:
+		default:
+			// Drop it, as the network might.
+		}
+	}
+}
+
+// exchange sends pkt, a binding request with transaction ID tx, to dst until
+// it receives a packet with the same transaction ID or natTestTimeout
+// passes, in which case it returns errNoSTUNResponse.
+func (t *natTester) exchange(ctx context.Context, dst netip.AddrPort, tx stun.TxID, pkt []byte) (natPacket, error) {
+	ctx, cancel := context.WithTimeout(ctx, natTestTimeout)
+	defer cancel()
+	retransmit := time.NewTicker(natTestRetransmit)
+	defer retransmit.Stop()
+	for {
+		if _, err := t.pc.WriteToUDPAddrPort(pkt, dst); err != nil {
+			return natPacket{}, err
+		}
+		select {
+		case p := <-t.ch:
+			if p.tx == tx {
+				return p, nil
+			}
+			// A late response to an earlier test; ignore it. Note
+			// that this also retransmits, which is harmless.
+		case <-retransmit.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return natPacket{}, errNoSTUNResponse
+			}
+			return natPacket{}, ctx.Err()
+		}
+	}
+}
+
+// test sends a binding request to dst, asking the server to respond from
+// its alternate IP and/or port, and returns the response. It returns an
+// error if the response doesn't come from wantSrc, which means the server
+// ignored the CHANGE-REQUEST.
+func (t *natTester) test(ctx context.Context, dst, wantSrc netip.AddrPort, changeIP, changePort bool) (stun.ResponseAddrs, error) {
+	tx := stun.NewTxID()
+	p, err := t.exchange(ctx, dst, tx, stun.RequestChange(tx, changeIP, changePort))
+	if err != nil {
+		return stun.ResponseAddrs{}, err
+	}
+	if p.request {
+		return stun.ResponseAddrs{}, fmt.Errorf("got binding request instead of response from %v", p.src)
+	}
+	if p.src != wantSrc {
+		return stun.ResponseAddrs{}, fmt.Errorf("response from %v; want %v", p.src, wantSrc)
+	}
+	return p.addrs, nil
+}
+
+func (t *natTester) classify(ctx context.Context, server netip.AddrPort) (NATType, error) {
+	var nt NATType
+
+	// Test I: learn our mapped address and the server's other address.
+	r, err := t.test(ctx, server, server, false, false)
+	if err != nil {
+		return nt, fmt.Errorf("test I: %w", err)
+	}
+	other, mapped := r.OtherAddress, r.Mapped
+	if !other.Addr().Is4() || other.Addr() == server.Addr() || other.Port() == server.Port() {
+		return nt, ErrNoRFC5780
+	}
+
+	// Filtering tests (Section 4.4) go first, as the mapping tests send
+	// to the server's alternate IP, which would open filtering NATs to it.
+	//
+	// Test II: ask for a response from the alternate IP and port.
+	_, err = t.test(ctx, server, other, true, true)
+	switch {
+	case err == nil:
+		nt.Filtering = EndpointIndependent
+	case errors.Is(err, errNoSTUNResponse):
+		// Test III: ask for a response from the alternate port.
+		_, err = t.test(ctx, server, netip.AddrPortFrom(server.Addr(), other.Port()), false, true)
+		switch {
+		case err == nil:
+			nt.Filtering = AddressDependent
+		case errors.Is(err, errNoSTUNResponse):
+			nt.Filtering = AddressAndPortDependent
+		default:
+			return nt, fmt.Errorf("filtering test III: %w", err)
+		}
+	default:
+		return nt, fmt.Errorf("filtering test II: %w", err)
+	}
+
+	// Mapping tests (Section 4.3).
+	//
+	// Test II: send to the alternate IP and primary port.
+	altIP := netip.AddrPortFrom(other.Addr(), server.Port())
+	r, err = t.test(ctx, altIP, altIP, false, false)
+	if err != nil {
+		return nt, fmt.Errorf("mapping test II: %w", err)
+	}
+	if r.Mapped == mapped {
+		nt.Mapping = EndpointIndependent
+	} else {
+		mapped2 := r.Mapped
+		// Test III: send to the alternate IP and port.
+		r, err = t.test(ctx, other, other, false, false)
+		if err != nil {
+			return nt, fmt.Errorf("mapping test III: %w", err)
+		}
+		if r.Mapped == mapped2 {
+			nt.Mapping = AddressDependent
+		} else {
+			nt.Mapping = AddressAndPortDependent
+		}
+	}
+
+	// Hairpinning (Section 4.5): send a request to our own mapped address.
+	tx := stun.NewTxID()
+	p, err := t.exchange(ctx, mapped, tx, stun.Request(tx))
+	switch {
+	case err == nil:
+		nt.Hairpinning = p.request
+	case !errors.Is(err, errNoSTUNResponse):
+		return nt, fmt.Errorf("hairpinning test: %w", err)
+	}
+	return nt, nil
+}
+
+// classifyNAT classifies the behavior of the NAT on IPv4, using the first
+// STUN server of the nodes in the three lowest latency regions that
+// supports RFC 5780, and records it in rs.report.
+func (c *Client) classifyNAT(ctx context.Context, rs *reportState, dm *tailcfg.DERPMap) {
+	rs.mu.Lock()
+	latency := rs.report.RegionV4Latency
+	rids := make([]int, 0, len(latency))
+	for rid := range latency {
+		rids = append(rids, rid)
+	}
+	slices.SortFunc(rids, func(a, b int) int { return cmp.Compare(latency[a], latency[b]) })
+	rs.mu.Unlock()
+
+	for _, rid := range rids[:min(len(rids), 3)] {
+		reg := dm.Regions[rid]
+		if reg == nil {
+			continue
+		}
+		for _, n := range reg.Nodes {
+			addr := c.nodeAddr(ctx, n, probeIPv4)
+			if !addr.IsValid() {
+				continue
+			}
+			pc, err := nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.NetMon)).ListenPacket(ctx, "udp4", ":0")
+			if err != nil {
+				c.logf("[v1] netcheck: classifying NAT: %v", err)
+				return
+			}
+			nt, err := ClassifyNAT(ctx, pc, addr)
+			pc.Close()
+			if errors.Is(err, ErrNoRFC5780) {
+				c.vlogf("node %q doesn't support RFC 5780", n.Name)
+				continue
+			}
+			if err != nil {
+				c.logf("[v1] netcheck: classifying NAT with node %q: %v", n.Name, err)
+				continue
+			}
+			rs.mu.Lock()
+			rs.report.NATMapping = nt.Mapping
+			rs.report.NATFiltering = nt.Filtering
+			rs.report.Hairpinning.Set(nt.Hairpinning)
+			rs.mu.Unlock()
+			return
+		}
+	}
+}
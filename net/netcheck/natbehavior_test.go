@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/tstest/natlab"
+	"tailscale.com/types/nettype"
+)
+
+// serveRFC5780 runs a STUN server that supports RFC 5780 on the internet
+// network, with its primary and alternate IPs on two machines, and returns
+// its primary address.
+func serveRFC5780(t *testing.T, internet *natlab.Network) netip.AddrPort {
+	ctx := context.Background()
+	var pcs []net.PacketConn
+	var addrs []netip.AddrPort
+	for i, name := range []string{"stun1", "stun2"} {
+		m := &natlab.Machine{Name: name}
+		ip := m.Attach("eth0", internet).V4()
+		for _, port := range []uint16{3478, 3479} {
+			addr := netip.AddrPortFrom(ip, port)
+			pc, err := m.ListenPacket(ctx, "udp4", addr.String())
+			if err != nil {
+				t.Fatalf("server %d: %v", i, err)
+			}
+			t.Cleanup(func() { pc.Close() })
+			pcs = append(pcs, pc)
+			addrs = append(addrs, addr)
+		}
+	}
+	// pcs and addrs are indexed by ip<<1|port, as in stunserver.
+	for i, pc := range pcs {
+		go func() {
+			var buf [1500]byte
+			for {
+				n, src, err := pc.(nettype.PacketConn).ReadFromUDPAddrPort(buf[:])
+				if err != nil {
+					return
+				}
+				tx, err := stun.ParseBindingRequest(buf[:n])
+				if err != nil {
+					continue
+				}
+				j := i
+				changeIP, changePort := stun.ChangeRequested(buf[:n])
+				if changeIP {
+					j ^= 0b10
+				}
+				if changePort {
+					j ^= 0b01
+				}
+				res := stun.ResponseRFC5780(tx, src, addrs[j], addrs[i^0b11])
+				pcs[j].(nettype.PacketConn).WriteToUDPAddrPort(res, src)
+			}
+		}()
+	}
+	return addrs[0]
+}
+
+func TestClassifyNAT(t *testing.T) {
+	defer func(timeout, retransmit time.Duration) {
+		natTestTimeout, natTestRetransmit = timeout, retransmit
+	}(natTestTimeout, natTestRetransmit)
+	natTestTimeout, natTestRetransmit = 100*time.Millisecond, 20*time.Millisecond
+
+	tests := []struct {
+		nat  natlab.NATType
+		fw   natlab.FirewallType
+		want NATType
+	}{
+		{natlab.EndpointIndependentNAT, natlab.EndpointIndependentFirewall, NATType{Mapping: EndpointIndependent, Filtering: EndpointIndependent}},
+		{natlab.EndpointIndependentNAT, natlab.AddressDependentFirewall, NATType{Mapping: EndpointIndependent, Filtering: AddressDependent}},
+		{natlab.EndpointIndependentNAT, natlab.AddressAndPortDependentFirewall, NATType{Mapping: EndpointIndependent, Filtering: AddressAndPortDependent}},
+		{natlab.AddressDependentNAT, natlab.AddressDependentFirewall, NATType{Mapping: AddressDependent, Filtering: AddressDependent}},
+		{natlab.AddressAndPortDependentNAT, natlab.AddressAndPortDependentFirewall, NATType{Mapping: AddressAndPortDependent, Filtering: AddressAndPortDependent}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			internet := natlab.NewInternet()
+			lan := &natlab.Network{
+				Name:    "lan",
+				Prefix4: netip.MustParsePrefix("192.168.0.0/24"),
+			}
+			client := &natlab.Machine{Name: "client"}
+			nat := &natlab.Machine{Name: "nat"}
+			client.Attach("eth0", lan)
+			wanIf := nat.Attach("wan", internet)
+			lanIf := nat.Attach("lan", lan)
+			lan.SetDefaultGateway(lanIf)
+			nat.PacketHandler = &natlab.SNAT44{
+				Machine:           nat,
+				ExternalInterface: wanIf,
+				Type:              tt.nat,
+				Firewall: &natlab.Firewall{
+					Type:             tt.fw,
+					TrustedInterface: lanIf,
+				},
+			}
+			server := serveRFC5780(t, internet)
+
+			pc, err := client.ListenPacket(context.Background(), "udp4", ":0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			got, err := ClassifyNAT(context.Background(), pc.(nettype.PacketConn), server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyNATNoRFC5780(t *testing.T) {
+	defer func(timeout time.Duration) { natTestTimeout = timeout }(natTestTimeout)
+	natTestTimeout = 100 * time.Millisecond
+
+	internet := natlab.NewInternet()
+	client := &natlab.Machine{Name: "client"}
+	client.Attach("eth0", internet)
+	server := &natlab.Machine{Name: "server"}
+	serverAddr := netip.AddrPortFrom(server.Attach("eth0", internet).V4(), 3478)
+
+	ctx := context.Background()
+	spc, err := server.ListenPacket(ctx, "udp4", serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spc.Close()
+	go func() {
+		var buf [1500]byte
+		for {
+			n, src, err := spc.(nettype.PacketConn).ReadFromUDPAddrPort(buf[:])
+			if err != nil {
+				return
+			}
+			if tx, err := stun.ParseBindingRequest(buf[:n]); err == nil {
+				spc.(nettype.PacketConn).WriteToUDPAddrPort(stun.Response(tx, src), src)
+			}
+		}
+	}()
+
+	pc, err := client.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := ClassifyNAT(ctx, pc.(nettype.PacketConn), serverAddr); !errors.Is(err, ErrNoRFC5780) {
+		t.Errorf("got error %v; want %v", err, ErrNoRFC5780)
+	}
+}
@@ -118,6 +118,15 @@ type Report struct {
 	// intercepting HTTP traffic.
 	CaptivePortal opt.Bool
 
+	// NATMapping and NATFiltering are the NAT's mapping and filtering
+	// behavior on IPv4, as classified using a STUN server that supports
+	// RFC 5780. Empty means not checked; see Client.ClassifyNAT.
+	NATMapping   NATBehavior
+	NATFiltering NATBehavior
+	// Hairpinning is whether the NAT hairpins packets sent to our own
+	// mapped address on IPv4. Empty means not checked.
+	Hairpinning opt.Bool
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -231,6 +240,13 @@ type Client struct {
 	// If false, the default net.Resolver will be used, with no caching.
 	UseDNSCache bool
 
+	// ClassifyNAT controls whether full reports also classify the NAT's
+	// behavior using the RFC 5780 tests (see ClassifyNAT), against the
+	// first STUN server of the nearest DERP regions that supports them.
+	// It costs a few more round trips, and up to a few seconds when the
+	// NAT filters, so it's meant for interactive use.
+	ClassifyNAT bool
+
 	// For tests
 	testEnoughRegions      int
 	testCaptivePortalDelay time.Duration
@@ -971,6 +987,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap, opts *GetRe
 		wg.Wait()
 	}
 
+	if c.ClassifyNAT && !rs.incremental && rs.anyUDP() && ctx.Err() == nil {
+		c.classifyNAT(ctx, rs, dm)
+	}
+
 	// Wait for captive portal check before finishing the report.
 	<-captivePortalDone
 
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// bindAcceptTimeout is how long a BIND request waits for the expected peer
+// to connect before giving up.
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleBind implements the BIND command described in RFC 1928, section 4.
+//
+// A listener is opened with the Server's Listen func and its address is sent
+// to the client in a first reply. Once the expected peer connects, a second
+// reply with the peer's address is sent and the two connections are spliced
+// together.
+func (c *Conn) handleBind() error {
+	if c.srv.Listen == nil {
+		res := &response{reply: commandNotSupported}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return fmt.Errorf("unsupported command %v", c.request.command)
+	}
+
+	peer := net.JoinHostPort(c.request.destination, strconv.Itoa(int(c.request.port)))
+	ctx, cancel := context.WithTimeout(context.Background(), bindAcceptTimeout)
+	defer cancel()
+	ln, err := c.srv.Listen(ctx, "tcp", peer)
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer ln.Close()
+
+	if err := c.writeSuccess(ln.Addr()); err != nil {
+		return err
+	}
+
+	srv, err := acceptPeer(ctx, ln, c.request.destination)
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return fmt.Errorf("waiting for BIND peer %v: %w", peer, err)
+	}
+	defer srv.Close()
+	ln.Close()
+
+	if err := c.writeSuccess(srv.RemoteAddr()); err != nil {
+		return err
+	}
+	return c.relay(srv)
+}
+
+// acceptPeer accepts the first connection on ln that comes from peerHost,
+// closing any others. If peerHost is not an IP address or is the unspecified
+// address, any connection is accepted.
+func acceptPeer(ctx context.Context, ln net.Listener, peerHost string) (net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	want := net.ParseIP(peerHost)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if want == nil || want.IsUnspecified() {
+			return conn, nil
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err == nil && want.Equal(net.ParseIP(host)) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
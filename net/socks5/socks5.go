@@ -86,9 +86,17 @@ type Server struct {
 	Logf logger.Logf
 
 	// Dialer optionally specifies the dialer to use for outgoing connections.
+	// It is called with network "tcp" for CONNECT requests and "udp" for
+	// each destination of a UDP ASSOCIATE relay.
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// Listen optionally opens the listener used to serve a BIND request.
+	// peer is the "host:port" address of the host that the client expects to
+	// connect back to the proxy, as given in the request.
+	// If nil, BIND requests are rejected.
+	Listen func(ctx context.Context, network, peer string) (net.Listener, error)
+
 	// Username and Password, if set, are the credential clients must provide.
 	Username string
 	Password string
@@ -177,14 +185,24 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
-	if req.command != connect {
+	c.request = req
+
+	switch req.command {
+	case connect:
+		return c.handleTCP()
+	case bind:
+		return c.handleBind()
+	case udpAssociate:
+		return c.handleUDP()
+	default:
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
+}
 
+func (c *Conn) handleTCP() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
@@ -199,35 +217,16 @@ func (c *Conn) handleRequest() error {
 		return err
 	}
 	defer srv.Close()
-	serverAddr, serverPortStr, err := net.SplitHostPort(srv.LocalAddr().String())
-	if err != nil {
-		return err
-	}
-	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
-		}
-	} else {
-		bindAddrType = domainName
-	}
-	res := &response{
-		reply:        success,
-		bindAddrType: bindAddrType,
-		bindAddr:     serverAddr,
-		bindPort:     uint16(serverPort),
-	}
-	buf, err := res.marshal()
-	if err != nil {
-		res = &response{reply: generalFailure}
-		buf, _ = res.marshal()
+	if err := c.writeSuccess(srv.LocalAddr()); err != nil {
+		return err
 	}
-	c.clientConn.Write(buf)
+	return c.relay(srv)
+}
 
+// relay copies data in both directions between the client and srv
+// until either side fails or closes.
+func (c *Conn) relay(srv net.Conn) error {
 	errc := make(chan error, 2)
 	go func() {
 		_, err := io.Copy(c.clientConn, srv)
@@ -246,6 +245,50 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
+// writeSuccess writes a success reply to the client, reporting addr as
+// the bound address.
+func (c *Conn) writeSuccess(addr net.Addr) error {
+	res, err := successResponse(addr)
+	if err != nil {
+		return err
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		res = &response{reply: generalFailure}
+		buf, _ = res.marshal()
+	}
+	c.clientConn.Write(buf)
+	return nil
+}
+
+// successResponse returns a success response whose bind address
+// is addr.
+func successResponse(addr net.Addr) (*response, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &response{
+		reply:        success,
+		bindAddrType: hostAddrType(host),
+		bindAddr:     host,
+		bindPort:     uint16(port),
+	}, nil
+}
+
+// hostAddrType returns the SOCKS5 address type for host, which is
+// either an IP address literal or a domain name.
+func hostAddrType(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
+
 // parseClientGreeting parses a request initiation packet.
 func parseClientGreeting(r io.Reader, authMethod byte) error {
 	var hdr [2]byte
@@ -315,52 +358,82 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	destination, port, err := readAddrPort(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
 
-	if destAddrType == ipv4 {
+// readAddrPort reads a SOCKS5 address of type atype followed by a
+// big-endian port number from r.
+func readAddrPort(r io.Reader, atype addrType) (addr string, port uint16, err error) {
+	switch atype {
+	case ipv4:
 		var ip [4]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+		addr = net.IP(ip[:]).String()
+	case domainName:
 		var dstSizeByte [1]byte
-		_, err = io.ReadFull(r, dstSizeByte[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+		if _, err := io.ReadFull(r, dstSizeByte[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
-		_, err = io.ReadFull(r, domainName)
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+		if _, err := io.ReadFull(r, domainName); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
-		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+		addr = string(domainName)
+	case ipv6:
 		var ip [16]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		addr = net.IP(ip[:]).String()
+	default:
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
-	_, err = io.ReadFull(r, portBytes[:])
-	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+	if _, err := io.ReadFull(r, portBytes[:]); err != nil {
+		return "", 0, fmt.Errorf("could not read port")
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
+	return addr, binary.BigEndian.Uint16(portBytes[:]), nil
+}
 
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+// appendAddrPort appends the wire encoding of a SOCKS5 address of type
+// atype followed by port to b.
+func appendAddrPort(b []byte, atype addrType, addr string, port uint16) ([]byte, error) {
+	switch atype {
+	case ipv4:
+		ip := net.ParseIP(addr).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address")
+		}
+		b = append(b, ip...)
+	case domainName:
+		if len(addr) > 255 {
+			return nil, fmt.Errorf("invalid domain name")
+		}
+		b = append(b, byte(len(addr)))
+		b = append(b, addr...)
+	case ipv6:
+		ip := net.ParseIP(addr).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address")
+		}
+		b = append(b, ip...)
+	default:
+		return nil, fmt.Errorf("unsupported address type")
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
 }
 
 // response contains the contents of
@@ -387,31 +460,9 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
-	var addr []byte
-	switch res.bindAddrType {
-	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv4 address for binding")
-		}
-	case domainName:
-		if len(res.bindAddr) > 255 {
-			return nil, fmt.Errorf("invalid domain name for binding")
-		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
-	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv6 address for binding")
-		}
-	default:
-		return nil, fmt.Errorf("unsupported address type")
+	pkt, err := appendAddrPort(pkt, res.bindAddrType, res.bindAddr, res.bindPort)
+	if err != nil {
+		return nil, fmt.Errorf("%w for binding", err)
 	}
-
-	pkt = append(pkt, addr...)
-	pkt = binary.BigEndian.AppendUint16(pkt, uint16(res.bindPort))
-
 	return pkt, nil
 }
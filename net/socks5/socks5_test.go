@@ -4,11 +4,15 @@
 package socks5
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -152,3 +156,411 @@ func TestReadPassword(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// socks5Associate performs a UDP ASSOCIATE handshake with the SOCKS5 server
+// at addr and returns the control connection and the relay address.
+func socks5Associate(t *testing.T, addr string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	if _, err := ctrl.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	if greeting != [2]byte{socks5Version, noAuthRequired} {
+		t.Fatalf("greeting = %v", greeting)
+	}
+	req := []byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(ctrl, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != success {
+		t.Fatalf("UDP ASSOCIATE reply = %v", hdr[1])
+	}
+	host, port, err := readAddrPort(ctrl, addrType(hdr[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctrl, &net.UDPAddr{IP: net.ParseIP(host), Port: int(port)}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEchoServer(t)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go (&Server{Logf: t.Logf}).Serve(ln)
+
+	_, relayAddr := socks5Associate(t, ln.Addr().String())
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	hdr, err := (&udpRequest{
+		destAddrType: ipv4,
+		destination:  echoAddr.IP.String(),
+		port:         uint16(echoAddr.Port),
+	}).marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fragmented datagram must be dropped rather than relayed.
+	frag := append([]byte{0, 0, 1}, hdr[3:]...)
+	if _, err := client.WriteTo(append(frag, "fragment"...), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(append(hdr, "hello"...), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, payload, err := parseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.destination != echoAddr.IP.String() || int(got.port) != echoAddr.Port {
+		t.Errorf("reply from %v:%v; want %v", got.destination, got.port, echoAddr)
+	}
+	if string(payload) != "hello" {
+		t.Errorf("payload = %q; want %q", payload, "hello")
+	}
+}
+
+func TestUDPAssociateSlowDial(t *testing.T) {
+	echo := udpEchoServer(t)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	// Dials to the "slow" domain hang until the relay gives up on them;
+	// they mustn't hold up the flow to echo.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "slow:") {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	go srv.Serve(ln)
+
+	_, relayAddr := socks5Associate(t, ln.Addr().String())
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	slowHdr, err := (&udpRequest{destAddrType: domainName, destination: "slow", port: 53}).marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := (&udpRequest{
+		destAddrType: ipv4,
+		destination:  echoAddr.IP.String(),
+		port:         uint16(echoAddr.Port),
+	}).marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(append(slowHdr, "stuck"...), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(append(hdr, "hello"...), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Well under the relay's 5 second dial timeout.
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, payload, err := parseUDPRequest(buf[:n]); err != nil || string(payload) != "hello" {
+		t.Errorf("got payload %q, %v; want %q", payload, err, "hello")
+	}
+}
+
+func TestUDPAssociateClosesWithControlConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go (&Server{Logf: t.Logf}).Serve(ln)
+
+	ctrl, relayAddr := socks5Associate(t, ln.Addr().String())
+	ctrl.Close()
+
+	// Once the control connection is gone, the relay's port should be
+	// released; binding to it must eventually succeed.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pc, err := net.ListenUDP("udp", relayAddr)
+		if err == nil {
+			pc.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay socket still open after control conn closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPAcceptFrom(t *testing.T) {
+	ctrl := &net.UDPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(100, 64, 0, 2), Port: 5000}
+	tests := []struct {
+		name   string
+		req    *request
+		ctrlIP netip.Addr
+		from   []*net.UDPAddr
+		want   []bool
+	}{
+		{
+			name:   "unspecified-request-other-host",
+			req:    &request{destination: "0.0.0.0"},
+			ctrlIP: netip.MustParseAddr("100.64.0.1"),
+			from:   []*net.UDPAddr{other, ctrl},
+			want:   []bool{false, true},
+		},
+		{
+			name:   "request-port",
+			req:    &request{destination: "0.0.0.0", port: 5001},
+			ctrlIP: netip.MustParseAddr("100.64.0.1"),
+			from:   []*net.UDPAddr{ctrl, {IP: ctrl.IP, Port: 5001}},
+			want:   []bool{false, true},
+		},
+		{
+			name: "first-source-wins",
+			req:  &request{destination: "0.0.0.0"},
+			from: []*net.UDPAddr{other, ctrl, other},
+			want: []bool{true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &udpRelay{req: tt.req, ctrlIP: tt.ctrlIP}
+			for i, from := range tt.from {
+				if got := r.acceptFrom(from); got != tt.want[i] {
+					t.Errorf("acceptFrom(%v) #%d = %v; want %v", from, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseUDPRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkt     []byte
+		want    *udpRequest
+		payload string
+		wantErr bool
+	}{
+		{
+			name:    "ipv4",
+			pkt:     []byte{0, 0, 0, byte(ipv4), 100, 64, 0, 1, 0, 53, 'x'},
+			want:    &udpRequest{destAddrType: ipv4, destination: "100.64.0.1", port: 53},
+			payload: "x",
+		},
+		{
+			name:    "domain",
+			pkt:     append([]byte{0, 0, 0, byte(domainName), 3, 'f', 'o', 'o', 1, 187}, "data"...),
+			want:    &udpRequest{destAddrType: domainName, destination: "foo", port: 443},
+			payload: "data",
+		},
+		{
+			name:    "fragment",
+			pkt:     []byte{0, 0, 1, byte(ipv4), 100, 64, 0, 1, 0, 53},
+			wantErr: true,
+		},
+		{
+			name:    "short",
+			pkt:     []byte{0, 0, 0, byte(ipv4), 100},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, payload, err := parseUDPRequest(tt.pkt)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			if string(payload) != tt.payload {
+				t.Errorf("payload = %q; want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+// readReply reads a SOCKS5 reply from r and returns its bound address.
+func readReply(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != success {
+		t.Fatalf("reply = %v", hdr[1])
+	}
+	host, port, err := readAddrPort(r, addrType(hdr[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+func TestBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &Server{
+		Logf: t.Logf,
+		Listen: func(ctx context.Context, network, peer string) (net.Listener, error) {
+			return net.Listen(network, "127.0.0.1:0")
+		},
+	}
+	go srv.Serve(ln)
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ctrl.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socks5Version, byte(bind), 0, byte(ipv4), 127, 0, 0, 1, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	bindAddr := readReply(t, ctrl)
+
+	peer, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if got, want := readReply(t, ctrl), peer.LocalAddr().String(); got != want {
+		t.Errorf("second reply peer = %v; want %v", got, want)
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("client got %q; want %q", buf, "ping")
+	}
+	if _, err := ctrl.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong" {
+		t.Errorf("peer got %q; want %q", buf, "pong")
+	}
+}
+
+func TestBindNotSupported(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go (&Server{Logf: t.Logf}).Serve(ln)
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	ctrl.Write([]byte{socks5Version, 1, noAuthRequired})
+	var greeting [2]byte
+	if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.Write([]byte{socks5Version, byte(bind), 0, byte(ipv4), 127, 0, 0, 1, 0, 0})
+	var hdr [4]byte
+	if _, err := io.ReadFull(ctrl, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != commandNotSupported {
+		t.Errorf("reply = %v; want %v", hdr[1], commandNotSupported)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpFlowIdleTimeout is how long a relayed UDP flow to a single destination
+// may go without receiving any datagrams before its backend socket is closed.
+const udpFlowIdleTimeout = 2 * time.Minute
+
+// maxUDPPacketSize is the largest UDP datagram we relay, including the
+// SOCKS5 UDP request header.
+const maxUDPPacketSize = 64 << 10
+
+// udpFlowQueueLen is how many datagrams to a single destination may be
+// waiting to be sent, such as while its backend socket is being dialed.
+// Further datagrams are dropped.
+const udpFlowQueueLen = 64
+
+// handleUDP implements the UDP ASSOCIATE command described in RFC 1928,
+// section 7.
+//
+// A UDP socket is opened on the same local address the client used to reach
+// us and reported back to the client. Datagrams the client sends there are
+// relayed to their destination via the Server's Dialer, and replies are sent
+// back to the client wrapped in a UDP request header. The association lives
+// as long as the TCP control connection.
+func (c *Conn) handleUDP() error {
+	host, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil || net.ParseIP(host) == nil {
+		host = "127.0.0.1"
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer pc.Close()
+
+	if err := c.writeSuccess(pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	// The association is limited to the host of the control connection,
+	// even when the request doesn't name a source address.
+	ctrlIP, _ := netip.ParseAddrPort(c.clientConn.RemoteAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &udpRelay{
+		ctx:    ctx,
+		srv:    c.srv,
+		client: pc,
+		req:    c.request,
+		ctrlIP: ctrlIP.Addr().Unmap(),
+		flows:  make(map[string]*udpFlow),
+	}
+	defer r.close()
+	go r.run()
+
+	// RFC 1928: "A UDP association terminates when the TCP connection
+	// that the UDP ASSOCIATE request arrived on terminates."
+	_, err = io.Copy(io.Discard, c.clientConn)
+	return err
+}
+
+// udpRelay relays datagrams between a SOCKS5 client's UDP socket
+// and the destinations it addresses.
+type udpRelay struct {
+	ctx    context.Context
+	srv    *Server
+	client net.PacketConn // socket that the SOCKS client sends to
+	req    *request       // the UDP ASSOCIATE request
+	ctrlIP netip.Addr     // IP of the control connection's peer, if known
+
+	mu         sync.Mutex
+	clientAddr net.Addr            // learned from the first accepted datagram
+	flows      map[string]*udpFlow // keyed by destination "host:port"
+	closed     bool
+}
+
+// udpFlow is a relayed UDP flow to a single destination.
+type udpFlow struct {
+	atype    addrType // address type of dest, as the client sent it
+	destHost string
+	destPort uint16
+	out      chan []byte   // datagrams to send to dest
+	done     chan struct{} // closed when the flow ends
+
+	conn net.Conn // guarded by udpRelay.mu; nil until dialed
+}
+
+func (r *udpRelay) run() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := r.client.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !r.acceptFrom(from) {
+			continue
+		}
+		hdr, payload, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			r.srv.logf("udp: dropping datagram from %v: %v", from, err)
+			continue
+		}
+		f, ok := r.flow(hdr)
+		if !ok {
+			return
+		}
+		select {
+		case f.out <- bytes.Clone(payload):
+		default:
+			// Queue full, likely as the destination is still being
+			// dialed; drop the datagram, as the network might.
+		}
+	}
+}
+
+// acceptFrom reports whether a datagram from addr should be relayed. Per RFC
+// 1928, only the host of the control connection may use the association,
+// and the address given in the UDP ASSOCIATE request, if any, further
+// restricts its source. Once the first datagram has been accepted, only
+// datagrams from that same address are relayed, as that is where replies
+// are sent.
+func (r *udpRelay) acceptFrom(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clientAddr != nil {
+		return r.clientAddr.String() == addr.String()
+	}
+	if ip, ok := netip.AddrFromSlice(ua.IP); r.ctrlIP.IsValid() && (!ok || ip.Unmap() != r.ctrlIP) {
+		return false
+	}
+	if ip := net.ParseIP(r.req.destination); ip != nil && !ip.IsUnspecified() && !ip.Equal(ua.IP) {
+		return false
+	}
+	if r.req.port != 0 && int(r.req.port) != ua.Port {
+		return false
+	}
+	r.clientAddr = addr
+	return true
+}
+
+// flow returns the flow for the destination in hdr, starting a new one if
+// necessary. It reports false if the relay is closed.
+//
+// A new flow's backend socket is dialed by runFlow, so that a slow dial
+// doesn't hold up datagrams to other destinations.
+func (r *udpRelay) flow(hdr *udpRequest) (_ *udpFlow, ok bool) {
+	dest := net.JoinHostPort(hdr.destination, strconv.Itoa(int(hdr.port)))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	if f, ok := r.flows[dest]; ok {
+		return f, true
+	}
+	f := &udpFlow{
+		atype:    hdr.destAddrType,
+		destHost: hdr.destination,
+		destPort: hdr.port,
+		out:      make(chan []byte, udpFlowQueueLen),
+		done:     make(chan struct{}),
+	}
+	r.flows[dest] = f
+	go r.runFlow(dest, f)
+	return f, true
+}
+
+// runFlow dials f's destination, then sends it the datagrams queued on f
+// and copies the datagrams it receives back to the client, until f is idle
+// for udpFlowIdleTimeout or the relay is closed.
+func (r *udpRelay) runFlow(dest string, f *udpFlow) {
+	defer func() {
+		r.mu.Lock()
+		if r.flows[dest] == f {
+			delete(r.flows, dest)
+		}
+		r.mu.Unlock()
+		close(f.done)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.ctx, 5*time.Second)
+	conn, err := r.srv.dial(ctx, "udp", dest)
+	cancel()
+	if err != nil {
+		r.srv.logf("udp: dial %v: %v", dest, err)
+		return
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	closed := r.closed
+	f.conn = conn
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case pkt := <-f.out:
+				conn.Write(pkt)
+			case <-f.done:
+				return
+			}
+		}
+	}()
+
+	// Replies are framed with the destination as the client addressed it.
+	hdr, err := (&udpRequest{
+		destAddrType: f.atype,
+		destination:  f.destHost,
+		port:         f.destPort,
+	}).marshal()
+	if err != nil {
+		r.srv.logf("udp: %v", err)
+		return
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(udpFlowIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				if !errors.Is(err, net.ErrClosed) {
+					r.srv.logf("udp: read from %v: %v", dest, err)
+				}
+			}
+			return
+		}
+		r.mu.Lock()
+		clientAddr := r.clientAddr
+		r.mu.Unlock()
+		pkt := append(hdr[:len(hdr):len(hdr)], buf[:n]...)
+		if _, err := r.client.WriteTo(pkt, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, f := range r.flows {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+}
+
+// udpRequest is the header prepended to each datagram relayed via a UDP
+// association, as described in RFC 1928, section 7.
+type udpRequest struct {
+	frag         byte
+	destAddrType addrType
+	destination  string
+	port         uint16
+}
+
+// parseUDPRequest parses the UDP request header at the start of pkt and
+// returns it along with the datagram payload that follows it.
+//
+// Fragmented datagrams are not supported and are rejected.
+func parseUDPRequest(pkt []byte) (*udpRequest, []byte, error) {
+	if len(pkt) < 4 {
+		return nil, nil, fmt.Errorf("short UDP request header")
+	}
+	if pkt[0] != 0 || pkt[1] != 0 {
+		return nil, nil, fmt.Errorf("invalid reserved bytes in UDP request header")
+	}
+	if pkt[2] != 0 {
+		return nil, nil, fmt.Errorf("fragmented UDP requests not supported")
+	}
+	hdr := &udpRequest{
+		frag:         pkt[2],
+		destAddrType: addrType(pkt[3]),
+	}
+	r := bytes.NewReader(pkt[4:])
+	var err error
+	hdr.destination, hdr.port, err = readAddrPort(r, hdr.destAddrType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, pkt[len(pkt)-r.Len():], nil
+}
+
+// marshal returns the wire encoding of the UDP request header.
+func (u *udpRequest) marshal() ([]byte, error) {
+	pkt := []byte{0, 0, u.frag, byte(u.destAddrType)}
+	return appendAddrPort(pkt, u.destAddrType, u.destination, u.port)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package stun
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Attributes from RFC 5780, NAT Behavior Discovery Using STUN.
+const (
+	attrChangeRequest  = 0x0003
+	attrResponseOrigin = 0x802b
+	attrOtherAddress   = 0x802c
+
+	// Flags in the CHANGE-REQUEST attribute value, RFC 5780 Section 7.2.
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
+)
+
+// RequestChange generates a binding request STUN packet that asks the
+// server, using the RFC 5780 CHANGE-REQUEST attribute, to respond from its
+// alternate IP address, alternate port, or both.
+// The transaction ID, tID, should be a random sequence of bytes.
+//
+// Like Request, the packet advertises that it came from Tailscale, so
+// ParseBindingRequest accepts it.
+func RequestChange(tID TxID, changeIP, changePort bool) []byte {
+	const (
+		lenAttrSoftware = 4 + len(software)
+		lenAttrChange   = 4 + 4
+	)
+	b := make([]byte, 0, headerLen+lenAttrSoftware+lenAttrChange+lenFingerprint)
+	b = append(b, bindingRequest...)
+	b = appendU16(b, uint16(lenAttrSoftware+lenAttrChange+lenFingerprint))
+	b = append(b, magicCookie...)
+	b = append(b, tID[:]...)
+
+	// Attribute SOFTWARE first, as in Request.
+	b = appendU16(b, attrNumSoftware)
+	b = appendU16(b, uint16(len(software)))
+	b = append(b, software...)
+
+	// Attribute CHANGE-REQUEST, RFC 5780 Section 7.2.
+	var flags uint32
+	if changeIP {
+		flags |= changeIPFlag
+	}
+	if changePort {
+		flags |= changePortFlag
+	}
+	b = appendU16(b, attrChangeRequest)
+	b = appendU16(b, 4)
+	b = appendU32(b, flags)
+
+	fp := fingerPrint(b)
+	b = appendU16(b, attrNumFingerprint)
+	b = appendU16(b, 4)
+	b = appendU32(b, fp)
+
+	return b
+}
+
+// ChangeRequested reports which changes the binding request b asks for in
+// its CHANGE-REQUEST attribute. It reports false for both if b has none or
+// is malformed. It does not otherwise validate b; use ParseBindingRequest
+// for that.
+func ChangeRequested(b []byte) (changeIP, changePort bool) {
+	if !Is(b) {
+		return false, false
+	}
+	foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if attrType == attrChangeRequest && len(a) == 4 {
+			flags := binary.BigEndian.Uint32(a)
+			changeIP = flags&changeIPFlag != 0
+			changePort = flags&changePortFlag != 0
+		}
+		return nil
+	})
+	return changeIP, changePort
+}
+
+// ResponseRFC5780 generates a binding response like Response, with the
+// addition of the RFC 5780 RESPONSE-ORIGIN attribute set to origin, the
+// address the response is sent from, and the OTHER-ADDRESS attribute set to
+// other, the server's address with both alternate IP and alternate port.
+// Either may be the zero value to omit the attribute.
+func ResponseRFC5780(txID TxID, addrPort, origin, other netip.AddrPort) []byte {
+	b := Response(txID, addrPort)
+	if b == nil {
+		return nil
+	}
+	b = appendAddrAttr(b, attrResponseOrigin, origin)
+	b = appendAddrAttr(b, attrOtherAddress, other)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen))
+	return b
+}
+
+// appendAddrAttr appends an attribute of type attrType in the format of
+// MAPPED-ADDRESS (RFC 5389 Section 15.1), which RESPONSE-ORIGIN and
+// OTHER-ADDRESS share. It appends nothing if ap is not valid.
+func appendAddrAttr(b []byte, attrType uint16, ap netip.AddrPort) []byte {
+	addr := ap.Addr().Unmap()
+	var fam byte
+	switch {
+	case addr.Is4():
+		fam = 1
+	case addr.Is6():
+		fam = 2
+	default:
+		return b
+	}
+	b = appendU16(b, attrType)
+	b = appendU16(b, uint16(4+addr.BitLen()/8))
+	b = append(b, 0, fam)
+	b = appendU16(b, ap.Port())
+	return append(b, addr.AsSlice()...)
+}
+
+// ResponseAddrs are the addresses in a binding response.
+type ResponseAddrs struct {
+	// Mapped is the client's address as seen by the server, from the
+	// XOR-MAPPED-ADDRESS attribute, or MAPPED-ADDRESS as a fallback.
+	Mapped netip.AddrPort
+
+	// ResponseOrigin is the address the server sent the response from,
+	// from the RFC 5780 RESPONSE-ORIGIN attribute. It is the zero value if
+	// the server didn't send one.
+	ResponseOrigin netip.AddrPort
+
+	// OtherAddress is the server's address with both alternate IP and
+	// alternate port, from the RFC 5780 OTHER-ADDRESS attribute. It is the
+	// zero value if the server didn't send one, in which case the server
+	// doesn't support CHANGE-REQUEST.
+	OtherAddress netip.AddrPort
+}
+
+// ParseResponseAddrs parses a successful binding response STUN packet like
+// ParseResponse, and also returns the RFC 5780 addresses in it.
+func ParseResponseAddrs(b []byte) (tID TxID, addrs ResponseAddrs, err error) {
+	tID, addrs.Mapped, err = ParseResponse(b)
+	if err != nil {
+		return tID, ResponseAddrs{}, err
+	}
+	// ParseResponse validated the header and attributes.
+	attrsLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if err := foreachAttr(b[headerLen:headerLen+attrsLen], func(attrType uint16, attr []byte) error {
+		var dst *netip.AddrPort
+		switch attrType {
+		case attrResponseOrigin:
+			dst = &addrs.ResponseOrigin
+		case attrOtherAddress:
+			dst = &addrs.OtherAddress
+		default:
+			return nil
+		}
+		ipSlice, port, err := mappedAddress(attr)
+		if err != nil {
+			return err
+		}
+		if ip, ok := netip.AddrFromSlice(ipSlice); ok {
+			*dst = netip.AddrPortFrom(ip.Unmap(), port)
+		}
+		return nil
+	}); err != nil {
+		return tID, ResponseAddrs{}, err
+	}
+	return tID, addrs, nil
+}
@@ -299,3 +299,58 @@ func TestAttrOrderForXdpDERP(t *testing.T) {
 		t.Fatal("unexpected software attr value")
 	}
 }
+
+func TestRequestChange(t *testing.T) {
+	for _, tt := range []struct{ changeIP, changePort bool }{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		tx := stun.NewTxID()
+		req := stun.RequestChange(tx, tt.changeIP, tt.changePort)
+		gotTx, err := stun.ParseBindingRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotTx != tx {
+			t.Errorf("original txID %q != got txID %q", tx, gotTx)
+		}
+		changeIP, changePort := stun.ChangeRequested(req)
+		if changeIP != tt.changeIP || changePort != tt.changePort {
+			t.Errorf("ChangeRequested = %v, %v; want %v, %v", changeIP, changePort, tt.changeIP, tt.changePort)
+		}
+	}
+	if changeIP, changePort := stun.ChangeRequested(stun.Request(stun.NewTxID())); changeIP || changePort {
+		t.Errorf("ChangeRequested of plain request = %v, %v; want false, false", changeIP, changePort)
+	}
+}
+
+func TestResponseRFC5780(t *testing.T) {
+	tx := stun.NewTxID()
+	want := stun.ResponseAddrs{
+		Mapped:         netip.MustParseAddrPort("1.2.3.4:5678"),
+		ResponseOrigin: netip.MustParseAddrPort("5.6.7.8:3478"),
+		OtherAddress:   netip.MustParseAddrPort("5.6.7.9:3479"),
+	}
+	res := stun.ResponseRFC5780(tx, want.Mapped, want.ResponseOrigin, want.OtherAddress)
+	gotTx, got, err := stun.ParseResponseAddrs(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotTx != tx {
+		t.Errorf("got TxID = %v; want %v", gotTx, tx)
+	}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	// A plain response has no RFC 5780 addresses.
+	_, got, err = stun.ParseResponseAddrs(stun.Response(tx, want.Mapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (stun.ResponseAddrs{Mapped: want.Mapped}); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
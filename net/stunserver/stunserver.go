@@ -9,6 +9,7 @@
 	"context"
 	"errors"
 	"expvar"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -41,6 +42,16 @@ func init() {
 type STUNServer struct {
 	ctx context.Context // ctx signals service shutdown
 	pc  *net.UDPConn    // pc is the UDP listener
+
+	// rfc5780 are the listeners for RFC 5780 NAT behavior discovery, or
+	// nil if it's not enabled. They're indexed by ip<<1|port, where ip
+	// and port are 0 for the primary address and port and 1 for the
+	// alternate ones, so rfc5780[0] is pc and a response to a request
+	// received on rfc5780[i] that asks to change the IP and port is sent
+	// from rfc5780[i^0b11].
+	rfc5780 []*net.UDPConn
+
+	turn *turnServer // or nil if TURN isn't enabled
 }
 
 // New creates a new STUN server. The server is shutdown when ctx is done.
@@ -67,8 +78,96 @@ func (s *STUNServer) Listen(listenAddr string) error {
 	return nil
 }
 
-// Serve starts serving responses to STUN requests. Listen must be called before Serve.
+// ListenRFC5780 binds the listen sockets for the server with support for
+// RFC 5780 NAT behavior discovery: it responds to CHANGE-REQUEST attributes
+// and includes RESPONSE-ORIGIN and OTHER-ADDRESS attributes in responses.
+//
+// The server listens on the primary address, listenAddr, and on the
+// combinations of its IP and port with the alternate address, altAddr. Both
+// must have specific IPs of the same family, on different interfaces or
+// addresses of the host, as clients use them to tell the server's addresses
+// apart. A zero port in either picks one.
+func (s *STUNServer) ListenRFC5780(listenAddr, altAddr string) error {
+	primary, err := netip.ParseAddrPort(listenAddr)
+	if err != nil {
+		return fmt.Errorf("primary address: %w", err)
+	}
+	alt, err := netip.ParseAddrPort(altAddr)
+	if err != nil {
+		return fmt.Errorf("alternate address: %w", err)
+	}
+	switch {
+	case primary.Addr().IsUnspecified() || alt.Addr().IsUnspecified():
+		return errors.New("RFC 5780 requires specific primary and alternate IPs")
+	case primary.Addr() == alt.Addr():
+		return errors.New("RFC 5780 requires different primary and alternate IPs")
+	case primary.Addr().Is4() != alt.Addr().Is4():
+		return errors.New("RFC 5780 requires primary and alternate IPs of the same family")
+	}
+
+	var pcs []*net.UDPConn
+	listen := func(ip netip.Addr, port uint16) (uint16, error) {
+		pc, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+		if err != nil {
+			return 0, err
+		}
+		pcs = append(pcs, pc)
+		return uint16(pc.LocalAddr().(*net.UDPAddr).Port), nil
+	}
+	// Bind in index order, resolving zero ports on the primary IP first.
+	p1, err := listen(primary.Addr(), primary.Port())
+	if err == nil {
+		var p2 uint16
+		p2, err = listen(primary.Addr(), alt.Port())
+		if err == nil {
+			_, err = listen(alt.Addr(), p1)
+		}
+		if err == nil {
+			_, err = listen(alt.Addr(), p2)
+		}
+	}
+	if err != nil {
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		return err
+	}
+	s.pc = pcs[0]
+	s.rfc5780 = pcs
+	for _, pc := range pcs {
+		log.Printf("STUN server listening on %v (RFC 5780)", pc.LocalAddr())
+	}
+	go func() {
+		<-s.ctx.Done()
+		for _, pc := range pcs {
+			pc.Close()
+		}
+	}()
+	return nil
+}
+
+// Serve starts serving responses to STUN requests. Listen or ListenRFC5780
+// must be called before Serve.
 func (s *STUNServer) Serve() error {
+	if s.rfc5780 == nil {
+		return s.serve(0, s.pc)
+	}
+	errc := make(chan error, len(s.rfc5780))
+	for i, pc := range s.rfc5780 {
+		go func() { errc <- s.serve(i, pc) }()
+	}
+	var firstErr error
+	for range s.rfc5780 {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// serve serves responses to STUN requests received on pc, which is
+// s.rfc5780[i] if RFC 5780 is enabled.
+func (s *STUNServer) serve(i int, pc *net.UDPConn) error {
 	var buf [64 << 10]byte
 	var (
 		n   int
@@ -76,7 +175,7 @@ func (s *STUNServer) Serve() error {
 		err error
 	)
 	for {
-		n, ua, err = s.pc.ReadFromUDP(buf[:])
+		n, ua, err = pc.ReadFromUDP(buf[:])
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return nil
@@ -87,13 +186,19 @@ func (s *STUNServer) Serve() error {
 			continue
 		}
 		pkt := buf[:n]
+		addr, _ := netip.AddrFromSlice(ua.IP)
+		src := netip.AddrPortFrom(addr.Unmap(), uint16(ua.Port))
 		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
+			if s.turn == nil || !s.turn.handle(pc, src, pkt) {
+				stunNotSTUN.Add(1)
+			}
 			continue
 		}
 		txid, err := stun.ParseBindingRequest(pkt)
 		if err != nil {
-			stunNotSTUN.Add(1)
+			if s.turn == nil || !s.turn.handle(pc, src, pkt) {
+				stunNotSTUN.Add(1)
+			}
 			continue
 		}
 		if ua.IP.To4() != nil {
@@ -101,9 +206,23 @@ func (s *STUNServer) Serve() error {
 		} else {
 			stunIPv6.Add(1)
 		}
-		addr, _ := netip.AddrFromSlice(ua.IP)
-		res := stun.Response(txid, netip.AddrPortFrom(addr, uint16(ua.Port)))
-		_, err = s.pc.WriteTo(res, ua)
+		var res []byte
+		out := pc
+		if s.rfc5780 == nil {
+			res = stun.Response(txid, src)
+		} else {
+			j := i
+			changeIP, changePort := stun.ChangeRequested(pkt)
+			if changeIP {
+				j ^= 0b10
+			}
+			if changePort {
+				j ^= 0b01
+			}
+			out = s.rfc5780[j]
+			res = stun.ResponseRFC5780(txid, src, localAddrPort(out), localAddrPort(s.rfc5780[i^0b11]))
+		}
+		_, err = out.WriteTo(res, ua)
 		if err != nil {
 			stunWriteError.Add(1)
 		} else {
@@ -120,6 +239,10 @@ func (s *STUNServer) ListenAndServe(listenAddr string) error {
 	return s.Serve()
 }
 
+func localAddrPort(pc *net.UDPConn) netip.AddrPort {
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
 // LocalAddr returns the local address of the STUN server. It must not be called before ListenAndServe.
 func (s *STUNServer) LocalAddr() net.Addr {
 	return s.pc.LocalAddr()
@@ -6,6 +6,7 @@
 import (
 	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
@@ -58,6 +59,70 @@ func TestSTUNServer(t *testing.T) {
 	}
 }
 
+func TestSTUNServerRFC5780(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New(ctx)
+	if err := s.ListenRFC5780("127.0.0.1:0", "127.0.0.2:0"); err != nil {
+		t.Skipf("can't listen on 127.0.0.2: %v", err)
+	}
+	go s.Serve()
+	primary := s.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	c := must.Get(net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var other netip.AddrPort
+	for _, tt := range []struct {
+		changeIP, changePort bool
+	}{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	} {
+		txid := stun.NewTxID()
+		if _, err := c.WriteToUDPAddrPort(stun.RequestChange(txid, tt.changeIP, tt.changePort), primary); err != nil {
+			t.Fatal(err)
+		}
+		var buf [64 << 10]byte
+		n, from, err := c.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			t.Fatalf("change %v: failed to read STUN response: %v", tt, err)
+		}
+		tid, addrs, err := stun.ParseResponseAddrs(buf[:n])
+		if err != nil {
+			t.Fatalf("change %v: failed to parse STUN response: %v", tt, err)
+		}
+		if tid != txid {
+			t.Fatalf("change %v: STUN response has wrong transaction ID", tt)
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if addrs.ResponseOrigin != from {
+			t.Errorf("change %v: RESPONSE-ORIGIN = %v; but sent from %v", tt, addrs.ResponseOrigin, from)
+		}
+		if addrs.Mapped != c.LocalAddr().(*net.UDPAddr).AddrPort() {
+			t.Errorf("change %v: mapped address = %v; want %v", tt, addrs.Mapped, c.LocalAddr())
+		}
+		if other.IsValid() && addrs.OtherAddress != other {
+			t.Errorf("change %v: OTHER-ADDRESS = %v; want %v", tt, addrs.OtherAddress, other)
+		}
+		other = addrs.OtherAddress
+
+		wantIP, wantPort := primary.Addr(), primary.Port()
+		if tt.changeIP {
+			wantIP = other.Addr()
+		}
+		if tt.changePort {
+			wantPort = other.Port()
+		}
+		if want := netip.AddrPortFrom(wantIP, wantPort); from != want {
+			t.Errorf("change %v: response from %v; want %v", tt, from, want)
+		}
+	}
+}
+
 func BenchmarkServerSTUN(b *testing.B) {
 	b.ReportAllocs()
 	ctx, cancel := context.WithCancel(context.Background())
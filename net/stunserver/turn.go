@@ -0,0 +1,740 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package stunserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/net/stun"
+	"tailscale.com/net/tsaddr"
+)
+
+// TURN lifetimes, RFC 8656.
+const (
+	defaultAllocationLifetime = 10 * time.Minute
+	maxAllocationLifetime     = time.Hour
+	permissionLifetime        = 5 * time.Minute
+	channelLifetime           = 10 * time.Minute
+	nonceLifetime             = time.Hour
+
+	// turnSweepInterval is how often expired allocations, permissions
+	// and channel bindings are removed.
+	turnSweepInterval = 10 * time.Second
+)
+
+var (
+	turnRequests    = &metrics.LabelMap{Label: "method"}
+	turnErrors      = &metrics.LabelMap{Label: "code"}
+	turnRelayed     = &metrics.LabelMap{Label: "direction"}
+	turnRelayedPkts = &metrics.LabelMap{Label: "direction"}
+	turnDropped     = &metrics.LabelMap{Label: "reason"}
+	turnAllocations = new(expvar.Int)
+
+	turnBytesToPeer   = turnRelayed.Get("to_peer")
+	turnBytesToClient = turnRelayed.Get("to_client")
+	turnPktsToPeer    = turnRelayedPkts.Get("to_peer")
+	turnPktsToClient  = turnRelayedPkts.Get("to_client")
+	turnNoPermission  = turnDropped.Get("no_permission")
+	turnNoAllocation  = turnDropped.Get("no_allocation")
+	turnNoChannel     = turnDropped.Get("no_channel")
+)
+
+func init() {
+	stats.Set("counter_turn_requests", turnRequests)
+	stats.Set("counter_turn_errors", turnErrors)
+	stats.Set("counter_turn_relayed_bytes", turnRelayed)
+	stats.Set("counter_turn_relayed_packets", turnRelayedPkts)
+	stats.Set("counter_turn_dropped_packets", turnDropped)
+	stats.Set("gauge_turn_allocations", turnAllocations)
+}
+
+// TURNConfig configures the TURN (RFC 8656) relay mode of a STUNServer.
+//
+// Clients authenticate with long-term credentials: either a username and
+// password from Users, or time-limited credentials derived from Secret as
+// in the "TURN REST API" that WebRTC deployments commonly use, where the
+// username is "<expiry unix time>[:<name>]" and the password is the
+// base64 HMAC-SHA1 of the username keyed by Secret.
+type TURNConfig struct {
+	// Realm is the authentication realm. It's required.
+	Realm string `json:"realm"`
+
+	// RelayIP is the public IPv4 address of the relay, advertised to
+	// clients in their relayed addresses. It's required. Relay sockets
+	// listen on all interfaces, so it may be the address of a 1:1 NAT in
+	// front of the server.
+	RelayIP netip.Addr `json:"relayIP"`
+
+	// Users maps usernames to passwords.
+	Users map[string]string `json:"users,omitempty"`
+
+	// Secret, if non-empty, is the shared secret for time-limited
+	// credentials.
+	Secret string `json:"secret,omitempty"`
+
+	// MaxAllocations, if positive, limits the number of allocations.
+	MaxAllocations int `json:"maxAllocations,omitempty"`
+
+	// MaxAllocationsPerUser, if positive, limits the number of
+	// allocations per username.
+	MaxAllocationsPerUser int `json:"maxAllocationsPerUser,omitempty"`
+
+	// AllowPrivatePeers allows relaying to peers at loopback, private,
+	// link-local and CGNAT addresses, which is otherwise forbidden to
+	// keep clients from reaching the server's own networks. It's meant
+	// for tests and private deployments.
+	AllowPrivatePeers bool `json:"allowPrivatePeers,omitempty"`
+}
+
+// ReadTURNConfig reads a JSON TURNConfig from the file at path.
+func ReadTURNConfig(path string) (*TURNConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c TURNConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing TURN config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func (c *TURNConfig) validate() error {
+	switch {
+	case c.Realm == "":
+		return errors.New("TURN realm is required")
+	case !c.RelayIP.Is4():
+		return errors.New("TURN relay IP must be an IPv4 address")
+	case len(c.Users) == 0 && c.Secret == "":
+		return errors.New("TURN requires users or a secret")
+	case c.MaxAllocations < 0 || c.MaxAllocationsPerUser < 0:
+		return errors.New("negative TURN allocation limit")
+	}
+	return nil
+}
+
+// EnableTURN makes s also serve TURN on its listeners, with config c. It
+// must be called before Serve. Tailscale binding requests are still answered
+// as before.
+func (s *STUNServer) EnableTURN(c TURNConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	t := &turnServer{
+		ctx:      s.ctx,
+		cfg:      c,
+		nonceKey: make([]byte, 32),
+		allocs:   map[netip.AddrPort]*turnAllocation{},
+		perUser:  map[string]int{},
+		timeNow:  time.Now,
+	}
+	if _, err := crand.Read(t.nonceKey); err != nil {
+		return err
+	}
+	s.turn = t
+	go t.sweepLoop()
+	return nil
+}
+
+type turnServer struct {
+	ctx      context.Context
+	cfg      TURNConfig
+	nonceKey []byte
+	timeNow  func() time.Time
+
+	mu      sync.Mutex
+	allocs  map[netip.AddrPort]*turnAllocation // by client address
+	perUser map[string]int                     // number of allocations
+}
+
+// turnAllocation is a TURN allocation. Its fields, other than those set at
+// creation, are guarded by turnServer.mu.
+type turnAllocation struct {
+	client    netip.AddrPort
+	pc        *net.UDPConn // the server listener the client uses
+	relay     *net.UDPConn
+	relayAddr netip.AddrPort // advertised
+	username  string
+	key       []byte
+	tx        stun.TxID // of the Allocate request
+
+	expires  time.Time
+	perms    map[netip.Addr]time.Time // peer IP to expiry
+	channels map[uint16]*turnChannel
+	byPeer   map[netip.AddrPort]*turnChannel
+}
+
+type turnChannel struct {
+	num     uint16
+	peer    netip.AddrPort
+	expires time.Time
+}
+
+// turnError is a TURN error response code.
+type turnError struct {
+	code   int
+	reason string
+}
+
+var (
+	errBadRequest           = &turnError{400, "Bad Request"}
+	errUnauthorized         = &turnError{401, "Unauthorized"}
+	errForbidden            = &turnError{403, "Forbidden"}
+	errUnknownAttribute     = &turnError{420, "Unknown Attribute"}
+	errAllocationMismatch   = &turnError{437, "Allocation Mismatch"}
+	errStaleNonce           = &turnError{438, "Stale Nonce"}
+	errFamilyNotSupported   = &turnError{440, "Address Family not Supported"}
+	errWrongCredentials     = &turnError{441, "Wrong Credentials"}
+	errUnsupportedProto     = &turnError{442, "Unsupported Transport Protocol"}
+	errPeerFamilyMismatch   = &turnError{443, "Peer Address Family Mismatch"}
+	errQuotaReached         = &turnError{486, "Allocation Quota Reached"}
+	errInsufficientCapacity = &turnError{508, "Insufficient Capacity"}
+)
+
+// handle handles pkt, received on pc from src, if it's a TURN message,
+// and reports whether it was.
+func (t *turnServer) handle(pc *net.UDPConn, src netip.AddrPort, pkt []byte) bool {
+	if isChannelData(pkt) {
+		t.handleChannelData(src, pkt)
+		return true
+	}
+	m, err := parseTURNMsg(pkt)
+	if err != nil {
+		return false
+	}
+	switch m.class {
+	case classRequest:
+		res := t.handleRequest(pc, src, m)
+		if res != nil {
+			pc.WriteToUDPAddrPort(res, src)
+		}
+		return true
+	case classIndication:
+		if m.method == methodSend {
+			t.handleSend(src, m)
+		}
+		return true
+	}
+	return false
+}
+
+func methodName(method uint16) string {
+	switch method {
+	case methodBinding:
+		return "binding"
+	case methodAllocate:
+		return "allocate"
+	case methodRefresh:
+		return "refresh"
+	case methodCreatePermission:
+		return "create_permission"
+	case methodChannelBind:
+		return "channel_bind"
+	}
+	return "other"
+}
+
+// handleRequest handles the request m and returns the response.
+func (t *turnServer) handleRequest(pc *net.UDPConn, src netip.AddrPort, m *turnMsg) []byte {
+	turnRequests.Add(methodName(m.method), 1)
+	if m.method == methodBinding {
+		// Binding requests from non-Tailscale clients; TURN servers
+		// answer those too.
+		return stun.Response(m.tx, src)
+	}
+	switch m.method {
+	case methodAllocate, methodRefresh, methodCreatePermission, methodChannelBind:
+	default:
+		return t.errorResponse(m, errBadRequest, nil)
+	}
+	// Comprehension-required attributes we don't understand make the
+	// request fail, RFC 8489 Section 7.3.1.
+	var unknown []byte
+	for _, a := range m.attrs {
+		if a.typ < 0x8000 && !knownAttr(a.typ) {
+			unknown = binary.BigEndian.AppendUint16(unknown, a.typ)
+		}
+	}
+	if unknown != nil {
+		return t.errorResponse(m, errUnknownAttribute, nil, func(b *turnMsgBuilder) {
+			b.add(attrUnknownAttributes, unknown)
+		})
+	}
+
+	username, key, terr := t.authenticate(src, m)
+	if terr != nil {
+		return t.errorResponse(m, terr, nil)
+	}
+
+	switch m.method {
+	case methodAllocate:
+		return t.allocate(pc, src, m, username, key)
+	case methodRefresh:
+		return t.refresh(src, m, username, key)
+	case methodCreatePermission:
+		return t.createPermission(src, m, username, key)
+	default:
+		return t.channelBind(src, m, username, key)
+	}
+}
+
+func knownAttr(typ uint16) bool {
+	switch typ {
+	case attrUsername, attrMessageIntegrity, attrChannelNumber, attrLifetime,
+		attrXorPeerAddress, attrData, attrRealm, attrNonce,
+		attrRequestedFamily, attrRequestedTransport:
+		return true
+	}
+	// DONT-FRAGMENT (0x001A) and EVEN-PORT (0x0018) are safe to ignore
+	// for a relay that never sets DF and allocates random ports.
+	return typ == 0x0018 || typ == 0x001a
+}
+
+// errorResponse returns an error response to m. If key is non-nil, the
+// response is authenticated with it. Any extra functions add attributes.
+func (t *turnServer) errorResponse(m *turnMsg, e *turnError, key []byte, extra ...func(*turnMsgBuilder)) []byte {
+	turnErrors.Add(strconv.Itoa(e.code), 1)
+	b := newTURNMsg(m.method, classError, m.tx)
+	b.addError(e.code, e.reason)
+	if e == errUnauthorized || e == errStaleNonce {
+		b.add(attrRealm, []byte(t.cfg.Realm))
+		b.add(attrNonce, []byte(t.newNonce()))
+	}
+	for _, f := range extra {
+		f(b)
+	}
+	return b.finish(key)
+}
+
+// authenticate checks the long-term credentials of the request m, RFC 8489
+// Section 9.2, and returns the username and key.
+func (t *turnServer) authenticate(src netip.AddrPort, m *turnMsg) (username string, key []byte, _ *turnError) {
+	if m.integrityOff == 0 {
+		return "", nil, errUnauthorized
+	}
+	user, ok1 := m.attr(attrUsername)
+	realm, ok2 := m.attr(attrRealm)
+	nonce, ok3 := m.attr(attrNonce)
+	if !ok1 || !ok2 || !ok3 {
+		return "", nil, errBadRequest
+	}
+	if !t.validNonce(string(nonce)) {
+		return "", nil, errStaleNonce
+	}
+	if string(realm) != t.cfg.Realm {
+		return "", nil, errUnauthorized
+	}
+	username = string(user)
+	password, ok := t.password(username)
+	if !ok {
+		return "", nil, errUnauthorized
+	}
+	sum := md5.Sum([]byte(username + ":" + t.cfg.Realm + ":" + password))
+	key = sum[:]
+	if !m.checkIntegrity(key) {
+		return "", nil, errUnauthorized
+	}
+	return username, key, nil
+}
+
+// password returns the password of username.
+func (t *turnServer) password(username string) (string, bool) {
+	if p, ok := t.cfg.Users[username]; ok {
+		return p, true
+	}
+	if t.cfg.Secret == "" {
+		return "", false
+	}
+	expiry, _, _ := strings.Cut(username, ":")
+	sec, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || t.timeNow().Unix() > sec {
+		return "", false
+	}
+	h := hmac.New(sha1.New, []byte(t.cfg.Secret))
+	h.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), true
+}
+
+// newNonce returns a nonce that's valid for nonceLifetime. Nonces are the
+// hex expiry time and its truncated HMAC, so they need no state.
+func (t *turnServer) newNonce() string {
+	exp := strconv.FormatInt(t.timeNow().Add(nonceLifetime).Unix(), 16)
+	return exp + "-" + t.nonceMAC(exp)
+}
+
+func (t *turnServer) nonceMAC(exp string) string {
+	h := hmac.New(sha1.New, t.nonceKey)
+	h.Write([]byte(exp))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (t *turnServer) validNonce(nonce string) bool {
+	exp, mac, ok := strings.Cut(nonce, "-")
+	if !ok || !hmac.Equal([]byte(mac), []byte(t.nonceMAC(exp))) {
+		return false
+	}
+	sec, err := strconv.ParseInt(exp, 16, 64)
+	return err == nil && t.timeNow().Unix() <= sec
+}
+
+// lifetime returns the lifetime requested by m, clamped.
+func lifetime(m *turnMsg) time.Duration {
+	v, ok := m.attr(attrLifetime)
+	if !ok || len(v) != 4 {
+		return defaultAllocationLifetime
+	}
+	d := time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	if d == 0 {
+		return 0
+	}
+	return min(max(d, defaultAllocationLifetime), maxAllocationLifetime)
+}
+
+func (t *turnServer) allocate(pc *net.UDPConn, src netip.AddrPort, m *turnMsg, username string, key []byte) []byte {
+	if v, ok := m.attr(attrRequestedTransport); !ok || len(v) != 4 {
+		return t.errorResponse(m, errBadRequest, key)
+	} else if v[0] != protoUDP {
+		return t.errorResponse(m, errUnsupportedProto, key)
+	}
+	if v, ok := m.attr(attrRequestedFamily); ok && (len(v) != 4 || v[0] != 1) {
+		return t.errorResponse(m, errFamilyNotSupported, key)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a := t.allocs[src]; a != nil {
+		if a.tx == m.tx && a.username == username {
+			// A retransmission.
+			return t.allocateSuccess(m, a, key)
+		}
+		return t.errorResponse(m, errAllocationMismatch, key)
+	}
+	if max := t.cfg.MaxAllocations; max > 0 && len(t.allocs) >= max {
+		return t.errorResponse(m, errQuotaReached, key)
+	}
+	if max := t.cfg.MaxAllocationsPerUser; max > 0 && t.perUser[username] >= max {
+		return t.errorResponse(m, errQuotaReached, key)
+	}
+	d := lifetime(m)
+	if d == 0 {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+	relay, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Printf("TURN relay listen: %v", err)
+		return t.errorResponse(m, errInsufficientCapacity, key)
+	}
+	a := &turnAllocation{
+		client:    src,
+		pc:        pc,
+		relay:     relay,
+		relayAddr: netip.AddrPortFrom(t.cfg.RelayIP, uint16(relay.LocalAddr().(*net.UDPAddr).Port)),
+		username:  username,
+		key:       key,
+		tx:        m.tx,
+		expires:   t.timeNow().Add(d),
+		perms:     map[netip.Addr]time.Time{},
+		channels:  map[uint16]*turnChannel{},
+		byPeer:    map[netip.AddrPort]*turnChannel{},
+	}
+	t.allocs[src] = a
+	t.perUser[username]++
+	turnAllocations.Add(1)
+	go t.relayLoop(a)
+	return t.allocateSuccess(m, a, key)
+}
+
+func (t *turnServer) allocateSuccess(m *turnMsg, a *turnAllocation, key []byte) []byte {
+	b := newTURNMsg(methodAllocate, classSuccess, m.tx)
+	b.addXorAddr(attrXorRelayedAddress, a.relayAddr)
+	b.addXorAddr(attrXorMappedAddress, a.client)
+	b.addUint32(attrLifetime, uint32(a.expires.Sub(t.timeNow()).Round(time.Second)/time.Second))
+	return b.finish(key)
+}
+
+// allocationLocked returns the allocation of src, checking that it belongs
+// to username. t.mu must be held.
+func (t *turnServer) allocationLocked(src netip.AddrPort, username string) (*turnAllocation, *turnError) {
+	a := t.allocs[src]
+	switch {
+	case a == nil || !t.timeNow().Before(a.expires):
+		return nil, errAllocationMismatch
+	case a.username != username:
+		return nil, errWrongCredentials
+	}
+	return a, nil
+}
+
+func (t *turnServer) refresh(src netip.AddrPort, m *turnMsg, username string, key []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, terr := t.allocationLocked(src, username)
+	if terr != nil {
+		return t.errorResponse(m, terr, key)
+	}
+	d := lifetime(m)
+	if d == 0 {
+		t.deleteLocked(a)
+	} else {
+		a.expires = t.timeNow().Add(d)
+	}
+	b := newTURNMsg(methodRefresh, classSuccess, m.tx)
+	b.addUint32(attrLifetime, uint32(d/time.Second))
+	return b.finish(key)
+}
+
+// peerAllowed reports whether clients may relay to ip.
+func (t *turnServer) peerAllowed(ip netip.Addr) bool {
+	if t.cfg.AllowPrivatePeers {
+		return true
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !tsaddr.CGNATRange().Contains(ip) && ip != t.cfg.RelayIP
+}
+
+func (t *turnServer) createPermission(src netip.AddrPort, m *turnMsg, username string, key []byte) []byte {
+	var peers []netip.Addr
+	for _, at := range m.attrs {
+		if at.typ != attrXorPeerAddress {
+			continue
+		}
+		ap, ok := parseXorAddr(at.val, m.tx)
+		if !ok {
+			return t.errorResponse(m, errBadRequest, key)
+		}
+		if !ap.Addr().Is4() {
+			return t.errorResponse(m, errPeerFamilyMismatch, key)
+		}
+		if !t.peerAllowed(ap.Addr()) {
+			return t.errorResponse(m, errForbidden, key)
+		}
+		peers = append(peers, ap.Addr())
+	}
+	if len(peers) == 0 {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, terr := t.allocationLocked(src, username)
+	if terr != nil {
+		return t.errorResponse(m, terr, key)
+	}
+	exp := t.timeNow().Add(permissionLifetime)
+	for _, ip := range peers {
+		a.perms[ip] = exp
+	}
+	return newTURNMsg(methodCreatePermission, classSuccess, m.tx).finish(key)
+}
+
+func (t *turnServer) channelBind(src netip.AddrPort, m *turnMsg, username string, key []byte) []byte {
+	v, ok := m.attr(attrChannelNumber)
+	if !ok || len(v) != 4 {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+	num := binary.BigEndian.Uint16(v)
+	peer, ok := m.xorAddr(attrXorPeerAddress)
+	if !ok || num < minChannel || num > maxChannel {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+	if !peer.Addr().Is4() {
+		return t.errorResponse(m, errPeerFamilyMismatch, key)
+	}
+	if !t.peerAllowed(peer.Addr()) {
+		return t.errorResponse(m, errForbidden, key)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, terr := t.allocationLocked(src, username)
+	if terr != nil {
+		return t.errorResponse(m, terr, key)
+	}
+	// A channel can't be rebound to another peer, nor a peer to another
+	// channel, RFC 8656 Section 11.2.
+	if c := a.channels[num]; c != nil && c.peer != peer {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+	if c := a.byPeer[peer]; c != nil && c.num != num {
+		return t.errorResponse(m, errBadRequest, key)
+	}
+	now := t.timeNow()
+	c := &turnChannel{num: num, peer: peer, expires: now.Add(channelLifetime)}
+	a.channels[num] = c
+	a.byPeer[peer] = c
+	a.perms[peer.Addr()] = now.Add(permissionLifetime)
+	return newTURNMsg(methodChannelBind, classSuccess, m.tx).finish(key)
+}
+
+// handleSend relays the data in a Send indication to its peer.
+func (t *turnServer) handleSend(src netip.AddrPort, m *turnMsg) {
+	peer, ok := m.xorAddr(attrXorPeerAddress)
+	data, ok2 := m.attr(attrData)
+	if !ok || !ok2 {
+		return
+	}
+	t.mu.Lock()
+	a := t.allocs[src]
+	var relay *net.UDPConn
+	if a == nil {
+		turnNoAllocation.Add(1)
+	} else if exp, ok := a.perms[peer.Addr()]; !ok || !t.timeNow().Before(exp) {
+		turnNoPermission.Add(1)
+	} else {
+		relay = a.relay
+	}
+	t.mu.Unlock()
+	if relay != nil {
+		t.sendToPeer(relay, peer, data)
+	}
+}
+
+// handleChannelData relays the data in a ChannelData message to its peer.
+func (t *turnServer) handleChannelData(src netip.AddrPort, pkt []byte) {
+	num, data, ok := parseChannelData(pkt)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	a := t.allocs[src]
+	var relay *net.UDPConn
+	var peer netip.AddrPort
+	if a == nil {
+		turnNoAllocation.Add(1)
+	} else if c := a.channels[num]; c == nil || !t.timeNow().Before(c.expires) {
+		turnNoChannel.Add(1)
+	} else {
+		relay, peer = a.relay, c.peer
+	}
+	t.mu.Unlock()
+	if relay != nil {
+		t.sendToPeer(relay, peer, data)
+	}
+}
+
+func (t *turnServer) sendToPeer(relay *net.UDPConn, peer netip.AddrPort, data []byte) {
+	if _, err := relay.WriteToUDPAddrPort(data, peer); err == nil {
+		turnBytesToPeer.Add(int64(len(data)))
+		turnPktsToPeer.Add(1)
+	}
+}
+
+// relayLoop relays packets from peers to the client of a until its relay
+// socket is closed.
+func (t *turnServer) relayLoop(a *turnAllocation) {
+	var buf [64 << 10]byte
+	for {
+		n, peer, err := a.relay.ReadFromUDPAddrPort(buf[channelDataHeaderLen:])
+		if err != nil {
+			return
+		}
+		peer = netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())
+		data := buf[channelDataHeaderLen : channelDataHeaderLen+n]
+
+		t.mu.Lock()
+		exp, ok := a.perms[peer.Addr()]
+		permitted := ok && t.timeNow().Before(exp)
+		var num uint16
+		if c := a.byPeer[peer]; c != nil && t.timeNow().Before(c.expires) {
+			num = c.num
+		}
+		t.mu.Unlock()
+		if !permitted {
+			turnNoPermission.Add(1)
+			continue
+		}
+
+		var pkt []byte
+		if num != 0 {
+			// Fill in the ChannelData header in front of the data.
+			binary.BigEndian.PutUint16(buf[0:2], num)
+			binary.BigEndian.PutUint16(buf[2:4], uint16(n))
+			pkt = buf[:channelDataHeaderLen+n]
+		} else {
+			b := newTURNMsg(methodData, classIndication, stun.NewTxID())
+			b.addXorAddr(attrXorPeerAddress, peer)
+			b.add(attrData, data)
+			pkt = b.finish(nil)
+		}
+		if _, err := a.pc.WriteToUDPAddrPort(pkt, a.client); err == nil {
+			turnBytesToClient.Add(int64(n))
+			turnPktsToClient.Add(1)
+		}
+	}
+}
+
+// deleteLocked deletes the allocation a. t.mu must be held.
+func (t *turnServer) deleteLocked(a *turnAllocation) {
+	if t.allocs[a.client] != a {
+		return
+	}
+	delete(t.allocs, a.client)
+	if t.perUser[a.username]--; t.perUser[a.username] <= 0 {
+		delete(t.perUser, a.username)
+	}
+	turnAllocations.Add(-1)
+	a.relay.Close()
+}
+
+// sweepLoop removes expired state every turnSweepInterval until t.ctx is
+// done, when it deletes all allocations.
+func (t *turnServer) sweepLoop() {
+	tick := time.NewTicker(turnSweepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.sweep()
+		case <-t.ctx.Done():
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			for _, a := range t.allocs {
+				t.deleteLocked(a)
+			}
+			return
+		}
+	}
+}
+
+func (t *turnServer) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.timeNow()
+	for _, a := range t.allocs {
+		if !now.Before(a.expires) {
+			t.deleteLocked(a)
+			continue
+		}
+		for ip, exp := range a.perms {
+			if !now.Before(exp) {
+				delete(a.perms, ip)
+			}
+		}
+		for num, c := range a.channels {
+			if !now.Before(c.expires) {
+				delete(a.channels, num)
+				delete(a.byPeer, c.peer)
+			}
+		}
+	}
+}
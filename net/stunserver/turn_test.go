@@ -0,0 +1,316 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package stunserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/util/must"
+)
+
+func TestMsgType(t *testing.T) {
+	tests := []struct {
+		method uint16
+		class  uint8
+		want   uint16
+	}{
+		{methodBinding, classRequest, 0x0001},
+		{methodBinding, classSuccess, 0x0101},
+		{methodAllocate, classError, 0x0113},
+		{methodSend, classIndication, 0x0016},
+		{methodData, classIndication, 0x0017},
+		{methodChannelBind, classSuccess, 0x0109},
+	}
+	for _, tt := range tests {
+		if got := msgType(tt.method, tt.class); got != tt.want {
+			t.Errorf("msgType(%#x, %d) = %#04x; want %#04x", tt.method, tt.class, got, tt.want)
+		}
+		if m, c := splitMsgType(tt.want); m != tt.method || c != tt.class {
+			t.Errorf("splitMsgType(%#04x) = %#x, %d; want %#x, %d", tt.want, m, c, tt.method, tt.class)
+		}
+	}
+}
+
+// turnTestClient is a minimal TURN client.
+type turnTestClient struct {
+	t      *testing.T
+	c      *net.UDPConn
+	server netip.AddrPort
+
+	user, realm, nonce string
+	key                []byte
+}
+
+func newTURNTestClient(t *testing.T, server netip.AddrPort, user, password string) *turnTestClient {
+	c := must.Get(net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	t.Cleanup(func() { c.Close() })
+	tc := &turnTestClient{t: t, c: c, server: server, user: user}
+	// Learn the realm and nonce.
+	res := tc.do(methodAllocate, false, requestUDP)
+	if code := errorCode(res); code != 401 {
+		t.Fatalf("unauthenticated Allocate: got code %d; want 401", code)
+	}
+	realm, _ := res.attr(attrRealm)
+	nonce, _ := res.attr(attrNonce)
+	tc.realm, tc.nonce = string(realm), string(nonce)
+	sum := md5.Sum([]byte(user + ":" + tc.realm + ":" + password))
+	tc.key = sum[:]
+	return tc
+}
+
+func requestUDP(b *turnMsgBuilder) {
+	b.add(attrRequestedTransport, []byte{protoUDP, 0, 0, 0})
+}
+
+func withPeer(peer netip.AddrPort) func(*turnMsgBuilder) {
+	return func(b *turnMsgBuilder) { b.addXorAddr(attrXorPeerAddress, peer) }
+}
+
+// do sends a request and returns the response.
+func (tc *turnTestClient) do(method uint16, auth bool, attrs ...func(*turnMsgBuilder)) *turnMsg {
+	tc.t.Helper()
+	b := newTURNMsg(method, classRequest, stun.NewTxID())
+	for _, f := range attrs {
+		f(b)
+	}
+	var key []byte
+	if auth {
+		b.add(attrUsername, []byte(tc.user))
+		b.add(attrRealm, []byte(tc.realm))
+		b.add(attrNonce, []byte(tc.nonce))
+		key = tc.key
+	}
+	tc.send(b.finish(key))
+	m := tc.recv()
+	if m == nil || m.tx != b.tx || m.method != method {
+		tc.t.Fatalf("bad response to %v: %+v", methodName(method), m)
+	}
+	if auth && m.class == classSuccess && !m.checkIntegrity(tc.key) {
+		tc.t.Fatalf("response to %v has bad MESSAGE-INTEGRITY", methodName(method))
+	}
+	return m
+}
+
+func (tc *turnTestClient) send(pkt []byte) {
+	tc.t.Helper()
+	if _, err := tc.c.WriteToUDPAddrPort(pkt, tc.server); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// recvRaw returns the next packet, or nil after a timeout.
+func (tc *turnTestClient) recvRaw(timeout time.Duration) []byte {
+	tc.c.SetReadDeadline(time.Now().Add(timeout))
+	var buf [1500]byte
+	n, err := tc.c.Read(buf[:])
+	if err != nil {
+		return nil
+	}
+	return bytes.Clone(buf[:n])
+}
+
+func (tc *turnTestClient) recv() *turnMsg {
+	tc.t.Helper()
+	pkt := tc.recvRaw(5 * time.Second)
+	if pkt == nil {
+		tc.t.Fatal("no response")
+	}
+	m, err := parseTURNMsg(pkt)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return m
+}
+
+func errorCode(m *turnMsg) int {
+	if m.class != classError {
+		return 0
+	}
+	v, ok := m.attr(attrErrorCode)
+	if !ok || len(v) < 4 {
+		return -1
+	}
+	return int(v[2])*100 + int(v[3])
+}
+
+func TestTURN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New(ctx)
+	must.Do(s.Listen("127.0.0.1:0"))
+	must.Do(s.EnableTURN(TURNConfig{
+		Realm:                 "example.com",
+		RelayIP:               netip.MustParseAddr("127.0.0.1"),
+		Users:                 map[string]string{"alice": "pw", "bob": "pw2"},
+		Secret:                "s3cret",
+		MaxAllocationsPerUser: 1,
+		AllowPrivatePeers:     true,
+	}))
+	go s.Serve()
+	server := s.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	peer := must.Get(net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+	peerRecv := func() (string, netip.AddrPort) {
+		t.Helper()
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var buf [1500]byte
+		n, from, err := peer.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			t.Fatalf("peer: %v", err)
+		}
+		return string(buf[:n]), from
+	}
+
+	// Wrong password.
+	bad := newTURNTestClient(t, server, "alice", "wrong")
+	if code := errorCode(bad.do(methodAllocate, true, requestUDP)); code != 401 {
+		t.Fatalf("Allocate with wrong password: got code %d; want 401", code)
+	}
+
+	alice := newTURNTestClient(t, server, "alice", "pw")
+	res := alice.do(methodAllocate, true, requestUDP)
+	if res.class != classSuccess {
+		t.Fatalf("Allocate failed with code %d", errorCode(res))
+	}
+	relayAddr, ok := res.xorAddr(attrXorRelayedAddress)
+	if !ok || relayAddr.Addr() != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("bad relayed address %v", relayAddr)
+	}
+	if mapped, _ := res.xorAddr(attrXorMappedAddress); mapped != alice.c.LocalAddr().(*net.UDPAddr).AddrPort() {
+		t.Errorf("mapped address = %v; want %v", mapped, alice.c.LocalAddr())
+	}
+	if v, _ := res.attr(attrLifetime); binary.BigEndian.Uint32(v) != 600 {
+		t.Errorf("lifetime = %d; want 600", binary.BigEndian.Uint32(v))
+	}
+
+	// A second allocation from the same address is a mismatch.
+	if code := errorCode(alice.do(methodAllocate, true, requestUDP)); code != 437 {
+		t.Errorf("second Allocate: got code %d; want 437", code)
+	}
+	// And one by the same user from elsewhere exceeds the quota.
+	alice2 := newTURNTestClient(t, server, "alice", "pw")
+	if code := errorCode(alice2.do(methodAllocate, true, requestUDP)); code != 486 {
+		t.Errorf("Allocate over quota: got code %d; want 486", code)
+	}
+	// Bob can't use Alice's allocation.
+	bob := newTURNTestClient(t, server, "bob", "pw2")
+	bob.c.Close()
+	bob.c = alice.c
+	if code := errorCode(bob.do(methodCreatePermission, true, withPeer(peerAddr))); code != 441 {
+		t.Errorf("CreatePermission by another user: got code %d; want 441", code)
+	}
+
+	// Without a permission, the relay drops packets from the peer.
+	must.Get(peer.WriteToUDPAddrPort([]byte("dropped"), relayAddr))
+	if pkt := alice.recvRaw(100 * time.Millisecond); pkt != nil {
+		t.Fatalf("got packet from peer without permission: %q", pkt)
+	}
+
+	if res := alice.do(methodCreatePermission, true, withPeer(peerAddr)); res.class != classSuccess {
+		t.Fatalf("CreatePermission failed with code %d", errorCode(res))
+	}
+
+	// Send and Data indications.
+	send := newTURNMsg(methodSend, classIndication, stun.NewTxID())
+	send.addXorAddr(attrXorPeerAddress, peerAddr)
+	send.add(attrData, []byte("hello peer"))
+	alice.send(send.finish(nil))
+	if got, from := peerRecv(); got != "hello peer" || from != relayAddr {
+		t.Errorf("peer got %q from %v; want %q from %v", got, from, "hello peer", relayAddr)
+	}
+	must.Get(peer.WriteToUDPAddrPort([]byte("hello client"), relayAddr))
+	m := alice.recv()
+	data, _ := m.attr(attrData)
+	from, _ := m.xorAddr(attrXorPeerAddress)
+	if m.method != methodData || m.class != classIndication || string(data) != "hello client" || from != peerAddr {
+		t.Errorf("got %v %d with data %q from %v; want Data indication", methodName(m.method), m.class, data, from)
+	}
+
+	// Channels.
+	channel := func(b *turnMsgBuilder) { b.addUint32(attrChannelNumber, 0x4001<<16) }
+	if res := alice.do(methodChannelBind, true, channel, withPeer(peerAddr)); res.class != classSuccess {
+		t.Fatalf("ChannelBind failed with code %d", errorCode(res))
+	}
+	alice.send(appendChannelData(nil, 0x4001, []byte("over channel")))
+	if got, _ := peerRecv(); got != "over channel" {
+		t.Errorf("peer got %q; want %q", got, "over channel")
+	}
+	must.Get(peer.WriteToUDPAddrPort([]byte("channel back"), relayAddr))
+	num, data, ok := parseChannelData(alice.recvRaw(5 * time.Second))
+	if !ok || num != 0x4001 || string(data) != "channel back" {
+		t.Errorf("got ChannelData %#x %q (ok=%v); want %#x %q", num, data, ok, 0x4001, "channel back")
+	}
+	otherPeer := netip.AddrPortFrom(peerAddr.Addr(), peerAddr.Port()+1)
+	if code := errorCode(alice.do(methodChannelBind, true, channel, withPeer(otherPeer))); code != 400 {
+		t.Errorf("rebinding channel: got code %d; want 400", code)
+	}
+
+	// Deleting the allocation frees the quota.
+	zero := func(b *turnMsgBuilder) { b.addUint32(attrLifetime, 0) }
+	if res := alice.do(methodRefresh, true, zero); res.class != classSuccess {
+		t.Fatalf("Refresh failed with code %d", errorCode(res))
+	}
+	if res := alice2.do(methodAllocate, true, requestUDP); res.class != classSuccess {
+		t.Fatalf("Allocate after delete failed with code %d", errorCode(res))
+	}
+
+	// Time-limited credentials.
+	restPassword := func(user string) string {
+		h := hmac.New(sha1.New, []byte("s3cret"))
+		h.Write([]byte(user))
+		return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	user := fmt.Sprintf("%d:carol", time.Now().Add(time.Hour).Unix())
+	carol := newTURNTestClient(t, server, user, restPassword(user))
+	if res := carol.do(methodAllocate, true, requestUDP); res.class != classSuccess {
+		t.Errorf("Allocate with time-limited credentials failed with code %d", errorCode(res))
+	}
+	user = fmt.Sprintf("%d:dave", time.Now().Add(-time.Minute).Unix())
+	dave := newTURNTestClient(t, server, user, restPassword(user))
+	if code := errorCode(dave.do(methodAllocate, true, requestUDP)); code != 401 {
+		t.Errorf("Allocate with expired credentials: got code %d; want 401", code)
+	}
+
+	// A stale nonce.
+	dave.nonce = "0-0000000000000000"
+	if code := errorCode(dave.do(methodAllocate, true, requestUDP)); code != 438 {
+		t.Errorf("Allocate with stale nonce: got code %d; want 438", code)
+	}
+}
+
+func TestTURNPeerAllowed(t *testing.T) {
+	ts := &turnServer{cfg: TURNConfig{RelayIP: netip.MustParseAddr("1.2.3.4")}}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"1.2.3.4", false},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.1.1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	} {
+		if got := ts.peerAllowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("peerAllowed(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package stunserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/netip"
+
+	"tailscale.com/net/stun"
+)
+
+// STUN methods used by TURN, RFC 8656 Section 17.
+const (
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+	methodChannelBind      = 0x009
+)
+
+// STUN message classes, RFC 8489 Section 5.
+const (
+	classRequest    = 0b00
+	classIndication = 0b01
+	classSuccess    = 0b10
+	classError      = 0b11
+)
+
+// STUN and TURN attributes, RFC 8489 Section 18.3 and RFC 8656 Section 18.
+const (
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrUnknownAttributes  = 0x000a
+	attrChannelNumber      = 0x000c
+	attrLifetime           = 0x000d
+	attrXorPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXorRelayedAddress  = 0x0016
+	attrRequestedFamily    = 0x0017
+	attrRequestedTransport = 0x0019
+	attrXorMappedAddress   = 0x0020
+	attrFingerprint        = 0x8028
+)
+
+const (
+	stunHeaderLen   = 20
+	stunMagicCookie = 0x2112a442
+	lenIntegrity    = 4 + sha1.Size
+	lenFingerprint  = 4 + 4
+
+	// protoUDP is the REQUESTED-TRANSPORT value for UDP.
+	protoUDP = 17
+)
+
+// msgType returns the STUN message type for method and class,
+// RFC 8489 Section 5.
+func msgType(method uint16, class uint8) uint16 {
+	c := uint16(class)
+	return method&0x000f | (c&1)<<4 | (method&0x0070)<<1 | (c&2)<<7 | (method&0x0f80)<<2
+}
+
+// splitMsgType is the inverse of msgType.
+func splitMsgType(t uint16) (method uint16, class uint8) {
+	method = t&0x000f | (t&0x00e0)>>1 | (t&0x3e00)>>2
+	class = uint8((t&0x0010)>>4 | (t&0x0100)>>7)
+	return method, class
+}
+
+var errMalformedMsg = errors.New("malformed STUN message")
+
+// turnMsg is a parsed STUN message.
+type turnMsg struct {
+	method uint16
+	class  uint8
+	tx     stun.TxID
+	attrs  []turnAttr
+
+	raw          []byte // the whole message
+	integrityOff int    // offset of MESSAGE-INTEGRITY in raw, or 0 if none
+}
+
+type turnAttr struct {
+	typ uint16
+	val []byte
+}
+
+// parseTURNMsg parses the STUN message b. The returned message aliases b.
+func parseTURNMsg(b []byte) (*turnMsg, error) {
+	if !stun.Is(b) {
+		return nil, errMalformedMsg
+	}
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if n%4 != 0 || stunHeaderLen+n != len(b) {
+		return nil, errMalformedMsg
+	}
+	m := &turnMsg{raw: b}
+	m.method, m.class = splitMsgType(binary.BigEndian.Uint16(b[0:2]))
+	copy(m.tx[:], b[8:stunHeaderLen])
+	for off := stunHeaderLen; off < len(b); {
+		if len(b)-off < 4 {
+			return nil, errMalformedMsg
+		}
+		typ := binary.BigEndian.Uint16(b[off:])
+		alen := int(binary.BigEndian.Uint16(b[off+2:]))
+		end := off + 4 + (alen+3)&^3
+		if end > len(b) {
+			return nil, errMalformedMsg
+		}
+		if m.integrityOff == 0 {
+			// Attributes after MESSAGE-INTEGRITY, other than
+			// FINGERPRINT, must be ignored.
+			m.attrs = append(m.attrs, turnAttr{typ, b[off+4 : off+4+alen]})
+		}
+		if typ == attrMessageIntegrity && m.integrityOff == 0 {
+			m.integrityOff = off
+		}
+		off = end
+	}
+	return m, nil
+}
+
+// attr returns the value of the first attribute of type typ, if any.
+func (m *turnMsg) attr(typ uint16) ([]byte, bool) {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.val, true
+		}
+	}
+	return nil, false
+}
+
+// xorAddr returns the value of the XOR-*-ADDRESS attribute of type typ.
+func (m *turnMsg) xorAddr(typ uint16) (netip.AddrPort, bool) {
+	v, ok := m.attr(typ)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	return parseXorAddr(v, m.tx)
+}
+
+// checkIntegrity reports whether the message has a MESSAGE-INTEGRITY
+// attribute that's valid for key, RFC 8489 Section 14.5.
+func (m *turnMsg) checkIntegrity(key []byte) bool {
+	if m.integrityOff == 0 {
+		return false
+	}
+	got, _ := m.attr(attrMessageIntegrity)
+	return hmac.Equal(got, integrity(m.raw[:m.integrityOff], key))
+}
+
+// integrity returns the MESSAGE-INTEGRITY value for the message b, which
+// ends just before the attribute.
+func integrity(b, key []byte) []byte {
+	// The HMAC covers the header with a length that includes the
+	// MESSAGE-INTEGRITY attribute, but nothing after it.
+	var hdr [4]byte
+	copy(hdr[:2], b[:2])
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(b)-stunHeaderLen+lenIntegrity))
+	h := hmac.New(sha1.New, key)
+	h.Write(hdr[:])
+	h.Write(b[4:])
+	return h.Sum(nil)
+}
+
+// turnMsgBuilder builds a STUN message.
+type turnMsgBuilder struct {
+	b  []byte
+	tx stun.TxID
+}
+
+func newTURNMsg(method uint16, class uint8, tx stun.TxID) *turnMsgBuilder {
+	b := make([]byte, stunHeaderLen, 128)
+	binary.BigEndian.PutUint16(b[0:2], msgType(method, class))
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:], tx[:])
+	return &turnMsgBuilder{b: b, tx: tx}
+}
+
+func (m *turnMsgBuilder) add(typ uint16, val []byte) {
+	m.b = binary.BigEndian.AppendUint16(m.b, typ)
+	m.b = binary.BigEndian.AppendUint16(m.b, uint16(len(val)))
+	m.b = append(m.b, val...)
+	for len(m.b)%4 != 0 {
+		m.b = append(m.b, 0)
+	}
+}
+
+func (m *turnMsgBuilder) addUint32(typ uint16, v uint32) {
+	m.add(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (m *turnMsgBuilder) addXorAddr(typ uint16, ap netip.AddrPort) {
+	m.add(typ, appendXorAddr(nil, ap, m.tx))
+}
+
+// addError adds an ERROR-CODE attribute, RFC 8489 Section 14.8.
+func (m *turnMsgBuilder) addError(code int, reason string) {
+	v := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	m.add(attrErrorCode, append(v, reason...))
+}
+
+// finish adds a MESSAGE-INTEGRITY attribute for key, if non-nil, and a
+// FINGERPRINT attribute, and returns the message.
+func (m *turnMsgBuilder) finish(key []byte) []byte {
+	if key != nil {
+		m.add(attrMessageIntegrity, integrity(m.b, key))
+	}
+	binary.BigEndian.PutUint16(m.b[2:4], uint16(len(m.b)-stunHeaderLen+lenFingerprint))
+	fp := crc32.ChecksumIEEE(m.b) ^ 0x5354554e
+	m.b = binary.BigEndian.AppendUint16(m.b, attrFingerprint)
+	m.b = binary.BigEndian.AppendUint16(m.b, 4)
+	m.b = binary.BigEndian.AppendUint32(m.b, fp)
+	return m.b
+}
+
+// appendXorAddr appends the value of an XOR-*-ADDRESS attribute for ap,
+// RFC 8489 Section 14.2.
+func appendXorAddr(b []byte, ap netip.AddrPort, tx stun.TxID) []byte {
+	addr := ap.Addr().Unmap()
+	fam := byte(1)
+	if addr.Is6() {
+		fam = 2
+	}
+	b = append(b, 0, fam)
+	b = binary.BigEndian.AppendUint16(b, ap.Port()^stunMagicCookie>>16)
+	for i, o := range addr.AsSlice() {
+		b = append(b, o^xorKey(i, tx))
+	}
+	return b
+}
+
+func parseXorAddr(v []byte, tx stun.TxID) (netip.AddrPort, bool) {
+	if len(v) < 4 {
+		return netip.AddrPort{}, false
+	}
+	var n int
+	switch v[1] {
+	case 1:
+		n = 4
+	case 2:
+		n = 16
+	default:
+		return netip.AddrPort{}, false
+	}
+	if len(v) != 4+n {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(v[2:4]) ^ stunMagicCookie>>16
+	ip := make([]byte, n)
+	for i := range ip {
+		ip[i] = v[4+i] ^ xorKey(i, tx)
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), true
+}
+
+// xorKey returns the byte that the i'th byte of an XOR-*-ADDRESS is XORed
+// with: the magic cookie, then the transaction ID.
+func xorKey(i int, tx stun.TxID) byte {
+	if i < 4 {
+		return byte(uint32(stunMagicCookie) >> (24 - 8*i))
+	}
+	return tx[i-4]
+}
+
+// Channel numbers and ChannelData messages, RFC 8656 Section 12.
+const (
+	minChannel           = 0x4000
+	maxChannel           = 0x4fff
+	channelDataHeaderLen = 4
+)
+
+// isChannelData reports whether b looks like a ChannelData message.
+func isChannelData(b []byte) bool {
+	return len(b) >= channelDataHeaderLen && b[0]&0b11000000 == 0b01000000
+}
+
+// parseChannelData parses the ChannelData message b.
+func parseChannelData(b []byte) (channel uint16, data []byte, ok bool) {
+	if !isChannelData(b) {
+		return 0, nil, false
+	}
+	channel = binary.BigEndian.Uint16(b[0:2])
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if channel > maxChannel || n > len(b)-channelDataHeaderLen {
+		return 0, nil, false
+	}
+	return channel, b[channelDataHeaderLen : channelDataHeaderLen+n], true
+}
+
+// appendChannelData appends a ChannelData message to b. Over UDP it needs
+// no padding.
+func appendChannelData(b []byte, channel uint16, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, channel)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
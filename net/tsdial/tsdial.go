@@ -63,6 +63,11 @@ type Dialer struct {
 	// If nil, it's not used.
 	NetstackDialUDP func(context.Context, netip.AddrPort) (net.Conn, error)
 
+	// NetstackListenTCP listens on the provided IPPort, one of this node's
+	// Tailscale addresses, using netstack.
+	// If nil, UserListen is unsupported.
+	NetstackListenTCP func(netip.AddrPort) (net.Listener, error)
+
 	peerClientOnce sync.Once
 	peerClient     *http.Client
 
@@ -77,7 +82,8 @@ type Dialer struct {
 	mu               sync.Mutex
 	closed           bool
 	dns              dnsMap
-	tunName          string // tun device name
+	selfAddrs        []netip.Addr // this node's Tailscale addresses
+	tunName          string       // tun device name
 	netMon           *netmon.Monitor
 	netMonUnregister func()
 	exitDNSDoHBase   string                 // non-empty if DoH-proxying exit node in use; base URL+path (without '?')
@@ -287,10 +293,20 @@ func (d *Dialer) PeerDialControlFunc() func(network, address string, c syscall.R
 // in its DNS configuration.
 func (d *Dialer) SetNetMap(nm *netmap.NetworkMap) {
 	m := dnsMapFromNetworkMap(nm)
+	var selfAddrs []netip.Addr
+	if nm != nil {
+		addrs := nm.GetAddresses()
+		for i := range addrs.Len() {
+			if pfx := addrs.At(i); pfx.IsSingleIP() {
+				selfAddrs = append(selfAddrs, pfx.Addr())
+			}
+		}
+	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.dns = m
+	d.selfAddrs = selfAddrs
 }
 
 // userDialResolve resolves addr as if a user initiating the dial. (e.g. from a
@@ -437,6 +453,36 @@ func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn,
 	return stdDialer.DialContext(ctx, network, ipp.String())
 }
 
+// UserListen opens a TCP listener on an ephemeral port of this node's
+// Tailscale address, for a user-initiated (e.g. SOCKS BIND) request expecting
+// a connection back from peer, an "ip:port" or "host:port" address. The
+// listening address is of the same IP family as peer.
+//
+// It requires NetstackListenTCP to be set.
+func (d *Dialer) UserListen(ctx context.Context, network, peer string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("UserListen: unsupported network %q", network)
+	}
+	if d.NetstackListenTCP == nil {
+		return nil, errors.New("UserListen: Dialer not initialized for listening")
+	}
+	ipp, err := d.userDialResolve(ctx, network, peer)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	selfAddrs := d.selfAddrs
+	d.mu.Unlock()
+	for _, a := range selfAddrs {
+		if a.Is4() == ipp.Addr().Is4() {
+			return d.NetstackListenTCP(netip.AddrPortFrom(a, 0))
+		}
+	}
+	return nil, fmt.Errorf("UserListen: no Tailscale address to listen on for peer %v", ipp.Addr())
+}
+
 // dialPeerAPI connects to a Tailscale peer's peerapi over TCP.
 //
 // network must a "tcp" type, and addr must be an ip:port. Name resolution
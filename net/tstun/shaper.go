@@ -0,0 +1,486 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/util/clientmetric"
+)
+
+// DefaultShaperQueueLen is the number of packets a shaper bucket queues
+// when ShaperConfig.QueueLen is zero.
+const DefaultShaperQueueLen = 256
+
+// maxShaperPeerBuckets is the number of per-peer buckets a rule keeps before
+// it forgets idle ones.
+const maxShaperPeerBuckets = 1024
+
+// ShaperConfig configures the traffic shaper of a Wrapper, which rate-limits
+// and prioritizes packets sent to peers.
+//
+// Packets that exceed a rule's rate are queued, and sent as its token bucket
+// refills, highest priority first. Packets that don't fit in the queue are
+// dropped.
+type ShaperConfig struct {
+	// Rules are the shaping rules. A packet is shaped by the first rule
+	// that matches it. Packets that match no rule aren't shaped.
+	Rules []ShaperRule `json:"rules,omitempty"`
+
+	// QueueLen is the maximum number of packets that each bucket queues.
+	// Zero means DefaultShaperQueueLen.
+	QueueLen int `json:"queueLen,omitempty"`
+}
+
+// ShaperRule is a rule of a ShaperConfig.
+type ShaperRule struct {
+	// Dst are the prefixes that a packet's destination must be in. Empty
+	// means any destination.
+	Dst []netip.Prefix `json:"dst,omitempty"`
+
+	// Ports are the port ranges that a packet's source or destination port
+	// must be in. Empty means any port, or none.
+	Ports []tailcfg.PortRange `json:"ports,omitempty"`
+
+	// Rate is the rate limit, in bytes per second. Zero means no limit,
+	// which exempts matching packets from later rules.
+	Rate int64 `json:"rate,omitempty"`
+
+	// Burst is the size of the token bucket, in bytes: how much can be sent
+	// at once after an idle period. Zero means a tenth of Rate. It's never
+	// less than MaxPacketSize.
+	Burst int64 `json:"burst,omitempty"`
+
+	// PerPeer is whether each destination IP gets its own token bucket,
+	// rather than all matching packets sharing one.
+	PerPeer bool `json:"perPeer,omitempty"`
+
+	// Priority is the priority of matching packets. Empty means a priority
+	// based on the packet's DSCP; see ShaperPriority.
+	Priority ShaperPriority `json:"priority,omitempty"`
+}
+
+// Check reports an error if r is invalid: if it has a negative rate or
+// burst, an invalid prefix, an empty port range, or an unknown priority.
+func (r *ShaperRule) Check() error {
+	if r.Rate < 0 {
+		return fmt.Errorf("negative rate %d", r.Rate)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("negative burst %d", r.Burst)
+	}
+	for _, pfx := range r.Dst {
+		if !pfx.IsValid() {
+			return fmt.Errorf("invalid destination prefix %v", pfx)
+		}
+	}
+	for _, pr := range r.Ports {
+		if pr.First > pr.Last {
+			return fmt.Errorf("empty port range %d-%d", pr.First, pr.Last)
+		}
+	}
+	if r.Priority != "" {
+		if _, ok := r.Priority.index(); !ok {
+			return fmt.Errorf("unknown priority %q", r.Priority)
+		}
+	}
+	return nil
+}
+
+// ShaperPriority is the priority of a queued packet. Packets of higher
+// priority are sent first.
+//
+// Without a rule priority, DSCP CS2 and above, which include the AF21 that
+// OpenSSH uses for interactive sessions, are high priority. CS1, which
+// OpenSSH uses for bulk transfers, AF1x and LE are low priority. Everything
+// else is normal priority.
+type ShaperPriority string
+
+const (
+	PriorityHigh   ShaperPriority = "high"
+	PriorityNormal ShaperPriority = "normal"
+	PriorityLow    ShaperPriority = "low"
+)
+
+// Indexes of the queues of a tokenBucket, in the order that they're served.
+const (
+	prioHigh = iota
+	prioNormal
+	prioLow
+	numPrio
+)
+
+func (p ShaperPriority) index() (int, bool) {
+	switch p {
+	case PriorityHigh:
+		return prioHigh, true
+	case PriorityNormal:
+		return prioNormal, true
+	case PriorityLow:
+		return prioLow, true
+	}
+	return 0, false
+}
+
+var (
+	metricShaperQueued   = clientmetric.NewCounter("tstun_shaper_queued")
+	metricShaperDrop     = clientmetric.NewCounter("tstun_shaper_drop")
+	metricShaperQueueLen = clientmetric.NewGauge("tstun_shaper_queue_len")
+)
+
+// SetShaper configures the traffic shaper for packets sent to peers. A nil
+// config, or one without rules, disables it. Packets that the previous
+// shaper had queued are sent right away. Rules that fail ShaperRule.Check
+// are ignored, as is a negative QueueLen.
+func (t *Wrapper) SetShaper(cfg *ShaperConfig) {
+	var s *shaper
+	if cfg != nil && len(cfg.Rules) > 0 {
+		if old := t.shaper.Load(); old != nil && reflect.DeepEqual(old.cfg, *cfg) {
+			return
+		}
+		s = newShaper(*cfg, t.now, t.InjectOutbound)
+		t.logf("traffic shaper: %d rules", len(cfg.Rules))
+	} else if t.shaper.Load() == nil {
+		return
+	} else {
+		t.logf("traffic shaper: off")
+	}
+	if old := t.shaper.Swap(s); old != nil {
+		old.close()
+	}
+}
+
+// shaper rate-limits and prioritizes packets according to a ShaperConfig.
+type shaper struct {
+	cfg    ShaperConfig
+	now    func() time.Time
+	send   func([]byte) error // sends a queued packet when it's released
+	queueN int                // max packets queued per bucket
+
+	// afterFunc schedules release. It's tstime.StdClock's, except in tests.
+	afterFunc func(time.Duration, func()) tstime.TimerController
+
+	mu      sync.Mutex
+	closed  bool
+	rules   []*shaperRule
+	backlog map[*tokenBucket]bool  // buckets with queued packets
+	timer   tstime.TimerController // pending release, if non-nil
+	timerAt time.Time              // when timer fires
+}
+
+type shaperRule struct {
+	ShaperRule
+	prio    int // index of Priority, if hasPrio
+	hasPrio bool
+	shared  *tokenBucket                // if !PerPeer
+	peers   map[netip.Addr]*tokenBucket // if PerPeer
+}
+
+// tokenBucket is a token bucket with a queue per priority for packets that
+// exceed it.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time // when tokens was last refilled
+
+	queues [numPrio][][]byte
+	queued int // total length of queues
+}
+
+func newShaper(cfg ShaperConfig, now func() time.Time, send func([]byte) error) *shaper {
+	s := &shaper{
+		cfg:       cfg,
+		now:       now,
+		send:      send,
+		queueN:    cmp.Or(max(cfg.QueueLen, 0), DefaultShaperQueueLen),
+		afterFunc: tstime.StdClock{}.AfterFunc,
+		backlog:   make(map[*tokenBucket]bool),
+	}
+	for _, r := range cfg.Rules {
+		if r.Check() != nil {
+			continue
+		}
+		sr := &shaperRule{ShaperRule: r}
+		sr.prio, sr.hasPrio = r.Priority.index()
+		if r.PerPeer {
+			sr.peers = make(map[netip.Addr]*tokenBucket)
+		} else {
+			sr.shared = sr.newBucket(now())
+		}
+		s.rules = append(s.rules, sr)
+	}
+	return s
+}
+
+func (r *shaperRule) newBucket(now time.Time) *tokenBucket {
+	burst := r.Burst
+	if burst == 0 {
+		burst = r.Rate / 10
+	}
+	burst = max(burst, MaxPacketSize)
+	return &tokenBucket{
+		rate:   float64(r.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (r *shaperRule) match(p *packet.Parsed) bool {
+	if len(r.Dst) > 0 && !slices.ContainsFunc(r.Dst, func(pfx netip.Prefix) bool { return pfx.Contains(p.Dst.Addr()) }) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		switch p.IPProto {
+		case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		default:
+			return false
+		}
+		if !slices.ContainsFunc(r.Ports, func(pr tailcfg.PortRange) bool {
+			return pr.Contains(p.Src.Port()) || pr.Contains(p.Dst.Port())
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// bucket returns the token bucket for packets to dst, creating it if needed.
+// s.mu must be held.
+func (s *shaper) bucket(r *shaperRule, dst netip.Addr, now time.Time) *tokenBucket {
+	if !r.PerPeer {
+		return r.shared
+	}
+	if b := r.peers[dst]; b != nil {
+		return b
+	}
+	if len(r.peers) >= maxShaperPeerBuckets {
+		// Forget buckets that are full and have nothing queued, as a new
+		// bucket would be the same.
+		for ip, b := range r.peers {
+			if b.queued == 0 {
+				b.refill(now)
+				if b.tokens >= b.burst {
+					delete(r.peers, ip)
+				}
+			}
+		}
+	}
+	b := r.newBucket(now)
+	r.peers[dst] = b
+	return b
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens = min(b.burst, b.tokens+d.Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// packetPriority returns the queue index for p, based on its DSCP.
+func packetPriority(p *packet.Parsed) int {
+	b := p.Buffer()
+	if len(b) < 2 {
+		return prioNormal
+	}
+	var dscp byte
+	switch p.IPVersion {
+	case 4:
+		dscp = b[1] >> 2
+	case 6:
+		dscp = (b[0]&0x0f)<<2 | b[1]>>6
+	}
+	switch dscp {
+	case 1, 8, 10, 12, 14: // LE, CS1, AF11, AF12, AF13
+		return prioLow
+	}
+	if dscp >= 16 { // CS2 and above
+		return prioHigh
+	}
+	return prioNormal
+}
+
+// shape reports whether p may be sent now. If not, it has either been queued
+// to be sent later or dropped, which shape also reports.
+func (s *shaper) shape(p *packet.Parsed) (ok, dropped bool) {
+	var r *shaperRule
+	for _, sr := range s.rules {
+		if sr.match(p) {
+			r = sr
+			break
+		}
+	}
+	if r == nil || r.Rate == 0 {
+		return true, false
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true, false
+	}
+	b := s.bucket(r, p.Dst.Addr(), now)
+	b.refill(now)
+	n := len(p.Buffer())
+	if b.queued == 0 && b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return true, false
+	}
+
+	prio := r.prio
+	if !r.hasPrio {
+		prio = packetPriority(p)
+	}
+	if b.queued >= s.queueN {
+		// Make room by dropping the newest packet of lower priority, if
+		// any, so that bulk traffic can't starve higher priorities.
+		victim := -1
+		for i := numPrio - 1; i > prio; i-- {
+			if len(b.queues[i]) > 0 {
+				victim = i
+				break
+			}
+		}
+		if victim < 0 {
+			metricShaperDrop.Add(1)
+			return false, true
+		}
+		q := b.queues[victim]
+		q[len(q)-1] = nil
+		b.queues[victim] = q[:len(q)-1]
+		b.queued--
+		metricShaperDrop.Add(1)
+		metricShaperQueueLen.Add(-1)
+	}
+	b.queues[prio] = append(b.queues[prio], slices.Clone(p.Buffer()))
+	b.queued++
+	metricShaperQueued.Add(1)
+	metricShaperQueueLen.Add(1)
+	s.backlog[b] = true
+	_, head := b.head()
+	s.scheduleLocked(now, b.wait(len(head)))
+	return false, false
+}
+
+// scheduleLocked makes release run in d, unless it's already due to run
+// sooner. s.mu must be held.
+func (s *shaper) scheduleLocked(now time.Time, d time.Duration) {
+	d = max(d, time.Millisecond) // don't spin on rounding errors
+	at := now.Add(d)
+	if s.timer == nil {
+		s.timer = s.afterFunc(d, s.release)
+	} else if at.Before(s.timerAt) {
+		s.timer.Reset(d)
+	} else {
+		return
+	}
+	s.timerAt = at
+}
+
+// wait returns how long until b has enough tokens to send n bytes.
+func (b *tokenBucket) wait(n int) time.Duration {
+	need := float64(n) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// head returns the next packet to send from b.
+func (b *tokenBucket) head() (prio int, pkt []byte) {
+	for i, q := range b.queues {
+		if len(q) > 0 {
+			return i, q[0]
+		}
+	}
+	return -1, nil
+}
+
+// release sends the queued packets whose buckets have enough tokens, and
+// schedules itself to run again when the next one will.
+func (s *shaper) release() {
+	now := s.now()
+	var out [][]byte
+	s.mu.Lock()
+	s.timer = nil
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	var next time.Duration = -1
+	for b := range s.backlog {
+		b.refill(now)
+		for {
+			prio, pkt := b.head()
+			if pkt == nil {
+				delete(s.backlog, b)
+				break
+			}
+			if b.tokens < float64(len(pkt)) {
+				if w := b.wait(len(pkt)); next < 0 || w < next {
+					next = w
+				}
+				break
+			}
+			b.tokens -= float64(len(pkt))
+			b.queues[prio][0] = nil
+			b.queues[prio] = b.queues[prio][1:]
+			b.queued--
+			out = append(out, pkt)
+		}
+	}
+	if next >= 0 {
+		s.scheduleLocked(now, next)
+	}
+	s.mu.Unlock()
+
+	metricShaperQueueLen.Add(-int64(len(out)))
+	for _, pkt := range out {
+		s.send(pkt)
+	}
+}
+
+// close stops s and sends all the packets it has queued.
+func (s *shaper) close() {
+	var out [][]byte
+	s.mu.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	for b := range s.backlog {
+		for prio := range b.queues {
+			out = append(out, b.queues[prio]...)
+			b.queues[prio] = nil
+		}
+		b.queued = 0
+	}
+	clear(s.backlog)
+	s.mu.Unlock()
+
+	metricShaperQueueLen.Add(-int64(len(out)))
+	if len(out) > 0 {
+		// Sending can block until WireGuard reads, so don't make the
+		// caller wait.
+		go func() {
+			for _, pkt := range out {
+				s.send(pkt)
+			}
+		}()
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+)
+
+// shaperPacket returns a UDP packet to dst:dport with a payload of n bytes
+// and the given DSCP.
+func shaperPacket(dst string, dport uint16, dscp byte, n int) *packet.Parsed {
+	h := &packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netip.MustParseAddr("100.64.0.1"),
+			Dst: netip.MustParseAddr(dst),
+		},
+		SrcPort: 1234,
+		DstPort: dport,
+	}
+	b := packet.Generate(h, make([]byte, n))
+	b[1] = dscp << 2
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+// fakeTimer is a tstime.TimerController for a shaper's afterFunc, which the
+// test fires by hand.
+type fakeTimer struct {
+	d time.Duration
+	f func()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool { t.d = d; return true }
+func (t *fakeTimer) Stop() bool                 { t.f = nil; return true }
+
+type shaperTest struct {
+	t     *testing.T
+	s     *shaper
+	now   time.Time
+	timer *fakeTimer
+	sent  []uint16 // destination ports of released packets
+}
+
+func newShaperTest(t *testing.T, cfg ShaperConfig) *shaperTest {
+	st := &shaperTest{t: t, now: time.Unix(1000, 0)}
+	st.s = newShaper(cfg, func() time.Time { return st.now }, func(b []byte) error {
+		st.sent = append(st.sent, binary.BigEndian.Uint16(b[22:24]))
+		return nil
+	})
+	st.s.afterFunc = func(d time.Duration, f func()) tstime.TimerController {
+		st.timer = &fakeTimer{d: d, f: f}
+		return st.timer
+	}
+	return st
+}
+
+func (st *shaperTest) shape(p *packet.Parsed, wantOK, wantDropped bool) {
+	st.t.Helper()
+	ok, dropped := st.s.shape(p)
+	if ok != wantOK || dropped != wantDropped {
+		st.t.Fatalf("shape(%v) = %v, %v; want %v, %v", p, ok, dropped, wantOK, wantDropped)
+	}
+}
+
+// advance moves time forward by d and fires the release timer if it's due.
+func (st *shaperTest) advance(d time.Duration) {
+	st.now = st.now.Add(d)
+	if tm := st.timer; tm != nil && tm.f != nil && tm.d <= d {
+		st.timer = nil
+		tm.f()
+	}
+}
+
+func TestShaper(t *testing.T) {
+	const (
+		size = 16000
+		cs1  = 8
+		af21 = 18
+	)
+	st := newShaperTest(t, ShaperConfig{
+		Rules: []ShaperRule{{
+			Dst:  []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			Rate: 100_000,
+		}},
+		QueueLen: 3,
+	})
+
+	// Other destinations aren't shaped.
+	for range 10 {
+		st.shape(shaperPacket("100.64.0.3", 1, 0, size), true, false)
+	}
+	// The burst is MaxPacketSize, which fits 4 packets.
+	for range 4 {
+		st.shape(shaperPacket("100.64.0.2", 1, 0, size), true, false)
+	}
+	st.shape(shaperPacket("100.64.0.2", 5, cs1, size), false, false)
+	st.shape(shaperPacket("100.64.0.2", 6, 0, size), false, false)
+	st.shape(shaperPacket("100.64.0.2", 7, af21, size), false, false)
+	// The queue is full, and nothing queued has lower priority.
+	st.shape(shaperPacket("100.64.0.2", 8, cs1, size), false, true)
+	// Packet 5 makes way for a higher priority packet.
+	st.shape(shaperPacket("100.64.0.2", 9, af21, size), false, false)
+	if got := st.s.backlog; len(got) != 1 {
+		t.Fatalf("backlog has %d buckets; want 1", len(got))
+	}
+
+	if st.timer == nil {
+		t.Fatal("no release scheduled")
+	}
+	if d := st.timer.d; d < 140*time.Millisecond || d > 150*time.Millisecond {
+		t.Errorf("release scheduled in %v; want ~146ms", d)
+	}
+	st.advance(150 * time.Millisecond)
+	if want := []uint16{7}; !slices.Equal(st.sent, want) {
+		t.Errorf("after 150ms, sent %v; want %v", st.sent, want)
+	}
+	st.advance(time.Second)
+	if want := []uint16{7, 9, 6}; !slices.Equal(st.sent, want) {
+		t.Errorf("after 1s, sent %v; want %v", st.sent, want)
+	}
+	if len(st.s.backlog) != 0 {
+		t.Errorf("backlog not empty")
+	}
+	if st.timer != nil {
+		t.Errorf("release scheduled with empty backlog")
+	}
+
+	// With nothing queued, packets pass again.
+	st.shape(shaperPacket("100.64.0.2", 1, 0, size), true, false)
+}
+
+func TestShaperRules(t *testing.T) {
+	st := newShaperTest(t, ShaperConfig{
+		Rules: []ShaperRule{
+			{
+				Ports: []tailcfg.PortRange{{First: 22, Last: 22}},
+			},
+			{
+				Dst:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")},
+				Rate:    1000,
+				PerPeer: true,
+			},
+		},
+	})
+	big := MaxPacketSize - 100
+
+	st.shape(shaperPacket("100.64.0.2", 80, 0, big), true, false)
+	st.shape(shaperPacket("100.64.0.2", 80, 0, big), false, false)
+	// Port 22 is exempt from the rate limit.
+	st.shape(shaperPacket("100.64.0.2", 22, 0, big), true, false)
+	// Each peer has its own bucket.
+	st.shape(shaperPacket("100.64.0.3", 80, 0, big), true, false)
+	st.shape(shaperPacket("100.64.0.3", 80, 0, big), false, false)
+	// Outside of the rule's prefix.
+	st.shape(shaperPacket("10.0.0.1", 80, 0, big), true, false)
+}
+
+func TestShaperRuleCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       ShaperRule
+		wantErr bool
+	}{
+		{"zero", ShaperRule{}, false},
+		{"valid", ShaperRule{
+			Dst:      []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")},
+			Ports:    []tailcfg.PortRange{{First: 22, Last: 22}, {First: 80, Last: 443}},
+			Rate:     1000,
+			Burst:    2000,
+			Priority: PriorityLow,
+		}, false},
+		{"negative-rate", ShaperRule{Rate: -1}, true},
+		{"negative-burst", ShaperRule{Rate: 1000, Burst: -1}, true},
+		{"invalid-prefix", ShaperRule{Dst: []netip.Prefix{{}}}, true},
+		{"empty-port-range", ShaperRule{Ports: []tailcfg.PortRange{{First: 443, Last: 80}}}, true},
+		{"unknown-priority", ShaperRule{Priority: "urgent"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.r.Check(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check() = %v; want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShaperIgnoresInvalidRules(t *testing.T) {
+	st := newShaperTest(t, ShaperConfig{
+		Rules: []ShaperRule{
+			{Rate: -1000},
+			{Dst: []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")}, Rate: 1000},
+		},
+		QueueLen: -1,
+	})
+	if len(st.s.rules) != 1 || st.s.queueN != DefaultShaperQueueLen {
+		t.Fatalf("got %d rules, queue length %d; want 1, %d", len(st.s.rules), st.s.queueN, DefaultShaperQueueLen)
+	}
+	big := MaxPacketSize - 100
+	// Outside of the valid rule's prefix, so not shaped by the negative
+	// rate rule either.
+	for range 10 {
+		st.shape(shaperPacket("10.0.0.1", 80, 0, big), true, false)
+	}
+	st.shape(shaperPacket("100.64.0.2", 80, 0, big), true, false)
+	st.shape(shaperPacket("100.64.0.2", 80, 0, big), false, false)
+}
+
+func TestPacketPriority(t *testing.T) {
+	tests := []struct {
+		dscp byte
+		want int
+	}{
+		{0, prioNormal},
+		{1, prioLow},    // LE
+		{4, prioNormal}, // unassigned
+		{8, prioLow},    // CS1
+		{14, prioLow},   // AF13
+		{18, prioHigh},  // AF21
+		{46, prioHigh},  // EF
+		{48, prioHigh},  // CS6
+	}
+	for _, tt := range tests {
+		if got := packetPriority(shaperPacket("100.64.0.2", 1, tt.dscp, 0)); got != tt.want {
+			t.Errorf("packetPriority(DSCP %d) = %d; want %d", tt.dscp, got, tt.want)
+		}
+	}
+}
@@ -195,6 +195,9 @@ type Wrapper struct {
 	stats atomic.Pointer[connstats.Statistics]
 
 	captureHook syncs.AtomicValue[capture.Callback]
+
+	// shaper, if non-nil, shapes packets sent to peers. See SetShaper.
+	shaper atomic.Pointer[shaper]
 }
 
 // tunInjectedRead is an injected packet pretending to be a tun.Read().
@@ -337,6 +340,9 @@ func (t *Wrapper) Close() error {
 		t.outboundClosed = true
 		close(t.vectorOutbound)
 		t.outboundMu.Unlock()
+		if s := t.shaper.Swap(nil); s != nil {
+			s.close()
+		}
 		err = t.tdev.Close()
 	})
 	return err
@@ -928,6 +934,15 @@ func (t *Wrapper) Read(buffs [][]byte, sizes []int, offset int) (int, error) {
 				continue
 			}
 		}
+		if s := t.shaper.Load(); s != nil {
+			// Queued packets are sent later, by InjectOutbound.
+			if ok, dropped := s.shape(p); !ok {
+				if dropped {
+					metricPacketOutDrop.Add(1)
+				}
+				continue
+			}
+		}
 
 		// Make sure to do SNAT after filtering, so that any flow tracking in
 		// the filter sees the original source address. See #12133.
@@ -0,0 +1,279 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// AlertConfig configures when a probe's alert fires and clears.
+//
+// The zero value fires on the first failure and clears on the first success,
+// with no flap suppression.
+type AlertConfig struct {
+	// FailuresToFire is the number of consecutive failures that fire the
+	// alert. Values below 1 mean 1.
+	FailuresToFire int
+
+	// SuccessesToClear is the number of consecutive successes that clear
+	// a firing alert. Values below 1 mean 1.
+	SuccessesToClear int
+
+	// FlapThreshold, if positive, is the number of times the alert must
+	// fire or clear within FlapWindow for it to be considered flapping.
+	// A single notification is sent when an alert starts flapping, and
+	// another, with its state, once it has stopped changing for
+	// FlapWindow; changes in between aren't notified.
+	FlapThreshold int
+	FlapWindow    time.Duration
+}
+
+// AlertState is the state of a probe's alert.
+type AlertState string
+
+const (
+	AlertOK     AlertState = "ok"
+	AlertFiring AlertState = "firing"
+)
+
+// AlertEvent is a notification of a change to a probe's alert.
+type AlertEvent struct {
+	Probe  string            `json:"probe"`
+	Class  string            `json:"class"`
+	Labels map[string]string `json:"labels,omitempty"`
+	State  AlertState        `json:"state"`
+
+	// Flapping is whether the alert is flapping. An event with Flapping
+	// set is sent when it starts, and one with it unset when it stops.
+	Flapping bool `json:"flapping"`
+
+	Time  time.Time `json:"time"`
+	Since time.Time `json:"since"` // when the alert entered State
+	Error string    `json:"error,omitempty"`
+}
+
+// String returns a one-line description of e, suitable for chat messages.
+func (e AlertEvent) String() string {
+	var s string
+	switch {
+	case e.Flapping:
+		s = fmt.Sprintf("probe %s is flapping (now %s); notifications are suppressed until it's stable", e.Probe, e.State)
+	case e.State == AlertFiring:
+		s = fmt.Sprintf("probe %s is firing", e.Probe)
+	default:
+		s = fmt.Sprintf("probe %s is ok", e.Probe)
+	}
+	if e.State == AlertFiring && e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+// AlertNotifier is notified of alert events. Notify may block, such as to
+// retry; events are delivered to each notifier in order.
+type AlertNotifier interface {
+	Notify(context.Context, AlertEvent) error
+}
+
+// alertQueueSize is the number of events that may be waiting for a slow
+// notifier before further events are dropped.
+const alertQueueSize = 100
+
+// WithAlertNotifier sends the alert events of all probes to n. It may be
+// called multiple times to add more notifiers.
+func (p *Prober) WithAlertNotifier(n AlertNotifier) *Prober {
+	ch := make(chan AlertEvent, alertQueueSize)
+	go func() {
+		for ev := range ch {
+			if err := n.Notify(context.Background(), ev); err != nil {
+				log.Printf("prober: notifying of alert for %s: %v", ev.Probe, err)
+			}
+		}
+	}()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notifiers = append(p.notifiers, ch)
+	return p
+}
+
+// notify queues ev for all notifiers.
+func (p *Prober) notify(ev AlertEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ch := range p.notifiers {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("prober: alert notifier is behind; dropping alert for %s", ev.Probe)
+		}
+	}
+}
+
+// WithAlert enables alerting for p with the config c. Calling it again with
+// a different config resets the alert to AlertOK.
+func (p *Probe) WithAlert(c AlertConfig) *Probe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.alert != nil && p.alert.cfg == c {
+		return p
+	}
+	p.alert = &alertMachine{cfg: c, state: AlertOK, notified: AlertOK}
+	return p
+}
+
+// alertMachine is the state machine of a probe's alert.
+type alertMachine struct {
+	cfg AlertConfig
+
+	state    AlertState // state after hysteresis
+	since    time.Time  // when state was entered
+	fails    int        // consecutive failures
+	succs    int        // consecutive successes
+	changes  []time.Time
+	flapping bool
+	notified AlertState // last state notified
+	lastErr  string
+}
+
+// step records a probe result at now, and returns the event to notify of,
+// if any.
+func (a *alertMachine) step(now time.Time, err error) (ev AlertEvent, ok bool) {
+	if err != nil {
+		a.fails++
+		a.succs = 0
+		a.lastErr = err.Error()
+	} else {
+		a.succs++
+		a.fails = 0
+	}
+
+	changed := false
+	switch {
+	case a.state == AlertOK && a.fails >= max(a.cfg.FailuresToFire, 1):
+		a.state = AlertFiring
+		changed = true
+	case a.state == AlertFiring && a.succs >= max(a.cfg.SuccessesToClear, 1):
+		a.state = AlertOK
+		changed = true
+	}
+	if changed {
+		a.since = now
+	}
+
+	ev = AlertEvent{
+		State: a.state,
+		Time:  now,
+		Since: a.since,
+	}
+	if a.state == AlertFiring {
+		ev.Error = a.lastErr
+	}
+
+	if a.cfg.FlapThreshold > 0 {
+		if changed {
+			a.changes = append(a.changes, now)
+		}
+		cutoff := now.Add(-a.cfg.FlapWindow)
+		for len(a.changes) > 0 && !a.changes[0].After(cutoff) {
+			a.changes = a.changes[1:]
+		}
+		switch {
+		case !a.flapping && len(a.changes) >= a.cfg.FlapThreshold:
+			a.flapping = true
+			a.notified = a.state
+			ev.Flapping = true
+			return ev, true
+		case a.flapping && len(a.changes) == 0:
+			a.flapping = false
+			a.notified = a.state
+			return ev, true
+		case a.flapping:
+			return AlertEvent{}, false
+		}
+	}
+
+	if changed && a.state != a.notified {
+		a.notified = a.state
+		return ev, true
+	}
+	return AlertEvent{}, false
+}
+
+// AlertStatus is the state of a probe's alert.
+type AlertStatus struct {
+	Probe               string
+	State               AlertState
+	Flapping            bool
+	Since               time.Time // zero if the alert never fired
+	ConsecutiveFailures int
+	Error               string // last error, if firing
+}
+
+// Alerts returns the alert status of all probes with alerting enabled,
+// firing alerts first.
+func (p *Prober) Alerts() []AlertStatus {
+	p.mu.Lock()
+	probes := make([]*Probe, 0, len(p.probes))
+	for _, probe := range p.probes {
+		probes = append(probes, probe)
+	}
+	p.mu.Unlock()
+
+	var ret []AlertStatus
+	for _, probe := range probes {
+		probe.mu.Lock()
+		if a := probe.alert; a != nil {
+			st := AlertStatus{
+				Probe:               probe.name,
+				State:               a.state,
+				Flapping:            a.flapping,
+				Since:               a.since,
+				ConsecutiveFailures: a.fails,
+			}
+			if a.state == AlertFiring {
+				st.Error = a.lastErr
+			}
+			ret = append(ret, st)
+		}
+		probe.mu.Unlock()
+	}
+	slices.SortFunc(ret, func(a, b AlertStatus) int {
+		if a.State != b.State {
+			if a.State == AlertFiring {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Probe, b.Probe)
+	})
+	return ret
+}
+
+// ServeAlerts serves an HTML page of the alert status of all probes, for
+// use in a debug UI.
+func (p *Prober) ServeAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><style>.firing { font-weight: bold; color: #700; }</style></head><body><h1>Alerts</h1>\n")
+	fmt.Fprintf(w, "<table><tr><th>Probe</th><th>State</th><th>Since</th><th>Failures</th><th>Error</th></tr>\n")
+	for _, st := range p.Alerts() {
+		state := string(st.State)
+		if st.Flapping {
+			state += " (flapping)"
+		}
+		since := ""
+		if !st.Since.IsZero() {
+			since = st.Since.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "<tr class=%s><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			st.State, html.EscapeString(st.Probe), state, since, st.ConsecutiveFailures, html.EscapeString(st.Error))
+	}
+	fmt.Fprintf(w, "</table></body></html>\n")
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertMachine(t *testing.T) {
+	errFail := errors.New("fail")
+	type step struct {
+		at        time.Duration // since epoch
+		err       error
+		wantEvent string // "" for none, or state, with "+flapping" if flapping
+	}
+	tests := []struct {
+		name  string
+		cfg   AlertConfig
+		steps []step
+	}{
+		{
+			name: "zero",
+			steps: []step{
+				{0, nil, ""},
+				{1 * time.Second, errFail, "firing"},
+				{2 * time.Second, errFail, ""},
+				{3 * time.Second, nil, "ok"},
+			},
+		},
+		{
+			name: "hysteresis",
+			cfg:  AlertConfig{FailuresToFire: 3, SuccessesToClear: 2},
+			steps: []step{
+				{1 * time.Second, errFail, ""},
+				{2 * time.Second, errFail, ""},
+				{3 * time.Second, nil, ""},
+				{4 * time.Second, errFail, ""},
+				{5 * time.Second, errFail, ""},
+				{6 * time.Second, errFail, "firing"},
+				{7 * time.Second, nil, ""},
+				{8 * time.Second, errFail, ""},
+				{9 * time.Second, nil, ""},
+				{10 * time.Second, nil, "ok"},
+			},
+		},
+		{
+			name: "flapping",
+			cfg:  AlertConfig{FlapThreshold: 3, FlapWindow: time.Minute},
+			steps: []step{
+				{0, errFail, "firing"},
+				{10 * time.Second, nil, "ok"},
+				{20 * time.Second, errFail, "firing+flapping"},
+				{30 * time.Second, nil, ""},
+				{40 * time.Second, errFail, ""},
+				{50 * time.Second, nil, ""},
+				{90 * time.Second, nil, ""},
+				{111 * time.Second, nil, "ok"}, // a minute after the last change
+				{120 * time.Second, errFail, "firing"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &alertMachine{cfg: tt.cfg, state: AlertOK, notified: AlertOK}
+			for _, s := range tt.steps {
+				ev, ok := a.step(epoch.Add(s.at), s.err)
+				got := ""
+				if ok {
+					got = string(ev.State)
+					if ev.Flapping {
+						got += "+flapping"
+					}
+				}
+				if got != s.wantEvent {
+					t.Fatalf("at %v: got event %q; want %q", s.at, got, s.wantEvent)
+				}
+			}
+		})
+	}
+}
+
+type chanNotifier chan AlertEvent
+
+func (n chanNotifier) Notify(ctx context.Context, ev AlertEvent) error {
+	n <- ev
+	return nil
+}
+
+func TestProbeAlert(t *testing.T) {
+	clk := newFakeTime()
+	events := make(chanNotifier, 10)
+	p := newForTest(clk.Now, clk.NewTicker).WithAlertNotifier(events)
+
+	results := make(chan error)
+	probe := p.Run("test-probe", probeInterval, Labels{"team": "x"}, FuncProbe(func(context.Context) error {
+		return <-results
+	})).WithAlert(AlertConfig{FailuresToFire: 2})
+	defer probe.Close()
+
+	wantEvent := func(want AlertState) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.State != want || ev.Probe != "test-probe" || ev.Labels["team"] != "x" {
+				t.Fatalf("got event %+v; want state %v", ev, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event; want state %v", want)
+		}
+	}
+
+	results <- errors.New("fail")
+	waitActiveProbes(t, p, clk, 1)
+	clk.Advance(probeInterval + aFewMillis)
+	results <- errors.New("fail")
+	wantEvent(AlertFiring)
+
+	alerts := p.Alerts()
+	if len(alerts) != 1 || alerts[0].State != AlertFiring || alerts[0].ConsecutiveFailures != 2 || alerts[0].Error != "fail" {
+		t.Errorf("Alerts() = %+v", alerts)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeAlerts(rec, httptest.NewRequest("GET", "/debug/alerts", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "<tr class=firing><td>test-probe</td>") {
+		t.Errorf("alerts page doesn't show firing alert:\n%s", body)
+	}
+
+	clk.Advance(probeInterval)
+	results <- nil
+	wantEvent(AlertOK)
+}
@@ -204,6 +204,19 @@ func (d *derpProber) probeMapFn(ctx context.Context) error {
 	return nil
 }
 
+// Close closes the probes of individual DERP servers that d created. The
+// probe running ProbeMap should be closed first, so that it doesn't create
+// more.
+func (d *derpProber) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	for n, probe := range d.probes {
+		probe.Close()
+		delete(d.probes, n)
+	}
+	return nil
+}
+
 // probeMesh returs a probe class that sends a test packet through a pair of DERP
 // servers (or just one server, if 'from' and 'to' are the same). 'from' and 'to'
 // are expected to be names (DERPNode.Name) of two DERP servers in the same region.
@@ -113,6 +113,15 @@ func TestDerpProber(t *testing.T) {
 	if len(dp.probes) != 4 {
 		t.Errorf("unexpected probes: %+v", dp.probes)
 	}
+
+	// Close and check that all probes have been destroyed.
+	dp.Close()
+	if len(dp.probes) != 0 {
+		t.Errorf("unexpected probes: %+v", dp.probes)
+	}
+	if n := len(p.ProbeInfo()); n != 0 {
+		t.Errorf("got %d probes registered; want 0", n)
+	}
 }
 
 func TestRunDerpProbeNodePair(t *testing.T) {
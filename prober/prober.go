@@ -66,6 +66,7 @@ type Prober struct {
 
 	namespace string
 	metrics   *prometheus.Registry
+	notifiers []chan AlertEvent // alert events to notify of
 }
 
 // New returns a new Prober.
@@ -124,6 +125,7 @@ func (p *Prober) Run(name string, interval time.Duration, labels Labels, pc Prob
 		mEndTime:     prometheus.NewDesc("end_secs", "Latest probe end time (seconds since epoch)", nil, l),
 		mLatency:     prometheus.NewDesc("latency_millis", "Latest probe latency (ms)", nil, l),
 		mResult:      prometheus.NewDesc("result", "Latest probe result (1 = success, 0 = failure)", nil, l),
+		mAlertFiring: prometheus.NewDesc("alert_firing", "Whether the probe's alert is firing (1) or not (0), if alerting is enabled", nil, l),
 		mAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "attempts_total", Help: "Total number of probing attempts", ConstLabels: l,
 		}, []string{"status"}),
@@ -223,6 +225,7 @@ type Probe struct {
 	mEndTime     *prometheus.Desc
 	mLatency     *prometheus.Desc
 	mResult      *prometheus.Desc
+	mAlertFiring *prometheus.Desc
 	mAttempts    *prometheus.CounterVec
 	mSeconds     *prometheus.CounterVec
 
@@ -232,6 +235,7 @@ type Probe struct {
 	latency   time.Duration // last successful probe latency
 	succeeded bool          // whether the last doProbe call succeeded
 	lastErr   error
+	alert     *alertMachine // nil if alerting is disabled
 }
 
 // Close shuts down the Probe and unregisters it from its Prober.
@@ -318,7 +322,6 @@ func (p *Probe) recordStart() time.Time {
 func (p *Probe) recordEnd(start time.Time, err error) {
 	end := p.prober.now()
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	p.end = end
 	p.succeeded = err == nil
 	p.lastErr = err
@@ -332,6 +335,19 @@ func (p *Probe) recordEnd(start time.Time, err error) {
 		p.mAttempts.WithLabelValues("fail").Inc()
 		p.mSeconds.WithLabelValues("fail").Add(latency.Seconds())
 	}
+	var ev AlertEvent
+	var notify bool
+	if p.alert != nil {
+		ev, notify = p.alert.step(end, err)
+		ev.Probe = p.name
+		ev.Class = p.probeClass.Class
+		ev.Labels = maps.Clone(p.metricLabels)
+	}
+	p.mu.Unlock()
+
+	if notify {
+		p.prober.notify(ev)
+	}
 }
 
 // ProbeInfo is the state of a Probe.
@@ -379,6 +395,7 @@ func (p *Probe) Describe(ch chan<- *prometheus.Desc) {
 	ch <- p.mEndTime
 	ch <- p.mResult
 	ch <- p.mLatency
+	ch <- p.mAlertFiring
 	p.mAttempts.Describe(ch)
 	p.mSeconds.Describe(ch)
 	if p.probeClass.Metrics != nil {
@@ -393,6 +410,13 @@ func (p *Probe) Collect(ch chan<- prometheus.Metric) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	ch <- prometheus.MustNewConstMetric(p.mInterval, prometheus.GaugeValue, p.interval.Seconds())
+	if p.alert != nil {
+		firing := 0.0
+		if p.alert.state == AlertFiring {
+			firing = 1
+		}
+		ch <- prometheus.MustNewConstMetric(p.mAlertFiring, prometheus.GaugeValue, firing)
+	}
 	if !p.start.IsZero() {
 		ch <- prometheus.MustNewConstMetric(p.mStartTime, prometheus.GaugeValue, float64(p.start.Unix()))
 	}
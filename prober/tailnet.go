@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+// TailnetClient is the subset of tailscale.LocalClient used by Tailnet
+// probes. To probe from a node of its own, a prober binary can embed a
+// tsnet.Server and use TailnetFromServer.
+type TailnetClient interface {
+	Status(context.Context) (*ipnstate.Status, error)
+	Ping(ctx context.Context, ip netip.Addr, pingtype tailcfg.PingType) (*ipnstate.PingResult, error)
+}
+
+var _ TailnetClient = (*tailscale.LocalClient)(nil)
+
+// TailnetServer is implemented by *tsnet.Server. It's an interface so that
+// probers that don't probe a tailnet needn't link in tsnet.
+type TailnetServer interface {
+	LocalClient() (*tailscale.LocalClient, error)
+}
+
+// TailnetFromServer is like Tailnet, but pings from the node of s, usually
+// a *tsnet.Server.
+func TailnetFromServer(s TailnetServer, peer string, pingType tailcfg.PingType) (ProbeClass, error) {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return ProbeClass{}, fmt.Errorf("getting LocalClient: %w", err)
+	}
+	return Tailnet(lc, peer, pingType), nil
+}
+
+// Tailnet returns a ProbeClass that pings peer across the tailnet of lc, with
+// pings of type pingType: tailcfg.PingDisco, tailcfg.PingTSMP or
+// tailcfg.PingICMP.
+//
+// The peer is a Tailscale IP, a MagicDNS name, or the first label of one.
+//
+// Besides the result, the probe exports the ping latency and the path the
+// ping took: "direct", "derp" (with the DERP region used), or "unknown",
+// which is all TSMP pings report.
+func Tailnet(lc TailnetClient, peer string, pingType tailcfg.PingType) ProbeClass {
+	tp := &tailnetProber{lc: lc, peer: peer, pingType: pingType}
+	return ProbeClass{
+		Probe:   tp.probe,
+		Class:   "tailnet",
+		Labels:  Labels{"peer": peer, "ping_type": string(pingType)},
+		Metrics: tp.metrics,
+	}
+}
+
+type tailnetProber struct {
+	lc       TailnetClient
+	peer     string
+	pingType tailcfg.PingType
+
+	mu   sync.Mutex
+	last *ipnstate.PingResult // last successful ping, or nil
+}
+
+func (tp *tailnetProber) probe(ctx context.Context) error {
+	ip, err := tp.resolve(ctx)
+	if err == nil {
+		var res *ipnstate.PingResult
+		res, err = tp.lc.Ping(ctx, ip, tp.pingType)
+		if err == nil && res.Err != "" {
+			err = errors.New(res.Err)
+		}
+		if err == nil {
+			tp.mu.Lock()
+			tp.last = res
+			tp.mu.Unlock()
+			return nil
+		}
+		err = fmt.Errorf("pinging %v: %w", ip, err)
+	}
+	tp.mu.Lock()
+	tp.last = nil
+	tp.mu.Unlock()
+	return err
+}
+
+// resolve returns the Tailscale IP of tp.peer.
+func (tp *tailnetProber) resolve(ctx context.Context) (netip.Addr, error) {
+	if ip, err := netip.ParseAddr(tp.peer); err == nil {
+		return ip, nil
+	}
+	st, err := tp.lc.Status(ctx)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("getting status: %w", err)
+	}
+	want := strings.TrimSuffix(tp.peer, ".")
+	for _, ps := range st.Peer {
+		name := strings.TrimSuffix(ps.DNSName, ".")
+		if (name == want || dnsname.FirstLabel(ps.DNSName) == want) && len(ps.TailscaleIPs) > 0 {
+			return ps.TailscaleIPs[0], nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("peer %q not found in tailnet", tp.peer)
+}
+
+// tailnetPath returns the path res took and its DERP region code, if any.
+func tailnetPath(res *ipnstate.PingResult) (path, region string) {
+	switch {
+	case res.Endpoint != "":
+		return "direct", ""
+	case res.DERPRegionID != 0:
+		return "derp", res.DERPRegionCode
+	}
+	return "unknown", ""
+}
+
+func (tp *tailnetProber) metrics(l prometheus.Labels) []prometheus.Metric {
+	tp.mu.Lock()
+	res := tp.last
+	tp.mu.Unlock()
+	if res == nil {
+		return nil
+	}
+	path, region := tailnetPath(res)
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(prometheus.NewDesc("tailnet_ping_latency_seconds", "Latency of the last successful ping to the peer", nil, l), prometheus.GaugeValue, res.LatencySeconds),
+		prometheus.MustNewConstMetric(prometheus.NewDesc("tailnet_path", "Path of the last successful ping to the peer (always 1)", []string{"path", "derp_region"}, l), prometheus.GaugeValue, 1, path, region),
+	}
+}
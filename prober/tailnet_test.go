@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+type fakeTailnetClient struct {
+	peers map[string]netip.Addr               // DNS name => IP
+	pings map[netip.Addr]*ipnstate.PingResult // missing means no reply
+}
+
+func (c *fakeTailnetClient) Status(context.Context) (*ipnstate.Status, error) {
+	st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{}}
+	for name, ip := range c.peers {
+		st.Peer[key.NewNode().Public()] = &ipnstate.PeerStatus{DNSName: name, TailscaleIPs: []netip.Addr{ip}}
+	}
+	return st, nil
+}
+
+func (c *fakeTailnetClient) Ping(ctx context.Context, ip netip.Addr, pingType tailcfg.PingType) (*ipnstate.PingResult, error) {
+	if res, ok := c.pings[ip]; ok {
+		return res, nil
+	}
+	return &ipnstate.PingResult{IP: ip.String(), Err: "timeout"}, nil
+}
+
+func TestTailnet(t *testing.T) {
+	db := netip.MustParseAddr("100.64.0.1")
+	web := netip.MustParseAddr("100.64.0.2")
+	c := &fakeTailnetClient{
+		peers: map[string]netip.Addr{
+			"db.example.ts.net.":  db,
+			"web.example.ts.net.": web,
+		},
+		pings: map[netip.Addr]*ipnstate.PingResult{
+			db:  {LatencySeconds: 0.5, Endpoint: "192.0.2.1:41641"},
+			web: {LatencySeconds: 0.25, DERPRegionID: 1, DERPRegionCode: "nyc"},
+		},
+	}
+
+	clk := newFakeTime()
+	p := newForTest(clk.Now, clk.NewTicker).WithOnce(true)
+	p.Run("db", probeInterval, nil, Tailnet(c, "db", tailcfg.PingDisco))
+	p.Run("web", probeInterval, nil, Tailnet(c, "web.example.ts.net", tailcfg.PingDisco))
+	p.Run("ip", probeInterval, nil, Tailnet(c, "100.64.0.1", tailcfg.PingDisco))
+	p.Run("gone", probeInterval, nil, Tailnet(c, "gone", tailcfg.PingDisco))
+	p.Run("silent", probeInterval, nil, Tailnet(c, "100.64.0.3", tailcfg.PingDisco))
+	p.Wait()
+
+	want := `
+# HELP prober_tailnet_path Path of the last successful ping to the peer (always 1)
+# TYPE prober_tailnet_path gauge
+prober_tailnet_path{class="tailnet",derp_region="",name="db",path="direct",peer="db",ping_type="disco"} 1
+prober_tailnet_path{class="tailnet",derp_region="",name="ip",path="direct",peer="100.64.0.1",ping_type="disco"} 1
+prober_tailnet_path{class="tailnet",derp_region="nyc",name="web",path="derp",peer="web.example.ts.net",ping_type="disco"} 1
+# HELP prober_tailnet_ping_latency_seconds Latency of the last successful ping to the peer
+# TYPE prober_tailnet_ping_latency_seconds gauge
+prober_tailnet_ping_latency_seconds{class="tailnet",name="db",peer="db",ping_type="disco"} 0.5
+prober_tailnet_ping_latency_seconds{class="tailnet",name="ip",peer="100.64.0.1",ping_type="disco"} 0.5
+prober_tailnet_ping_latency_seconds{class="tailnet",name="web",peer="web.example.ts.net",ping_type="disco"} 0.25
+`
+	if err := testutil.GatherAndCompare(p.metrics, strings.NewReader(want), "prober_tailnet_path", "prober_tailnet_ping_latency_seconds"); err != nil {
+		t.Error(err)
+	}
+
+	info := p.ProbeInfo()
+	for name, wantOK := range map[string]bool{"db": true, "web": true, "ip": true, "gone": false, "silent": false} {
+		if got := info[name].Result; got != wantOK {
+			t.Errorf("probe %q result = %v; want %v (error %q)", name, got, wantOK, info[name].Error)
+		}
+	}
+}
+
+type fakeTailnetServer struct {
+	lc  *tailscale.LocalClient
+	err error
+}
+
+func (s fakeTailnetServer) LocalClient() (*tailscale.LocalClient, error) { return s.lc, s.err }
+
+func TestTailnetFromServer(t *testing.T) {
+	if _, err := TailnetFromServer(fakeTailnetServer{err: errors.New("not started")}, "db", tailcfg.PingDisco); err == nil {
+		t.Error("got nil error for a server without a LocalClient")
+	}
+	lc := new(tailscale.LocalClient)
+	pc, err := TailnetFromServer(fakeTailnetServer{lc: lc}, "db", tailcfg.PingDisco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Class != "tailnet" || pc.Labels["peer"] != "db" {
+		t.Errorf("got class %q, labels %v; want a tailnet probe of db", pc.Class, pc.Labels)
+	}
+}
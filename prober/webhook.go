@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhook is an AlertNotifier that POSTs alert events to a URL.
+type Webhook struct {
+	// URL is the URL to POST events to.
+	URL string
+
+	// Format is the format of the request body: "slack" for a Slack (or
+	// compatible) incoming webhook message, or "json" (the default) for
+	// the AlertEvent as JSON.
+	Format string
+
+	// Retries is the number of times a failed request is retried, with
+	// exponential backoff. Requests that fail with a 4xx status other
+	// than 429 aren't retried.
+	Retries int
+
+	// Client is the HTTP client to use. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+// webhookTimeout is the timeout of each webhook request.
+const webhookTimeout = 10 * time.Second
+
+// webhookBackoff is the delay before the first retry of a webhook request.
+// It's a var so tests can change it.
+var webhookBackoff = time.Second
+
+// Notify implements AlertNotifier.
+func (w *Webhook) Notify(ctx context.Context, ev AlertEvent) error {
+	body, err := w.body(ev)
+	if err != nil {
+		return err
+	}
+	delay := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.Retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) body(ev AlertEvent) ([]byte, error) {
+	switch w.Format {
+	case "slack":
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{ev.String()})
+	case "json", "":
+		return json.Marshal(ev)
+	}
+	return nil, fmt.Errorf("unknown webhook format %q", w.Format)
+}
+
+// post POSTs body to the webhook. On failure, it reports whether the request
+// may be retried.
+func (w *Webhook) post(ctx context.Context, body []byte) (retry bool, _ error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := w.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		// Don't log the URL, which is often secret.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return true, fmt.Errorf("webhook: %w", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = res.StatusCode/100 != 4 || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook: %s", res.Status)
+}
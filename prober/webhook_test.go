@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	var (
+		calls    atomic.Int32
+		failWith atomic.Int32 // status of the first response, if non-zero
+		lastBody atomic.Value
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		lastBody.Store(string(b))
+		if calls.Add(1) == 1 && failWith.Load() != 0 {
+			w.WriteHeader(int(failWith.Load()))
+		}
+	}))
+	defer srv.Close()
+
+	ev := AlertEvent{Probe: "p", State: AlertFiring, Error: "boom"}
+	tests := []struct {
+		format    string
+		retries   int
+		failWith  int
+		wantErr   bool
+		wantCalls int32
+		wantBody  string
+	}{
+		{format: "slack", wantCalls: 1, wantBody: `{"text":"probe p is firing: boom"}`},
+		{format: "json", retries: 2, failWith: 503, wantCalls: 2},
+		{format: "json", retries: 0, failWith: 503, wantErr: true, wantCalls: 1},
+		{format: "json", retries: 2, failWith: 400, wantErr: true, wantCalls: 1},
+		{format: "json", retries: 2, failWith: 429, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		calls.Store(0)
+		failWith.Store(int32(tt.failWith))
+		w := &Webhook{URL: srv.URL, Format: tt.format, Retries: tt.retries}
+		err := w.Notify(context.Background(), ev)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: Notify error = %v; want error: %v", tt, err, tt.wantErr)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("%+v: got %d calls; want %d", tt, got, tt.wantCalls)
+		}
+		if tt.wantBody != "" && lastBody.Load() != tt.wantBody {
+			t.Errorf("%+v: got body %v; want %v", tt, lastBody.Load(), tt.wantBody)
+		}
+	}
+
+	var got AlertEvent
+	if err := json.Unmarshal([]byte(lastBody.Load().(string)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Probe != "p" || got.State != AlertFiring || got.Error != "boom" {
+		t.Errorf("got JSON event %+v", got)
+	}
+}
@@ -181,6 +181,13 @@ type DERPNode struct {
 	// CanPort80 specifies whether this DERP node is accessible over HTTP
 	// on port 80 specifically. This is used for captive portal checks.
 	CanPort80 bool `json:",omitempty"`
+
+	// QUICPort optionally provides a UDP port number on which the
+	// node serves DERP over QUIC, which clients may prefer over
+	// DERPPort on lossy links.
+	//
+	// If zero, the node doesn't serve DERP over QUIC.
+	QUICPort int `json:",omitempty"`
 }
 
 func (n *DERPNode) IsTestNode() bool {
@@ -145,7 +145,8 @@
 //   - 100: 2024-06-18: Client supports filtertype.Match.SrcCaps (issue #12542)
 //   - 101: 2024-07-01: Client supports SSH agent forwarding when handling connections with /bin/su
 //   - 102: 2024-07-12: NodeAttrDisableMagicSockCryptoRouting support
-const CurrentCapabilityVersion CapabilityVersion = 102
+//   - 103: 2024-07-24: Client understands NodeAttrTrafficShaping
+const CurrentCapabilityVersion CapabilityVersion = 103
 
 type StableID string
 
@@ -2327,6 +2328,11 @@ type Oauth2Token struct {
 	// NodeAttrDisableMagicSockCryptoRouting disables the use of the
 	// magicsock cryptorouting hook. See tailscale/corp#20732.
 	NodeAttrDisableMagicSockCryptoRouting NodeCapability = "disable-magicsock-crypto-routing"
+
+	// NodeAttrTrafficShaping configures the node to rate-limit and
+	// prioritize the packets that it sends to peers. Its values are JSON
+	// tstun.ShaperConfig values, whose rules are applied in order.
+	NodeAttrTrafficShaping NodeCapability = "traffic-shaping"
 )
 
 // SetDNSRequest is a request to add a DNS record.
@@ -480,6 +480,7 @@ func (src *DERPNode) Clone() *DERPNode {
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
+	QUICPort         int
 }{})
 
 // Clone makes a deep copy of SSHRule.
@@ -1050,6 +1050,7 @@ func (v DERPNodeView) DERPPort() int          { return v.ж.DERPPort }
 func (v DERPNodeView) InsecureForTests() bool { return v.ж.InsecureForTests }
 func (v DERPNodeView) STUNTestIP() string     { return v.ж.STUNTestIP }
 func (v DERPNodeView) CanPort80() bool        { return v.ж.CanPort80 }
+func (v DERPNodeView) QUICPort() int          { return v.ж.QUICPort }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _DERPNodeViewNeedsRegeneration = DERPNode(struct {
@@ -1065,6 +1066,7 @@ func (v DERPNodeView) CanPort80() bool        { return v.ж.CanPort80 }
 	InsecureForTests bool
 	STUNTestIP       string
 	CanPort80        bool
+	QUICPort         int
 }{})
 
 // View returns a readonly view of SSHRule.
@@ -56,6 +56,7 @@
 	"tailscale.com/util/set"
 	"tailscale.com/util/testenv"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/netstack"
 )
 
@@ -1206,7 +1207,15 @@ func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, erro
 // in this repository.
 // https://tailscale.com/kb/1023/troubleshooting/#can-i-examine-network-traffic-inside-the-encrypted-tunnel
 func (s *Server) CapturePcap(ctx context.Context, pcapFile string) error {
-	stream, err := s.localClient.StreamDebugCapture(ctx)
+	return s.CapturePcapFormat(ctx, pcapFile, capture.FormatPcap)
+}
+
+// CapturePcapFormat is like CapturePcap, but writes packets in the given
+// format. Captures in capture.FormatPcapng have an interface per capture
+// path and comments describing NAT and disco packets, so Wireshark decodes
+// all but the disco frames without the Lua dissector.
+func (s *Server) CapturePcapFormat(ctx context.Context, pcapFile string, format capture.Format) error {
+	stream, err := s.localClient.StreamDebugCaptureFormat(ctx, format.String())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package bytesize parses sizes in bytes, as given in flags and options.
+package bytesize
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Parse parses a size in bytes, with an optional K, M or G suffix (in either
+// case) for powers of 1024, such as "512", "64K" or "10M". It rejects
+// negative sizes and sizes that don't fit in an int64.
+func Parse(s string) (int64, error) {
+	num, shift := s, 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			num = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
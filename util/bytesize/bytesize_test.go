@@ -0,0 +1,41 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package bytesize
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "64k", want: 64 << 10},
+		{in: "64K", want: 64 << 10},
+		{in: "10M", want: 10 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "8589934591G", want: 8589934591 << 30},
+		{in: "8589934592G", wantErr: true}, // 1<<63 overflows
+		{in: "9223372036854775807", want: 1<<63 - 1},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "-1K", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "10T", wantErr: true},
+		{in: "1.5M", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net/http"
 	"sync"
@@ -78,6 +79,57 @@ func writePktHeader(w *bytes.Buffer, when time.Time, length int) {
 	PathDisco Path = 254
 )
 
+func (p Path) String() string {
+	switch p {
+	case FromLocal:
+		return "from-local"
+	case FromPeer:
+		return "from-peer"
+	case SynthesizedToLocal:
+		return "synthesized-to-local"
+	case SynthesizedToPeer:
+		return "synthesized-to-peer"
+	case PathDisco:
+		return "disco"
+	}
+	return fmt.Sprintf("path-%d", uint8(p))
+}
+
+// Format is a capture file format.
+type Format int
+
+const (
+	// FormatPcap is the classic pcap format, with the USER0 link type.
+	// Each packet is preceded by Tailscale metadata, so it needs
+	// ts-dissector.lua to decode.
+	FormatPcap Format = iota
+	// FormatPcapng is the pcapng format, with an interface per Path and
+	// metadata in packet comments, which stock Wireshark understands.
+	FormatPcapng
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatPcap:
+		return "pcap"
+	case FormatPcapng:
+		return "pcapng"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat parses the name of a Format, as returned by its String
+// method. The empty string is FormatPcap.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "pcap":
+		return FormatPcap, nil
+	case "pcapng":
+		return FormatPcapng, nil
+	}
+	return 0, fmt.Errorf("unknown capture format %q; want pcap or pcapng", s)
+}
+
 // New creates a new capture sink.
 func New() *Sink {
 	ctx, c := context.WithCancel(context.Background())
@@ -95,10 +147,16 @@ type Sink struct {
 	ctxCancel context.CancelFunc
 
 	mu         sync.Mutex
-	outputs    set.HandleSet[io.Writer]
+	outputs    set.HandleSet[output]
 	flushTimer *time.Timer // or nil if none running
 }
 
+// output is an output of a Sink.
+type output struct {
+	w      io.Writer
+	format Format
+}
+
 // RegisterOutput connects an output to this sink, which
 // will be written to with a pcap stream as packets are logged.
 // A function is returned which unregisters the output when
@@ -108,15 +166,25 @@ type Sink struct {
 // or when the sink is closed. If w implements http.Flusher,
 // it will be flushed periodically.
 func (s *Sink) RegisterOutput(w io.Writer) (unregister func()) {
+	return s.RegisterOutputFormat(w, FormatPcap)
+}
+
+// RegisterOutputFormat is like RegisterOutput, but writes a stream in the
+// given format.
+func (s *Sink) RegisterOutputFormat(w io.Writer, format Format) (unregister func()) {
 	select {
 	case <-s.ctx.Done():
 		return func() {}
 	default:
 	}
 
-	writePcapHeader(w)
+	if format == FormatPcapng {
+		w.Write(appendPcapngHeader(nil))
+	} else {
+		writePcapHeader(w)
+	}
 	s.mu.Lock()
-	hnd := s.outputs.Add(w)
+	hnd := s.outputs.Add(output{w, format})
 	s.mu.Unlock()
 
 	return func() {
@@ -146,8 +214,8 @@ func (s *Sink) Close() error {
 	}
 
 	for _, o := range s.outputs {
-		if o, ok := o.(io.Closer); ok {
-			o.Close()
+		if c, ok := o.w.(io.Closer); ok {
+			c.Close()
 		}
 	}
 	s.outputs = nil
@@ -171,25 +239,9 @@ func customDataLen(meta packet.CaptureMeta) int {
 	return length
 }
 
-// LogPacket is called to insert a packet into the capture.
-//
-// This function does not take ownership of the provided data slice.
-func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta) {
-	select {
-	case <-s.ctx.Done():
-		return
-	default:
-	}
-
-	extraLen := customDataLen(meta)
-	b := bufferPool.Get().(*bytes.Buffer)
-	b.Reset()
-	b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
-	defer bufferPool.Put(b)
-
-	writePktHeader(b, when, len(data)+extraLen)
-
-	// Custom tailscale debugging data
+// writeCustomData writes the Tailscale debugging data that precedes each
+// packet, which ts-dissector.lua decodes.
+func writeCustomData(b *bytes.Buffer, path Path, meta packet.CaptureMeta) {
 	binary.Write(b, binary.LittleEndian, uint16(path))
 	if meta.DidSNAT {
 		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
@@ -203,22 +255,58 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 	} else {
 		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
 	}
+}
 
-	b.Write(data)
+// LogPacket is called to insert a packet into the capture.
+//
+// This function does not take ownership of the provided data slice.
+func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta) {
+	select {
+	case <-s.ctx.Done():
+		return
+	default:
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// The records in each format, built as needed.
+	var pcapRec, pcapngRec []byte
+
 	var hadError []set.Handle
 	for hnd, o := range s.outputs {
-		if _, err := o.Write(b.Bytes()); err != nil {
+		var rec []byte
+		switch o.format {
+		case FormatPcapng:
+			if pcapngRec == nil {
+				pcapngRec = appendPcapngRecord(nil, path, when, data, meta)
+			}
+			rec = pcapngRec
+		default:
+			if pcapRec == nil {
+				b := bufferPool.Get().(*bytes.Buffer)
+				defer bufferPool.Put(b)
+				b.Reset()
+				extraLen := customDataLen(meta)
+				b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
+				writePktHeader(b, when, len(data)+extraLen)
+				writeCustomData(b, path, meta)
+				b.Write(data)
+				pcapRec = b.Bytes()
+			}
+			rec = pcapRec
+		}
+		if len(rec) == 0 {
+			continue
+		}
+		if _, err := o.w.Write(rec); err != nil {
 			hadError = append(hadError, hnd)
 			continue
 		}
 	}
 	for _, hnd := range hadError {
-		if o, ok := s.outputs[hnd].(io.Closer); ok {
-			o.Close()
+		if c, ok := s.outputs[hnd].w.(io.Closer); ok {
+			c.Close()
 		}
 		delete(s.outputs, hnd)
 	}
@@ -228,7 +316,7 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 			s.mu.Lock()
 			defer s.mu.Unlock()
 			for _, o := range s.outputs {
-				if f, ok := o.(http.Flusher); ok {
+				if f, ok := o.w.(http.Flusher); ok {
 					f.Flush()
 				}
 			}
@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/disco"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// pcapng block types and options, from draft-ietf-opsawg-pcapng.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterfaceDesc  = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEndOfOpt    = 0
+	pcapngOptComment     = 1
+	pcapngOptIfName      = 2
+	pcapngOptIfDesc      = 3
+	pcapngOptUserAppl    = 4 // in a Section Header Block
+	pcapngMaxSnapLen     = 65535
+)
+
+// Link types, from https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeRaw   = 101 // raw IPv4 or IPv6 packets
+	linkTypeUser1 = 148
+)
+
+// pcapngInterfaces are the interfaces of pcapng output, one per Path, in
+// order of interface ID.
+var pcapngInterfaces = []struct {
+	path     Path
+	linkType uint16
+	desc     string
+}{
+	{FromLocal, linkTypeRaw, "packets from the local system into the TUN"},
+	{FromPeer, linkTypeRaw, "packets received from peers"},
+	{SynthesizedToLocal, linkTypeRaw, "packets generated by tailscaled for the local system"},
+	{SynthesizedToPeer, linkTypeRaw, "packets generated by tailscaled for peers"},
+	// Disco frames have the format of disco.ToPCAPFrame, which only
+	// ts-dissector.lua decodes. Their comments describe them for readers
+	// without it.
+	{PathDisco, linkTypeUser1, "disco frames received"},
+}
+
+// pcapngInterfaceID returns the ID of the pcapng interface for path.
+func pcapngInterfaceID(path Path) (uint32, bool) {
+	for i, ifc := range pcapngInterfaces {
+		if ifc.path == path {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// appendPcapngHeader appends the start of a pcapng file: a Section Header
+// Block and an Interface Description Block per Path.
+func appendPcapngHeader(b []byte) []byte {
+	b = appendPcapngSectionHeader(b)
+	for _, ifc := range pcapngInterfaces {
+		b = appendPcapngInterface(b, ifc.linkType, ifc.path.String(), ifc.desc)
+	}
+	return b
+}
+
+// appendPcapngRecord appends an Enhanced Packet Block for a packet captured
+// on path, with a comment that describes meta or, for disco frames, the
+// frame. Packets on unknown paths are skipped.
+func appendPcapngRecord(b []byte, path Path, when time.Time, data []byte, meta packet.CaptureMeta) []byte {
+	id, ok := pcapngInterfaceID(path)
+	if !ok {
+		return b
+	}
+	var comment string
+	if path == PathDisco {
+		comment = discoComment(data)
+	} else {
+		comment = metaComment(meta)
+	}
+	return appendPcapngPacket(b, id, when, data, comment)
+}
+
+// metaComment returns a description of meta, or "" if there's nothing to
+// describe.
+func metaComment(meta packet.CaptureMeta) string {
+	var parts []string
+	if meta.DidSNAT {
+		parts = append(parts, "SNAT, original source "+meta.OriginalSrc.String())
+	}
+	if meta.DidDNAT {
+		parts = append(parts, "DNAT, original destination "+meta.OriginalDst.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// discoComment returns a description of frame, a disco.ToPCAPFrame frame.
+func discoComment(frame []byte) string {
+	const malformed = "malformed disco frame"
+	// flag (1), DERP node key (32), port (2), address length (2).
+	const hdrLen = 1 + key.NodePublicRawLen + 2 + 2
+	if len(frame) < hdrLen {
+		return malformed
+	}
+	viaDERP := frame[0]&0x01 != 0
+	derpKey := key.NodePublicFromRaw32(mem.B(frame[1 : 1+key.NodePublicRawLen]))
+	off := 1 + key.NodePublicRawLen
+	port := binary.LittleEndian.Uint16(frame[off:])
+	addrLen := int(binary.LittleEndian.Uint16(frame[off+2:]))
+	off += 4
+	if len(frame) < off+addrLen+2 {
+		return malformed
+	}
+	var addr netip.Addr
+	if err := addr.UnmarshalBinary(frame[off : off+addrLen]); err != nil {
+		return malformed
+	}
+	off += addrLen
+	payloadLen := int(binary.LittleEndian.Uint16(frame[off:]))
+	off += 2
+	if len(frame) < off+payloadLen {
+		return malformed
+	}
+
+	var typ string
+	switch msg, err := disco.Parse(frame[off : off+payloadLen]); msg.(type) {
+	case *disco.Ping:
+		typ = "ping"
+	case *disco.Pong:
+		typ = "pong"
+	case *disco.CallMeMaybe:
+		typ = "call-me-maybe"
+	default:
+		typ = fmt.Sprintf("message (%v)", err)
+	}
+	if viaDERP || addr == tailcfg.DerpMagicIPAddr {
+		// The port of the DERP magic IP is the region ID.
+		return fmt.Sprintf("disco %s via DERP region %d from %v", typ, port, derpKey.ShortString())
+	}
+	return fmt.Sprintf("disco %s from %v", typ, netip.AddrPortFrom(addr, port))
+}
+
+// appendPcapngBlock appends a pcapng block of type typ to b. Its body,
+// which must be padded to 32 bits, is appended by fn.
+func appendPcapngBlock(b []byte, typ uint32, fn func([]byte) []byte) []byte {
+	start := len(b)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, 0) // length, set below
+	b = fn(b)
+	n := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], n)
+	return binary.LittleEndian.AppendUint32(b, n)
+}
+
+// appendPad32 appends the zero bytes that pad n bytes to 32 bits.
+func appendPad32(b []byte, n int) []byte {
+	for ; n%4 != 0; n++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendPcapngOpt appends the option code with value v.
+func appendPcapngOpt(b []byte, code uint16, v string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	return appendPad32(b, len(v))
+}
+
+// appendPcapngSectionHeader appends a Section Header Block.
+func appendPcapngSectionHeader(b []byte) []byte {
+	return appendPcapngBlock(b, pcapngSectionHeader, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+		b = binary.LittleEndian.AppendUint16(b, 1)          // version major
+		b = binary.LittleEndian.AppendUint16(b, 0)          // version minor
+		b = binary.LittleEndian.AppendUint64(b, ^uint64(0)) // section length: unspecified
+		b = appendPcapngOpt(b, pcapngOptUserAppl, "tailscaled")
+		return appendPcapngOpt(b, pcapngOptEndOfOpt, "")
+	})
+}
+
+// appendPcapngInterface appends an Interface Description Block for an
+// interface with the given link type, name and description. Its timestamps
+// have the default resolution, microseconds.
+func appendPcapngInterface(b []byte, linkType uint16, name, desc string) []byte {
+	return appendPcapngBlock(b, pcapngInterfaceDesc, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint16(b, linkType)
+		b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+		b = binary.LittleEndian.AppendUint32(b, pcapngMaxSnapLen)
+		b = appendPcapngOpt(b, pcapngOptIfName, name)
+		b = appendPcapngOpt(b, pcapngOptIfDesc, desc)
+		return appendPcapngOpt(b, pcapngOptEndOfOpt, "")
+	})
+}
+
+// appendPcapngPacket appends an Enhanced Packet Block for pkt, captured on
+// interface ifIndex at when, with an optional comment.
+func appendPcapngPacket(b []byte, ifIndex uint32, when time.Time, pkt []byte, comment string) []byte {
+	return appendPcapngBlock(b, pcapngEnhancedPacket, func(b []byte) []byte {
+		us := uint64(when.UnixMicro())
+		b = binary.LittleEndian.AppendUint32(b, ifIndex)
+		b = binary.LittleEndian.AppendUint32(b, uint32(us>>32))
+		b = binary.LittleEndian.AppendUint32(b, uint32(us))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt))) // captured length
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt))) // original length
+		b = append(b, pkt...)
+		b = appendPad32(b, len(pkt))
+		if comment != "" {
+			b = appendPcapngOpt(b, pcapngOptComment, comment)
+			b = appendPcapngOpt(b, pcapngOptEndOfOpt, "")
+		}
+		return b
+	})
+}
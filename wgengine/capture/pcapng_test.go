@@ -0,0 +1,179 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+type pcapngPacket struct {
+	iface    string // name of the interface
+	linkType uint16
+	when     time.Time
+	data     []byte
+	comment  string
+}
+
+// parsePcapngOpts calls fn for each option in b.
+func parsePcapngOpts(t *testing.T, b []byte, fn func(code uint16, v []byte)) {
+	t.Helper()
+	for len(b) >= 4 {
+		code := binary.LittleEndian.Uint16(b)
+		n := int(binary.LittleEndian.Uint16(b[2:]))
+		if code == pcapngOptEndOfOpt {
+			return
+		}
+		if 4+n > len(b) {
+			t.Fatalf("truncated option %d", code)
+		}
+		fn(code, b[4:4+n])
+		b = b[min(len(b), 4+(n+3)&^3):]
+	}
+}
+
+// parsePcapng parses the pcapng file b, which must have a single section,
+// and returns its packets.
+func parsePcapng(t *testing.T, b []byte) []pcapngPacket {
+	t.Helper()
+	type iface struct {
+		name     string
+		linkType uint16
+	}
+	var ifaces []iface
+	var pkts []pcapngPacket
+	for first := true; len(b) > 0; first = false {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || n < 12 || int(n) > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != n {
+			t.Fatalf("bad block of type %#x, length %d", typ, n)
+		}
+		body := b[8 : n-4]
+		b = b[n:]
+		if first != (typ == pcapngSectionHeader) {
+			t.Fatalf("block of type %#x; section header must be first, and only", typ)
+		}
+		switch typ {
+		case pcapngSectionHeader:
+			if binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				t.Fatalf("bad byte-order magic")
+			}
+		case pcapngInterfaceDesc:
+			ifc := iface{linkType: binary.LittleEndian.Uint16(body)}
+			parsePcapngOpts(t, body[8:], func(code uint16, v []byte) {
+				if code == pcapngOptIfName {
+					ifc.name = string(v)
+				}
+			})
+			ifaces = append(ifaces, ifc)
+		case pcapngEnhancedPacket:
+			id := binary.LittleEndian.Uint32(body)
+			if int(id) >= len(ifaces) {
+				t.Fatalf("packet on undescribed interface %d", id)
+			}
+			us := int64(binary.LittleEndian.Uint32(body[4:]))<<32 | int64(binary.LittleEndian.Uint32(body[8:]))
+			capLen := int(binary.LittleEndian.Uint32(body[12:]))
+			p := pcapngPacket{
+				iface:    ifaces[id].name,
+				linkType: ifaces[id].linkType,
+				when:     time.UnixMicro(us),
+				data:     body[20 : 20+capLen],
+			}
+			parsePcapngOpts(t, body[20+(capLen+3)&^3:], func(code uint16, v []byte) {
+				if code == pcapngOptComment {
+					p.comment = string(v)
+				}
+			})
+			pkts = append(pkts, p)
+		default:
+			t.Fatalf("unexpected block type %#x", typ)
+		}
+	}
+	return pkts
+}
+
+func TestSinkPcapng(t *testing.T) {
+	s := New()
+	defer s.Close()
+	var pcapng, pcap bytes.Buffer
+	s.RegisterOutputFormat(&pcapng, FormatPcapng)
+	s.RegisterOutput(&pcap)
+
+	when := time.Unix(1700000000, 123456000)
+	ip := udp4("100.64.0.1", "100.64.0.2", 1234, 53, 5)
+	s.LogPacket(FromLocal, when, ip, packet.CaptureMeta{
+		DidSNAT:     true,
+		OriginalSrc: netip.MustParseAddrPort("10.0.0.1:1234"),
+	})
+	s.LogPacket(SynthesizedToPeer, when, ip, packet.CaptureMeta{})
+
+	nodeKey := key.NewNode().Public()
+	ping := (&disco.Ping{TxID: [12]byte{1}}).AppendMarshal(nil)
+	s.LogPacket(PathDisco, when, disco.ToPCAPFrame(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 3), nodeKey, ping), packet.CaptureMeta{})
+	s.LogPacket(PathDisco, when, disco.ToPCAPFrame(netip.MustParseAddrPort("192.0.2.1:41641"), key.NodePublic{}, []byte{0xff, 0}), packet.CaptureMeta{})
+	s.LogPacket(PathDisco, when, []byte{0}, packet.CaptureMeta{})
+
+	pkts := parsePcapng(t, pcapng.Bytes())
+	want := []struct {
+		iface    string
+		linkType uint16
+		comment  string
+	}{
+		{"from-local", linkTypeRaw, "SNAT, original source 10.0.0.1:1234"},
+		{"synthesized-to-peer", linkTypeRaw, ""},
+		{"disco", linkTypeUser1, "disco ping via DERP region 3 from " + nodeKey.ShortString()},
+		{"disco", linkTypeUser1, "disco message (unknown message type 0xff) from 192.0.2.1:41641"},
+		{"disco", linkTypeUser1, "malformed disco frame"},
+	}
+	if len(pkts) != len(want) {
+		t.Fatalf("got %d packets; want %d", len(pkts), len(want))
+	}
+	for i, p := range pkts {
+		w := want[i]
+		if p.iface != w.iface || p.linkType != w.linkType || p.comment != w.comment {
+			t.Errorf("packet %d: interface %q, link type %d, comment %q; want %q, %d, %q", i, p.iface, p.linkType, p.comment, w.iface, w.linkType, w.comment)
+		}
+		if !p.when.Equal(when) {
+			t.Errorf("packet %d: time %v; want %v", i, p.when, when)
+		}
+	}
+	if !bytes.Equal(pkts[0].data, ip) {
+		t.Errorf("packet 0: data %x; want %x", pkts[0].data, ip)
+	}
+
+	// The pcap output is still written.
+	if !bytes.HasPrefix(pcap.Bytes(), []byte{0xd4, 0xc3, 0xb2, 0xa1}) {
+		t.Errorf("pcap output has no pcap header")
+	}
+	if got, want := pcap.Len(), 24+5*16+2*(4+len(ip))+4+len(ip); got < want {
+		t.Errorf("pcap output is %d bytes; want at least %d", got, want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{FormatPcap, FormatPcapng} {
+		got, err := ParseFormat(f.String())
+		if err != nil || got != f {
+			t.Errorf("ParseFormat(%q) = %v, %v; want %v", f, got, err, f)
+		}
+	}
+	if got, err := ParseFormat(""); err != nil || got != FormatPcap {
+		t.Errorf(`ParseFormat("") = %v, %v; want pcap`, got, err)
+	}
+	if _, err := ParseFormat("erf"); err == nil || !strings.Contains(err.Error(), "erf") {
+		t.Errorf(`ParseFormat("erf") error = %v`, err)
+	}
+}
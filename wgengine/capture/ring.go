@@ -0,0 +1,263 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// DefaultRingBytes is the size of a Ring whose RingConfig.MaxBytes is zero.
+const DefaultRingBytes = 16 << 20
+
+// MaxRingBytes is the largest RingConfig.MaxBytes that tailscaled accepts,
+// so that a single request can't make it pin arbitrary amounts of memory.
+const MaxRingBytes = 1 << 30
+
+// ringPacketOverhead is roughly how much memory a Ring uses per packet,
+// in addition to the packet itself. It's counted towards MaxBytes.
+const ringPacketOverhead = 64
+
+// RingConfig configures a Ring.
+type RingConfig struct {
+	// MaxBytes bounds the memory that the Ring uses for packets.
+	// Zero means DefaultRingBytes.
+	MaxBytes int
+
+	// MaxAge, if non-zero, bounds the age of the packets that the Ring
+	// keeps.
+	MaxAge time.Duration
+
+	// Filter selects the packets that the Ring keeps.
+	Filter Filter
+}
+
+// Filter selects captured packets by peer, protocol and port. A packet
+// matches if it matches all of the non-empty fields. Packets that aren't
+// IP, such as PathDisco frames, only match the zero Filter.
+type Filter struct {
+	Peers  []netip.Prefix  // the packet's source or destination IP is in one
+	Protos []ipproto.Proto // the packet's protocol is one
+	Ports  []uint16        // the packet's source or destination port is one
+}
+
+// ParseFilter parses a filter expression, a space-separated list of
+// "peer IP-or-prefix", "proto name-or-number" and "port number" terms,
+// optionally joined by "and". Terms of the same kind are alternatives, as if
+// joined by "or"; the empty expression matches all packets. For example:
+//
+//	peer 100.64.0.2 and proto tcp and port 22 port 80
+func ParseFilter(s string) (Filter, error) {
+	var f Filter
+	fields := strings.Fields(s)
+	for len(fields) > 0 {
+		kw := fields[0]
+		if kw == "and" {
+			fields = fields[1:]
+			continue
+		}
+		if len(fields) < 2 {
+			return Filter{}, fmt.Errorf("filter %q: missing value after %q", s, kw)
+		}
+		v := fields[1]
+		fields = fields[2:]
+		switch kw {
+		case "peer":
+			pfx, err := netip.ParsePrefix(v)
+			if err != nil {
+				ip, err := netip.ParseAddr(v)
+				if err != nil {
+					return Filter{}, fmt.Errorf("filter %q: invalid peer %q", s, v)
+				}
+				pfx = netip.PrefixFrom(ip, ip.BitLen())
+			}
+			f.Peers = append(f.Peers, pfx.Masked())
+		case "proto":
+			var p ipproto.Proto
+			if err := p.UnmarshalText([]byte(v)); err != nil {
+				return Filter{}, fmt.Errorf("filter %q: %w", s, err)
+			}
+			f.Protos = append(f.Protos, p)
+		case "port":
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return Filter{}, fmt.Errorf("filter %q: invalid port %q", s, v)
+			}
+			f.Ports = append(f.Ports, uint16(port))
+		default:
+			return Filter{}, fmt.Errorf("filter %q: unknown term %q", s, kw)
+		}
+	}
+	return f, nil
+}
+
+// String returns f in the syntax of ParseFilter.
+func (f Filter) String() string {
+	var terms []string
+	for _, p := range f.Peers {
+		terms = append(terms, "peer "+p.String())
+	}
+	for _, p := range f.Protos {
+		name, _ := p.MarshalText() // never fails; round-trips, unlike String
+		terms = append(terms, "proto "+string(name))
+	}
+	for _, p := range f.Ports {
+		terms = append(terms, "port "+strconv.Itoa(int(p)))
+	}
+	return strings.Join(terms, " and ")
+}
+
+// IsZero reports whether f matches all packets.
+func (f Filter) IsZero() bool {
+	return len(f.Peers) == 0 && len(f.Protos) == 0 && len(f.Ports) == 0
+}
+
+var parsedPool = sync.Pool{New: func() any { return new(packet.Parsed) }}
+
+// Match reports whether the packet data matches f.
+func (f Filter) Match(data []byte) bool {
+	if f.IsZero() {
+		return true
+	}
+	p := parsedPool.Get().(*packet.Parsed)
+	defer parsedPool.Put(p)
+	p.Decode(data)
+	if p.IPVersion == 0 {
+		return false
+	}
+	if len(f.Peers) > 0 && !slices.ContainsFunc(f.Peers, func(pfx netip.Prefix) bool {
+		return pfx.Contains(p.Src.Addr()) || pfx.Contains(p.Dst.Addr())
+	}) {
+		return false
+	}
+	if len(f.Protos) > 0 && !slices.Contains(f.Protos, p.IPProto) {
+		return false
+	}
+	if len(f.Ports) > 0 {
+		switch p.IPProto {
+		case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		default:
+			return false
+		}
+		if !slices.Contains(f.Ports, p.Src.Port()) && !slices.Contains(f.Ports, p.Dst.Port()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ring keeps the most recent captured packets in memory, bounded by size and
+// age, so that they can be written out after the fact, such as when a
+// problem is noticed.
+type Ring struct {
+	cfg     RingConfig
+	timeNow func() time.Time // for MaxAge when writing out packets
+
+	mu   sync.Mutex
+	pkts []ringPacket // oldest first, starting at head
+	head int
+	size int // memory used by pkts[head:], as counted towards MaxBytes
+}
+
+type ringPacket struct {
+	path Path
+	when time.Time
+	data []byte
+	meta packet.CaptureMeta
+}
+
+// NewRing returns a new Ring configured by cfg.
+func NewRing(cfg RingConfig) *Ring {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultRingBytes
+	}
+	return &Ring{cfg: cfg, timeNow: time.Now}
+}
+
+// Config returns the configuration of r.
+func (r *Ring) Config() RingConfig {
+	return r.cfg
+}
+
+// LogPacket is a Callback that adds a packet to r, if it matches r's filter.
+//
+// This function does not take ownership of the provided data slice.
+func (r *Ring) LogPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta) {
+	if !r.cfg.Filter.Match(data) {
+		return
+	}
+	pkt := ringPacket{path: path, when: when, data: bytes.Clone(data), meta: meta}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pkts = append(r.pkts, pkt)
+	r.size += len(data) + ringPacketOverhead
+	for r.head < len(r.pkts)-1 {
+		oldest := &r.pkts[r.head]
+		if r.size <= r.cfg.MaxBytes && (r.cfg.MaxAge == 0 || when.Sub(oldest.when) <= r.cfg.MaxAge) {
+			break
+		}
+		r.size -= len(oldest.data) + ringPacketOverhead
+		*oldest = ringPacket{}
+		r.head++
+	}
+	if r.head > len(r.pkts)/2 {
+		// Reuse the evicted half of the slice.
+		n := copy(r.pkts, r.pkts[r.head:])
+		clear(r.pkts[n:])
+		r.pkts = r.pkts[:n]
+		r.head = 0
+	}
+}
+
+// Len returns the number of packets in r.
+func (r *Ring) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pkts) - r.head
+}
+
+// WritePcapng writes the packets in r that were captured at or after since
+// to w, as a pcapng file. Packets older than MaxAge are left out, even if
+// no newer packet has evicted them yet.
+func (r *Ring) WritePcapng(w io.Writer, since time.Time) error {
+	if r.cfg.MaxAge > 0 {
+		if oldest := r.timeNow().Add(-r.cfg.MaxAge); since.Before(oldest) {
+			since = oldest
+		}
+	}
+	// The packets themselves are never modified, so they can be written
+	// out after unlocking. Concurrent callbacks can add them slightly out
+	// of order, so check every timestamp.
+	r.mu.Lock()
+	var pkts []ringPacket
+	for _, p := range r.pkts[r.head:] {
+		if !p.when.Before(since) {
+			pkts = append(pkts, p)
+		}
+	}
+	r.mu.Unlock()
+
+	b := appendPcapngHeader(nil)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	for _, p := range pkts {
+		b = appendPcapngRecord(b[:0], p.path, p.when, p.data, p.meta)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
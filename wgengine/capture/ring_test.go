@@ -0,0 +1,185 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+func udp4(src, dst string, sport, dport uint16, payloadLen int) []byte {
+	h := &packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netip.MustParseAddr(src),
+			Dst: netip.MustParseAddr(dst),
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}
+	return packet.Generate(h, make([]byte, payloadLen))
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Filter
+		wantStr string
+		wantErr bool
+	}{
+		{in: "", want: Filter{}},
+		{
+			in: "peer 100.64.0.2 and proto tcp port 22 port 80 peer 10.0.0.0/8",
+			want: Filter{
+				Peers:  []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("10.0.0.0/8")},
+				Protos: []ipproto.Proto{ipproto.TCP},
+				Ports:  []uint16{22, 80},
+			},
+			wantStr: "peer 100.64.0.2/32 and peer 10.0.0.0/8 and proto tcp and port 22 and port 80",
+		},
+		{in: "proto 17", want: Filter{Protos: []ipproto.Proto{ipproto.UDP}}, wantStr: "proto udp"},
+		{in: "peer", wantErr: true},
+		{in: "port http", wantErr: true},
+		{in: "host 1.2.3.4", wantErr: true},
+		{in: "proto bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFilter(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if s := got.String(); s != tt.wantStr {
+			t.Errorf("ParseFilter(%q).String() = %q; want %q", tt.in, s, tt.wantStr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	pkt := udp4("100.64.0.1", "100.64.0.2", 1234, 53, 10)
+	tests := []struct {
+		filter string
+		data   []byte
+		want   bool
+	}{
+		{"", pkt, true},
+		{"", []byte("disco"), true},
+		{"peer 100.64.0.1", pkt, true},
+		{"peer 100.64.0.2", pkt, true},
+		{"peer 100.64.0.3", pkt, false},
+		{"proto udp", pkt, true},
+		{"proto tcp", pkt, false},
+		{"port 53", pkt, true},
+		{"port 1234", pkt, true},
+		{"port 80", pkt, false},
+		{"peer 100.64.0.2 and proto udp and port 53", pkt, true},
+		{"peer 100.64.0.2 and proto tcp and port 53", pkt, false},
+		{"port 53", []byte("disco"), false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(tt.data); got != tt.want {
+			t.Errorf("%q matches %x = %v; want %v", tt.filter, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	pkt := udp4("100.64.0.1", "100.64.0.2", 1234, 53, 100-28)
+	perPkt := len(pkt) + ringPacketOverhead
+
+	t.Run("bytes", func(t *testing.T) {
+		r := NewRing(RingConfig{MaxBytes: 10 * perPkt})
+		for i := range 25 {
+			r.LogPacket(FromLocal, start.Add(time.Duration(i)*time.Second), pkt, packet.CaptureMeta{})
+		}
+		if got := r.Len(); got != 10 {
+			t.Errorf("Len = %d; want 10", got)
+		}
+	})
+	t.Run("age", func(t *testing.T) {
+		r := NewRing(RingConfig{MaxAge: 5 * time.Second})
+		for i := range 25 {
+			r.LogPacket(FromLocal, start.Add(time.Duration(i)*time.Second), pkt, packet.CaptureMeta{})
+		}
+		if got := r.Len(); got != 6 {
+			t.Errorf("Len = %d; want 6", got)
+		}
+	})
+	t.Run("filter", func(t *testing.T) {
+		f, _ := ParseFilter("port 80")
+		r := NewRing(RingConfig{Filter: f})
+		r.LogPacket(FromLocal, start, pkt, packet.CaptureMeta{})
+		r.LogPacket(FromPeer, start, udp4("100.64.0.2", "100.64.0.1", 80, 1234, 0), packet.CaptureMeta{})
+		if got := r.Len(); got != 1 {
+			t.Errorf("Len = %d; want 1", got)
+		}
+	})
+}
+
+func TestRingWritePcapng(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := NewRing(RingConfig{})
+	for i := range 10 {
+		r.LogPacket(FromPeer, start.Add(time.Duration(i)*time.Second), udp4("100.64.0.1", "100.64.0.2", 1234, 53, i), packet.CaptureMeta{})
+	}
+
+	var buf bytes.Buffer
+	if err := r.WritePcapng(&buf, start.Add(7*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	pkts := parsePcapng(t, buf.Bytes())
+	if len(pkts) != 3 {
+		t.Fatalf("got %d packets; want 3", len(pkts))
+	}
+	for i, p := range pkts {
+		if want := start.Add(time.Duration(7+i) * time.Second); !p.when.Equal(want) {
+			t.Errorf("packet %d: time %v; want %v", i, p.when, want)
+		}
+		if p.iface != FromPeer.String() {
+			t.Errorf("packet %d: interface %q; want %q", i, p.iface, FromPeer)
+		}
+		if want := 28 + 7 + i; len(p.data) != want {
+			t.Errorf("packet %d: length %d; want %d", i, len(p.data), want)
+		}
+	}
+}
+
+func TestRingWritePcapngMaxAge(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := NewRing(RingConfig{MaxAge: 5 * time.Second})
+	for i := range 10 {
+		r.LogPacket(FromPeer, start.Add(time.Duration(i)*time.Second), udp4("100.64.0.1", "100.64.0.2", 1234, 53, i), packet.CaptureMeta{})
+	}
+
+	// After a quiet spell, packets older than MaxAge are still in the ring,
+	// as no new packet evicted them, but they aren't written out.
+	r.timeNow = func() time.Time { return start.Add(12 * time.Second) }
+	var buf bytes.Buffer
+	if err := r.WritePcapng(&buf, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	pkts := parsePcapng(t, buf.Bytes())
+	if len(pkts) != 3 {
+		t.Fatalf("got %d packets; want 3", len(pkts))
+	}
+	if want := start.Add(7 * time.Second); !pkts[0].when.Equal(want) {
+		t.Errorf("oldest packet at %v; want %v", pkts[0].when, want)
+	}
+}
@@ -104,6 +104,10 @@ end
 
 ts_dissectors:add(1, tsdisco_meta)
 
+-- In pcapng captures, disco frames have their own interface with link-layer
+-- ID 148 (User-defined protocol 1)
+eth_table:add(wtap.USER1, tsdisco_meta)
+
 --
 -- DISCO frame dissector
 --
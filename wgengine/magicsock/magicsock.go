@@ -170,6 +170,9 @@ type Conn struct {
 
 	lastNetCheckReport atomic.Pointer[netcheck.Report]
 
+	// netCheckHistory is a history of netcheck reports, for debugging.
+	netCheckHistory *netcheck.History
+
 	// port is the preferred port from opts.Port; 0 means auto.
 	port atomic.Uint32
 
@@ -428,6 +431,8 @@ func newConn() *Conn {
 		discoInfo:    make(map[key.DiscoPublic]*discoInfo),
 		discoPrivate: discoPrivate,
 		discoPublic:  discoPrivate.Public(),
+
+		netCheckHistory: netcheck.NewHistory(),
 	}
 	c.discoShort = c.discoPublic.ShortString()
 	c.bind = &connBind{Conn: c, closed: true}
@@ -681,6 +686,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 
 	c.lastNetCheckReport.Store(report)
+	c.netCheckHistory.Add(time.Now(), report)
 	c.noV4.Store(!report.IPv4)
 	c.noV6.Store(!report.IPv6)
 	c.noV4Send.Store(!report.IPv4CanSend)
@@ -3113,6 +3119,12 @@ func (c *Conn) GetLastNetcheckReport(ctx context.Context) *netcheck.Report {
 	return lastReport
 }
 
+// NetcheckHistory returns the recent history of netcheck reports, oldest
+// first. See netcheck.History for which reports are kept.
+func (c *Conn) NetcheckHistory() []netcheck.HistoryEntry {
+	return c.netCheckHistory.Entries()
+}
+
 // SetLastNetcheckReportForTest sets the magicsock conn's last netcheck report.
 // Used for testing purposes.
 func (c *Conn) SetLastNetcheckReportForTest(ctx context.Context, report *netcheck.Report) {
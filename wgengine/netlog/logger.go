@@ -2,12 +2,13 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package netlog provides a logger that monitors a TUN device and
-// periodically records any traffic into a log stream.
+// periodically records any traffic into a log stream, a local sink, or both.
 package netlog
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -24,8 +25,10 @@
 	"tailscale.com/net/sockstats"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
+	"tailscale.com/types/netmap"
 	"tailscale.com/util/multierr"
 	"tailscale.com/wgengine/router"
 )
@@ -50,17 +53,28 @@ func (noopDevice) SetStatistics(*connstats.Statistics) {}
 type Logger struct {
 	mu sync.Mutex // protects all fields below
 
-	logger *logtail.Logger
+	logger *logtail.Logger // nil if not uploading
+	sink   sink            // nil if no local sink
 	stats  *connstats.Statistics
 	tun    Device
 	sock   Device
 
 	addrs    map[netip.Addr]bool
 	prefixes map[netip.Prefix]bool
+
+	nm *netmap.NetworkMap // or nil; kept across restarts
 }
 
 // Running reports whether the logger is running.
 func (nl *Logger) Running() bool {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	return nl.stats != nil
+}
+
+// Uploading reports whether the logger is running and uploading messages to
+// the log service, rather than only writing them to a local sink.
+func (nl *Logger) Uploading() bool {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
 	return nl.logger != nil
@@ -93,33 +107,44 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
-func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool) error {
+//
+// Messages are uploaded to Tailscale's logging service unless nodeLogID is
+// zero. If sinkCfg is non-nil, they're also written to that local sink.
+func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, sinkCfg *SinkConfig, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger != nil {
-		return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+	if nl.stats != nil {
+		if nl.logger != nil {
+			return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+		}
+		return errors.New("network logger already running")
+	}
+	if nodeLogID.IsZero() && sinkCfg == nil {
+		return errors.New("network logger has neither log IDs nor a local sink")
 	}
 
-	// Startup a log stream to Tailscale's logging service.
+	// Open the local sink first, as it's the only step that can fail.
 	logf := log.Printf
-	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
-	if testClient != nil {
-		httpc = testClient
+	var localSink sink
+	if sinkCfg != nil {
+		var err error
+		localSink, err = openSink(sinkCfg, logf)
+		if err != nil {
+			return fmt.Errorf("opening network log sink %v: %w", sinkCfg, err)
+		}
+		if s, ok := localSink.(flowSink); ok && nl.nm != nil {
+			s.x.SetIdentities(identities(nl.nm))
+		}
 	}
-	nl.logger = logtail.NewLogger(logtail.Config{
-		Collection:    "tailtraffic.log.tailscale.io",
-		PrivateID:     nodeLogID,
-		CopyPrivateID: domainLogID,
-		Stderr:        io.Discard,
-		CompressLogs:  true,
-		HTTPC:         httpc,
-		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+	nl.sink = localSink
+	sinkLogf := logger.LogOnChange(logf, 5*time.Minute, time.Now)
 
-		// Include process sequence numbers to identify missing samples.
-		IncludeProcID:       true,
-		IncludeProcSequence: true,
-	}, logf)
-	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	// Startup a log stream to Tailscale's logging service.
+	var upload *logtail.Logger
+	if !nodeLogID.IsZero() {
+		upload = newUploadLogger(nodeLogID, domainLogID, netMon, health, logf)
+	}
+	nl.logger = upload
 
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
@@ -131,7 +156,22 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 		addrs := nl.addrs
 		prefixes := nl.prefixes
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		m := makeMessage(nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) == 0 {
+			return
+		}
+		if upload != nil {
+			if b, err := json.Marshal(m); err != nil {
+				upload.Logf("json.Marshal error: %v", err)
+			} else {
+				upload.Logf("%s", b)
+			}
+		}
+		if localSink != nil {
+			if err := localSink.writeMessage(m); err != nil {
+				sinkLogf("netlog: writing to %v: %v", sinkCfg, err)
+			}
+		}
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -151,8 +191,34 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	return nil
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
-	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
+// newUploadLogger returns a logger that uploads to Tailscale's logging
+// service.
+func newUploadLogger(nodeLogID, domainLogID logid.PrivateID, netMon *netmon.Monitor, health *health.Tracker, logf logger.Logf) *logtail.Logger {
+	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
+	if testClient != nil {
+		httpc = testClient
+	}
+	l := logtail.NewLogger(logtail.Config{
+		Collection:    "tailtraffic.log.tailscale.io",
+		PrivateID:     nodeLogID,
+		CopyPrivateID: domainLogID,
+		Stderr:        io.Discard,
+		CompressLogs:  true,
+		HTTPC:         httpc,
+		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+
+		// Include process sequence numbers to identify missing samples.
+		IncludeProcID:       true,
+		IncludeProcSequence: true,
+	}, logf)
+	l.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	return l
+}
+
+// makeMessage returns the message that records the statistics connstats and
+// sockStats, collected from start to end.
+func makeMessage(nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) *netlogtype.Message {
+	m := &netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
 		// NOTE: There could be mis-classifications where an address is treated
@@ -200,14 +266,7 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 	for conn, cnts := range sockStats {
 		m.PhysicalTraffic = append(m.PhysicalTraffic, netlogtype.ConnectionCounts{Connection: conn, Counts: cnts})
 	}
-
-	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
-		if b, err := json.Marshal(m); err != nil {
-			logger.Logf("json.Marshal error: %v", err)
-		} else {
-			logger.Logf("%s", b)
-		}
-	}
+	return m
 }
 
 func makeRouteMaps(cfg *router.Config) (addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool) {
@@ -243,13 +302,24 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 	nl.addrs, nl.prefixes = makeRouteMaps(cfg)
 }
 
+// SetNetworkMap updates the nodes whose identities are exported with the
+// flows of their tailnet IPs, if the logger has an IPFIX or NetFlow v9 sink.
+func (nl *Logger) SetNetworkMap(nm *netmap.NetworkMap) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.nm = nm
+	if s, ok := nl.sink.(flowSink); ok && nm != nil {
+		s.x.SetIdentities(identities(nm))
+	}
+}
+
 // Shutdown shuts down the network logger.
 // This attempts to flush out all pending log messages.
 // Even if an error is returned, the logger is still shut down.
 func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	if nl.stats == nil {
 		return nil
 	}
 
@@ -259,16 +329,23 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.sock.SetStatistics(nil)
 	nl.tun.SetStatistics(nil)
 	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
+	var err2, err3 error
+	if nl.logger != nil {
+		err2 = nl.logger.Shutdown(ctx)
+	}
+	if nl.sink != nil {
+		err3 = nl.sink.Close()
+	}
 	nl.mu.Lock()
 
 	// Purge state.
 	nl.logger = nil
+	nl.sink = nil
 	nl.stats = nil
 	nl.tun = nil
 	nl.sock = nil
 	nl.addrs = nil
 	nl.prefixes = nil
 
-	return multierr.New(err1, err2)
+	return multierr.New(err1, err2, err3)
 }
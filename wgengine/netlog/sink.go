@@ -0,0 +1,395 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/net/flowexport"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/bytesize"
+)
+
+// SinkKind is a kind of local sink for network logs.
+type SinkKind string
+
+const (
+	// SinkFile appends messages as JSON lines to a file,
+	// rotating it as it grows.
+	SinkFile SinkKind = "file"
+
+	// SinkUnix writes messages as JSON lines to a Unix stream socket,
+	// which a local collector listens on.
+	SinkUnix SinkKind = "unix"
+
+	// SinkIPFIX sends the connections of messages as IPFIX flow records
+	// to a collector over UDP.
+	SinkIPFIX SinkKind = "ipfix"
+
+	// SinkNetFlowV9 sends the connections of messages as NetFlow v9 flow
+	// records to a collector over UDP.
+	SinkNetFlowV9 SinkKind = "netflow9"
+)
+
+const (
+	// DefaultMaxFileSize is the size at which a SinkFile is rotated, if
+	// SinkConfig.MaxFileSize is zero.
+	DefaultMaxFileSize = 10 << 20
+
+	// DefaultMaxFiles is the number of rotated files kept by a SinkFile,
+	// in addition to the current one, if SinkConfig.MaxFiles is zero.
+	DefaultMaxFiles = 5
+)
+
+// SinkConfig configures a local sink for network logs. A local sink gets
+// the same per-interval messages that are uploaded to the log service, but
+// it doesn't need the control plane to enable network logging.
+type SinkConfig struct {
+	Kind SinkKind
+
+	// Path is the path of the file (SinkFile) or socket (SinkUnix).
+	// Files are rotated by renaming them to Path.1, Path.2, and so on.
+	Path string
+
+	// Addr is the host and optional port of the collector, for SinkIPFIX
+	// and SinkNetFlowV9. The port defaults to the protocol's usual one.
+	Addr string
+
+	// MaxFileSize and MaxFiles configure the rotation of a SinkFile.
+	// Zero means DefaultMaxFileSize and DefaultMaxFiles, respectively.
+	MaxFileSize int64
+	MaxFiles    int
+
+	// ObservationDomain, TemplateRefresh and EnterpriseNumber configure
+	// the flow records of SinkIPFIX and SinkNetFlowV9, as the
+	// flowexport.Config fields of the same names do.
+	ObservationDomain uint32
+	TemplateRefresh   time.Duration
+	EnterpriseNumber  uint32
+}
+
+// ParseSinkConfig parses a local sink for network logs, of the form
+// "file:PATH", "unix:PATH", "ipfix:HOST[:PORT]" or "netflow9:HOST[:PORT]".
+// Files may have rotation options, as in
+// "file:/var/log/netlog.jsonl?max-size=50M&max-files=10", and flow
+// collectors may have encoding options, as in
+// "ipfix:siem.example.com?domain=7&template-refresh=5m&enterprise=12345".
+func ParseSinkConfig(s string) (*SinkConfig, error) {
+	kind, v, ok := strings.Cut(s, ":")
+	if !ok || v == "" {
+		return nil, fmt.Errorf("invalid network log sink %q; want KIND:PATH or KIND:HOST[:PORT]", s)
+	}
+	cfg := &SinkConfig{Kind: SinkKind(kind)}
+	var query string
+	switch cfg.Kind {
+	case SinkFile:
+		cfg.Path, query, _ = strings.Cut(v, "?")
+	case SinkUnix:
+		cfg.Path = v
+	case SinkIPFIX, SinkNetFlowV9:
+		cfg.Addr, query, _ = strings.Cut(v, "?")
+	default:
+		return nil, fmt.Errorf("invalid network log sink %q: unknown kind %q; want file, unix, ipfix or netflow9", s, kind)
+	}
+	if cfg.Path == "" && cfg.Addr == "" {
+		return nil, fmt.Errorf("invalid network log sink %q; want KIND:PATH or KIND:HOST[:PORT]", s)
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network log sink %q: %w", s, err)
+	}
+	isFlow := cfg.Kind == SinkIPFIX || cfg.Kind == SinkNetFlowV9
+	for k := range opts {
+		var err error
+		switch v := opts.Get(k); {
+		case cfg.Kind == SinkFile && k == "max-size":
+			cfg.MaxFileSize, err = bytesize.Parse(v)
+		case cfg.Kind == SinkFile && k == "max-files":
+			cfg.MaxFiles, err = strconv.Atoi(v)
+			if err == nil && cfg.MaxFiles < 1 {
+				err = fmt.Errorf("max-files must be at least 1")
+			}
+		case isFlow && k == "domain":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			cfg.ObservationDomain = uint32(n)
+		case isFlow && k == "template-refresh":
+			cfg.TemplateRefresh, err = time.ParseDuration(v)
+			if err == nil && cfg.TemplateRefresh <= 0 {
+				err = fmt.Errorf("template-refresh must be positive")
+			}
+		case isFlow && k == "enterprise":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			if err == nil && n == 0 {
+				err = fmt.Errorf("enterprise must be nonzero")
+			}
+			cfg.EnterpriseNumber = uint32(n)
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid network log sink %q: %w", s, err)
+		}
+	}
+	return cfg, nil
+}
+
+// String returns cfg in the form accepted by ParseSinkConfig.
+func (cfg *SinkConfig) String() string {
+	s := string(cfg.Kind) + ":" + cmp.Or(cfg.Path, cfg.Addr)
+	opts := url.Values{}
+	if cfg.MaxFileSize != 0 {
+		opts.Set("max-size", strconv.FormatInt(cfg.MaxFileSize, 10))
+	}
+	if cfg.MaxFiles != 0 {
+		opts.Set("max-files", strconv.Itoa(cfg.MaxFiles))
+	}
+	if cfg.ObservationDomain != 0 {
+		opts.Set("domain", strconv.FormatUint(uint64(cfg.ObservationDomain), 10))
+	}
+	if cfg.TemplateRefresh != 0 {
+		opts.Set("template-refresh", cfg.TemplateRefresh.String())
+	}
+	if cfg.EnterpriseNumber != 0 {
+		opts.Set("enterprise", strconv.FormatUint(uint64(cfg.EnterpriseNumber), 10))
+	}
+	if len(opts) > 0 {
+		s += "?" + opts.Encode()
+	}
+	return s
+}
+
+// sink is a local destination of network log messages.
+// Its methods are called from a single goroutine.
+type sink interface {
+	writeMessage(*netlogtype.Message) error
+	Close() error
+}
+
+func openSink(cfg *SinkConfig, logf logger.Logf) (sink, error) {
+	switch cfg.Kind {
+	case SinkFile:
+		return openFileSink(cfg.Path, cmp.Or(cfg.MaxFileSize, DefaultMaxFileSize), cmp.Or(cfg.MaxFiles, DefaultMaxFiles))
+	case SinkUnix:
+		return &unixSink{path: cfg.Path}, nil
+	case SinkIPFIX, SinkNetFlowV9:
+		p, err := flowexport.ParseProtocol(string(cfg.Kind))
+		if err != nil {
+			return nil, err
+		}
+		x, err := flowexport.NewExporter(flowexport.Config{
+			Protocol:          p,
+			Collector:         cfg.Addr,
+			ObservationDomain: cfg.ObservationDomain,
+			TemplateRefresh:   cfg.TemplateRefresh,
+			EnterpriseNumber:  cfg.EnterpriseNumber,
+			Logf:              logf,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return flowSink{x}, nil
+	}
+	return nil, fmt.Errorf("unknown network log sink kind %q", cfg.Kind)
+}
+
+// localMessage is a message as written to a SinkFile or SinkUnix.
+// Like messages uploaded to the log service, it records when it was logged,
+// which "tailscale.com/cmd/netlogfmt" prints.
+type localMessage struct {
+	Logged time.Time `json:"logged"`
+	*netlogtype.Message
+}
+
+func marshalLocal(m *netlogtype.Message) ([]byte, error) {
+	b, err := json.Marshal(localMessage{Logged: time.Now().UTC(), Message: m})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// fileSink writes messages as JSON lines to a file that's rotated once it
+// exceeds maxSize, keeping maxFiles (at least one) old files.
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func openFileSink(path string, maxSize int64, maxFiles int) (*fileSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	s := &fileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, after renaming path.1 to
+// path.2 and so on, deleting the oldest, and opens a new file.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) writeMessage(m *netlogtype.Message) error {
+	b, err := marshalLocal(m)
+	if err != nil {
+		return err
+	}
+	if s.f != nil && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", s.path, err)
+		}
+	}
+	if s.f == nil {
+		// A previous rotation failed part way; try again to open it.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// unixSink writes messages as JSON lines to a Unix stream socket.
+// It connects when a message is written, so it tolerates the collector
+// starting after, or restarting while, the logger runs; messages written
+// while the collector is down are dropped.
+type unixSink struct {
+	path string
+	conn net.Conn // or nil if not connected
+}
+
+const unixSinkTimeout = 5 * time.Second
+
+func (s *unixSink) writeMessage(m *netlogtype.Message) error {
+	b, err := marshalLocal(m)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		c, err := net.DialTimeout("unix", s.path, unixSinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(unixSinkTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// flowSink sends the connections of messages as flow records, with the
+// identities of the nodes of tailnet IPs.
+type flowSink struct {
+	x *flowexport.Exporter
+}
+
+func (s flowSink) writeMessage(m *netlogtype.Message) error {
+	// PhysicalTraffic isn't exported: its connections pair a peer's
+	// Tailscale IP with its WireGuard endpoint, which isn't the source
+	// and destination of any packet.
+	cc := make([]netlogtype.ConnectionCounts, 0, len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic))
+	cc = append(cc, m.VirtualTraffic...)
+	cc = append(cc, m.SubnetTraffic...)
+	cc = append(cc, m.ExitTraffic...)
+	if len(cc) == 0 {
+		return nil
+	}
+	return s.x.Export(m.Start, m.End, cc)
+}
+
+func (s flowSink) Close() error {
+	return s.x.Close()
+}
+
+// identities returns the identities of the tailnet IPs of the nodes in nm.
+func identities(nm *netmap.NetworkMap) map[netip.Addr]flowexport.Identity {
+	ids := make(map[netip.Addr]flowexport.Identity)
+	add := func(n tailcfg.NodeView) {
+		id := flowexport.Identity{NodeName: n.Name(), NodeID: string(n.StableID())}
+		if n.IsTagged() {
+			id.User = strings.Join(n.Tags().AsSlice(), ",")
+		} else if up, ok := nm.UserProfiles[n.User()]; ok {
+			id.User = up.LoginName
+		}
+		addrs := n.Addresses()
+		for i := range addrs.Len() {
+			if p := addrs.At(i); p.IsSingleIP() {
+				ids[p.Addr()] = id
+			}
+		}
+	}
+	if nm.SelfNode.Valid() {
+		add(nm.SelfNode)
+	}
+	for _, p := range nm.Peers {
+		add(p)
+	}
+	return ids
+}
@@ -0,0 +1,248 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/net/flowexport"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/types/netmap"
+)
+
+func TestParseSinkConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *SinkConfig
+		wantErr bool
+	}{
+		{in: "file:/var/log/netlog.jsonl", want: &SinkConfig{Kind: SinkFile, Path: "/var/log/netlog.jsonl"}},
+		{
+			in:   "file:/var/log/netlog.jsonl?max-size=50M&max-files=10",
+			want: &SinkConfig{Kind: SinkFile, Path: "/var/log/netlog.jsonl", MaxFileSize: 50 << 20, MaxFiles: 10},
+		},
+		{in: "unix:/run/netlog.sock", want: &SinkConfig{Kind: SinkUnix, Path: "/run/netlog.sock"}},
+		{in: "ipfix:127.0.0.1", want: &SinkConfig{Kind: SinkIPFIX, Addr: "127.0.0.1"}},
+		{in: "netflow9:[::1]:9995", want: &SinkConfig{Kind: SinkNetFlowV9, Addr: "[::1]:9995"}},
+		{
+			in:   "ipfix:siem.example.com?domain=7&template-refresh=5m&enterprise=12345",
+			want: &SinkConfig{Kind: SinkIPFIX, Addr: "siem.example.com", ObservationDomain: 7, TemplateRefresh: 5 * time.Minute, EnterpriseNumber: 12345},
+		},
+		{in: "", wantErr: true},
+		{in: "file:", wantErr: true},
+		{in: "syslog:/dev/log", wantErr: true},
+		{in: "file:/tmp/x?max-size=big", wantErr: true},
+		{in: "file:/tmp/x?max-size=9223372036854775807G", wantErr: true},
+		{in: "file:/tmp/x?max-files=0", wantErr: true},
+		{in: "file:/tmp/x?color=blue", wantErr: true},
+		{in: "file:/tmp/x?domain=7", wantErr: true},
+		{in: "ipfix:?domain=7", wantErr: true},
+		{in: "ipfix:127.0.0.1?max-files=2", wantErr: true},
+		{in: "ipfix:127.0.0.1?template-refresh=0s", wantErr: true},
+		{in: "netflow9:127.0.0.1?enterprise=0", wantErr: true},
+		{in: "netflow9:127.0.0.1?domain=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSinkConfig(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSinkConfig(%q) error = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSinkConfig(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if rt, err := ParseSinkConfig(got.String()); err != nil || !reflect.DeepEqual(rt, got) {
+			t.Errorf("ParseSinkConfig(%q) = %+v, %v; want round trip of %+v", got.String(), rt, err, got)
+		}
+	}
+}
+
+func testMessage(i int) *netlogtype.Message {
+	start := time.Unix(1700000000, 0).UTC().Add(time.Duration(i) * 5 * time.Second)
+	return &netlogtype.Message{
+		NodeID: "n123456CNTRL",
+		Start:  start,
+		End:    start.Add(5 * time.Second),
+		VirtualTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.TCP,
+				Src:   netip.MustParseAddrPort("100.64.0.1:1234"),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:22"),
+			},
+			Counts: netlogtype.Counts{TxPackets: uint64(i + 1), TxBytes: 100},
+		}},
+	}
+}
+
+// readMessages reads the JSON lines in the file name.
+func readMessages(t *testing.T, name string) []localMessage {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var msgs []localMessage
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m localMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		msgs = append(msgs, m)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestFileSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "logs", "netlog.jsonl")
+	line, err := marshalLocal(testMessage(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate after every three messages, keeping two old files. Lines
+	// vary by a few bytes, as logged times drop trailing zeros.
+	s, err := openFileSink(name, int64(3*len(line)+len(line)/2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if err := s.writeMessage(testMessage(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages 0 through 2 were rotated out and deleted.
+	for name, want := range map[string][]int{
+		name + ".2": {3, 4, 5},
+		name + ".1": {6, 7, 8},
+		name:        {9},
+	} {
+		msgs := readMessages(t, name)
+		var got []int
+		for _, m := range msgs {
+			got = append(got, int(m.VirtualTraffic[0].TxPackets)-1)
+			if m.Logged.IsZero() || m.NodeID != "n123456CNTRL" {
+				t.Errorf("%s: message %+v lacks logged time or node ID", name, m)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has messages %v; want %v", name, got, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists; want only two rotated files", name)
+	}
+
+	// Reopening appends to the current file.
+	s, err = openFileSink(name, DefaultMaxFileSize, DefaultMaxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeMessage(testMessage(10)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if got := len(readMessages(t, name)); got != 2 {
+		t.Errorf("%s has %d messages after reopening; want 2", name, got)
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.sock")
+	s := &unixSink{path: path}
+	defer s.Close()
+
+	// Messages are dropped while there's no collector.
+	if err := s.writeMessage(testMessage(0)); err == nil {
+		t.Fatal("writeMessage without a collector succeeded; want error")
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("can't listen on Unix socket: %v", err)
+	}
+	defer ln.Close()
+	got := make(chan localMessage, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		sc := bufio.NewScanner(c)
+		for sc.Scan() {
+			var m localMessage
+			if json.Unmarshal(sc.Bytes(), &m) == nil {
+				got <- m
+			}
+		}
+	}()
+
+	for i := 1; i <= 2; i++ {
+		if err := s.writeMessage(testMessage(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case m := <-got:
+			if want := testMessage(i).Start; !m.Start.Equal(want) {
+				t.Errorf("message %d starts at %v; want %v", i, m.Start, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			StableID:  "nSELF",
+			Name:      "self.example.ts.net.",
+			User:      1,
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+		}).View(),
+		Peers: []tailcfg.NodeView{(&tailcfg.Node{
+			StableID:  "nSERVER",
+			Name:      "server.example.ts.net.",
+			User:      2,
+			Tags:      []string{"tag:prod", "tag:server"},
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}).View()},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {LoginName: "alice@example.com"},
+		},
+	}
+	self := flowexport.Identity{NodeName: "self.example.ts.net.", NodeID: "nSELF", User: "alice@example.com"}
+	want := map[netip.Addr]flowexport.Identity{
+		netip.MustParseAddr("100.64.0.1"):        self,
+		netip.MustParseAddr("fd7a:115c:a1e0::1"): self,
+		netip.MustParseAddr("100.64.0.2"):        {NodeName: "server.example.ts.net.", NodeID: "nSERVER", User: "tag:prod,tag:server"},
+	}
+	if got := identities(nm); !reflect.DeepEqual(got, want) {
+		t.Errorf("identities:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -786,6 +786,27 @@ func (ns *Impl) DialContextUDP(ctx context.Context, ipp netip.AddrPort) (*gonet.
 	return gonet.DialUDP(ns.ipstack, nil, remoteAddress, ipType)
 }
 
+// ListenTCP listens for incoming TCP connections to ipp, which must be one of
+// this node's addresses. If ipp's port is zero, an ephemeral port is chosen.
+//
+// Connections to the listener take precedence over the default forwarding
+// of inbound flows.
+func (ns *Impl) ListenTCP(ipp netip.AddrPort) (*gonet.TCPListener, error) {
+	localAddress := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(ipp.Addr().AsSlice()),
+		Port: ipp.Port(),
+	}
+	var ipType tcpip.NetworkProtocolNumber
+	if ipp.Addr().Is4() {
+		ipType = ipv4.ProtocolNumber
+	} else {
+		ipType = ipv6.ProtocolNumber
+	}
+
+	return gonet.ListenTCP(ns.ipstack, localAddress, ipType)
+}
+
 // The inject goroutine reads in packets that netstack generated, and delivers
 // them to the correct path.
 func (ns *Impl) inject() {
@@ -922,6 +943,11 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 			return true
 		}
 	}
+	// Handle UDP datagrams to the Tailscale IP(s) on ports served by
+	// tailscaled.
+	if ns.lb != nil && p.IPProto == ipproto.UDP && isLocal && ns.lb.ShouldInterceptUDPPort(p.Dst.Port()) {
+		return true
+	}
 	if p.IPVersion == 6 && !isLocal && viaRange.Contains(dstIP) {
 		return ns.lb != nil && ns.lb.ShouldHandleViaIP(dstIP)
 	}
@@ -1425,6 +1451,13 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 		return
 	}
 
+	if ns.lb != nil && ns.lb.ShouldInterceptUDPPort(dstAddr.Port()) {
+		if h := ns.lb.UDPHandlerForDst(srcAddr, dstAddr); h != nil {
+			go h(gonet.NewUDPConn(&wq, ep))
+			return
+		}
+	}
+
 	if get := ns.GetUDPHandlerForFlow; get != nil {
 		h, intercept := get(srcAddr, dstAddr)
 		if intercept {
@@ -42,6 +42,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
@@ -105,6 +106,7 @@ type userspaceEngine struct {
 	netMonUnregister func()              // unsubscribes from changes; used regardless of netMonOwned
 	birdClient       BIRDClient          // or nil
 	controlKnobs     *controlknobs.Knobs // or nil
+	netLogSink       *netlog.SinkConfig  // or nil
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -222,6 +224,11 @@ type Config struct {
 	// DriveForLocal, if populated, will cause the engine to expose a Taildrive
 	// listener at 100.100.100.100:8080.
 	DriveForLocal drive.FileSystemForLocal
+
+	// NetLogSink, if non-nil, is a local sink that network logs are written
+	// to whenever the engine is up, whether or not the control plane
+	// enables uploading them.
+	NetLogSink *netlog.SinkConfig
 }
 
 // NewFakeUserspaceEngine returns a new userspace engine for testing.
@@ -321,6 +328,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		confListenPort: conf.ListenPort,
 		birdClient:     conf.BIRDClient,
 		controlKnobs:   conf.ControlKnobs,
+		netLogSink:     conf.NetLogSink,
 		reconfigureVPN: conf.ReconfigureVPN,
 		health:         conf.HealthTracker,
 	}
@@ -903,10 +911,8 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
 	netLogIDsWasValid := !oldLogIDs.NodeID.IsZero() && !oldLogIDs.DomainID.IsZero()
 	netLogIDsChanged := netLogIDsNowValid && netLogIDsWasValid && newLogIDs != oldLogIDs
-	netLogRunning := netLogIDsNowValid && !routerCfg.Equal(&router.Config{})
-	if envknob.NoLogsNoSupport() {
-		netLogRunning = false
-	}
+	netLogUpload := netLogIDsNowValid && !envknob.NoLogsNoSupport()
+	netLogRunning := (netLogUpload || e.netLogSink != nil) && !routerCfg.Equal(&router.Config{})
 
 	// TODO(bradfitz,danderson): maybe delete this isDNSIPOverTailscale
 	// field and delete the resolver.ForwardLinkSelector hook and
@@ -957,9 +963,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		return err
 	}
 
-	// Shutdown the network logger because the IDs changed.
+	// Shutdown the network logger because the IDs changed, or because
+	// uploading was enabled or disabled while it writes to a local sink.
 	// Let it be started back up by subsequent logic.
-	if netLogIDsChanged && e.networkLogger.Running() {
+	if e.networkLogger.Running() && (netLogIDsChanged || netLogRunning && netLogUpload != e.networkLogger.Uploading()) {
 		e.logf("wgengine: Reconfig: shutting down network logger")
 		ctx, cancel := context.WithTimeout(context.Background(), networkLoggerUploadTimeout)
 		defer cancel()
@@ -971,11 +978,18 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if netLogRunning && !e.networkLogger.Running() {
-		nid := cfg.NetworkLogging.NodeID
-		tid := cfg.NetworkLogging.DomainID
+		var nid, tid logid.PrivateID
+		if netLogUpload {
+			nid = cfg.NetworkLogging.NodeID
+			tid = cfg.NetworkLogging.DomainID
+		}
 		logExitFlowEnabled := cfg.NetworkLogging.LogExitFlowEnabled
-		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
-		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, e.health, logExitFlowEnabled); err != nil {
+		if netLogUpload {
+			e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
+		} else {
+			e.logf("wgengine: Reconfig: starting up network logger (local sink only: %v)", e.netLogSink)
+		}
+		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.netLogSink, e.tundev, e.magicConn, e.netMon, e.health, logExitFlowEnabled); err != nil {
 			e.logf("wgengine: Reconfig: error starting up network logger: %v", err)
 		}
 		e.networkLogger.ReconfigRoutes(routerCfg)
@@ -1251,6 +1265,7 @@ func (e *userspaceEngine) linkChange(delta *netmon.ChangeDelta) {
 
 func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.magicConn.SetNetworkMap(nm)
+	e.networkLogger.SetNetworkMap(nm)
 	e.mu.Lock()
 	e.netMap = nm
 	e.mu.Unlock()